@@ -0,0 +1,73 @@
+package main
+
+import (
+	"aTES/core/operations/analytics"
+	auth "aTES/core/operations/authenticator"
+	"aTES/core/rbac"
+	"aTES/infrastructure"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The analytics service. Keeps its read model in its own tables, filled from the task and
+// transaction events TES stores, and serves it to roles with analytics:read. With OIDC_ISSUER
+// set users sign in at /login as the analytics client, its secret in
+// ANALYTICS_OIDC_CLIENT_SECRET when it's a confidential one:
+//
+//	Analytics -port 8282 -sync 1m
+func main() {
+	port := flag.Int("port", 8282, "port to serve the analytics API on")
+	syncInterval := flag.Duration("sync", time.Minute, "how often to handle new events")
+	oidcClient := flag.String("oidc-client", "analytics", "what analytics is registered as in the authenticator's clients.yaml")
+	oidcRedirect := flag.String("oidc-redirect", "", "where the authenticator sends users back to, /login/callback on -port when empty")
+	flag.Parse()
+
+	// Loading the configuration.
+	config, err := infrastructure.LoadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// Connecting to the database, TES owns it and migrates it.
+	sqlDB, err := infrastructure.ConnectDB(config)
+	if err != nil {
+		log.Fatalf("Error connecting to the database: %v", err)
+	}
+	defer sqlDB.Close()
+
+	service, err := analytics.New(sqlDB)
+	if err != nil {
+		log.Fatalf("Error setting up analytics: %v", err)
+	}
+	consumer := infrastructure.NewAnalyticsConsumer(sqlDB, service, config.ConsumerConcurrency)
+	go consumer.Run(context.Background(), *syncInterval)
+
+	policy, err := rbac.LoadPolicy(config.RBACPolicyPath)
+	if err != nil {
+		log.Fatalf("Error loading the rbac policy: %v", err)
+	}
+	http.HandleFunc("/analytics/", policy.Require(rbac.AnalyticsRead, auth.RoleFromRequest, service.Handler))
+
+	// Sending users to the authenticator to sign in as analytics, not as TES.
+	config.OIDCClientID = *oidcClient
+	config.OIDCClientSecret = os.Getenv("ANALYTICS_OIDC_CLIENT_SECRET")
+	config.OIDCRedirectURL = *oidcRedirect
+	if config.OIDCRedirectURL == "" {
+		config.OIDCRedirectURL = fmt.Sprintf("http://localhost:%d/login/callback", *port)
+	}
+	if login := infrastructure.NewOIDCLogin(config); login != nil {
+		http.HandleFunc("/login", login.LoginHandler)
+		http.HandleFunc("/login/callback", login.CallbackHandler)
+	}
+
+	addr := fmt.Sprintf(":%d", *port)
+	fmt.Printf("Starting analytics on %s...\n", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Fatalf("Error starting the server: %v", err)
+	}
+}
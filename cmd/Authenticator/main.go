@@ -2,36 +2,177 @@ package main
 
 import (
 	auth "aTES/core/operations/authenticator"
+	"aTES/core/rbac"
+	"aTES/infrastructure"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 )
 
+// Serves the authenticator, or with -migrate-passwords hashes the plaintext passwords left in
+// passwords.yaml and exits. Serving from the yaml files hashes them on the way in as well. -backend picks where users are kept: the yaml files (the default) or
+// the auth_users table in Postgres.
+//
+// It's also the OpenID Connect provider the other services sign users in with, for the clients
+// in clients.yaml. -new-client-secret prints a secret for a confidential client and the hash that
+// goes into clients.yaml, then exits.
+//
+// On Postgres auth_users starts out empty: -bootstrap-admin creates an admin with the email and
+// prints their password, unless there's an admin already, then exits.
 func main() {
 	passYamlPath := "/home/ccat/Repos/Task-Exchange-Service/core/operations/authenticator/passwords.yaml"
 	usersYamlPath := "/home/ccat/Repos/Task-Exchange-Service/core/operations/authenticator/users.yaml"
+	clientsYamlPath := "/home/ccat/Repos/Task-Exchange-Service/core/operations/authenticator/clients.yaml"
 
-	err := initAuthServer("localhost", passYamlPath, usersYamlPath, 8181)
+	migratePasswords := flag.Bool("migrate-passwords", false, "hash the plaintext passwords in passwords.yaml and exit")
+	backend := flag.String("backend", "yaml", "where users are kept: yaml or postgres")
+	issuer := flag.String("issuer", "http://localhost:8181", "the public base URL of the authenticator, as the services reach it")
+	signingKey := flag.String("signing-key", "", "PEM file of the RSA key ID tokens are signed with, a fresh one on every start when empty")
+	newClientSecret := flag.Bool("new-client-secret", false, "print a client secret and its hash for clients.yaml and exit")
+	bootstrapAdminEmail := flag.String("bootstrap-admin", "", "create an admin with this email in auth_users if there's none, print the password and exit")
+	flag.Parse()
+	if *newClientSecret {
+		secret, hash, err := auth.NewClientSecret()
+		if err != nil {
+			log.Fatalf("Error generating a client secret: %v", err)
+		}
+		fmt.Printf("secret: %s\nsecret_hash: %s\n", secret, hash)
+		return
+	}
+	if *migratePasswords {
+		migrated, err := auth.MigratePasswordsYaml(passYamlPath)
+		if err != nil {
+			log.Fatalf("Error migrating the passwords: %v", err)
+		}
+		fmt.Printf("Hashed %d plaintext passwords.\n", migrated)
+		return
+	}
+
+	if *bootstrapAdminEmail != "" {
+		if err := bootstrapAdmin(*bootstrapAdminEmail); err != nil {
+			log.Fatalf("Error creating the admin: %v", err)
+		}
+		return
+	}
+
+	oidc := oidcOptions{issuer: *issuer, clientsYamlPath: clientsYamlPath, signingKeyPath: *signingKey}
+	err := initAuthServer("localhost", *backend, passYamlPath, usersYamlPath, 8181, oidc)
 	if err != nil {
 		log.Fatalf("Coulden't start the authentication server: %v", err)
 	}
 }
 
-// Creates a Mock authenticator from a pre declared instance and starts the server.
-func initAuthServer(host, passwordYamlPath, usersYamlPath string, port int) error {
+// Creating the first admin of the postgres backend, queueing UserCreated like any other user.
+func bootstrapAdmin(email string) error {
+	config, err := infrastructure.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	sqlDB, err := infrastructure.InitOutboxDB(config)
+	if err != nil {
+		return fmt.Errorf("error inititalising the database: %w", err)
+	}
+	defer sqlDB.Close()
+	pgA, err := auth.NewPostgresAuthenticator(sqlDB)
+	if err != nil {
+		return fmt.Errorf("error starting the authenticator on postgres: %w", err)
+	}
+	pgA.SetPublisher(infrastructure.NewOutboxPublisher(sqlDB, "authenticator"))
+
+	userID, password, err := pgA.BootstrapAdmin(context.Background(), "admin", email)
+	if err != nil {
+		return err
+	}
+	if userID == 0 {
+		fmt.Println("There's an admin already, nothing to do.")
+		return nil
+	}
+	fmt.Printf("Created admin %d (%s), password: %s\n", userID, email, password)
+
+	return nil
+}
+
+// How the authenticator signs users in to the other services.
+type oidcOptions struct {
+	issuer          string
+	clientsYamlPath string
+	signingKeyPath  string
+}
+
+// Creates the authenticator for the backend and starts the server.
+func initAuthServer(host, backend, passwordYamlPath, usersYamlPath string, port int, oidc oidcOptions) error {
+
+	// Queueing user changes in the outbox, TES relays them to the broker. Only the outbox is set
+	// up here, the rest of the database is TES's.
+	config, err := infrastructure.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("error loading config: %w", err)
+	}
+	sqlDB, err := infrastructure.InitOutboxDB(config)
+	if err != nil {
+		return fmt.Errorf("error inititalising the database: %w", err)
+	}
+	defer sqlDB.Close()
+	publisher := infrastructure.NewOutboxPublisher(sqlDB, "authenticator")
 
 	// Invoking the constructor and starting the server.
-	var maP *auth.MockAuthenticator
-	maP, err := auth.NewMockAuthenticator(passwordYamlPath, usersYamlPath)
+	var authenticator auth.Authenticator
+	switch backend {
+	case "yaml":
+		// Hashing whatever plaintext passwords are left, the authenticator only takes hashes.
+		migrated, err := auth.MigratePasswordsYaml(passwordYamlPath)
+		if err != nil {
+			return fmt.Errorf("error migrating the passwords in %s: %w", passwordYamlPath, err)
+		}
+		if migrated > 0 {
+			log.Printf("Authenticator: hashed %d plaintext passwords in %s.\n", migrated, passwordYamlPath)
+		}
+		maP, err := auth.NewMockAuthenticator(passwordYamlPath, usersYamlPath)
+		if err != nil {
+			return fmt.Errorf("error starting the authenticator using yaml file at %s: %w",
+				passwordYamlPath, err)
+		}
+		maP.SetPublisher(publisher)
+		authenticator = maP
+	case "postgres":
+		pgA, err := auth.NewPostgresAuthenticator(sqlDB)
+		if err != nil {
+			return fmt.Errorf("error starting the authenticator on postgres: %w", err)
+		}
+		pgA.SetPublisher(publisher)
+		authenticator = pgA
+	default:
+		return fmt.Errorf("unknown backend %q, expected yaml or postgres", backend)
+	}
+	policy, err := rbac.LoadPolicy(config.RBACPolicyPath)
+	if err != nil {
+		return fmt.Errorf("error loading the rbac policy: %w", err)
+	}
+	server := auth.NewServer(authenticator, policy)
+
+	http.HandleFunc("/create_user", server.CreateUserHandler)
+	http.HandleFunc("/get_user", server.GetUserHandler)
+	http.HandleFunc("/update_user", server.UpdateUserHandler)
+	http.HandleFunc("/delete_user", server.DeleteUserHandler)
+
+	// Signing users in to the registered clients.
+	clients, err := auth.LoadOIDCClients(oidc.clientsYamlPath)
+	if err != nil {
+		return fmt.Errorf("error loading the OIDC clients: %w", err)
+	}
+	if oidc.signingKeyPath == "" {
+		log.Println("Authenticator: no -signing-key, ID tokens are signed with a key that lasts until the next restart.")
+	}
+	key, err := auth.LoadSigningKey(oidc.signingKeyPath)
 	if err != nil {
-		return fmt.Errorf("error starting the authenticator using yaml file at %s: %w",
-			passwordYamlPath, err)
+		return fmt.Errorf("error loading the signing key: %w", err)
 	}
+	provider := auth.NewOIDCProvider(oidc.issuer, authenticator, clients, key)
+	provider.RegisterRoutes(http.DefaultServeMux)
+	server.SetLoginThrottle(provider)
 
-	http.HandleFunc("/create_user", maP.CreateUserHandler)
-	http.HandleFunc("/get_user", maP.GetUserHandler)
-	http.HandleFunc("/update_user", maP.UpdateUserHandler)
-	http.HandleFunc("/delete_user", maP.DeleteUserHandler)
 	err = http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil)
 	if err != nil {
 		return fmt.Errorf("error starting the authentication server: %w", err)
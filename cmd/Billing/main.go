@@ -0,0 +1,53 @@
+package main
+
+import (
+	"aTES/infrastructure"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+// Admin command for billing cycles. Closes a day (yesterday by default) or shows how one was closed:
+//
+//	Billing -day 2024-10-31
+//	Billing -day 2024-10-31 -show
+func main() {
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
+	dayFlag := flag.String("day", yesterday, "billing day to close or show, YYYY-MM-DD")
+	show := flag.Bool("show", false, "only print the recorded cycle, don't close anything")
+	flag.Parse()
+
+	day, err := time.ParseInLocation(time.DateOnly, *dayFlag, time.Local)
+	if err != nil {
+		log.Fatalf("Invalid day %q: %v", *dayFlag, err)
+	}
+
+	// Loading the configuration.
+	config, err := infrastructure.LoadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// Connecting to the database.
+	sqlDB, _, err := infrastructure.InitDB(config)
+	if err != nil {
+		log.Fatalf("Error inititalising the database: %v", err)
+	}
+	defer sqlDB.Close()
+
+	var summary infrastructure.BillingCloseSummary
+	if *show {
+		summary, err = infrastructure.GetBillingCycle(sqlDB, day)
+	} else {
+		summary, err = infrastructure.CloseBillingCycle(sqlDB, day)
+	}
+	if err != nil {
+		log.Fatalf("Error with the billing cycle of %s: %v", *dayFlag, err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(summary)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"aTES/core/operations/analytics"
+	"aTES/infrastructure"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin command for the durable event bus. Lists dead letters by default, or:
+//
+//	Events [-subscriber tes-users] [-status dead] [-limit 20]  - lists dead letters.
+//	Events -show 12                                           - shows a dead letter.
+//	Events -edit 12 -payload fixed.json                       - replaces its envelope ("-" reads stdin).
+//	Events -replay 12,15                                      - queues dead letters for replay.
+//	Events -replay all                                        - queues every dead letter.
+//	Events -rewind tes-users -from 2024-06-01                 - has a subscriber handle the events since then again.
+//	Events -rebuild users                                     - refills the users replica from every user event.
+//	Events -rebuild tasks                                     - rebuilds the tasks table and snapshots from the task streams.
+//	Events -rebuild balances                                  - takes the balance snapshots again from the whole ledger.
+//	Events -rebuild analytics                                 - refills the analytics read model from every stored event.
+//
+// -from defaults to the beginning of the history. Rebuilds empty the read model and fill it again
+// in one transaction, readers wait for them.
+func main() {
+	subscriber := flag.String("subscriber", "", "with the listing, only this subscriber's dead letters")
+	status := flag.String("status", "", "with the listing, only dead letters in this status (dead, queued, replayed)")
+	limit := flag.Int("limit", 100, "with the listing, how many dead letters to show")
+	show := flag.Int64("show", 0, "dead letter to show")
+	edit := flag.Int64("edit", 0, "dead letter to replace the envelope of, see -payload")
+	payload := flag.String("payload", "-", "with -edit, file holding the new envelope")
+	replay := flag.String("replay", "", "comma separated dead letter IDs to queue for replay, or \"all\"")
+	rewind := flag.String("rewind", "", "subscriber to rewind to -from")
+	rebuild := flag.String("rebuild", "", "read model to rebuild: users, tasks, balances or analytics")
+	from := flag.String("from", "", "with -rewind, YYYY-MM-DD or YYYY-MM-DD HH:MM:SS")
+	flag.Parse()
+
+	var since time.Time
+	if *from != "" {
+		var err error
+		if since, err = time.Parse(time.DateOnly, *from); err != nil {
+			if since, err = time.Parse(time.DateTime, *from); err != nil {
+				log.Fatalf("Invalid -from %q, expected YYYY-MM-DD or YYYY-MM-DD HH:MM:SS", *from)
+			}
+		}
+	}
+
+	// Loading the configuration.
+	config, err := infrastructure.LoadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// Connecting to the database.
+	sqlDB, _, err := infrastructure.InitDB(config)
+	if err != nil {
+		log.Fatalf("Error inititalising the database: %v", err)
+	}
+	defer sqlDB.Close()
+
+	var result any
+	switch {
+	case *show != 0:
+		result, err = infrastructure.GetDeadLetter(sqlDB, *show)
+
+	case *edit != 0:
+		var data []byte
+		if *payload == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*payload)
+		}
+		if err != nil {
+			log.Fatalf("Error reading the new envelope: %v", err)
+		}
+		result, err = infrastructure.EditDeadLetter(sqlDB, *edit, data)
+
+	case *replay != "":
+		var deadLetterIDs []int64
+		if *replay != "all" {
+			for _, raw := range strings.Split(*replay, ",") {
+				deadLetterID, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+				if err != nil {
+					log.Fatalf("Invalid dead letter ID %q: %v", raw, err)
+				}
+				deadLetterIDs = append(deadLetterIDs, deadLetterID)
+			}
+		}
+		var queued int
+		queued, err = infrastructure.QueueDeadLetters(sqlDB, deadLetterIDs...)
+		result = map[string]int{"queued": queued}
+
+	case *rewind != "":
+		var ahead int
+		ahead, err = infrastructure.RewindSubscriber(sqlDB, *rewind, since)
+		result = map[string]any{"subscriber": *rewind, "events_ahead": ahead}
+
+	case *rebuild != "":
+		switch *rebuild {
+		case "users":
+			var replayed int
+			replayed, err = infrastructure.RebuildUserReplica(sqlDB)
+			result = map[string]int{"replayed": replayed}
+		case "tasks":
+			var rebuilt int
+			rebuilt, err = infrastructure.RebuildTaskProjections(sqlDB)
+			result = map[string]int{"rebuilt": rebuilt}
+		case "balances":
+			err = infrastructure.RebuildBalanceSnapshots(sqlDB)
+			result = map[string]bool{"rebuilt": err == nil}
+		case "analytics":
+			var service *analytics.Analytics
+			if service, err = analytics.New(sqlDB); err == nil {
+				var replayed int
+				replayed, err = infrastructure.RebuildAnalytics(sqlDB, service)
+				result = map[string]int{"replayed": replayed}
+			}
+		default:
+			log.Fatalf("Unknown read model %q, expected users, tasks, balances or analytics", *rebuild)
+		}
+
+	default:
+		filter := infrastructure.DeadLetterFilter{Subscriber: *subscriber, Status: *status, Limit: *limit}
+		result, err = infrastructure.ListDeadLetters(sqlDB, filter)
+	}
+	if err != nil {
+		log.Fatalf("Error with the event bus: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
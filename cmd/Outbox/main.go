@@ -0,0 +1,81 @@
+package main
+
+import (
+	"aTES/infrastructure"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Admin command for the event outbox. Prints the outbox stats by default, or:
+//
+//	Outbox -list [-pending] [-min-attempts 3] [-limit 20]  - shows messages.
+//	Outbox -redrive 12,15                                  - retries the given messages now.
+//	Outbox -redrive failing                                - retries every message that failed.
+//	Outbox -relay                                          - runs one relay pass.
+func main() {
+	list := flag.Bool("list", false, "list outbox messages")
+	pending := flag.Bool("pending", false, "with -list, only undelivered messages")
+	minAttempts := flag.Int("min-attempts", 0, "with -list, only messages that failed at least this often")
+	limit := flag.Int("limit", 100, "with -list, how many messages to show")
+	redrive := flag.String("redrive", "", "comma separated message IDs to retry now, or \"failing\" for all failed ones")
+	relay := flag.Bool("relay", false, "deliver every due message once")
+	flag.Parse()
+
+	// Loading the configuration.
+	config, err := infrastructure.LoadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// Connecting to the database.
+	sqlDB, _, err := infrastructure.InitDB(config)
+	if err != nil {
+		log.Fatalf("Error inititalising the database: %v", err)
+	}
+	defer sqlDB.Close()
+
+	var result any
+	switch {
+	case *list:
+		filter := infrastructure.OutboxFilter{Pending: *pending, MinAttempts: *minAttempts, Limit: *limit}
+		result, err = infrastructure.ListOutboxMessages(sqlDB, filter)
+
+	case *redrive != "":
+		var messageIDs []int64
+		if *redrive != "failing" {
+			for _, raw := range strings.Split(*redrive, ",") {
+				messageID, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+				if err != nil {
+					log.Fatalf("Invalid message ID %q: %v", raw, err)
+				}
+				messageIDs = append(messageIDs, messageID)
+			}
+		}
+		var redriven int
+		redriven, err = infrastructure.RedriveOutboxMessages(sqlDB, messageIDs...)
+		result = map[string]int{"redriven": redriven}
+
+	case *relay:
+		broker, brokerErr := infrastructure.NewEventBroker(config, sqlDB)
+		if brokerErr != nil {
+			log.Fatalf("Error setting up the event broker: %v", brokerErr)
+		}
+		var delivered int
+		delivered, err = infrastructure.NewOutboxRelay(sqlDB, broker).RelayOnce()
+		result = map[string]int{"delivered": delivered}
+
+	default:
+		result, err = infrastructure.GetOutboxStats(sqlDB)
+	}
+	if err != nil {
+		log.Fatalf("Error with the outbox: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
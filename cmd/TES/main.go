@@ -1,10 +1,19 @@
 package main
 
 import (
+	"aTES/core/events"
+	auth "aTES/core/operations/authenticator"
+	"aTES/core/rbac"
 	"aTES/infrastructure"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 func main() {
@@ -14,24 +23,109 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
+	// Choosing how new tasks are priced. A policy that can't be set up stops TES before it starts.
+	pricing, err := infrastructure.NewPricingPolicy(config)
+	if err != nil {
+		log.Fatalf("Error setting up task pricing: %v", err)
+	}
+
 	// Connecting to the database.
-	sqlDB, _, err := infrastructure.InitDB(config)
+	sqlDB, gormDB, err := infrastructure.InitDB(config)
 	if err != nil {
 		log.Fatalf("Error inititalising the database: %v", err)
 	}
 	defer sqlDB.Close()
 
+	// Giving the tasks from before assignment fees one.
+	if _, err := infrastructure.BackfillAssignFees(sqlDB, pricing); err != nil {
+		log.Fatalf("Error pricing the existing tasks: %v", err)
+	}
+
+	// Stopping on SIGINT or SIGTERM. Background work finishes what it's in the middle of first.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+	runInBackground := func(run func(context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
+
+	// Relaying domain events from the outbox to the broker.
+	broker, err := infrastructure.NewEventBroker(config, sqlDB)
+	if err != nil {
+		log.Fatalf("Error setting up the event broker: %v", err)
+	}
+	relay := infrastructure.NewOutboxRelay(sqlDB, broker)
+	runInBackground(func(ctx context.Context) { relay.Run(ctx, config.OutboxRelayInterval) })
+
+	// Receiving every event from the broker, unless they're stored locally already: the user
+	// changes for the replica, and the task and transaction events the outbox relayed there for
+	// the webhooks.
+	inbox, err := infrastructure.NewEventInbox(config, sqlDB, "tes", events.Topics()...)
+	if err != nil {
+		log.Fatalf("Error setting up the event inbox: %v", err)
+	}
+	if inbox != nil {
+		runInBackground(inbox.Run)
+	}
+
+	// Keeping the local users in step with the authenticator.
+	userReplica := infrastructure.NewUserReplica(sqlDB, config.ConsumerConcurrency)
+	runInBackground(func(ctx context.Context) { userReplica.Run(ctx, config.OutboxRelayInterval) })
+
+	// Charging assignment fees and paying rewards from the task events.
+	accounting := infrastructure.NewAccountingConsumer(sqlDB, config.ConsumerConcurrency)
+	runInBackground(func(ctx context.Context) { accounting.Run(ctx, config.OutboxRelayInterval) })
+
+	// Queueing and posting webhooks for the events stored here.
+	webhookFanout := infrastructure.NewWebhookFanout(sqlDB, config.ConsumerConcurrency)
+	runInBackground(func(ctx context.Context) { webhookFanout.Run(ctx, config.OutboxRelayInterval) })
+	webhooks := infrastructure.NewWebhookDispatcher(sqlDB)
+	runInBackground(func(ctx context.Context) { webhooks.Run(ctx, config.OutboxRelayInterval) })
+
+	// Closing billing days in the background.
+	runInBackground(func(ctx context.Context) { infrastructure.RunBillingScheduler(ctx, sqlDB, config.BillingCheckInterval) })
+
+	// Loading who may do what.
+	policy, err := rbac.LoadPolicy(config.RBACPolicyPath)
+	if err != nil {
+		log.Fatalf("Error loading the rbac policy: %v", err)
+	}
+
 	// Initialising HTTP handlers.
-	httpHandlers := infrastructure.NewHandlersGroup(sqlDB)
+	httpHandlers := infrastructure.NewHandlersGroup(sqlDB, gormDB, pricing, policy)
 
-	// Setting up routs.
+	// Setting up routs, the ones for a single permission behind it.
 	http.HandleFunc("/tasks", httpHandlers.TaskHandler)
+	http.HandleFunc("/tasks/shuffle", policy.Require(rbac.TasksShuffle, auth.RoleFromRequest, httpHandlers.ShuffleHandler))
+	http.HandleFunc("/tasks/history", httpHandlers.TaskHistoryHandler)
 	http.HandleFunc("/accounting", httpHandlers.AccountingHandler)
+	http.HandleFunc("/accounting/", httpHandlers.AccountingHandler)
+	http.HandleFunc("/events/", policy.Require(rbac.EventsManage, auth.RoleFromRequest, httpHandlers.EventsHandler))
+	http.HandleFunc("/webhooks", policy.Require(rbac.WebhooksManage, auth.RoleFromRequest, httpHandlers.WebhooksHandler))
+	http.HandleFunc("/webhooks/", policy.Require(rbac.WebhooksManage, auth.RoleFromRequest, httpHandlers.WebhooksHandler))
 
-	// Starting the HTTP server.
-	addr := fmt.Sprintf(":%d", config.Port)
-	fmt.Printf("Starting server on %s...\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	// Sending users to the authenticator to sign in, when it's configured.
+	if login := infrastructure.NewOIDCLogin(config); login != nil {
+		http.HandleFunc("/login", login.LoginHandler)
+		http.HandleFunc("/login/callback", login.CallbackHandler)
+	}
+
+	// Starting the HTTP server, it stops taking requests on shutdown.
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Port)}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	fmt.Printf("Starting server on %s...\n", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Error starting the server: %v", err)
 	}
+
+	// Draining the consumers and the relay before the database goes away.
+	background.Wait()
+	fmt.Println("Stopped.")
 }
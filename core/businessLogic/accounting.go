@@ -1 +1,111 @@
 package businesslogic
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of ledger accounts.
+const (
+	AccountWorker  = "worker"  // What the company owes a worker, negative when the worker owes the company.
+	AccountCompany = "company" // The company's earnings: assignment fees in, completion rewards out.
+	AccountCash    = "cash"    // Money actually paid out to workers.
+)
+
+// Kinds of journal entries.
+const (
+	EntryAssignmentCharge = "assignment_charge"
+	EntryCompletionReward = "completion_reward"
+	EntryPayout           = "payout"
+	EntryReversal         = "reversal"
+)
+
+var (
+	ErrUnbalancedEntry = errors.New("journal entry debits and credits don't match")
+	ErrInvalidLine     = errors.New("invalid journal line")
+	ErrAlreadyReversed = errors.New("journal entry was already reversed")
+)
+
+// Checks that an entry has at least two lines, each moving a positive amount on exactly one
+// side, and that the debits add up to the credits.
+func ValidateEntry(lines []entities.JournalLine) error {
+	if len(lines) < 2 {
+		return fmt.Errorf("%w: an entry needs at least two lines", ErrUnbalancedEntry)
+	}
+
+	var debits, credits entities.Money
+	for _, line := range lines {
+		if line.Debit.IsNegative() || line.Credit.IsNegative() || line.Debit.IsZero() == line.Credit.IsZero() {
+			return fmt.Errorf("%w: account %d must have exactly one positive side", ErrInvalidLine, line.AccountID)
+		}
+		debits = debits.Add(line.Debit)
+		credits = credits.Add(line.Credit)
+	}
+
+	if debits.Cmp(credits) != 0 {
+		return fmt.Errorf("%w: debits %s, credits %s", ErrUnbalancedEntry, debits, credits)
+	}
+
+	return nil
+}
+
+// Moves an amount from one account to another: the payer is debited and the payee credited.
+func transfer(from, to int, amount entities.Money) []entities.JournalLine {
+	return []entities.JournalLine{
+		{AccountID: from, Debit: amount},
+		{AccountID: to, Credit: amount},
+	}
+}
+
+// A worker taking a task pays its assignment fee to the company.
+func AssignmentChargeLines(workerAccount, companyAccount int, fee entities.Money) []entities.JournalLine {
+	return transfer(workerAccount, companyAccount, fee)
+}
+
+// The company pays the reward to the worker who completed the task.
+func CompletionRewardLines(workerAccount, companyAccount int, reward entities.Money) []entities.JournalLine {
+	return transfer(companyAccount, workerAccount, reward)
+}
+
+// Paying a worker settles what the company owes them.
+func PayoutLines(workerAccount, cashAccount int, amount entities.Money) []entities.JournalLine {
+	return transfer(workerAccount, cashAccount, amount)
+}
+
+// Undoes an entry by swapping the sides of each of its lines.
+func ReversalLines(original []entities.JournalLine) []entities.JournalLine {
+	reversed := make([]entities.JournalLine, 0, len(original))
+	for _, line := range original {
+		reversed = append(reversed, entities.JournalLine{
+			AccountID: line.AccountID,
+			Debit:     line.Credit,
+			Credit:    line.Debit,
+		})
+	}
+
+	return reversed
+}
+
+// Balances are credits minus debits for every account kind. For a worker that's what the
+// company owes them, for the company account its earnings.
+func LineBalance(line entities.JournalLine) entities.Money {
+	return line.Credit.Sub(line.Debit)
+}
+
+// Parses a statement month (YYYY-MM) into the half-open range [start, end) it covers.
+func MonthRange(month string, loc *time.Location) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid month %q, expected YYYY-MM: %w", month, err)
+	}
+
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// Checks that a statement adds up: the opening balance plus the month's movements is the closing balance.
+func StatementBalances(record entities.AccountingRecord) bool {
+	closing := record.OpeningBalance.Sub(record.Charges).Add(record.Rewards).Sub(record.Payouts).Add(record.Adjustments)
+	return closing.Cmp(record.ClosingBalance) == 0
+}
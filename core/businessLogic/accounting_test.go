@@ -0,0 +1,52 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"testing"
+)
+
+var cents = entities.NewMoney
+
+func TestValidateEntry(t *testing.T) {
+	cases := []struct {
+		name    string
+		lines   []entities.JournalLine
+		wantErr error
+	}{
+		{"assignment charge", AssignmentChargeLines(1, 2, entities.MustParseMoney("12.50")), nil},
+		{"split debit", []entities.JournalLine{
+			{AccountID: 1, Debit: cents(10)}, {AccountID: 1, Debit: cents(20)}, {AccountID: 2, Credit: cents(30)},
+		}, nil},
+		{"single line", []entities.JournalLine{{AccountID: 1, Debit: cents(1000)}}, ErrUnbalancedEntry},
+		{"unbalanced", []entities.JournalLine{{AccountID: 1, Debit: cents(1000)}, {AccountID: 2, Credit: cents(999)}}, ErrUnbalancedEntry},
+		{"both sides", []entities.JournalLine{{AccountID: 1, Debit: cents(5), Credit: cents(5)}, {AccountID: 2}}, ErrInvalidLine},
+		{"negative", []entities.JournalLine{{AccountID: 1, Debit: cents(-5)}, {AccountID: 2, Credit: cents(-5)}}, ErrInvalidLine},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ValidateEntry(c.lines); !errors.Is(err, c.wantErr) {
+				t.Errorf("Expected error %v, got %v", c.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReversalCancelsOriginal(t *testing.T) {
+	original := CompletionRewardLines(1, 2, entities.MustParseMoney("33.33"))
+	reversal := ReversalLines(original)
+	if err := ValidateEntry(reversal); err != nil {
+		t.Fatalf("Reversal isn't a valid entry: %v", err)
+	}
+
+	balances := map[int]entities.Money{}
+	for _, line := range append(original, reversal...) {
+		balances[line.AccountID] = balances[line.AccountID].Add(LineBalance(line))
+	}
+	for accountID, balance := range balances {
+		if !balance.IsZero() {
+			t.Errorf("Account %d should be back to zero, got %v", accountID, balance)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"aTES/core/rbac"
+	"errors"
+	"math/rand"
+)
+
+var ErrNoEligibleWorkers = errors.New("there are no workers tasks can be assigned to")
+
+// One task changing hands during a shuffle.
+type Reassignment struct {
+	TaskID int            `json:"task_id"`
+	From   int            `json:"from"` // The previous assignee.
+	To     int            `json:"to"`   // The new assignee, charged the assignment fee.
+	Fee    entities.Money `json:"fee"`
+}
+
+// What a shuffle did, returned to the manager who triggered it.
+type ShuffleSummary struct {
+	TasksConsidered int            `json:"tasks_considered"` // Open tasks that took part in the draw.
+	Workers         int            `json:"workers"`          // Workers tasks could land on.
+	Reassignments   []Reassignment `json:"reassignments"`    // Only tasks that actually moved.
+	TotalFees       entities.Money `json:"total_fees"`
+}
+
+// Checks whether tasks may be assigned to the user: only roles with tasks:assignable do tasks,
+// and people who left the company or were removed from it don't get new ones. A nil policy is
+// rbac.Default().
+func IsEligibleAssignee(policy *rbac.Policy, user entities.User) bool {
+	return policyOrDefault(policy).Allows(user.Role, rbac.TasksAssignable) && user.LeftAt == "" && user.RemovedAt == ""
+}
+
+// Keeps only the users tasks may be assigned to.
+func EligibleAssignees(policy *rbac.Policy, users []entities.User) []entities.User {
+	var eligible []entities.User
+	for _, user := range users {
+		if IsEligibleAssignee(policy, user) {
+			eligible = append(eligible, user)
+		}
+	}
+
+	return eligible
+}
+
+// Picks a random worker out of the eligible ones.
+func PickAssignee(workers []entities.User, rng *rand.Rand) (entities.User, error) {
+	if len(workers) == 0 {
+		return entities.User{}, ErrNoEligibleWorkers
+	}
+
+	return workers[rng.Intn(len(workers))], nil
+}
+
+// The amount charged to a worker when a task lands on them. Fixed when the task is created.
+func AssignmentFee(task entities.Task) entities.Money {
+	return task.AssignFee
+}
+
+// Randomly redistributes every open task among the workers, for actors with tasks:shuffle. Closed
+// tasks are skipped, so the caller may pass whatever it has locked. Only tasks whose assignee
+// changed end up in the summary.
+func ShuffleTasks(actor Actor, tasks []entities.Task, workers []entities.User, rng *rand.Rand) (ShuffleSummary, error) {
+	if !actor.Can(rbac.TasksShuffle) {
+		return ShuffleSummary{}, ErrNotAllowed
+	}
+
+	workers = EligibleAssignees(actor.Policy, workers)
+	summary := ShuffleSummary{Workers: len(workers)}
+	for _, task := range tasks {
+		if !IsOpen(task) {
+			continue
+		}
+		summary.TasksConsidered++
+
+		worker, err := PickAssignee(workers, rng)
+		if err != nil {
+			return ShuffleSummary{}, err
+		}
+		if worker.UserID == task.AssignedTo {
+			continue
+		}
+
+		fee := AssignmentFee(task)
+		summary.Reassignments = append(summary.Reassignments, Reassignment{
+			TaskID: task.TaskID,
+			From:   task.AssignedTo,
+			To:     worker.UserID,
+			Fee:    fee,
+		})
+		summary.TotalFees = summary.TotalFees.Add(fee)
+	}
+
+	return summary, nil
+}
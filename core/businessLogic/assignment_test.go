@@ -0,0 +1,76 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"aTES/core/rbac"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestShuffleTasks(t *testing.T) {
+	manager := Actor{UserID: 1, Role: entities.RoleManager}
+	users := []entities.User{
+		{UserID: 1, Role: entities.RoleManager},
+		{UserID: 2, Role: entities.RoleAdmin},
+		{UserID: 3, Role: entities.RoleWorker, LeftAt: "2024-06-01"},
+		{UserID: 4, Role: entities.RoleWorker},
+		{UserID: 5, Role: entities.RoleWorker},
+		{UserID: 6, Role: entities.RoleWorker, RemovedAt: "2024-06-02 10:00:00"},
+	}
+	tasks := []entities.Task{
+		{TaskID: 1, AssignedTo: 4, Status: string(StatusPending)},
+		{TaskID: 2, AssignedTo: 4, Status: string(StatusStarted)},
+		{TaskID: 3, AssignedTo: 4, Status: string(StatusCompleted)},
+	}
+
+	summary, err := ShuffleTasks(manager, tasks, users, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if summary.TasksConsidered != 2 || summary.Workers != 2 {
+		t.Errorf("Expected 2 open tasks and 2 workers, got %+v", summary)
+	}
+	for _, moved := range summary.Reassignments {
+		if moved.TaskID == 3 {
+			t.Errorf("Completed task was reassigned")
+		}
+		if moved.To != 5 {
+			t.Errorf("Task %d landed on ineligible user %d", moved.TaskID, moved.To)
+		}
+	}
+
+	// Workers can't trigger a shuffle.
+	_, err = ShuffleTasks(Actor{UserID: 4, Role: entities.RoleWorker}, tasks, users, rand.New(rand.NewSource(1)))
+	if !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Expected ErrNotAllowed, got %v", err)
+	}
+}
+
+// Who shuffles and who gets tasks comes from the policy, not the role names.
+func TestShuffleTasksFollowsPolicy(t *testing.T) {
+	policy, err := rbac.ParsePolicy([]byte("roles:\n  accountant: [tasks:shuffle]\n  manager: [tasks:assignable]\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	users := []entities.User{
+		{UserID: 1, Role: entities.RoleAccountant},
+		{UserID: 2, Role: entities.RoleManager},
+		{UserID: 3, Role: entities.RoleWorker},
+	}
+	tasks := []entities.Task{{TaskID: 1, AssignedTo: 3, Status: string(StatusPending)}}
+
+	summary, err := ShuffleTasks(Actor{UserID: 1, Role: entities.RoleAccountant, Policy: policy}, tasks, users, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if summary.Workers != 1 || len(summary.Reassignments) != 1 || summary.Reassignments[0].To != 2 {
+		t.Errorf("Expected the task moved to the manager, got %+v", summary)
+	}
+
+	_, err = ShuffleTasks(Actor{UserID: 2, Role: entities.RoleManager, Policy: policy}, tasks, users, rand.New(rand.NewSource(1)))
+	if !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Expected ErrNotAllowed, got %v", err)
+	}
+}
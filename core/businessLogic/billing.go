@@ -0,0 +1,49 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"time"
+)
+
+// Billing cycle states.
+const (
+	CycleOpen   = "open"
+	CycleClosed = "closed"
+)
+
+var (
+	ErrCycleNotOver    = errors.New("the billing day isn't over yet")
+	ErrCycleOutOfOrder = errors.New("billing days are closed in order")
+)
+
+// Splits a worker's end of day balance into what gets paid out and what rolls over.
+// Positive balances are paid in full, negative ones carry into the next day untouched.
+func SettleBalance(ending entities.Money) (payout, carriedOver entities.Money) {
+	if ending.IsPositive() {
+		return ending, entities.NewMoney(0)
+	}
+
+	return entities.NewMoney(0), ending
+}
+
+// The start of the billing day a moment falls in, in the moment's location.
+func BillingDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// A day can only be closed once it's completely over.
+func CanCloseDay(day, now time.Time) error {
+	if !BillingDay(day).AddDate(0, 0, 1).After(now) {
+		return nil
+	}
+
+	return ErrCycleNotOver
+}
+
+// When a day's payouts are posted: its last second, so they count towards that day whenever
+// the day is closed, and the next day starts from what's left.
+func PayoutTime(day time.Time) time.Time {
+	return BillingDay(day).AddDate(0, 0, 1).Add(-time.Second)
+}
@@ -0,0 +1,140 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The two amounts attached to a task when it's created. They never change afterwards,
+// so every reassignment charges the same fee.
+type TaskPrices struct {
+	AssignFee entities.Money `json:"assign_fee" yaml:"assign_fee"` // Charged to each worker the task lands on.
+	Reward    entities.Money `json:"reward" yaml:"reward"`         // Paid to the worker who completes it.
+}
+
+// Decides what a new task costs to take and pays on completion.
+type PricingPolicy interface {
+	PriceTask(description string) TaskPrices
+}
+
+// Creates a random source. A zero seed means "seed from the clock" so production prices
+// aren't predictable, anything else makes the sequence reproducible for tests and replays.
+func NewRandSource(seed int64) *rand.Rand {
+	if seed == 0 {
+		seed = rand.Int63()
+	}
+
+	return rand.New(rand.NewSource(seed))
+}
+
+// rand.Rand isn't safe for concurrent use and handlers price tasks concurrently.
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// Draws a whole number of cents in [min, max].
+func (l *lockedRand) between(min, max entities.Money) entities.Money {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return min.Add(entities.NewMoney(l.rng.Int63n(max.Sub(min).Minor + 1)))
+}
+
+// The classic aTES rule: assignment fee between 10 and 20, completion reward between 20 and 40.
+type ClassicPricing struct {
+	rng *lockedRand
+}
+
+func NewClassicPricing(rng *rand.Rand) *ClassicPricing {
+	return &ClassicPricing{rng: &lockedRand{rng: rng}}
+}
+
+func (p *ClassicPricing) PriceTask(string) TaskPrices {
+	return TaskPrices{
+		AssignFee: p.rng.between(entities.NewMoney(1000), entities.NewMoney(2000)),
+		Reward:    p.rng.between(entities.NewMoney(2000), entities.NewMoney(4000)),
+	}
+}
+
+// Every task costs the same.
+type FixedPricing TaskPrices
+
+func (p FixedPricing) PriceTask(string) TaskPrices {
+	return TaskPrices(p)
+}
+
+// A row of the pricing table: tasks whose description contains the keyword are priced
+// between the given bounds. Equal bounds give a fixed price.
+type PricingRule struct {
+	Keyword string     `yaml:"keyword"`
+	Min     TaskPrices `yaml:"min"`
+	Max     TaskPrices `yaml:"max"`
+}
+
+// Prices tasks by the first rule whose keyword shows up in the description,
+// falling back to the default rule.
+type TablePricing struct {
+	Rules   []PricingRule `yaml:"rules"`
+	Default PricingRule   `yaml:"default"`
+	rng     *lockedRand
+}
+
+// Loads a pricing table from a yaml file shaped like:
+//
+//	default: { min: { assign_fee: 10, reward: 20 }, max: { assign_fee: 20, reward: 40 } }
+//	rules:
+//	  - keyword: "[urgent]"
+//	    min: { assign_fee: 15, reward: 40 }
+//	    max: { assign_fee: 25, reward: 60 }
+func LoadTablePricing(tableYamlPath string, rng *rand.Rand) (*TablePricing, error) {
+	data, err := os.ReadFile(tableYamlPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading pricing table %s: %w", tableYamlPath, err)
+	}
+
+	table := TablePricing{rng: &lockedRand{rng: rng}}
+	if err := yaml.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("error while parsing pricing table %s: %w", tableYamlPath, err)
+	}
+
+	for _, rule := range append(table.Rules, table.Default) {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid pricing table %s: %w", tableYamlPath, err)
+		}
+	}
+
+	return &table, nil
+}
+
+func (rule PricingRule) validate() error {
+	if rule.Min.AssignFee.IsNegative() || rule.Min.Reward.IsNegative() {
+		return fmt.Errorf("rule %q has negative prices", rule.Keyword)
+	}
+	if rule.Max.AssignFee.Cmp(rule.Min.AssignFee) < 0 || rule.Max.Reward.Cmp(rule.Min.Reward) < 0 {
+		return fmt.Errorf("rule %q has max below min", rule.Keyword)
+	}
+
+	return nil
+}
+
+func (p *TablePricing) PriceTask(description string) TaskPrices {
+	rule := p.Default
+	for _, candidate := range p.Rules {
+		if strings.Contains(strings.ToLower(description), strings.ToLower(candidate.Keyword)) {
+			rule = candidate
+			break
+		}
+	}
+
+	return TaskPrices{
+		AssignFee: p.rng.between(rule.Min.AssignFee, rule.Max.AssignFee),
+		Reward:    p.rng.between(rule.Min.Reward, rule.Max.Reward),
+	}
+}
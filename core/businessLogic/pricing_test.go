@@ -0,0 +1,49 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClassicPricingIsDeterministicAndInRange(t *testing.T) {
+	first := NewClassicPricing(NewRandSource(42))
+	second := NewClassicPricing(NewRandSource(42))
+
+	for i := 0; i < 100; i++ {
+		a, b := first.PriceTask("task"), second.PriceTask("task")
+		if a != b {
+			t.Fatalf("Same seed gave different prices: %+v vs %+v", a, b)
+		}
+		if a.AssignFee.Minor < 1000 || a.AssignFee.Minor > 2000 || a.Reward.Minor < 2000 || a.Reward.Minor > 4000 {
+			t.Fatalf("Prices out of range: %+v", a)
+		}
+	}
+}
+
+func TestTablePricing(t *testing.T) {
+	tablePath := filepath.Join(t.TempDir(), "pricing.yaml")
+	table := `
+default: { min: { assign_fee: 10, reward: 20 }, max: { assign_fee: 10, reward: 20 } }
+rules:
+  - keyword: "[urgent]"
+    min: { assign_fee: 15, reward: 50 }
+    max: { assign_fee: 15, reward: 50 }
+`
+	if err := os.WriteFile(tablePath, []byte(table), 0o600); err != nil {
+		t.Fatalf("Error writing the pricing table: %v", err)
+	}
+
+	pricing, err := LoadTablePricing(tablePath, NewRandSource(1))
+	if err != nil {
+		t.Fatalf("Error loading the pricing table: %v", err)
+	}
+
+	if got := pricing.PriceTask("[URGENT] fix the build"); got != (TaskPrices{AssignFee: entities.MustParseMoney("15"), Reward: entities.MustParseMoney("50")}) {
+		t.Errorf("Expected the urgent rule, got %+v", got)
+	}
+	if got := pricing.PriceTask("water the plants"); got != (TaskPrices{AssignFee: entities.MustParseMoney("10"), Reward: entities.MustParseMoney("20")}) {
+		t.Errorf("Expected the default rule, got %+v", got)
+	}
+}
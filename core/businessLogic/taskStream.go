@@ -0,0 +1,154 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A task's state is snapshotted every this many events.
+const TaskSnapshotEvery = 50
+
+var ErrBrokenTaskStream = errors.New("broken task stream")
+
+// Folding one event into the task. Events have to come in stream order, starting from the
+// zero task (or a snapshot).
+func ApplyTaskEvent(task *entities.Task, event entities.TaskEvent) error {
+	if event.Version != task.Version+1 {
+		return fmt.Errorf("%w: task %d is at version %d, got event %d", ErrBrokenTaskStream, event.TaskID, task.Version, event.Version)
+	}
+	if event.Version > 1 && event.TaskID != task.TaskID {
+		return fmt.Errorf("%w: event of task %d applied to task %d", ErrBrokenTaskStream, event.TaskID, task.TaskID)
+	}
+
+	data := event.Data
+	switch event.Type {
+	case entities.TaskEventCreated:
+		*task = entities.Task{TaskID: event.TaskID, JiraID: data.JiraID, Description: data.Description,
+			Status: string(StatusPending), CreationTime: event.OccurredAt}
+	case entities.TaskEventImported:
+		if data.Task == nil {
+			return fmt.Errorf("%w: task %d imported without its state", ErrBrokenTaskStream, event.TaskID)
+		}
+		*task = *data.Task
+		task.TaskID = event.TaskID
+	case entities.TaskEventPriceSet:
+		if data.AssignFee != nil {
+			task.AssignFee = *data.AssignFee
+		}
+		if data.Price != nil {
+			task.Price = *data.Price
+		}
+	case entities.TaskEventAssigned, entities.TaskEventReassigned:
+		task.AssignedTo = data.To
+	case entities.TaskEventDescribed:
+		task.JiraID = data.JiraID
+		task.Description = data.Description
+	case entities.TaskEventStarted:
+		task.Status = string(StatusStarted)
+	case entities.TaskEventCompleted:
+		task.Status = string(StatusCompleted)
+		task.CompletionTime = data.CompletionTime
+	case entities.TaskEventCancelled:
+		task.Status = string(StatusCancelled)
+	default:
+		return fmt.Errorf("%w: task %d has an event of unknown type %q", ErrBrokenTaskStream, event.TaskID, event.Type)
+	}
+
+	task.Version = event.Version
+	if event.Type != entities.TaskEventImported {
+		task.LastUpdated = event.OccurredAt
+	}
+
+	return nil
+}
+
+// Folding a stream into the state it leaves the task in.
+func FoldTaskEvents(task entities.Task, stream []entities.TaskEvent) (entities.Task, error) {
+	for _, event := range stream {
+		if err := ApplyTaskEvent(&task, event); err != nil {
+			return entities.Task{}, err
+		}
+	}
+
+	return task, nil
+}
+
+// Recording a change to the task: the event comes next in its stream and is folded in right away,
+// so checks made after it see the changed task.
+func RecordTaskEvent(task *entities.Task, eventType string, data entities.TaskEventData, actorID int, now time.Time) (entities.TaskEvent, error) {
+	event := entities.TaskEvent{TaskID: task.TaskID, Version: task.Version + 1, Type: eventType, Data: data,
+		ActorID: actorID, OccurredAt: now.Format(time.DateTime)}
+	if err := ApplyTaskEvent(task, event); err != nil {
+		return entities.TaskEvent{}, err
+	}
+
+	return event, nil
+}
+
+// The event moving a task into each status it can be moved into.
+var statusEvents = map[TaskStatus]string{
+	StatusStarted:   entities.TaskEventStarted,
+	StatusCompleted: entities.TaskEventCompleted,
+	StatusCancelled: entities.TaskEventCancelled,
+}
+
+// Recording a status change if the state machine allows it, like TransitionTask.
+func RecordTransition(task *entities.Task, to TaskStatus, actor Actor, now time.Time) (entities.TaskEvent, error) {
+	if err := CanTransition(*task, to, actor); err != nil {
+		return entities.TaskEvent{}, err
+	}
+
+	var data entities.TaskEventData
+	if to == StatusCompleted {
+		data.CompletionTime = now.Format(time.DateTime)
+	}
+	return RecordTaskEvent(task, statusEvents[to], data, actor.UserID, now)
+}
+
+// The fields an event changed, with their values before and after it. Imports change nothing:
+// they only record what a task looked like when the streams began.
+func TaskHistory(before, after entities.Task, event entities.TaskEvent) []entities.TaskHistoryEntry {
+	if event.Type == entities.TaskEventImported {
+		return nil
+	}
+
+	fields := []struct{ name, old, new string }{
+		{"jira_id", before.JiraID, after.JiraID},
+		{"description", before.Description, after.Description},
+		{"assigned_to", userRef(before.AssignedTo), userRef(after.AssignedTo)},
+		{"status", before.Status, after.Status},
+		{"assign_fee", moneyRef(before, before.AssignFee), moneyRef(after, after.AssignFee)},
+		{"price", moneyRef(before, before.Price), moneyRef(after, after.Price)},
+	}
+	var entries []entities.TaskHistoryEntry
+	for _, field := range fields {
+		if field.old == field.new {
+			continue
+		}
+		entries = append(entries, entities.TaskHistoryEntry{TaskID: event.TaskID, Version: event.Version, ActorID: event.ActorID,
+			Field: field.name, OldValue: field.old, NewValue: field.new, ChangedAt: event.OccurredAt})
+	}
+
+	return entries
+}
+
+// Nobody is an empty value rather than user 0.
+func userRef(userID int) string {
+	if userID == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(userID)
+}
+
+// Prices of a task that doesn't exist yet are empty rather than 0.00.
+func moneyRef(task entities.Task, amount entities.Money) string {
+	if task.Version == 0 {
+		return ""
+	}
+
+	return amount.String()
+}
@@ -0,0 +1,68 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFoldTaskEvents(t *testing.T) {
+	fee, price := entities.NewMoney(1500), entities.NewMoney(3000)
+	stream := []entities.TaskEvent{
+		{TaskID: 42, Version: 1, Type: entities.TaskEventCreated, OccurredAt: "2024-06-03 09:00:00",
+			Data: entities.TaskEventData{JiraID: "POP-1", Description: "Feed the parrots"}},
+		{TaskID: 42, Version: 2, Type: entities.TaskEventPriceSet, OccurredAt: "2024-06-03 09:00:00",
+			Data: entities.TaskEventData{AssignFee: &fee, Price: &price}},
+		{TaskID: 42, Version: 3, Type: entities.TaskEventAssigned, OccurredAt: "2024-06-03 09:00:00",
+			Data: entities.TaskEventData{To: 7}},
+		{TaskID: 42, Version: 4, Type: entities.TaskEventReassigned, OccurredAt: "2024-06-04 10:00:00",
+			Data: entities.TaskEventData{From: 7, To: 8}},
+		{TaskID: 42, Version: 5, Type: entities.TaskEventCompleted, OccurredAt: "2024-06-05 11:00:00",
+			Data: entities.TaskEventData{CompletionTime: "2024-06-05 11:00:00"}},
+	}
+
+	task, err := FoldTaskEvents(entities.Task{}, stream)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := entities.Task{TaskID: 42, JiraID: "POP-1", Description: "Feed the parrots", AssignedTo: 8,
+		Status: string(StatusCompleted), AssignFee: fee, Price: price, CreationTime: "2024-06-03 09:00:00",
+		CompletionTime: "2024-06-05 11:00:00", LastUpdated: "2024-06-05 11:00:00", Version: 5}
+	if task != expected {
+		t.Errorf("Expected %+v, got %+v", expected, task)
+	}
+
+	// Folding the tail onto a snapshot gets the same task.
+	snapshot, _ := FoldTaskEvents(entities.Task{}, stream[:3])
+	if task, err := FoldTaskEvents(snapshot, stream[3:]); err != nil || task != expected {
+		t.Errorf("Expected %+v from the snapshot, got %+v (%v)", expected, task, err)
+	}
+
+	if _, err := FoldTaskEvents(entities.Task{}, stream[1:]); !errors.Is(err, ErrBrokenTaskStream) {
+		t.Errorf("Expected ErrBrokenTaskStream for a stream with a gap, got %v", err)
+	}
+}
+
+func TestRecordTransition(t *testing.T) {
+	task := entities.Task{TaskID: 42, AssignedTo: 7, Status: string(StatusPending), Version: 3}
+	now := time.Date(2024, 6, 5, 11, 0, 0, 0, time.UTC)
+
+	event, err := RecordTransition(&task, StatusCompleted, Actor{UserID: 7, Role: entities.RoleWorker}, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event.Type != entities.TaskEventCompleted || event.Version != 4 || event.ActorID != 7 {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if task.Status != string(StatusCompleted) || task.CompletionTime != "2024-06-05 11:00:00" || task.Version != 4 {
+		t.Errorf("Expected the completion folded in, got %+v", task)
+	}
+
+	if _, err := RecordTransition(&task, StatusCancelled, Actor{UserID: 1, Role: entities.RoleManager}, now); !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Expected ErrIllegalTransition, got %v", err)
+	}
+	if task.Version != 4 {
+		t.Errorf("Expected a rejected transition to record nothing, got version %d", task.Version)
+	}
+}
@@ -1 +1,189 @@
 package businesslogic
+
+import (
+	"aTES/core/entities"
+	"aTES/core/rbac"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The states a task can be in. Stored as a string in entities.Task.Status.
+type TaskStatus string
+
+const (
+	StatusPending   TaskStatus = "pending"   // Created and assigned, work not started yet.
+	StatusStarted   TaskStatus = "started"   // The assignee is working on it.
+	StatusCompleted TaskStatus = "completed" // Done, terminal.
+	StatusCancelled TaskStatus = "cancelled" // Called off by a manager, terminal.
+)
+
+var (
+	ErrUnknownStatus     = errors.New("unknown task status")
+	ErrIllegalTransition = errors.New("illegal task status transition")
+	ErrNotAllowed        = errors.New("actor is not allowed to perform this transition")
+)
+
+// Describes a rejected status change. Unwraps to one of the sentinel errors above.
+type TransitionError struct {
+	TaskID int
+	From   TaskStatus
+	To     TaskStatus
+	Err    error
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("task %d: %s -> %s: %v", e.TaskID, e.From, e.To, e.Err)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return e.Err
+}
+
+// A tracker key in square brackets at the start of a description, e.g. "[UBERPOP-42] Fix login".
+var jiraIDPrefix = regexp.MustCompile(`^\s*\[([A-Z][A-Z0-9]*-[0-9]+)\]\s*`)
+
+// Splitting a leading [JIRA-ID] off a description. Descriptions without one come back as they are.
+func SplitJiraID(description string) (jiraID, rest string) {
+	match := jiraIDPrefix.FindStringSubmatch(description)
+	if match == nil {
+		return "", strings.TrimSpace(description)
+	}
+
+	return match[1], strings.TrimSpace(description[len(match[0]):])
+}
+
+// The user on whose behalf a task is being changed, with the policy saying what their role may
+// do. Without a policy it's rbac.Default().
+type Actor struct {
+	UserID int
+	Role   string
+	Policy *rbac.Policy
+}
+
+// Checks whether the actor's role holds the permission.
+func (a Actor) Can(permission rbac.Permission) bool {
+	return a.policy().Allows(a.Role, permission)
+}
+
+func (a Actor) policy() *rbac.Policy {
+	return policyOrDefault(a.Policy)
+}
+
+func policyOrDefault(policy *rbac.Policy) *rbac.Policy {
+	if policy == nil {
+		return rbac.Default()
+	}
+
+	return policy
+}
+
+// Checks whether the actor may look at tasks assigned to anybody.
+func CanViewAllTasks(actor Actor) bool {
+	return actor.Can(rbac.TasksReadAll)
+}
+
+// Workers only get to see their own tasks.
+func CanViewTask(actor Actor, task entities.Task) bool {
+	return CanViewAllTasks(actor) || task.AssignedTo == actor.UserID
+}
+
+// The history of a task is for roles with tasks:history and for whoever has or had the task, so
+// a worker can show when it was taken from them.
+func CanViewTaskHistory(actor Actor, task entities.Task, history []entities.TaskHistoryEntry) bool {
+	if actor.Can(rbac.TasksHistory) || task.AssignedTo == actor.UserID {
+		return true
+	}
+	me := strconv.Itoa(actor.UserID)
+	for _, entry := range history {
+		if entry.Field == "assigned_to" && (entry.OldValue == me || entry.NewValue == me) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A guard decides if the actor may move the task into the target state.
+type transitionGuard func(task entities.Task, actor Actor) bool
+
+// Only the user the task is assigned to may work on it.
+func assigneeOnly(task entities.Task, actor Actor) bool {
+	return task.AssignedTo == actor.UserID
+}
+
+// Only roles with tasks:cancel may call a task off.
+func cancellers(_ entities.Task, actor Actor) bool {
+	return actor.Can(rbac.TasksCancel)
+}
+
+// Allowed transitions and the guard for each of them. Anything missing here is illegal.
+var transitions = map[TaskStatus]map[TaskStatus]transitionGuard{
+	StatusPending: {
+		StatusStarted:   assigneeOnly,
+		StatusCompleted: assigneeOnly,
+		StatusCancelled: cancellers,
+	},
+	StatusStarted: {
+		StatusCompleted: assigneeOnly,
+		StatusCancelled: cancellers,
+	},
+	StatusCompleted: {},
+	StatusCancelled: {},
+}
+
+// Converts a raw status string into a TaskStatus, rejecting anything unknown.
+func ParseTaskStatus(status string) (TaskStatus, error) {
+	s := TaskStatus(status)
+	if _, known := transitions[s]; !known {
+		return "", fmt.Errorf("%w: %q", ErrUnknownStatus, status)
+	}
+
+	return s, nil
+}
+
+// Reports whether a task in this state can still change.
+func (s TaskStatus) IsTerminal() bool {
+	return len(transitions[s]) == 0
+}
+
+// Reports whether the task is still open for work (and for reassignment).
+func IsOpen(task entities.Task) bool {
+	return !TaskStatus(task.Status).IsTerminal()
+}
+
+// Checks that the actor may move the task into the target state, without changing anything.
+func CanTransition(task entities.Task, to TaskStatus, actor Actor) error {
+	from, err := ParseTaskStatus(task.Status)
+	if err != nil {
+		return &TransitionError{TaskID: task.TaskID, From: TaskStatus(task.Status), To: to, Err: err}
+	}
+
+	guard, allowed := transitions[from][to]
+	if !allowed {
+		return &TransitionError{TaskID: task.TaskID, From: from, To: to, Err: ErrIllegalTransition}
+	}
+	if !guard(task, actor) {
+		return &TransitionError{TaskID: task.TaskID, From: from, To: to, Err: ErrNotAllowed}
+	}
+
+	return nil
+}
+
+// Moves the task into the target state if the transition is allowed, stamping the timestamps.
+func TransitionTask(task *entities.Task, to TaskStatus, actor Actor, now time.Time) error {
+	if err := CanTransition(*task, to, actor); err != nil {
+		return err
+	}
+
+	task.Status = string(to)
+	if to == StatusCompleted {
+		task.CompletionTime = now.Format(time.DateTime)
+	}
+	task.LastUpdated = now.Format(time.DateTime)
+
+	return nil
+}
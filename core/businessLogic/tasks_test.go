@@ -0,0 +1,101 @@
+package businesslogic
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransitionTask(t *testing.T) {
+	assignee := Actor{UserID: 7, Role: entities.RoleWorker}
+	otherWorker := Actor{UserID: 8, Role: entities.RoleWorker}
+	manager := Actor{UserID: 1, Role: entities.RoleManager}
+
+	cases := []struct {
+		name    string
+		from    TaskStatus
+		to      TaskStatus
+		actor   Actor
+		wantErr error
+	}{
+		{"assignee starts", StatusPending, StatusStarted, assignee, nil},
+		{"assignee completes pending", StatusPending, StatusCompleted, assignee, nil},
+		{"assignee completes started", StatusStarted, StatusCompleted, assignee, nil},
+		{"manager cancels", StatusStarted, StatusCancelled, manager, nil},
+		{"other worker completes", StatusPending, StatusCompleted, otherWorker, ErrNotAllowed},
+		{"manager completes", StatusPending, StatusCompleted, manager, ErrNotAllowed},
+		{"assignee cancels", StatusPending, StatusCancelled, assignee, ErrNotAllowed},
+		{"cancelled completed", StatusCancelled, StatusCompleted, assignee, ErrIllegalTransition},
+		{"completed restarted", StatusCompleted, StatusStarted, assignee, ErrIllegalTransition},
+		{"started back to pending", StatusStarted, StatusPending, manager, ErrIllegalTransition},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			task := entities.Task{TaskID: 42, AssignedTo: assignee.UserID, Status: string(c.from)}
+
+			err := TransitionTask(&task, c.to, c.actor, time.Now())
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("Expected error %v, got %v", c.wantErr, err)
+			}
+
+			// A rejected transition must leave the task untouched.
+			wantStatus := c.to
+			if c.wantErr != nil {
+				wantStatus = c.from
+			}
+			if task.Status != string(wantStatus) {
+				t.Errorf("Expected status %s, got %s", wantStatus, task.Status)
+			}
+		})
+	}
+}
+
+func TestParseTaskStatus(t *testing.T) {
+	if _, err := ParseTaskStatus("done"); !errors.Is(err, ErrUnknownStatus) {
+		t.Errorf("Expected ErrUnknownStatus, got %v", err)
+	}
+	if s, err := ParseTaskStatus("started"); err != nil || s != StatusStarted {
+		t.Errorf("Expected started, got %v, %v", s, err)
+	}
+}
+
+func TestSplitJiraID(t *testing.T) {
+	cases := map[string][2]string{
+		"[UBERPOP-42] Fix the login page": {"UBERPOP-42", "Fix the login page"},
+		"  [POP-7]Feed the parrots ":      {"POP-7", "Feed the parrots"},
+		"Feed the parrots":                {"", "Feed the parrots"},
+		"[not a key] Feed the parrots":    {"", "[not a key] Feed the parrots"},
+	}
+	for description, expected := range cases {
+		jiraID, rest := SplitJiraID(description)
+		if jiraID != expected[0] || rest != expected[1] {
+			t.Errorf("%q: expected %q and %q, got %q and %q", description, expected[0], expected[1], jiraID, rest)
+		}
+	}
+}
+
+func TestCanViewTaskHistory(t *testing.T) {
+	task := entities.Task{TaskID: 42, AssignedTo: 8}
+	history := []entities.TaskHistoryEntry{
+		{TaskID: 42, Field: "assigned_to", OldValue: "", NewValue: "7"},
+		{TaskID: 42, Field: "assigned_to", OldValue: "7", NewValue: "8"},
+	}
+
+	cases := map[string]struct {
+		actor    Actor
+		expected bool
+	}{
+		"assignee":        {Actor{UserID: 8, Role: entities.RoleWorker}, true},
+		"former assignee": {Actor{UserID: 7, Role: entities.RoleWorker}, true},
+		"other worker":    {Actor{UserID: 9, Role: entities.RoleWorker}, false},
+		"accountant":      {Actor{UserID: 3, Role: entities.RoleAccountant}, false},
+		"manager":         {Actor{UserID: 1, Role: entities.RoleManager}, true},
+	}
+	for name, c := range cases {
+		if got := CanViewTaskHistory(c.actor, task, history); got != c.expected {
+			t.Errorf("%s: expected %v, got %v", name, c.expected, got)
+		}
+	}
+}
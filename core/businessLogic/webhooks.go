@@ -0,0 +1,55 @@
+package businesslogic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+)
+
+// Webhook delivery limits. A delivery is given up on after MaxWebhookAttempts failed posts, a
+// subscription is disabled after WebhookDisableAfter failed posts in a row, whatever the events.
+const (
+	MaxWebhookAttempts  = 10
+	WebhookDisableAfter = 20
+)
+
+// Header carrying the payload's signature, "sha256=<hex>".
+const WebhookSignatureHeader = "X-Ates-Signature"
+
+var ErrInvalidWebhookURL = errors.New("webhook URLs must be absolute http or https URLs")
+
+// The signature of a webhook payload: the hex HMAC-SHA256 of the exact body bytes, keyed by
+// the subscription's secret. Receivers recompute it and compare in constant time.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checking a signature the way receivers should.
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// A random secret for subscriptions registered without one.
+func NewWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+func ValidateWebhookURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package businesslogic
+
+import "testing"
+
+func TestSignWebhook(t *testing.T) {
+	// RFC 4231 test case 2.
+	signature := SignWebhook("Jefe", []byte("what do ya want for nothing?"))
+	expected := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if signature != expected {
+		t.Errorf("Expected %s, got %s", expected, signature)
+	}
+
+	if !VerifyWebhookSignature("Jefe", []byte("what do ya want for nothing?"), expected) {
+		t.Errorf("Expected the signature to verify")
+	}
+	if VerifyWebhookSignature("Jefe", []byte("what do ya want for something?"), expected) {
+		t.Errorf("Expected a changed body not to verify")
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	for raw, valid := range map[string]bool{
+		"https://chat.example.com/hooks/ates": true,
+		"http://payroll.internal:8080/in":     true,
+		"ftp://example.com/hook":              false,
+		"/hooks/ates":                         false,
+		"https://":                            false,
+	} {
+		if err := ValidateWebhookURL(raw); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", raw, valid, err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package entities
+
+// One day of accounting. Workers are paid what they earned when the day is closed.
+type BillingCycle struct {
+	CycleID  int    `gorm:"primaryKey;autoIncrement" json:"cycle_id"`
+	Day      string `gorm:"type:date;uniqueIndex" json:"day"` // YYYY-MM-DD, one cycle per day.
+	Status   string `gorm:"type:varchar(20)" json:"status"`   // Open/closed.
+	OpenedAt string `gorm:"type:timestamp" json:"opened_at"`
+	ClosedAt string `gorm:"type:timestamp" json:"closed_at,omitempty"`
+}
+
+// What happened to one worker's balance when a cycle was closed. Kept for auditing.
+type BillingCycleBalance struct {
+	CycleID        int   `gorm:"primaryKey" json:"cycle_id"`
+	UserID         int   `gorm:"primaryKey" json:"user_id"`
+	OpeningBalance Money `gorm:"type:bigint;default:0" json:"opening_balance"` // At the start of the day.
+	EndingBalance  Money `gorm:"type:bigint;default:0" json:"ending_balance"`  // At the end of the day, before the payout.
+	Payout         Money `gorm:"type:bigint;default:0" json:"payout"`          // Paid out, zero unless the balance was positive.
+	CarriedOver    Money `gorm:"type:bigint;default:0" json:"carried_over"`    // Negative balance rolled into the next day.
+	PayoutEntryID  int   `json:"payout_entry_id,omitempty"`                    // The ledger entry of the payout.
+}
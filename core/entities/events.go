@@ -0,0 +1,64 @@
+package entities
+
+// An event envelope as kept by the durable event bus. EventID isn't the envelope's event_id.
+// The table also keeps tx_id, the transaction that stored the event, and events are read in
+// (tx_id, EventID) order since a lower EventID can commit after a higher one.
+type StoredEvent struct {
+	EventID    int64  `gorm:"primaryKey;autoIncrement" json:"event_id"`
+	Name       string `gorm:"type:varchar(50);index" json:"name"`
+	Payload    string `gorm:"type:jsonb" json:"payload"`
+	OccurredAt string `gorm:"type:timestamp" json:"occurred_at"`
+}
+
+// How far a subscriber of the durable event bus has read.
+type EventSubscription struct {
+	Subscriber  string `gorm:"primaryKey;type:varchar(100)" json:"subscriber"`
+	LastEventID int64  `json:"last_event_id"`                 // The newest event all its handlers accepted.
+	LastTxID    uint64 `gorm:"-:migration" json:"last_tx_id"` // The transaction that stored it, events are read in (tx, ID) order.
+	Attempts    int    `gorm:"default:0" json:"attempts"`     // Failed tries at the event after it.
+	LastError   string `gorm:"type:text" json:"last_error"`   // Why the last of those failed.
+}
+
+// An event a consumer has handled, written in the same transaction as the handler's changes so a
+// redelivered event is recognised and skipped.
+type ProcessedEvent struct {
+	Consumer    string `gorm:"primaryKey;type:varchar(100)" json:"consumer"`
+	EventID     string `gorm:"primaryKey;type:varchar(36)" json:"event_id"` // From the event's envelope.
+	ProcessedAt string `gorm:"type:timestamp;index" json:"processed_at"`
+}
+
+// An event a subscriber gave up on, kept with the reason so it can be looked at, corrected and
+// replayed to that subscriber.
+type DeadLetter struct {
+	DeadLetterID  int64  `gorm:"primaryKey;autoIncrement" json:"dead_letter_id"`
+	Subscriber    string `gorm:"type:varchar(100);index" json:"subscriber"`
+	StoredEventID int64  `gorm:"index" json:"stored_event_id"` // Where it sits in stored_events.
+	EventName     string `gorm:"type:varchar(50)" json:"event_name"`
+	Payload       string `gorm:"type:jsonb" json:"payload"` // The envelope, as received or as corrected since.
+	Error         string `gorm:"type:text" json:"error"`
+	Attempts      int    `gorm:"default:0" json:"attempts"`
+	Status        string `gorm:"type:varchar(20);index" json:"status"` // dead, queued (for replay) or replayed.
+	DeadAt        string `gorm:"type:timestamp" json:"dead_at"`
+	ReplayedAt    string `gorm:"type:timestamp" json:"replayed_at,omitempty"`
+}
+
+// Where a dead letter is at.
+const (
+	DeadLetterDead     = "dead"
+	DeadLetterQueued   = "queued"
+	DeadLetterReplayed = "replayed"
+)
+
+// An event waiting to be handed to the broker. It's written in the same transaction as the
+// change it describes, so the two are stored together or not at all.
+type OutboxMessage struct {
+	MessageID     int64  `gorm:"primaryKey;autoIncrement" json:"message_id"`
+	EventID       string `gorm:"type:varchar(36);index" json:"event_id"` // From the event's envelope.
+	EventName     string `gorm:"type:varchar(50)" json:"event_name"`
+	Payload       string `gorm:"type:jsonb" json:"payload"`
+	CreatedAt     string `gorm:"type:timestamp;index" json:"created_at"`
+	Attempts      int    `gorm:"default:0" json:"attempts"`                          // Failed deliveries so far.
+	NextAttemptAt string `gorm:"type:timestamp;index" json:"next_attempt_at"`        // Not retried before this.
+	DeliveredAt   string `gorm:"type:timestamp;index" json:"delivered_at,omitempty"` // Empty until the broker took it.
+	LastError     string `gorm:"type:text" json:"last_error,omitempty"`
+}
@@ -0,0 +1,42 @@
+package entities
+
+// An account in the double-entry ledger. Every worker has one, plus a few system accounts
+// (see businesslogic.AccountKind) that aren't owned by anyone.
+type LedgerAccount struct {
+	AccountID int    `gorm:"primaryKey;autoIncrement" json:"account_id"`
+	Kind      string `gorm:"type:varchar(20);index" json:"kind"` // worker/company/cash.
+	UserID    *int   `gorm:"uniqueIndex" json:"user_id"`         // The owner of a worker account, nil for system accounts.
+	OpenedAt  string `gorm:"type:timestamp" json:"opened_at"`
+}
+
+// A single immutable business event in the ledger, e.g. a task assignment being charged.
+// The money movement itself lives in its lines. Mistakes are fixed by a reversing entry.
+type JournalEntry struct {
+	EntryID         int    `gorm:"primaryKey;autoIncrement" json:"entry_id"`
+	Kind            string `gorm:"type:varchar(30);index" json:"kind"` // assignment_charge/completion_reward/payout/reversal.
+	TaskID          int    `gorm:"index" json:"task_id,omitempty"`     // The task the entry is about, 0 if none.
+	Description     string `gorm:"type:text" json:"description"`
+	ReversesEntryID int    `gorm:"index" json:"reverses_entry_id,omitempty"` // Set on reversals only.
+	PostedAt        string `gorm:"type:timestamp;index" json:"posted_at"`
+}
+
+// One side of a journal entry. Exactly one of Debit and Credit is non zero, and the debits
+// of an entry always add up to its credits. The table also keeps tx_id, the transaction that
+// posted the line.
+type JournalLine struct {
+	LineID    int   `gorm:"primaryKey;autoIncrement" json:"line_id"`
+	EntryID   int   `gorm:"index" json:"entry_id"`
+	AccountID int   `gorm:"index" json:"account_id"`
+	Debit     Money `gorm:"type:bigint;default:0" json:"debit"`
+	Credit    Money `gorm:"type:bigint;default:0" json:"credit"`
+}
+
+// A cached account balance so it doesn't have to be summed from the first line every time.
+// The real balance is the snapshot plus every line after it, in (transaction, line ID) order.
+type BalanceSnapshot struct {
+	AccountID  int    `gorm:"primaryKey" json:"account_id"`
+	Balance    Money  `gorm:"type:bigint;default:0" json:"balance"`
+	LastLineID int    `json:"last_line_id"`                  // The newest line included in Balance.
+	LastTxID   uint64 `gorm:"-:migration" json:"last_tx_id"` // The transaction that posted it.
+	TakenAt    string `gorm:"type:timestamp" json:"taken_at"`
+}
@@ -0,0 +1,244 @@
+package entities
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The currency amounts are in unless they say otherwise. Only the amount is stored in the
+// database and sent as JSON, so only amounts in this currency can be stored (see Value) and
+// everything read back is in it.
+const DefaultCurrency = "USD"
+
+// Digits after the decimal point, i.e. minor units are cents.
+const moneyScale = 2
+
+var ErrInvalidMoney = errors.New("invalid money amount")
+
+// A plain decimal: digits, optionally signed, optionally with a fraction. Go literal syntax such
+// as "0x10", "0b101" or "1_000", which big.Rat would take, isn't an amount.
+var moneyPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// An exact amount of money held as an integer number of minor units (cents).
+// Arithmetic never goes through floats; rounding happens only when a value enters the type.
+//
+// In the database a Money is a BIGINT of minor units. In JSON and yaml it's a decimal string
+// such as "12.50" so clients never see a float either.
+type Money struct {
+	Minor    int64  // Amount in minor units, negative for debts.
+	Currency string // ISO 4217 code, DefaultCurrency when empty.
+}
+
+// Creates an amount from minor units in the default currency.
+func NewMoney(minor int64) Money {
+	return Money{Minor: minor, Currency: DefaultCurrency}
+}
+
+// Parses a decimal amount such as "12", "-3.5" or "10.005". Extra digits beyond cents are
+// rounded half to even, so repeated rounding doesn't drift in one direction.
+func ParseMoney(amount string) (Money, error) {
+	amount = strings.TrimSpace(amount)
+	if !moneyPattern.MatchString(amount) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidMoney, amount)
+	}
+	rat, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidMoney, amount)
+	}
+
+	minor, err := roundHalfEven(rat.Mul(rat, big.NewRat(100, 1)))
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q: %v", ErrInvalidMoney, amount, err)
+	}
+
+	return NewMoney(minor), nil
+}
+
+// Rounds an exact rational to the nearest integer, ties to even.
+func roundHalfEven(r *big.Rat) (int64, error) {
+	quotient, remainder := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+
+	// Comparing twice the remainder with the denominator tells if we're past the half.
+	twiceRemainder := new(big.Int).Abs(remainder)
+	twiceRemainder.Lsh(twiceRemainder, 1)
+	switch cmp := twiceRemainder.Cmp(r.Denom()); {
+	case cmp > 0, cmp == 0 && quotient.Bit(0) == 1:
+		if r.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+
+	if !quotient.IsInt64() {
+		return 0, errors.New("amount out of range")
+	}
+
+	return quotient.Int64(), nil
+}
+
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return DefaultCurrency
+	}
+
+	return m.Currency
+}
+
+// Mixing currencies is a programming error, not something to recover from. So is going past
+// what an int64 of cents holds, which no real amount comes near.
+func (m Money) mustMatch(other Money) {
+	if m.currency() != other.currency() {
+		panic(fmt.Sprintf("money: mixing %s and %s", m.currency(), other.currency()))
+	}
+}
+
+func (m Money) Add(other Money) Money {
+	m.mustMatch(other)
+	sum := m.Minor + other.Minor
+	if (other.Minor > 0 && sum < m.Minor) || (other.Minor < 0 && sum > m.Minor) {
+		panic(fmt.Sprintf("money: %s + %s overflows", m, other))
+	}
+
+	return Money{Minor: sum, Currency: m.currency()}
+}
+
+func (m Money) Sub(other Money) Money {
+	m.mustMatch(other)
+	difference := m.Minor - other.Minor
+	if (other.Minor < 0 && difference < m.Minor) || (other.Minor > 0 && difference > m.Minor) {
+		panic(fmt.Sprintf("money: %s - %s overflows", m, other))
+	}
+
+	return Money{Minor: difference, Currency: m.currency()}
+}
+
+func (m Money) Neg() Money {
+	if m.Minor == math.MinInt64 {
+		panic(fmt.Sprintf("money: -(%s) overflows", m))
+	}
+
+	return Money{Minor: -m.Minor, Currency: m.currency()}
+}
+
+// Returns -1, 0 or 1 like strings.Compare.
+func (m Money) Cmp(other Money) int {
+	m.mustMatch(other)
+	switch {
+	case m.Minor < other.Minor:
+		return -1
+	case m.Minor > other.Minor:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Minor > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Minor < 0
+}
+
+// Formats the amount as a plain decimal, e.g. "-12.05". The currency isn't included.
+func (m Money) String() string {
+	sign, minor := "", uint64(m.Minor)
+	if m.Minor < 0 {
+		// -math.MinInt64 doesn't fit an int64, the magnitude is taken one cent short and
+		// the cent added back once it's unsigned.
+		sign, minor = "-", uint64(-(m.Minor+1))+1
+	}
+
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/100, moneyScale, minor%100)
+}
+
+// Stored as a BIGINT of minor units. The column has no currency, so only amounts in the default
+// one can go in, anything else would come back as if it were.
+func (m Money) Value() (driver.Value, error) {
+	if m.currency() != DefaultCurrency {
+		return nil, fmt.Errorf("%w: only %s amounts can be stored, got %s", ErrInvalidMoney, DefaultCurrency, m.currency())
+	}
+
+	return m.Minor, nil
+}
+
+// Integers coming from the database are minor units. Text is a decimal amount in major units,
+// which is what legacy decimal columns (and casts of them) return.
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = NewMoney(0)
+	case int64:
+		*m = NewMoney(v)
+	case []byte:
+		return m.Scan(string(v))
+	case string:
+		parsed, err := ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	default:
+		return fmt.Errorf("%w: can't scan %T into Money", ErrInvalidMoney, src)
+	}
+
+	return nil
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// Accepting both "12.34" and 12.34, the latter for clients that can't help sending numbers.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var amount string
+	if err := json.Unmarshal(data, &amount); err != nil {
+		amount = string(data)
+	}
+
+	parsed, err := ParseMoney(amount)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+
+	return nil
+}
+
+func (m Money) MarshalYAML() (any, error) {
+	return m.String(), nil
+}
+
+func (m *Money) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := ParseMoney(value.Value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+
+	return nil
+}
+
+// Shortcut for tests and constants: "12.50" must be a valid amount.
+func MustParseMoney(amount string) Money {
+	m, err := ParseMoney(amount)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
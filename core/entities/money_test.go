@@ -0,0 +1,110 @@
+package entities
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+	}{
+		{"12", 1200},
+		{"12.5", 1250},
+		{"-3.05", -305},
+		{"0.125", 12},   // Tie, rounds to the even cent.
+		{"0.135", 14},   // Tie, rounds to the even cent.
+		{"-0.125", -12}, // Ties are symmetric around zero.
+		{"0.1251", 13},
+	}
+
+	for _, c := range cases {
+		got, err := ParseMoney(c.in)
+		if err != nil {
+			t.Errorf("ParseMoney(%q) returned %v", c.in, err)
+			continue
+		}
+		if got.Minor != c.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", c.in, got.Minor, c.want)
+		}
+	}
+
+	// Go literal syntax big.Rat would take isn't an amount.
+	for _, bad := range []string{"", "abc", "1/3", "1e3", "0x10", "0x1p4", "0b101", "0o17", "1_000", "+1", ".5", "1.", "- 1"} {
+		if _, err := ParseMoney(bad); err == nil {
+			t.Errorf("ParseMoney(%q) should have failed", bad)
+		}
+	}
+}
+
+func TestMoneyJSONAndScan(t *testing.T) {
+	var task struct {
+		Price Money `json:"price"`
+	}
+	if err := json.Unmarshal([]byte(`{"price": "-0.70"}`), &task); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if task.Price.Minor != -70 {
+		t.Errorf("Expected -70 minor units, got %d", task.Price.Minor)
+	}
+
+	encoded, _ := json.Marshal(task)
+	if string(encoded) != `{"price":"-0.70"}` {
+		t.Errorf("Unexpected encoding %s", encoded)
+	}
+
+	// BIGINT columns come back as minor units, legacy decimals as text.
+	var fromInt, fromText Money
+	if err := fromInt.Scan(int64(1999)); err != nil || fromInt.String() != "19.99" {
+		t.Errorf("Scanning int64 gave %v, %v", fromInt, err)
+	}
+	if err := fromText.Scan([]byte("19.99")); err != nil || fromText.Cmp(fromInt) != 0 {
+		t.Errorf("Scanning text gave %v, %v", fromText, err)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	cases := map[int64]string{
+		0:             "0.00",
+		5:             "0.05",
+		-5:            "-0.05",
+		-1205:         "-12.05",
+		math.MaxInt64: "92233720368547758.07",
+		math.MinInt64: "-92233720368547758.08",
+	}
+	for minor, want := range cases {
+		if got := NewMoney(minor).String(); got != want {
+			t.Errorf("NewMoney(%d).String() = %q, want %q", minor, got, want)
+		}
+	}
+}
+
+func TestMoneyArithmeticGuards(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: expected a panic", name)
+			}
+		}()
+		f()
+	}
+	mustPanic("Add", func() { NewMoney(math.MaxInt64).Add(NewMoney(1)) })
+	mustPanic("Sub", func() { NewMoney(math.MinInt64).Sub(NewMoney(1)) })
+	mustPanic("Neg", func() { NewMoney(math.MinInt64).Neg() })
+	mustPanic("mixing currencies", func() { NewMoney(1).Add(Money{Minor: 1, Currency: "EUR"}) })
+
+	if sum := NewMoney(math.MaxInt64 - 1).Add(NewMoney(1)); sum.Minor != math.MaxInt64 || sum.Currency != DefaultCurrency {
+		t.Errorf("Unexpected sum %+v", sum)
+	}
+
+	// Only the default currency fits the BIGINT columns.
+	if _, err := (Money{Minor: 100, Currency: "EUR"}).Value(); err == nil {
+		t.Errorf("Expected an error storing EUR")
+	}
+	if v, err := (Money{Minor: 100}).Value(); err != nil || v != int64(100) {
+		t.Errorf("Expected 100 stored, got %v (%v)", v, err)
+	}
+}
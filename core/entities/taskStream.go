@@ -0,0 +1,63 @@
+package entities
+
+// One change to a task. A task's events, in version order, are its history: the tasks table is
+// only a projection of them and can be rebuilt from them at any time.
+type TaskEvent struct {
+	TaskID     int           `gorm:"primaryKey;autoIncrement:false" json:"task_id"`
+	Version    int           `gorm:"primaryKey;autoIncrement:false" json:"version"` // Position in the task's stream, from 1.
+	Type       string        `gorm:"type:varchar(20)" json:"type"`
+	Data       TaskEventData `gorm:"type:jsonb;serializer:json" json:"data"`
+	ActorID    int           `json:"actor_id,omitempty"` // Who made the change, 0 when the system did.
+	OccurredAt string        `gorm:"type:timestamp;index" json:"occurred_at"`
+}
+
+// What a task event carries. Each type fills in its own fields, see the constants below.
+type TaskEventData struct {
+	JiraID         string `json:"jira_id,omitempty"`
+	Description    string `json:"description,omitempty"`
+	From           int    `json:"from,omitempty"` // The previous assignee.
+	To             int    `json:"to,omitempty"`   // The new assignee.
+	AssignFee      *Money `json:"assign_fee,omitempty"`
+	Price          *Money `json:"price,omitempty"`
+	CompletionTime string `json:"completion_time,omitempty"`
+	Task           *Task  `json:"task,omitempty"` // The whole task, on imports.
+}
+
+// Types of task events.
+const (
+	TaskEventCreated    = "created"    // JiraID and Description. The task starts pending.
+	TaskEventPriceSet   = "price_set"  // AssignFee and Price.
+	TaskEventAssigned   = "assigned"   // To, on creation.
+	TaskEventReassigned = "reassigned" // From and To.
+	TaskEventDescribed  = "described"  // JiraID and Description.
+	TaskEventStarted    = "started"
+	TaskEventCompleted  = "completed" // CompletionTime.
+	TaskEventCancelled  = "cancelled"
+	TaskEventImported   = "imported" // Task: a task from before the streams, as it was found.
+)
+
+// A task's state at a version, so long streams don't have to be folded from the start.
+type TaskSnapshot struct {
+	TaskID     int    `gorm:"primaryKey;autoIncrement:false" json:"task_id"`
+	Version    int    `gorm:"primaryKey;autoIncrement:false" json:"version"`
+	State      Task   `gorm:"type:jsonb;serializer:json" json:"state"`
+	OccurredAt string `gorm:"type:timestamp" json:"occurred_at"` // When the last event folded in happened.
+}
+
+// One field of a task changed by one of its events, for settling disputes about who had a task
+// when. Written along with the event.
+type TaskHistoryEntry struct {
+	HistoryID int64  `gorm:"primaryKey;autoIncrement" json:"history_id"`
+	TaskID    int    `gorm:"index" json:"task_id"`
+	Version   int    `json:"version"`            // The event that made the change.
+	ActorID   int    `json:"actor_id,omitempty"` // Who made the change, 0 when the system did.
+	Field     string `gorm:"type:varchar(30)" json:"field"`
+	OldValue  string `gorm:"type:text" json:"old_value"`
+	NewValue  string `gorm:"type:text" json:"new_value"`
+	ChangedAt string `gorm:"type:timestamp" json:"changed_at"`
+}
+
+// The table is called task_history rather than task_history_entries.
+func (TaskHistoryEntry) TableName() string {
+	return "task_history"
+}
@@ -2,35 +2,64 @@ package entities
 
 // Represents a single task in the task management system.
 type Task struct {
-	TaskID         int     `gorm:"primaryKey;autoIncrement"` // The ID of the task.
-	Description    string  `gorm:"type:text"`                // Description of the task.
-	AssignedTo     int     `gorm:"index;foreignKey:UserID"`  // The ID of the user the task is assigned to.
-	Status         string  `gorm:"type:varchar(50)"`         // Pending/completed/cancelled/started.
-	Price          float64 `gorm:"type:decimal(10, 2)"`      // Cost or reward for completing the task.
-	CreationTime   string  `gorm:"type:timestamp"`           // Timestamp of creation time.
-	CompletionTime string  `gorm:"type:timestamp"`           // Timestamp of completion time.
-	LastUpdated    string  `gorm:"type:timestamp"`           // Timestamp of last update time.
+	TaskID         int    `gorm:"primaryKey;autoIncrement" json:"task_id"`         // The ID of the task.
+	JiraID         string `gorm:"type:varchar(50)" json:"jira_id"`                 // Tracker key split out of the description, e.g. UBERPOP-42.
+	Description    string `gorm:"type:text" json:"description"`                    // Description of the task.
+	AssignedTo     int    `gorm:"index;foreignKey:UserID" json:"assigned_to"`      // The ID of the user the task is assigned to.
+	Status         string `gorm:"type:varchar(50)" json:"status"`                  // Pending/completed/cancelled/started.
+	AssignFee      Money  `gorm:"type:bigint;default:0" json:"assign_fee"`         // Charged to the assignee on every assignment.
+	Price          Money  `gorm:"type:bigint;default:0" json:"price"`              // Reward for completing the task.
+	CreationTime   string `gorm:"type:timestamp" json:"creation_time"`             // Timestamp of creation time.
+	CompletionTime string `gorm:"type:timestamp" json:"completion_time,omitempty"` // Timestamp of completion time.
+	LastUpdated    string `gorm:"type:timestamp" json:"last_updated"`              // Timestamp of last update time.
+	Version        int    `gorm:"default:0" json:"version"`                        // Events of the task's stream folded in.
 }
 
+// Roles a user can hold, stored in User.Role.
+const (
+	RoleAdmin      = "admin"
+	RoleManager    = "manager"
+	RoleAccountant = "accountant"
+	RoleWorker     = "worker"
+)
+
 type User struct { // We send this in http requests for the authorisation system to store.
-	UserID      int     `json:"user_id"`
-	Name        string  `json:"name"`
-	Email       string  `json:"email"`
-	Role        string  `json:"role"`
-	Balance     float64 `json:"balance"`
-	JoinedAt    string  `json:"joined_at"`    // Date of joining the company.
-	LeftAt      string  `json:"left_at"`      // Date of departure, empty list if currently employed.
-	LastUpdated string  `json:"last_updated"` // Timestamp of last update time.
+	UserID      int    `gorm:"uniqueIndex" json:"user_id"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Role        string `json:"role"`
+	Balance     Money  `gorm:"type:bigint;default:0" json:"balance"` // Cached from the ledger, never written directly.
+	JoinedAt    string `json:"joined_at"`                            // Date of joining the company.
+	LeftAt      string `json:"left_at"`                              // Date of departure, empty list if currently employed.
+	LastUpdated string `json:"last_updated"`                         // Timestamp of last update time.
+	Version     int64  `gorm:"default:0" json:"version"`             // Bumped by the authenticator on every change, replicas keep the highest.
+	RemovedAt   string `json:"removed_at,omitempty"`                 // Set on replicas when the user is deleted, the row stays as a tombstone.
 }
 
 type TaskFinanceInfo struct {
-	TaskID       int     `gorm:"primaryKey;autoIncrement"` // The ID of the task associated with this reduction/ payment.
-	UserID       int     `gorm:"index;foreignKey:UserID"`  // The ID of the user associated with this record.
-	kmount       float64 `gorm:"type:decimal(10, 2)"`      // Negative for reduction and positive for payment.
-	Status       string  `gorm:"type:varchar(50)"`         // Assigned/ Completed.
-	CreationTime string  `gorm:"type:timestamp"`           // Timestamp of the creation time of this record.
-	LastUpdated  string  `gorm:"type:timestamp"`           // Timestamp of last update time.
+	TaskID       int    `gorm:"primaryKey;autoIncrement"` // The ID of the task associated with this reduction/ payment.
+	UserID       int    `gorm:"index;foreignKey:UserID"`  // The ID of the user associated with this record.
+	Amount       Money  `gorm:"type:bigint;default:0"`    // Negative for reduction and positive for payment.
+	Status       string `gorm:"type:varchar(50)"`         // Assigned/ Completed.
+	CreationTime string `gorm:"type:timestamp"`           // Timestamp of the creation time of this record.
+	LastUpdated  string `gorm:"type:timestamp"`           // Timestamp of last update time.
 }
 
-// TODO: Change the type of the money amounts into something from the decimal library.
-// TODO: An accounting record should be a monthly balance, amount of tasks assigned, amount of task started and amount of tasks completed.
+// A user's monthly statement: the balance over the month and how many tasks they dealt with.
+// Built from the ledger by the statement job, one per user and month.
+type AccountingRecord struct {
+	RecordID       int    `gorm:"primaryKey;autoIncrement" json:"record_id"`
+	UserID         int    `gorm:"uniqueIndex:idx_accounting_records_user_month" json:"user_id"`
+	Month          string `gorm:"type:varchar(7);uniqueIndex:idx_accounting_records_user_month" json:"month"` // YYYY-MM.
+	OpeningBalance Money  `gorm:"type:bigint;default:0" json:"opening_balance"`
+	Charges        Money  `gorm:"type:bigint;default:0" json:"charges"`     // Assignment fees, as a positive amount.
+	Rewards        Money  `gorm:"type:bigint;default:0" json:"rewards"`     // Completion rewards.
+	Payouts        Money  `gorm:"type:bigint;default:0" json:"payouts"`     // Money paid out, as a positive amount.
+	Adjustments    Money  `gorm:"type:bigint;default:0" json:"adjustments"` // Net effect of reversals.
+	ClosingBalance Money  `gorm:"type:bigint;default:0" json:"closing_balance"`
+	TasksAssigned  int    `json:"tasks_assigned"`
+	TasksStarted   int    `json:"tasks_started"`
+	TasksCompleted int    `json:"tasks_completed"`
+	TasksCancelled int    `json:"tasks_cancelled"`
+	LastUpdated    string `gorm:"type:timestamp" json:"last_updated"` // When the statement was last rebuilt.
+}
@@ -0,0 +1,38 @@
+package entities
+
+// An outside tool told about events over HTTP. Payloads are signed with the secret, which is only
+// shown when the subscription is created.
+type WebhookSubscription struct {
+	SubscriptionID      int64    `gorm:"primaryKey;autoIncrement" json:"subscription_id"`
+	URL                 string   `gorm:"type:text" json:"url"`
+	EventTypes          []string `gorm:"type:jsonb;serializer:json" json:"event_types"` // Event names, e.g. TaskCompleted.
+	Secret              string   `gorm:"type:varchar(100)" json:"-"`
+	Active              bool     `gorm:"default:true" json:"active"`
+	ConsecutiveFailures int      `gorm:"default:0" json:"consecutive_failures"`       // Reset by any successful delivery.
+	DisabledAt          string   `gorm:"type:timestamp" json:"disabled_at,omitempty"` // When too many failures in a row turned it off.
+	CreatedAt           string   `gorm:"type:timestamp" json:"created_at"`
+}
+
+// One event on its way to one subscription.
+type WebhookDelivery struct {
+	DeliveryID     int64  `gorm:"primaryKey;autoIncrement" json:"delivery_id"`
+	SubscriptionID int64  `gorm:"index" json:"subscription_id"`
+	EventID        string `gorm:"type:varchar(36)" json:"event_id"`
+	EventName      string `gorm:"type:varchar(50)" json:"event_name"`
+	Payload        string `gorm:"type:jsonb" json:"payload"` // The event's envelope, as posted.
+	Status         string `gorm:"type:varchar(20);index" json:"status"`
+	Attempts       int    `gorm:"default:0" json:"attempts"` // Failed posts so far.
+	NextAttemptAt  string `gorm:"type:timestamp;index" json:"next_attempt_at"`
+	ResponseStatus int    `json:"response_status,omitempty"` // HTTP status of the last post, 0 if it got none.
+	LastError      string `gorm:"type:text" json:"last_error,omitempty"`
+	CreatedAt      string `gorm:"type:timestamp" json:"created_at"`
+	DeliveredAt    string `gorm:"type:timestamp" json:"delivered_at,omitempty"`
+}
+
+// Where a webhook delivery is at.
+const (
+	WebhookPending   = "pending"
+	WebhookInFlight  = "in_flight" // Claimed by a dispatcher posting it, until its next_attempt_at.
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed" // Gave up on it.
+)
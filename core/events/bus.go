@@ -0,0 +1,79 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Reacts to an event. Returning an error means the event wasn't handled and, on durable
+// buses, that it should be delivered again.
+type Handler func(event Event) error
+
+type Publisher interface {
+	Publish(events ...Event) error
+}
+
+type Subscriber interface {
+	Subscribe(name string, handler Handler)
+}
+
+type Bus interface {
+	Publisher
+	Subscriber
+}
+
+// Drops every event, for code paths that don't have anyone listening.
+type Discard struct{}
+
+func (Discard) Publish(...Event) error { return nil }
+
+// An in-process bus: handlers run synchronously inside Publish, in the order they subscribed.
+// Nothing survives a restart, it's meant for tests and single process setups.
+type MemoryBus struct {
+	mu        sync.Mutex
+	handlers  map[string][]Handler
+	published []Event
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{handlers: make(map[string][]Handler)}
+}
+
+func (b *MemoryBus) Subscribe(name string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[name] = append(b.handlers[name], handler)
+}
+
+// Every handler sees every event, a failing one doesn't stop the others. Their errors are
+// returned together.
+func (b *MemoryBus) Publish(events ...Event) error {
+	b.mu.Lock()
+	b.published = append(b.published, events...)
+	handlers := make(map[string][]Handler, len(b.handlers))
+	for name, list := range b.handlers {
+		handlers[name] = list
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for _, event := range events {
+		for _, handler := range handlers[event.EventName()] {
+			if err := handler(event); err != nil {
+				errs = append(errs, fmt.Errorf("handling %s: %w", event.EventName(), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Everything published so far, oldest first.
+func (b *MemoryBus) Published() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]Event(nil), b.published...)
+}
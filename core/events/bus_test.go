@@ -0,0 +1,78 @@
+package events
+
+import (
+	"aTES/core/entities"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryBus(t *testing.T) {
+	bus := NewMemoryBus()
+
+	var completed []TaskCompleted
+	bus.Subscribe(TaskCompletedName, func(event Event) error {
+		completed = append(completed, event.(TaskCompleted))
+		return nil
+	})
+	bus.Subscribe(TaskCompletedName, func(Event) error { return errors.New("boom") })
+
+	err := bus.Publish(TaskCreated{Task: entities.Task{TaskID: 1}}, TaskCompleted{TaskID: 1, CompletedBy: 4})
+	if err == nil {
+		t.Errorf("Expected the failing handler's error")
+	}
+	if len(completed) != 1 || completed[0].CompletedBy != 4 {
+		t.Errorf("Expected one TaskCompleted for user 4, got %+v", completed)
+	}
+	if len(bus.Published()) != 2 {
+		t.Errorf("Expected 2 published events, got %d", len(bus.Published()))
+	}
+}
+
+func TestDecode(t *testing.T) {
+	original := TaskAssigned{TaskID: 7, From: 3, To: 5, Fee: entities.NewMoney(1250)}
+	payload, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	decoded, err := Decode(original.EventName(), payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded != original {
+		t.Errorf("Expected %+v, got %+v", original, decoded)
+	}
+
+	if _, err := Decode("TaskExploded", payload); err == nil {
+		t.Errorf("Expected an error for an unknown event")
+	}
+}
+
+func TestAggregateKey(t *testing.T) {
+	cases := []struct {
+		event    Event
+		expected string
+	}{
+		{TaskAssigned{TaskID: 7, To: 5}, "task:7"},
+		{TaskCompleted{TaskID: 7, CompletedBy: 5}, "task:7"},
+		{UserDeleted{UserID: 5}, "user:5"},
+		{TransactionApplied{EntryID: 1, UserID: 5}, "account:5"},
+		{TransactionApplied{EntryID: 2, Kind: "payout"}, ""},
+	}
+	for _, c := range cases {
+		if key := AggregateKey(c.event); key != c.expected {
+			t.Errorf("%+v: expected %q, got %q", c.event, c.expected, key)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cases := map[int]time.Duration{0: 0, 1: time.Second, 2: 2 * time.Second, 5: 16 * time.Second, 50: MaxRetryDelay}
+	for attempts, expected := range cases {
+		if got := RetryDelay(attempts); got != expected {
+			t.Errorf("After %d failures: expected %v, got %v", attempts, expected, got)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+)
+
+// What actually travels between services: an event's data plus what a consumer needs to know
+// before decoding it. Data is shaped by the schema of EventName at EventVersion.
+type Envelope struct {
+	EventID      string          `json:"event_id"` // A random UUID, the same on every redelivery.
+	EventVersion int             `json:"event_version"`
+	EventName    string          `json:"event_name"`
+	EventTime    string          `json:"event_time"` // RFC 3339.
+	Producer     string          `json:"producer"`   // The service that published the event, e.g. "tes".
+	Data         json.RawMessage `json:"data"`
+}
+
+// Moves sealed events to their consumers, e.g. the Postgres bus or a message broker.
+type Transport interface {
+	Send(envelopes ...Envelope) error
+}
+
+// A random (version 4) UUID.
+func NewEventID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -0,0 +1,190 @@
+package events
+
+import (
+	"aTES/core/entities"
+	"encoding/json"
+	"fmt"
+)
+
+// Names events are published and subscribed under.
+const (
+	TaskCreatedName        = "TaskCreated"
+	TaskAssignedName       = "TaskAssigned"
+	TaskCompletedName      = "TaskCompleted"
+	UserCreatedName        = "UserCreated"
+	UserUpdatedName        = "UserUpdated"
+	UserDeletedName        = "UserDeleted"
+	UserRoleChangedName    = "UserRoleChanged"
+	TransactionAppliedName = "TransactionApplied"
+)
+
+// Streams events are published on when they go through a log based broker such as Kafka.
+// *-stream topics carry data changes (CUD), *-lifecycle topics business events.
+const (
+	TasksStreamTopic           = "tasks-stream"
+	TasksLifecycleTopic        = "tasks-lifecycle"
+	AccountsStreamTopic        = "accounts-stream"
+	TransactionsLifecycleTopic = "transactions-lifecycle"
+)
+
+// Something that happened in the domain. Events are facts: they're published after the change
+// is made and consumers can't veto them.
+type Event interface {
+	EventName() string
+}
+
+// A task was created. It's followed by a TaskAssigned for its first worker.
+type TaskCreated struct {
+	Task entities.Task `json:"task"`
+}
+
+// A task landed on a worker, either when it was created (From is 0) or when it was moved.
+type TaskAssigned struct {
+	TaskID int            `json:"task_id"`
+	From   int            `json:"from,omitempty"`
+	To     int            `json:"to"`
+	Fee    entities.Money `json:"fee"` // What the new assignee is charged, zero if nothing.
+}
+
+type TaskCompleted struct {
+	TaskID      int            `json:"task_id"`
+	CompletedBy int            `json:"completed_by"`
+	Reward      entities.Money `json:"reward"`
+	CompletedAt string         `json:"completed_at"`
+}
+
+// User events carry the user's version, which only goes up. Consumers keep the highest version
+// they've seen so duplicates and events arriving out of order are ignored. Version 0 comes from
+// events published before versions existed.
+type UserCreated struct {
+	User entities.User `json:"user"`
+}
+
+// Carries the whole user as it is after the update.
+type UserUpdated struct {
+	User entities.User `json:"user"`
+}
+
+type UserDeleted struct {
+	UserID  int   `json:"user_id"`
+	Version int64 `json:"version"`
+}
+
+// Published along with the UserUpdated that changed the role, under the same version.
+type UserRoleChanged struct {
+	UserID  int    `json:"user_id"`
+	OldRole string `json:"old_role"`
+	NewRole string `json:"new_role"`
+	Version int64  `json:"version"`
+}
+
+// A journal entry was posted to the ledger. UserID and Amount describe its effect on the worker
+// it concerns (Amount is positive when the worker gained money), both are zero if none.
+type TransactionApplied struct {
+	EntryID  int            `json:"entry_id"`
+	Kind     string         `json:"kind"`
+	Reverses string         `json:"reverses,omitempty"` // The kind of the entry a reversal undoes.
+	TaskID   int            `json:"task_id,omitempty"`
+	UserID   int            `json:"user_id,omitempty"`
+	Amount   entities.Money `json:"amount"`
+	PostedAt string         `json:"posted_at"`
+}
+
+func (TaskCreated) EventName() string        { return TaskCreatedName }
+func (TaskAssigned) EventName() string       { return TaskAssignedName }
+func (TaskCompleted) EventName() string      { return TaskCompletedName }
+func (UserCreated) EventName() string        { return UserCreatedName }
+func (UserUpdated) EventName() string        { return UserUpdatedName }
+func (UserDeleted) EventName() string        { return UserDeletedName }
+func (UserRoleChanged) EventName() string    { return UserRoleChangedName }
+func (TransactionApplied) EventName() string { return TransactionAppliedName }
+
+// Turning a stored or transmitted event back into its typed form.
+func Decode(name string, payload []byte) (Event, error) {
+	var event Event
+	var err error
+
+	switch name {
+	case TaskCreatedName:
+		event, err = decodeAs[TaskCreated](payload)
+	case TaskAssignedName:
+		event, err = decodeAs[TaskAssigned](payload)
+	case TaskCompletedName:
+		event, err = decodeAs[TaskCompleted](payload)
+	case UserCreatedName:
+		event, err = decodeAs[UserCreated](payload)
+	case UserUpdatedName:
+		event, err = decodeAs[UserUpdated](payload)
+	case UserDeletedName:
+		event, err = decodeAs[UserDeleted](payload)
+	case UserRoleChangedName:
+		event, err = decodeAs[UserRoleChanged](payload)
+	case TransactionAppliedName:
+		event, err = decodeAs[TransactionApplied](payload)
+	default:
+		return nil, fmt.Errorf("unknown event %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+
+	return event, nil
+}
+
+func decodeAs[T Event](payload []byte) (Event, error) {
+	var event T
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// The aggregate an event is about, e.g. "task:12". Consumers keep the events of an aggregate in
+// order and may handle different aggregates concurrently. Events about nothing in particular
+// share the empty key. Ledger postings are keyed by the worker account they moved money on.
+func AggregateKey(event Event) string {
+	switch e := event.(type) {
+	case TaskCreated:
+		return fmt.Sprintf("task:%d", e.Task.TaskID)
+	case TaskAssigned:
+		return fmt.Sprintf("task:%d", e.TaskID)
+	case TaskCompleted:
+		return fmt.Sprintf("task:%d", e.TaskID)
+	case UserCreated:
+		return fmt.Sprintf("user:%d", e.User.UserID)
+	case UserUpdated:
+		return fmt.Sprintf("user:%d", e.User.UserID)
+	case UserDeleted:
+		return fmt.Sprintf("user:%d", e.UserID)
+	case UserRoleChanged:
+		return fmt.Sprintf("user:%d", e.UserID)
+	case TransactionApplied:
+		if e.UserID != 0 {
+			return fmt.Sprintf("account:%d", e.UserID)
+		}
+	}
+
+	return ""
+}
+
+// Every topic events are published on.
+func Topics() []string {
+	return []string{TasksStreamTopic, TasksLifecycleTopic, AccountsStreamTopic, TransactionsLifecycleTopic}
+}
+
+// The topic an event is published on, empty for unknown events.
+func TopicOf(name string) string {
+	switch name {
+	case TaskCreatedName:
+		return TasksStreamTopic
+	case TaskAssignedName, TaskCompletedName:
+		return TasksLifecycleTopic
+	case UserCreatedName, UserUpdatedName, UserDeletedName, UserRoleChangedName:
+		return AccountsStreamTopic
+	case TransactionAppliedName:
+		return TransactionsLifecycleTopic
+	}
+
+	return ""
+}
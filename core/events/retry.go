@@ -0,0 +1,27 @@
+package events
+
+import "time"
+
+// Delays between delivery attempts: the first retry waits a second, each next one twice as
+// long, up to MaxRetryDelay.
+const (
+	BaseRetryDelay = time.Second
+	MaxRetryDelay  = 10 * time.Minute
+)
+
+// How long to wait before the next attempt after the given number of failed ones.
+func RetryDelay(failedAttempts int) time.Duration {
+	if failedAttempts <= 0 {
+		return 0
+	}
+
+	delay := BaseRetryDelay
+	for i := 1; i < failedAttempts; i++ {
+		delay *= 2
+		if delay >= MaxRetryDelay {
+			return MaxRetryDelay
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,258 @@
+// Package schemas keeps the versioned JSON Schemas of every domain event. Producers seal events
+// into envelopes validated against the latest schema, consumers open envelopes of any known
+// version: old data is upcast to the latest shape and validated before it's decoded, so a
+// consumer only ever deals with the current event types.
+//
+// Schemas live in definitions/<EventName>/<version>.json. Changing an event's shape means
+// adding the next version and an upcaster from the previous one.
+package schemas
+
+import (
+	"aTES/core/events"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//go:embed definitions
+var definitions embed.FS
+
+var (
+	ErrUnknownEvent   = errors.New("unknown event")
+	ErrUnknownVersion = errors.New("unknown event version")
+	ErrInvalidEvent   = errors.New("event doesn't match its schema")
+)
+
+// Turns data of one version of an event into the next version.
+type Upcaster func(data map[string]any) (map[string]any, error)
+
+type Registry struct {
+	envelope  *jsonschema.Schema
+	schemas   map[string]map[int]*jsonschema.Schema // Event name -> version -> schema.
+	latest    map[string]int
+	upcasters map[string]map[int]Upcaster // Event name -> the version it upcasts from.
+}
+
+// The registry built from the embedded definitions, with the built-in upcasters.
+var Default = sync.OnceValue(func() *Registry {
+	registry, err := Load(definitions)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded event schemas: %v", err))
+	}
+	for name, byVersion := range builtinUpcasters {
+		for from, upcaster := range byVersion {
+			registry.AddUpcaster(name, from, upcaster)
+		}
+	}
+
+	return registry
+})
+
+// Compiling every schema found under definitions/ in the given file system.
+func Load(fsys fs.FS) (*Registry, error) {
+	registry := &Registry{
+		schemas:   make(map[string]map[int]*jsonschema.Schema),
+		latest:    make(map[string]int),
+		upcasters: make(map[string]map[int]Upcaster),
+	}
+
+	compile := func(file string) (*jsonschema.Schema, error) {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		compiler := jsonschema.NewCompiler()
+		compiler.AssertFormat = true
+		if err := compiler.AddResource(file, strings.NewReader(string(data))); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", file, err)
+		}
+		return compiler.Compile(file)
+	}
+
+	var err error
+	if registry.envelope, err = compile("definitions/envelope.json"); err != nil {
+		return nil, err
+	}
+
+	files, err := fs.Glob(fsys, "definitions/*/*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := path.Base(path.Dir(file))
+		version, err := strconv.Atoi(strings.TrimSuffix(path.Base(file), ".json"))
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("schema %s: file names must be positive version numbers", file)
+		}
+
+		schema, err := compile(file)
+		if err != nil {
+			return nil, err
+		}
+		if registry.schemas[name] == nil {
+			registry.schemas[name] = make(map[int]*jsonschema.Schema)
+		}
+		registry.schemas[name][version] = schema
+		registry.latest[name] = max(registry.latest[name], version)
+	}
+
+	// Versions must be contiguous for upcasting to walk from any of them to the latest.
+	for name, latest := range registry.latest {
+		for version := 1; version <= latest; version++ {
+			if registry.schemas[name][version] == nil {
+				return nil, fmt.Errorf("%s is missing version %d", name, version)
+			}
+		}
+	}
+
+	return registry, nil
+}
+
+// Registering how to turn version `from` of an event into version from+1.
+func (r *Registry) AddUpcaster(name string, from int, upcaster Upcaster) {
+	if r.upcasters[name] == nil {
+		r.upcasters[name] = make(map[int]Upcaster)
+	}
+	r.upcasters[name][from] = upcaster
+}
+
+// The version producers publish, 0 for unknown events.
+func (r *Registry) Latest(name string) int {
+	return r.latest[name]
+}
+
+// Every event with a schema, sorted.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.latest))
+	for name := range r.latest {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Checking data against a version of an event's schema.
+func (r *Registry) Validate(name string, version int, data []byte) error {
+	versions, known := r.schemas[name]
+	if !known {
+		return fmt.Errorf("%w %q", ErrUnknownEvent, name)
+	}
+	schema, known := versions[version]
+	if !known {
+		return fmt.Errorf("%w: %s v%d", ErrUnknownVersion, name, version)
+	}
+
+	return validate(schema, data, fmt.Sprintf("%s v%d", name, version))
+}
+
+func validate(schema *jsonschema.Schema, data []byte, what string) error {
+	var document any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("%w: %s isn't valid JSON: %v", ErrInvalidEvent, what, err)
+	}
+	if err := schema.Validate(document); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidEvent, what, err)
+	}
+
+	return nil
+}
+
+// Bringing data of an older version up to the latest one, one version at a time.
+func (r *Registry) Upcast(name string, version int, data []byte) ([]byte, int, error) {
+	latest := r.Latest(name)
+	if latest == 0 {
+		return nil, 0, fmt.Errorf("%w %q", ErrUnknownEvent, name)
+	}
+	if version < 1 || version > latest {
+		return nil, 0, fmt.Errorf("%w: %s v%d", ErrUnknownVersion, name, version)
+	}
+	if version == latest {
+		return data, version, nil
+	}
+
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, 0, fmt.Errorf("%w: %s v%d isn't a JSON object: %v", ErrInvalidEvent, name, version, err)
+	}
+	for ; version < latest; version++ {
+		upcaster := r.upcasters[name][version]
+		if upcaster == nil {
+			return nil, 0, fmt.Errorf("no upcaster from %s v%d to v%d", name, version, version+1)
+		}
+		var err error
+		if document, err = upcaster(document); err != nil {
+			return nil, 0, fmt.Errorf("upcasting %s v%d: %w", name, version, err)
+		}
+	}
+
+	upcast, err := json.Marshal(document)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return upcast, latest, nil
+}
+
+// Wrapping an event in an envelope at the latest version of its schema. Events that don't
+// match it are refused, so a producer can't publish something consumers won't accept.
+func (r *Registry) Seal(producer string, event events.Event) (events.Envelope, error) {
+	name := event.EventName()
+	version := r.Latest(name)
+	if version == 0 {
+		return events.Envelope{}, fmt.Errorf("%w %q", ErrUnknownEvent, name)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return events.Envelope{}, fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	if err := r.Validate(name, version, data); err != nil {
+		return events.Envelope{}, err
+	}
+
+	return events.Envelope{
+		EventID:      events.NewEventID(),
+		EventVersion: version,
+		EventName:    name,
+		EventTime:    time.Now().Format(time.RFC3339Nano),
+		Producer:     producer,
+		Data:         data,
+	}, nil
+}
+
+// Checking an envelope, upcasting its data to the latest version and decoding the event.
+func (r *Registry) Open(envelope events.Envelope) (events.Event, error) {
+	raw, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(r.envelope, raw, "envelope"); err != nil {
+		return nil, err
+	}
+
+	if err := r.Validate(envelope.EventName, envelope.EventVersion, envelope.Data); err != nil {
+		return nil, err
+	}
+	data, version, err := r.Upcast(envelope.EventName, envelope.EventVersion, envelope.Data)
+	if err != nil {
+		return nil, err
+	}
+	if version != envelope.EventVersion {
+		if err := r.Validate(envelope.EventName, version, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return events.Decode(envelope.EventName, data)
+}
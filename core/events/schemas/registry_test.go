@@ -0,0 +1,103 @@
+package schemas
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSealAndOpen(t *testing.T) {
+	registry := Default()
+
+	task := entities.Task{TaskID: 1, JiraID: "POP-1", Description: "Feed the parrots", AssignedTo: 4,
+		Status: "pending", AssignFee: entities.NewMoney(1500), Price: entities.NewMoney(3000),
+		CreationTime: "2024-06-01 10:00:00"}
+	envelope, err := registry.Seal("tes", events.TaskCreated{Task: task})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if envelope.EventVersion != 2 || envelope.Producer != "tes" || envelope.EventID == "" {
+		t.Errorf("Unexpected envelope: %+v", envelope)
+	}
+
+	event, err := registry.Open(envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if event.(events.TaskCreated).Task != task {
+		t.Errorf("Expected %+v, got %+v", task, event)
+	}
+
+	// Producers can't publish what the schema doesn't allow.
+	_, err = registry.Seal("authenticator", events.UserCreated{User: entities.User{UserID: 1, Role: "parrot"}})
+	if !errors.Is(err, ErrInvalidEvent) {
+		t.Errorf("Expected ErrInvalidEvent, got %v", err)
+	}
+}
+
+func TestOpenUpcastsOldVersions(t *testing.T) {
+	v1 := `{"task": {"task_id": 1, "description": "[POP-1] Feed the parrots", "assigned_to": 4,
+		"status": "pending", "assign_fee": "15.00", "price": "30.00", "creation_time": "2024-06-01 10:00:00"}}`
+	envelope := events.Envelope{
+		EventID:      events.NewEventID(),
+		EventVersion: 1,
+		EventName:    events.TaskCreatedName,
+		EventTime:    "2024-06-01T10:00:00Z",
+		Producer:     "tes",
+		Data:         json.RawMessage(v1),
+	}
+
+	event, err := Default().Open(envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	task := event.(events.TaskCreated).Task
+	if task.JiraID != "POP-1" || task.Description != "Feed the parrots" {
+		t.Errorf("Expected the jira id split out, got %q and %q", task.JiraID, task.Description)
+	}
+
+	envelope.EventVersion = 3
+	if _, err := Default().Open(envelope); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Expected ErrUnknownVersion, got %v", err)
+	}
+}
+
+func TestOpenLegacyUserEvents(t *testing.T) {
+	envelope := events.Envelope{
+		EventID:      events.NewEventID(),
+		EventVersion: 1,
+		EventName:    events.UserDeletedName,
+		EventTime:    "2024-06-01T10:00:00Z",
+		Producer:     "authenticator",
+		Data:         json.RawMessage(`{"user_id": 7}`),
+	}
+
+	event, err := Default().Open(envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if deleted := event.(events.UserDeleted); deleted.UserID != 7 || deleted.Version != 0 {
+		t.Errorf("Expected user 7 at version 0, got %+v", deleted)
+	}
+}
+
+func TestOpenTransactionAppliedV1(t *testing.T) {
+	envelope := events.Envelope{
+		EventID:      events.NewEventID(),
+		EventVersion: 1,
+		EventName:    events.TransactionAppliedName,
+		EventTime:    "2024-06-01T10:00:00Z",
+		Producer:     "tes",
+		Data:         json.RawMessage(`{"entry_id": 3, "kind": "reversal", "task_id": 1, "user_id": 7, "amount": "-30.00", "posted_at": "2024-06-01 10:00:00"}`),
+	}
+
+	event, err := Default().Open(envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if applied := event.(events.TransactionApplied); applied.EntryID != 3 || applied.Reverses != "" {
+		t.Errorf("Expected entry 3 without what it reverses, got %+v", applied)
+	}
+}
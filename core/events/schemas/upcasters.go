@@ -0,0 +1,53 @@
+package schemas
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/events"
+	"fmt"
+)
+
+// Event name -> the version each upcaster starts from.
+var builtinUpcasters = map[string]map[int]Upcaster{
+	events.TaskCreatedName:        {1: taskCreatedV1ToV2},
+	events.UserCreatedName:        {1: userV1ToV2},
+	events.UserUpdatedName:        {1: userV1ToV2},
+	events.UserDeletedName:        {1: userDeletedV1ToV2},
+	events.TransactionAppliedName: {1: transactionAppliedV1ToV2},
+}
+
+// v2 moved the tracker key out of the description: "[POP-1] Feed the parrots" became
+// jira_id "POP-1" and description "Feed the parrots".
+func taskCreatedV1ToV2(data map[string]any) (map[string]any, error) {
+	task, ok := data["task"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("task isn't an object")
+	}
+	description, _ := task["description"].(string)
+
+	task["jira_id"], task["description"] = businesslogic.SplitJiraID(description)
+
+	return data, nil
+}
+
+// v2 added the user's version. Older events get version 0, which replicas apply in the order
+// they're received, as they were before.
+func userV1ToV2(data map[string]any) (map[string]any, error) {
+	user, ok := data["user"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("user isn't an object")
+	}
+	user["version"] = 0
+
+	return data, nil
+}
+
+func userDeletedV1ToV2(data map[string]any) (map[string]any, error) {
+	data["version"] = 0
+
+	return data, nil
+}
+
+// v2 added what a reversal undoes. It can't be told from a v1 event, those are left without it.
+func transactionAppliedV1ToV2(data map[string]any) (map[string]any, error) {
+	return data, nil
+}
@@ -0,0 +1,20 @@
+// JSON responses, the way every service of TES sends them.
+package httpjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Sending a JSON body with the given status code.
+func Write(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Sending an error as { "error": <message> }.
+func Error(w http.ResponseWriter, status int, format string, args ...any) {
+	Write(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,299 @@
+package analytics
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/events"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The read model. Only the analytics service writes to these tables.
+const schemaSQL = `
+CREATE TABLE IF NOT EXISTS analytics_daily_earnings (
+	day DATE PRIMARY KEY,
+	fees BIGINT NOT NULL DEFAULT 0,
+	rewards BIGINT NOT NULL DEFAULT 0,
+	earnings BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS analytics_worker_balances (
+	user_id INT PRIMARY KEY,
+	balance BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS analytics_worker_days (
+	user_id INT NOT NULL,
+	day DATE NOT NULL,
+	closing_balance BIGINT NOT NULL,
+	PRIMARY KEY (user_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS analytics_completed_tasks (
+	task_id INT PRIMARY KEY,
+	description TEXT NOT NULL,
+	completed_by INT NOT NULL,
+	reward BIGINT NOT NULL,
+	completed_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS analytics_completed_tasks_completed_at ON analytics_completed_tasks (completed_at);
+
+-- The descriptions of the tasks, from TaskCreated.
+CREATE TABLE IF NOT EXISTS analytics_tasks (
+	task_id INT PRIMARY KEY,
+	description TEXT NOT NULL
+);
+
+-- The journal entries applied so far, each is only counted once.
+CREATE TABLE IF NOT EXISTS analytics_entries (
+	entry_id INT PRIMARY KEY
+);
+
+-- The model used to be filled by tailing the ledger. Starting over from the events.
+DO $$
+BEGIN
+	IF to_regclass('analytics_sync_state') IS NOT NULL THEN
+		TRUNCATE analytics_daily_earnings, analytics_worker_balances, analytics_worker_days, analytics_completed_tasks;
+		DROP TABLE analytics_sync_state;
+	END IF;
+END $$;
+`
+
+// Creating the read model tables if needed.
+func New(db *sql.DB) (*Analytics, error) {
+	if _, err := db.Exec(schemaSQL); err != nil {
+		return nil, fmt.Errorf("failed to create the analytics tables: %w", err)
+	}
+
+	return &Analytics{db: db}, nil
+}
+
+// Emptying the read model, to fill it again from every event in tx. The tables stay locked
+// until tx ends, so the API waits rather than serving half of them.
+func (a *Analytics) Reset(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	TRUNCATE analytics_daily_earnings, analytics_worker_balances, analytics_worker_days, analytics_completed_tasks,
+		analytics_tasks, analytics_entries
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to clear the read model: %w", err)
+	}
+
+	return nil
+}
+
+// Keeping the task's description for its top task entry, whether the reward came first or not.
+func (a *Analytics) ApplyTaskCreated(tx *sql.Tx, created events.TaskCreated) error {
+	task := created.Task
+	query := `
+	INSERT INTO analytics_tasks (task_id, description) VALUES ($1, $2)
+	ON CONFLICT (task_id) DO UPDATE SET description = EXCLUDED.description
+	`
+	if _, err := tx.Exec(query, task.TaskID, task.Description); err != nil {
+		return fmt.Errorf("failed to store task %d: %w", task.TaskID, err)
+	}
+	_, err := tx.Exec(`UPDATE analytics_completed_tasks SET description = $1 WHERE task_id = $2`, task.Description, task.TaskID)
+	if err != nil {
+		return fmt.Errorf("failed to describe completed task %d: %w", task.TaskID, err)
+	}
+
+	return nil
+}
+
+// Folding a posted journal entry into the read model. An entry already applied is skipped, so a
+// rebuild and the consumer catching up after it don't count it twice.
+func (a *Analytics) ApplyTransaction(tx *sql.Tx, applied events.TransactionApplied) error {
+	result, err := tx.Exec(`INSERT INTO analytics_entries (entry_id) VALUES ($1) ON CONFLICT DO NOTHING`, applied.EntryID)
+	if err != nil {
+		return fmt.Errorf("failed to record entry %d: %w", applied.EntryID, err)
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+
+	if err := applyEarnings(tx, applied); err != nil {
+		return fmt.Errorf("failed to apply entry %d to the earnings: %w", applied.EntryID, err)
+	}
+	if applied.UserID == 0 {
+		return nil
+	}
+	if err := applyWorkerBalance(tx, applied); err != nil {
+		return fmt.Errorf("failed to apply entry %d to the balance of %d: %w", applied.EntryID, applied.UserID, err)
+	}
+	if err := applyCompletion(tx, applied); err != nil {
+		return fmt.Errorf("failed to apply entry %d to the completed tasks: %w", applied.EntryID, err)
+	}
+
+	return nil
+}
+
+func applyEarnings(tx *sql.Tx, applied events.TransactionApplied) error {
+	fees, rewards, earnings := earningsDelta(applied)
+	if fees.IsZero() && rewards.IsZero() && earnings.IsZero() {
+		return nil
+	}
+	query := `
+	INSERT INTO analytics_daily_earnings (day, fees, rewards, earnings) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (day) DO UPDATE SET
+		fees = analytics_daily_earnings.fees + EXCLUDED.fees,
+		rewards = analytics_daily_earnings.rewards + EXCLUDED.rewards,
+		earnings = analytics_daily_earnings.earnings + EXCLUDED.earnings
+	`
+	_, err := tx.Exec(query, postedOn(applied), fees, rewards, earnings)
+	return err
+}
+
+// The worker's balance now and at the end of the day the entry was posted on and every later
+// day. Entries aren't always applied in the order they were posted (a payout is back-dated to the
+// end of the billing day it closes), so the entry is added to the closing balances from its day
+// on, rather than the running balance being written to its day.
+func applyWorkerBalance(tx *sql.Tx, applied events.TransactionApplied) error {
+	query := `
+	INSERT INTO analytics_worker_balances (user_id, balance) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET balance = analytics_worker_balances.balance + EXCLUDED.balance
+	`
+	if _, err := tx.Exec(query, applied.UserID, applied.Amount); err != nil {
+		return err
+	}
+
+	// A day without a row yet starts from the closing balance of the one before it.
+	day := postedOn(applied)
+	query = `
+	INSERT INTO analytics_worker_days (user_id, day, closing_balance)
+	VALUES ($1, $2, COALESCE((
+		SELECT closing_balance FROM analytics_worker_days WHERE user_id = $1 AND day < $2 ORDER BY day DESC LIMIT 1
+	), 0) + $3)
+	ON CONFLICT (user_id, day) DO UPDATE SET closing_balance = analytics_worker_days.closing_balance + $3
+	`
+	if _, err := tx.Exec(query, applied.UserID, day, applied.Amount); err != nil {
+		return err
+	}
+
+	query = `UPDATE analytics_worker_days SET closing_balance = closing_balance + $3 WHERE user_id = $1 AND day > $2`
+	_, err := tx.Exec(query, applied.UserID, day, applied.Amount)
+	return err
+}
+
+func applyCompletion(tx *sql.Tx, applied events.TransactionApplied) error {
+	switch {
+	case applied.Kind == businesslogic.EntryCompletionReward:
+		query := `
+		INSERT INTO analytics_completed_tasks (task_id, description, completed_by, reward, completed_at)
+		VALUES ($1, COALESCE((SELECT description FROM analytics_tasks WHERE task_id = $1), ''), $2, $3, $4)
+		ON CONFLICT (task_id) DO UPDATE SET
+			completed_by = EXCLUDED.completed_by, reward = EXCLUDED.reward, completed_at = EXCLUDED.completed_at
+		`
+		_, err := tx.Exec(query, applied.TaskID, applied.UserID, applied.Amount, applied.PostedAt)
+		return err
+	case applied.Kind == businesslogic.EntryReversal && applied.Reverses == businesslogic.EntryCompletionReward:
+		_, err := tx.Exec(`DELETE FROM analytics_completed_tasks WHERE task_id = $1`, applied.TaskID)
+		return err
+	}
+
+	return nil
+}
+
+// The day of an entry's posted_at (YYYY-MM-DD HH:MM:SS).
+func postedOn(applied events.TransactionApplied) string {
+	return applied.PostedAt[:min(len(applied.PostedAt), len(time.DateOnly))]
+}
+
+// The company's earnings for each day in [from, to) that had any activity, oldest first.
+func (a *Analytics) Earnings(from, to time.Time) ([]DayEarnings, error) {
+	query := `
+	SELECT to_char(day, 'YYYY-MM-DD'), fees, rewards, earnings
+	FROM analytics_daily_earnings
+	WHERE day >= $1 AND day < $2
+	ORDER BY day
+	`
+	rows, err := a.db.Query(query, from.Format(time.DateOnly), to.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the earnings: %w", err)
+	}
+	defer rows.Close()
+
+	earnings := []DayEarnings{}
+	for rows.Next() {
+		var day DayEarnings
+		if err := rows.Scan(&day.Day, &day.Fees, &day.Rewards, &day.Earnings); err != nil {
+			return nil, err
+		}
+		earnings = append(earnings, day)
+	}
+
+	return earnings, rows.Err()
+}
+
+// How many workers have a negative balance right now.
+func (a *Analytics) NegativeWorkersNow() (int, error) {
+	var workers int
+	err := a.db.QueryRow(`SELECT COUNT(*) FROM analytics_worker_balances WHERE balance < 0`).Scan(&workers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count negative balances: %w", err)
+	}
+
+	return workers, nil
+}
+
+// For every day in [from, to), how many workers ended it with a negative balance. A worker
+// without activity on a day keeps the balance they had at the end of their last active one.
+func (a *Analytics) NegativeWorkers(from, to time.Time) ([]DayNegativeWorkers, error) {
+	query := `
+	SELECT to_char(d.day, 'YYYY-MM-DD'), COUNT(w.user_id)
+	FROM generate_series($1::date, $2::date - 1, interval '1 day') AS d(day)
+	LEFT JOIN LATERAL (
+		SELECT DISTINCT ON (user_id) user_id, closing_balance
+		FROM analytics_worker_days
+		WHERE day <= d.day
+		ORDER BY user_id, day DESC
+	) w ON w.closing_balance < 0
+	GROUP BY d.day
+	ORDER BY d.day
+	`
+	rows, err := a.db.Query(query, from.Format(time.DateOnly), to.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count negative balances: %w", err)
+	}
+	defer rows.Close()
+
+	days := []DayNegativeWorkers{}
+	for rows.Next() {
+		var day DayNegativeWorkers
+		if err := rows.Scan(&day.Day, &day.Workers); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+
+	return days, rows.Err()
+}
+
+// The most expensive task completed in each period (day, week or month) of [from, to).
+// Ties go to the task completed first. Periods without completions are left out.
+func (a *Analytics) TopTasks(from, to time.Time, period string) ([]TopTask, error) {
+	query := `
+	SELECT DISTINCT ON (date_trunc($3, completed_at))
+		to_char(date_trunc($3, completed_at), 'YYYY-MM-DD'), task_id, description, completed_by, reward,
+		to_char(completed_at, 'YYYY-MM-DD HH24:MI:SS')
+	FROM analytics_completed_tasks
+	WHERE completed_at >= $1 AND completed_at < $2
+	ORDER BY date_trunc($3, completed_at), reward DESC, completed_at
+	`
+	rows, err := a.db.Query(query, from.Format(time.DateTime), to.Format(time.DateTime), period)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the top tasks: %w", err)
+	}
+	defer rows.Close()
+
+	tasks := []TopTask{}
+	for rows.Next() {
+		var task TopTask
+		err := rows.Scan(&task.Period, &task.TaskID, &task.Description, &task.CompletedBy, &task.Reward, &task.CompletedAt)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
@@ -0,0 +1,64 @@
+package analytics
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"testing"
+	"time"
+)
+
+func TestDateRange(t *testing.T) {
+	now := time.Date(2024, 6, 13, 15, 4, 5, 0, time.UTC) // A Thursday.
+
+	cases := []struct {
+		period, from, to string
+		start, end       string
+	}{
+		{PeriodDay, "", "", "2024-06-13", "2024-06-14"},
+		{PeriodWeek, "", "", "2024-06-10", "2024-06-17"},
+		{PeriodMonth, "", "", "2024-06-01", "2024-07-01"},
+		{PeriodDay, "2024-05-01", "2024-05-08", "2024-05-01", "2024-05-08"},
+	}
+	for _, c := range cases {
+		start, end, err := DateRange(c.from, c.to, c.period, now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.period, err)
+		}
+		if start.Format(time.DateOnly) != c.start || end.Format(time.DateOnly) != c.end {
+			t.Errorf("%s %q-%q: expected %s-%s, got %s-%s", c.period, c.from, c.to, c.start, c.end,
+				start.Format(time.DateOnly), end.Format(time.DateOnly))
+		}
+	}
+
+	if _, _, err := DateRange("2024-05-08", "2024-05-01", PeriodDay, now); err == nil {
+		t.Errorf("Expected an error for an empty range")
+	}
+}
+
+func TestEarningsDelta(t *testing.T) {
+	cents := entities.NewMoney
+
+	fees, rewards, earnings := earningsDelta(events.TransactionApplied{Kind: businesslogic.EntryAssignmentCharge, Amount: cents(-1500)})
+	if fees != cents(1500) || !rewards.IsZero() || earnings != cents(1500) {
+		t.Errorf("Assignment charge: got fees %s, rewards %s, earnings %s", fees, rewards, earnings)
+	}
+
+	fees, rewards, earnings = earningsDelta(events.TransactionApplied{Kind: businesslogic.EntryCompletionReward, Amount: cents(3000)})
+	if !fees.IsZero() || rewards != cents(3000) || earnings != cents(-3000) {
+		t.Errorf("Completion reward: got fees %s, rewards %s, earnings %s", fees, rewards, earnings)
+	}
+
+	// Reversing a reward gives it back to the company.
+	fees, rewards, earnings = earningsDelta(events.TransactionApplied{Kind: businesslogic.EntryReversal,
+		Reverses: businesslogic.EntryCompletionReward, Amount: cents(-3000)})
+	if !fees.IsZero() || rewards != cents(-3000) || earnings != cents(3000) {
+		t.Errorf("Reversed reward: got fees %s, rewards %s, earnings %s", fees, rewards, earnings)
+	}
+
+	// Paying a worker out doesn't change what the company made.
+	fees, rewards, earnings = earningsDelta(events.TransactionApplied{Kind: businesslogic.EntryPayout, Amount: cents(-4500)})
+	if !fees.IsZero() || !rewards.IsZero() || !earnings.IsZero() {
+		t.Errorf("Payout: got fees %s, rewards %s, earnings %s", fees, rewards, earnings)
+	}
+}
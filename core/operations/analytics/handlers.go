@@ -0,0 +1,118 @@
+package analytics
+
+import (
+	"aTES/core/entities"
+	"aTES/core/httpjson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Routes (all GET, served behind analytics:read):
+//
+//	/analytics/earnings?from=&to=                     - the company's earnings today and per day.
+//	/analytics/negative_workers?from=&to=             - workers with a negative balance now and per day.
+//	/analytics/top_task?period=day|week|month&from=&to= - the most expensive completed task per period.
+//
+// from and to are YYYY-MM-DD, to is exclusive. Without them the current period is reported
+// (today for the first two routes).
+func (a *Analytics) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/analytics/earnings":
+		a.getEarnings(w, r)
+	case "/analytics/negative_workers":
+		a.getNegativeWorkers(w, r)
+	case "/analytics/top_task":
+		a.getTopTasks(w, r)
+	default:
+		httpjson.Error(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+func (a *Analytics) getEarnings(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from, to, err := DateRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), PeriodDay, now)
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	days, err := a.Earnings(from, to)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the earnings: %v", err)
+		return
+	}
+	today := PeriodStart(now, PeriodDay)
+	todays, err := a.Earnings(today, nextPeriod(today, PeriodDay))
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting today's earnings: %v", err)
+		return
+	}
+
+	response := struct {
+		Today DayEarnings    `json:"today"`
+		Days  []DayEarnings  `json:"days"`
+		Total entities.Money `json:"total"`
+	}{
+		Today: DayEarnings{Day: today.Format(time.DateOnly), Fees: entities.NewMoney(0),
+			Rewards: entities.NewMoney(0), Earnings: entities.NewMoney(0)},
+		Days:  days,
+		Total: entities.NewMoney(0),
+	}
+	if len(todays) > 0 {
+		response.Today = todays[0]
+	}
+	for _, day := range days {
+		response.Total = response.Total.Add(day.Earnings)
+	}
+
+	httpjson.Write(w, http.StatusOK, response)
+}
+
+func (a *Analytics) getNegativeWorkers(w http.ResponseWriter, r *http.Request) {
+	from, to, err := DateRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), PeriodDay, time.Now())
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	now, err := a.NegativeWorkersNow()
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error counting workers: %v", err)
+		return
+	}
+	days, err := a.NegativeWorkers(from, to)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error counting workers: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, map[string]any{"now": now, "days": days})
+}
+
+func (a *Analytics) getTopTasks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	period, err := ParsePeriod(query.Get("period"))
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	from, to, err := DateRange(query.Get("from"), query.Get("to"), period, time.Now())
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	tasks, err := a.TopTasks(from, to, period)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error finding the top tasks: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, tasks)
+}
@@ -0,0 +1,103 @@
+package analytics
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"fmt"
+	"time"
+)
+
+// Lengths of the periods the top task can be asked for. The names are the ones Postgres'
+// date_trunc takes, weeks start on Monday.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+func ParsePeriod(period string) (string, error) {
+	switch period {
+	case "":
+		return PeriodDay, nil
+	case PeriodDay, PeriodWeek, PeriodMonth:
+		return period, nil
+	default:
+		return "", fmt.Errorf("unknown period %q, expected day, week or month", period)
+	}
+}
+
+// The midnight starting the period that t falls in.
+func PeriodStart(t time.Time, period string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case PeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case PeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+func nextPeriod(start time.Time, period string) time.Time {
+	switch period {
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	case PeriodMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// Turning the from and to query parameters (YYYY-MM-DD, to is exclusive) into a range.
+// A missing from is the start of the current period, a missing to the start of the next one.
+func DateRange(from, to, period string, now time.Time) (time.Time, time.Time, error) {
+	start := PeriodStart(now, period)
+	if from != "" {
+		parsed, err := time.ParseInLocation(time.DateOnly, from, now.Location())
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from %q, expected YYYY-MM-DD", from)
+		}
+		start = parsed
+	}
+
+	end := nextPeriod(PeriodStart(now, period), period)
+	if to != "" {
+		parsed, err := time.ParseInLocation(time.DateOnly, to, now.Location())
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to %q, expected YYYY-MM-DD", to)
+		}
+		end = parsed
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+
+	return start, end, nil
+}
+
+// How a posted entry moves the company's numbers for the day, the opposite of what it does to the
+// worker. Reversals count against the kind of entry they undo, so a reversed fee lowers the fees
+// rather than showing up on its own. Payouts go to cash and leave the earnings alone, as do the
+// reversals published before events said what they undo.
+func earningsDelta(applied events.TransactionApplied) (fees, rewards, earnings entities.Money) {
+	fees, rewards, earnings = entities.NewMoney(0), entities.NewMoney(0), entities.NewMoney(0)
+
+	kind := applied.Kind
+	if kind == businesslogic.EntryReversal {
+		kind = applied.Reverses
+	}
+	switch kind {
+	case businesslogic.EntryAssignmentCharge:
+		fees = applied.Amount.Neg()
+		earnings = fees
+	case businesslogic.EntryCompletionReward:
+		rewards = applied.Amount
+		earnings = rewards.Neg()
+	}
+
+	return fees, rewards, earnings
+}
@@ -0,0 +1,37 @@
+package analytics
+
+import (
+	"aTES/core/entities"
+	"database/sql"
+)
+
+// Management's numbers, served from a read model the service keeps for itself. The model is
+// filled from the TaskCreated and TransactionApplied events TES publishes (see ApplyTransaction),
+// never from the TES tables, so it lags behind by however long those take to arrive.
+type Analytics struct {
+	db *sql.DB
+}
+
+// What the company made on one day: assignment fees taken minus completion rewards paid.
+type DayEarnings struct {
+	Day      string         `json:"day"`
+	Fees     entities.Money `json:"fees"`
+	Rewards  entities.Money `json:"rewards"`
+	Earnings entities.Money `json:"earnings"`
+}
+
+// How many workers ended a day owing the company money.
+type DayNegativeWorkers struct {
+	Day     string `json:"day"`
+	Workers int    `json:"workers"`
+}
+
+// The completed task with the highest reward in a period (a day, a week or a month).
+type TopTask struct {
+	Period      string         `json:"period"` // The first day of the period.
+	TaskID      int            `json:"task_id"`
+	Description string         `json:"description"`
+	CompletedBy int            `json:"completed_by"`
+	Reward      entities.Money `json:"reward"`
+	CompletedAt string         `json:"completed_at"`
+}
@@ -11,26 +11,29 @@ import (
 )
 
 func loadPasswordsFromYaml(passwordYamlPath string) (*passwordYaml, error) {
-	var passwords passwordYaml
-	passwords.location = passwordYamlPath
+	passwords := passwordYaml{location: passwordYamlPath, params: defaultPasswordParams}
 
 	data, err := os.ReadFile(passwordYamlPath)
 	if err != nil {
-		return &passwordYaml{passwordsMap: make(map[int]string)},
+		return &passwordYaml{passwordsMap: make(map[int]string), params: defaultPasswordParams},
 			fmt.Errorf("error while rading yaml: %w", err)
 	}
 
 	err = yaml.Unmarshal(data, &passwords.passwordsMap)
 	if err != nil {
-		return &passwordYaml{passwordsMap: make(map[int]string)},
+		return &passwordYaml{passwordsMap: make(map[int]string), params: defaultPasswordParams},
 			fmt.Errorf("error while loading passwords from yaml: %w", err)
 	}
+	if passwords.passwordsMap == nil {
+		passwords.passwordsMap = make(map[int]string)
+	}
 
 	return &passwords, nil
 }
 
+// Only the owner may read the file, hashes are still worth guessing at.
 func (passwords *passwordYaml) savePasswordsToYaml() error {
-	file, err := os.Create(passwords.location)
+	file, err := os.OpenFile(passwords.location, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		return fmt.Errorf("error recreating the file %s: %w", passwords.location, err)
 	}
@@ -44,9 +47,15 @@ func (passwords *passwordYaml) savePasswordsToYaml() error {
 	return nil
 }
 
+// How users.yaml is laid out. Files written before next_user_id existed are a plain map of the
+// users, the next id is then the one after the highest.
+type usersFile struct {
+	NextUserID int                   `yaml:"next_user_id"`
+	Users      map[int]entities.User `yaml:"users"`
+}
+
 func loadUsersFromYaml(usersYamlPath string) (*usersYaml, error) {
-	var users usersYaml
-	users.location = usersYamlPath
+	users := usersYaml{location: usersYamlPath}
 
 	data, err := os.ReadFile(usersYamlPath)
 	if err != nil {
@@ -54,10 +63,23 @@ func loadUsersFromYaml(usersYamlPath string) (*usersYaml, error) {
 			fmt.Errorf("error while rading yaml: %w", err)
 	}
 
-	err = yaml.Unmarshal(data, &users.usersMap)
+	var file usersFile
+	err = yaml.Unmarshal(data, &file)
+	if err == nil && file.Users == nil {
+		err = yaml.Unmarshal(data, &file.Users)
+	}
 	if err != nil {
 		return &usersYaml{usersMap: make(map[int]entities.User)},
-			fmt.Errorf("error while loading passwords from yaml: %w", err)
+			fmt.Errorf("error while loading users from yaml: %w", err)
+	}
+	if file.Users == nil {
+		file.Users = make(map[int]entities.User)
+	}
+
+	users.usersMap = file.Users
+	users.nextUserID = max(file.NextUserID, 1)
+	for userID := range users.usersMap {
+		users.nextUserID = max(users.nextUserID, userID+1)
 	}
 
 	return &users, nil
@@ -71,28 +93,45 @@ func (users *usersYaml) saveUsersToYaml() error {
 	defer file.Close()
 
 	encoder := yaml.NewEncoder(file)
-	if err := encoder.Encode(users.usersMap); err != nil {
+	if err := encoder.Encode(usersFile{NextUserID: users.nextUserID, Users: users.usersMap}); err != nil {
 		return fmt.Errorf("error writing data to fole %s: %w", users.location, err)
 	}
 
 	return nil
 }
 
-// Creates a password, refreshes the local storage of it and writes it to the password yaml file.
-func (ty *passwordYaml) generatePasswordForYaml(userID int) error {
-
-	// Generating a unique password.
-	passwordBytes := make([]byte, 16) // 128 bit long password.
-	if _, err := rand.Read(passwordBytes); err != nil {
-		return fmt.Errorf("error generating bytes for a new password: %w", err)
+// Creates a password, stores its hash and writes it to the password yaml file. The password itself
+// is only ever returned here, to be handed to the user.
+func (ty *passwordYaml) generatePasswordForYaml(userID int) (string, error) {
+	newpassword, hash, err := newPasswordHash(ty.params)
+	if err != nil {
+		return "", err
+	}
+	if err := ty.storePasswordHash(userID, hash); err != nil {
+		return "", err
 	}
-	newpassword := hex.EncodeToString(passwordBytes) // Converting from binary to hexadecimal and turns into a string.
 
-	// Storing the new password in the password map fur the given userID.
-	ty.passwordsMap[userID] = newpassword
+	return newpassword, nil
+}
 
-	// Updating the password repo (yaml).
+// Generating a unique password along with its hash. Hashing is slow on purpose, it's best done
+// without holding any lock.
+func newPasswordHash(params passwordParams) (string, string, error) {
+	newpassword, err := randomPassword()
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := hashPassword(newpassword, params)
+	if err != nil {
+		return "", "", fmt.Errorf("error hashing the new password: %w", err)
+	}
 
+	return newpassword, hash, nil
+}
+
+// Storing the hash in the password map for the given userID and updating the password repo (yaml).
+func (ty *passwordYaml) storePasswordHash(userID int, hash string) error {
+	ty.passwordsMap[userID] = hash
 	if err := ty.savePasswordsToYaml(); err != nil {
 		return fmt.Errorf("error while undating password repo with the new password: %w", err)
 	}
@@ -100,9 +139,12 @@ func (ty *passwordYaml) generatePasswordForYaml(userID int) error {
 	return nil
 }
 
-// General interface functions.
+// A 128 bit random password in hex.
+func randomPassword() (string, error) {
+	passwordBytes := make([]byte, 16)
+	if _, err := rand.Read(passwordBytes); err != nil {
+		return "", fmt.Errorf("error generating bytes for a new password: %w", err)
+	}
 
-// func GetUser(au Authenticator, userID int) (entities.User, error)
-// func UpdateUser(au Authenticator, userID int, name, email, role, leftAt string) error
-// func DeleteUser(au Authenticator, userID int) error
-// func Validatepassword(au Authenticator, userID int, password string) bool
+	return hex.EncodeToString(passwordBytes), nil // Converting from binary to hexadecimal and turns into a string.
+}
@@ -1,35 +1,174 @@
 package authenticator
 
 import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/rbac"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
+// A mock authenticator over empty yaml files in a temporary directory, hashing with the cheap
+// test settings.
+func newTestMockAuthenticator(t *testing.T) *MockAuthenticator {
+	t.Helper()
+	dir := t.TempDir()
+	passwordsPath, usersPath := filepath.Join(dir, "passwords.yaml"), filepath.Join(dir, "users.yaml")
+	for _, path := range []string{passwordsPath, usersPath} {
+		if err := os.WriteFile(path, []byte("{}\n"), 0o600); err != nil {
+			t.Fatalf("Error writing %s: %v", path, err)
+		}
+	}
+
+	auth, err := NewMockAuthenticator(passwordsPath, usersPath)
+	if err != nil {
+		t.Fatalf("Error creating a new authenticator instance: %v", err)
+	}
+	auth.passwords.params = testPasswordParams
+	return auth
+}
+
 func TestCreateUser(t *testing.T) {
-	// Initialising the mock authenticator.
-	auth, err := NewMockAuthenticator(
-		"/home/ccat/Repos/Task-Exchange-Service/core/operations/authenticator/passwords.yaml",
-		"/home/ccat/Repos/Task-Exchange-Service/core/operations/authenticator/users.yaml",
-	)
+	t.Setenv(jwtKeyEnv, "test-key")
+	auth := newTestMockAuthenticator(t)
+	ctx := context.Background()
+
+	// An admin to create the user with.
+	adminID, _, err := auth.CreateUser(ctx, "Admin", entities.RoleAdmin, "admin@example.com", "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating the admin: %v", err)
+	}
+	token, err := GenerateJWT(adminID, entities.RoleAdmin)
 	if err != nil {
-		t.Errorf("Error creating a new authenticator instance: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
 	// Preparing the request's body.
-	reqBody := `{"name":"Ken Cat", "role":"admin", "email":"kctest@example.com", "joined_at":"2024-01-01"}`
+	reqBody := `{"target": {"name":"Ken Cat", "role":"worker", "email":"kctest@example.com", "joined_at":"2024-01-01"}}`
 
 	// Creating a new request.
 	req := httptest.NewRequest(http.MethodPost, "/create_user", strings.NewReader(reqBody))
+	req.Header.Set("Authorization", "Bearer "+token)
 	w := httptest.NewRecorder()
 
 	// Calling the handler.
-	auth.CreateUserHandler(w, req)
+	NewServer(auth, rbac.Default()).CreateUserHandler(w, req)
 
 	// Checking the status code.
 	response := w.Result()
 	if response.StatusCode != http.StatusOK {
-		t.Errorf("Expected status ok, got %v", response.Status)
+		t.Fatalf("Expected status ok, got %v (%s)", response.Status, w.Body)
+	}
+	var created struct {
+		UserID   int    `json:"user_id"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&created); err != nil || created.Password == "" {
+		t.Fatalf("Expected the new user's id and password, got %s (%v)", w.Body, err)
+	}
+	user, err := auth.GetUser(ctx, created.UserID)
+	if err != nil || user.Email != "kctest@example.com" || user.Role != entities.RoleWorker {
+		t.Errorf("Expected the user stored, got %+v (%v)", user, err)
+	}
+}
+
+// The JSON login shares the sign-in page's throttle: failures on either count for both.
+func TestLoginThrottlesFailedLogins(t *testing.T) {
+	t.Setenv(jwtKeyEnv, "test-key")
+	auth := newTestMockAuthenticator(t)
+	userID, password, err := auth.CreateUser(context.Background(), "Ken Cat", entities.RoleManager, "kc@example.com", "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating a user: %v", err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating a key: %v", err)
+	}
+	provider := NewOIDCProvider("http://auth.example.com", auth, map[string]OIDCClient{}, key)
+	server := NewServer(auth, rbac.Default())
+	server.SetLoginThrottle(provider)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"login": {"user_id": %d, "password": %q}}`, userID, password)
+		w := httptest.NewRecorder()
+		server.login(w, httptest.NewRequest(http.MethodPost, "/get_user", strings.NewReader(body)))
+		return w
+	}
+
+	for range maxFailedLoginsPerUser - 1 {
+		if w := login(password + "0"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a wrong password to be refused, got %d", w.Code)
+		}
+	}
+	userKey, ipKey := loginThrottleKeys(httptest.NewRequest(http.MethodPost, "/oidc/authorize", nil), strconv.Itoa(userID))
+	provider.logins.fail(userKey, ipKey)
+	if w := login(password); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the login turned away, got %d", w.Code)
+	}
+
+	provider.logins.now = func() time.Time { return time.Now().Add(failedLoginWindow) }
+	if w := login(password); w.Code != http.StatusOK {
+		t.Errorf("Expected the login let through after the window, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUserEvents(t *testing.T) {
+	auth := newTestMockAuthenticator(t)
+	bus := events.NewMemoryBus()
+	auth.SetPublisher(bus)
+	ctx := context.Background()
+
+	userID, _, err := auth.CreateUser(ctx, "Ken Cat", entities.RoleWorker, "kc@example.com", "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating a user: %v", err)
+	}
+	if err := auth.UpdateUser(ctx, userID, "Ken Cat", "kc@example.com", entities.RoleManager, ""); err != nil {
+		t.Fatalf("Error updating the user: %v", err)
+	}
+	if err := auth.DeleteUser(ctx, userID); err != nil {
+		t.Fatalf("Error deleting the user: %v", err)
+	}
+
+	published := bus.Published()
+	expected := []string{events.UserCreatedName, events.UserUpdatedName, events.UserRoleChangedName, events.UserDeletedName}
+	if len(published) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(published))
+	}
+	for i, name := range expected {
+		if published[i].EventName() != name {
+			t.Errorf("Event %d: expected %s, got %s", i, name, published[i].EventName())
+		}
+	}
+	created, updated := published[0].(events.UserCreated), published[1].(events.UserUpdated)
+	if updated.User.Role != entities.RoleManager {
+		t.Errorf("Expected the updated role in UserUpdated, got %q", updated.User.Role)
+	}
+	if changed := published[2].(events.UserRoleChanged); changed.OldRole != entities.RoleWorker ||
+		changed.NewRole != entities.RoleManager || changed.Version != updated.User.Version {
+		t.Errorf("Unexpected role change: %+v", changed)
+	}
+	deleted := published[3].(events.UserDeleted)
+	if !(created.User.Version < updated.User.Version && updated.User.Version < deleted.Version) {
+		t.Errorf("Expected versions to go up, got %d, %d and %d", created.User.Version, updated.User.Version, deleted.Version)
+	}
+
+	// The deleted user's id isn't handed out again, and versions carry on.
+	againID, _, err := auth.CreateUser(ctx, "Ken Cat", entities.RoleWorker, "kc@example.com", "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating a user: %v", err)
+	}
+	if again := bus.Published()[4].(events.UserCreated); againID == userID || again.User.Version <= deleted.Version {
+		t.Errorf("Expected a new id above v%d, got %d v%d after deleting %d", deleted.Version, againID, again.User.Version, userID)
 	}
 }
@@ -0,0 +1,352 @@
+// The behaviour every Authenticator has to show, whatever it keeps users in. An implementation's
+// tests call Run with a way to make empty instances of it.
+package authenticatortest
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/operations/authenticator"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// An empty authenticator, and a way to open another one over the same storage as a restarted
+// service would.
+type Instance struct {
+	Auth   authenticator.Authenticator
+	Reopen func(t *testing.T) authenticator.Authenticator
+}
+
+// Makes a fresh Instance publishing to publisher. Anything it sets up is cleaned up with t.
+type Factory func(t *testing.T, publisher events.Publisher) Instance
+
+// Runs the whole suite, every subtest against instances of its own.
+func Run(t *testing.T, newInstance Factory) {
+	t.Run("create and get", func(t *testing.T) { testCreateAndGet(t, newInstance) })
+	t.Run("passwords", func(t *testing.T) { testPasswords(t, newInstance) })
+	t.Run("unique emails", func(t *testing.T) { testUniqueEmails(t, newInstance) })
+	t.Run("update and delete", func(t *testing.T) { testUpdateAndDelete(t, newInstance) })
+	t.Run("cancelled context", func(t *testing.T) { testCancelledContext(t, newInstance) })
+	t.Run("concurrency", func(t *testing.T) { testConcurrency(t, newInstance) })
+	t.Run("persistence", func(t *testing.T) { testPersistence(t, newInstance) })
+}
+
+func createUser(t *testing.T, auth authenticator.Authenticator, name, email string) (int, string) {
+	t.Helper()
+	userID, password, err := auth.CreateUser(context.Background(), name, entities.RoleWorker, email, "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating %s: %v", email, err)
+	}
+	if userID <= 0 || password == "" {
+		t.Fatalf("Expected an id and a password for %s, got %d and %q", email, userID, password)
+	}
+
+	return userID, password
+}
+
+func testCreateAndGet(t *testing.T, newInstance Factory) {
+	ctx := context.Background()
+	auth := newInstance(t, events.Discard{}).Auth
+	userID, _ := createUser(t, auth, "Ken Cat", "kc@example.com")
+
+	user, err := auth.GetUser(ctx, userID)
+	if err != nil {
+		t.Fatalf("Error getting the user: %v", err)
+	}
+	if user.UserID != userID || user.Name != "Ken Cat" || user.Email != "kc@example.com" ||
+		user.Role != entities.RoleWorker || user.JoinedAt != "2024-01-01" || user.LeftAt != "" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+	if _, err := auth.GetUser(ctx, userID+1000); !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound for a user that doesn't exist, got %v", err)
+	}
+}
+
+func testPasswords(t *testing.T, newInstance Factory) {
+	ctx := context.Background()
+	auth := newInstance(t, events.Discard{}).Auth
+	userID, password := createUser(t, auth, "Ken Cat", "kc@example.com")
+	otherID, otherPassword := createUser(t, auth, "Ken Dog", "kd@example.com")
+	if password == otherPassword {
+		t.Errorf("Expected every user to get a password of their own")
+	}
+
+	checks := []struct {
+		userID   int
+		password string
+		valid    bool
+	}{
+		{userID, password, true},
+		{otherID, otherPassword, true},
+		{userID, password + "0", false},
+		{userID, otherPassword, false},
+		{userID, "", false},
+		{userID + 1000, password, false}, // Unknown users are refused like wrong passwords.
+	}
+	for _, check := range checks {
+		valid, err := auth.ValidatePassword(ctx, check.userID, check.password)
+		if err != nil || valid != check.valid {
+			t.Errorf("Password %q of user %d: expected %v, got %v (%v)", check.password, check.userID, check.valid, valid, err)
+		}
+	}
+}
+
+func testUniqueEmails(t *testing.T, newInstance Factory) {
+	ctx := context.Background()
+	auth := newInstance(t, events.Discard{}).Auth
+	first, _ := createUser(t, auth, "Ken Cat", "kc@example.com")
+	_, _, err := auth.CreateUser(ctx, "Ken Dog", entities.RoleWorker, "KC@example.com", "2024-01-01")
+	if !errors.Is(err, authenticator.ErrDuplicateEmail) {
+		t.Errorf("Expected ErrDuplicateEmail for a taken email in another case, got %v", err)
+	}
+
+	second, _ := createUser(t, auth, "Ken Dog", "kd@example.com")
+	err = auth.UpdateUser(ctx, second, "Ken Dog", "kc@example.com", entities.RoleWorker, "")
+	if !errors.Is(err, authenticator.ErrDuplicateEmail) {
+		t.Errorf("Expected ErrDuplicateEmail updating to a taken email, got %v", err)
+	}
+	if user, _ := auth.GetUser(ctx, second); user.Email != "kd@example.com" {
+		t.Errorf("Expected a refused update to change nothing, got %+v", user)
+	}
+	if err := auth.UpdateUser(ctx, first, "Ken Cat", "KC@example.com", entities.RoleWorker, ""); err != nil {
+		t.Errorf("Expected users to keep their own email, got %v", err)
+	}
+}
+
+func testUpdateAndDelete(t *testing.T, newInstance Factory) {
+	ctx := context.Background()
+	bus := events.NewMemoryBus()
+	auth := newInstance(t, bus).Auth
+	userID, password := createUser(t, auth, "Ken Cat", "kc@example.com")
+
+	if err := auth.UpdateUser(ctx, userID, "Ken Cat", "kc@example.com", entities.RoleManager, "2024-12-31"); err != nil {
+		t.Fatalf("Error updating the user: %v", err)
+	}
+	user, err := auth.GetUser(ctx, userID)
+	if err != nil || user.Role != entities.RoleManager || user.LeftAt != "2024-12-31" {
+		t.Errorf("Expected the update to stick, got %+v (%v)", user, err)
+	}
+	err = auth.UpdateUser(ctx, userID+1000, "Nobody", "nobody@example.com", entities.RoleWorker, "")
+	if !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound updating a user that doesn't exist, got %v", err)
+	}
+
+	if err := auth.DeleteUser(ctx, userID); err != nil {
+		t.Fatalf("Error deleting the user: %v", err)
+	}
+	if _, err := auth.GetUser(ctx, userID); !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected the user to be gone, got %v", err)
+	}
+	if valid, err := auth.ValidatePassword(ctx, userID, password); valid || err != nil {
+		t.Errorf("Expected the password of a deleted user to be refused, got %v (%v)", valid, err)
+	}
+	if err := auth.DeleteUser(ctx, userID); !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound deleting the user twice, got %v", err)
+	}
+	// The email is free again once its user is gone, the id isn't.
+	if againID, _ := createUser(t, auth, "Ken Cat", "kc@example.com"); againID == userID {
+		t.Errorf("Expected a new id, got the deleted user's %d again", againID)
+	}
+
+	published := bus.Published()
+	expected := []string{events.UserCreatedName, events.UserUpdatedName, events.UserRoleChangedName, events.UserDeletedName,
+		events.UserCreatedName}
+	if len(published) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(published))
+	}
+	for i, name := range expected {
+		if published[i].EventName() != name {
+			t.Errorf("Event %d: expected %s, got %s", i, name, published[i].EventName())
+		}
+	}
+	created, updated := published[0].(events.UserCreated), published[1].(events.UserUpdated)
+	deleted := published[3].(events.UserDeleted)
+	if !(created.User.Version < updated.User.Version && updated.User.Version < deleted.Version) {
+		t.Errorf("Expected versions to go up, got %d, %d and %d", created.User.Version, updated.User.Version, deleted.Version)
+	}
+}
+
+func testCancelledContext(t *testing.T, newInstance Factory) {
+	auth := newInstance(t, events.Discard{}).Auth
+	userID, password := createUser(t, auth, "Ken Cat", "kc@example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := auth.CreateUser(ctx, "Ken Dog", entities.RoleWorker, "kd@example.com", "2024-01-01"); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateUser: expected context.Canceled, got %v", err)
+	}
+	if _, err := auth.GetUser(ctx, userID); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUser: expected context.Canceled, got %v", err)
+	}
+	if err := auth.UpdateUser(ctx, userID, "Ken Cat", "kc@example.com", entities.RoleAdmin, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("UpdateUser: expected context.Canceled, got %v", err)
+	}
+	if _, err := auth.ValidatePassword(ctx, userID, password); !errors.Is(err, context.Canceled) {
+		t.Errorf("ValidatePassword: expected context.Canceled, got %v", err)
+	}
+	if err := auth.DeleteUser(ctx, userID); !errors.Is(err, context.Canceled) {
+		t.Errorf("DeleteUser: expected context.Canceled, got %v", err)
+	}
+
+	// Nothing was changed on the way.
+	user, err := auth.GetUser(context.Background(), userID)
+	if err != nil || user.Role != entities.RoleWorker {
+		t.Errorf("Expected the user untouched, got %+v (%v)", user, err)
+	}
+	if _, err := auth.GetUser(context.Background(), userID+1); !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected no user created, got %v", err)
+	}
+}
+
+// Best run with -race.
+func testConcurrency(t *testing.T, newInstance Factory) {
+	const workers = 8
+	ctx := context.Background()
+	auth := newInstance(t, events.Discard{}).Auth
+
+	// Users created side by side all get ids of their own.
+	ids := make([]int, workers)
+	passwords := make([]string, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i], passwords[i], errs[i] = auth.CreateUser(ctx, fmt.Sprintf("Worker %d", i), entities.RoleWorker,
+				fmt.Sprintf("worker%d@example.com", i), "2024-01-01")
+		}()
+	}
+	wg.Wait()
+	seen := map[int]bool{}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Error creating worker %d: %v", i, err)
+		}
+		if seen[ids[i]] {
+			t.Errorf("Id %d handed out twice", ids[i])
+		}
+		seen[ids[i]] = true
+	}
+
+	// Only one of the users racing for the same email gets it.
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, errs[i] = auth.CreateUser(ctx, fmt.Sprintf("Twin %d", i), entities.RoleWorker, "twin@example.com", "2024-01-01")
+		}()
+	}
+	wg.Wait()
+	created := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, authenticator.ErrDuplicateEmail):
+			t.Errorf("Twin %d: expected ErrDuplicateEmail, got %v", i, err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("Expected exactly one user with the email, got %d", created)
+	}
+
+	// Only one of the users switching to the same email at once gets it.
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = auth.UpdateUser(ctx, ids[i], fmt.Sprintf("Worker %d", i), "switch@example.com", entities.RoleWorker, "")
+		}()
+	}
+	wg.Wait()
+	switched := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			switched++
+		case !errors.Is(err, authenticator.ErrDuplicateEmail):
+			t.Errorf("Worker %d: expected ErrDuplicateEmail, got %v", i, err)
+		}
+	}
+	if switched != 1 {
+		t.Errorf("Expected exactly one user switched to the email, got %d", switched)
+	}
+
+	// Passwords are checked side by side with updates going on.
+	valid := make([]bool, workers)
+	for i := range workers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			valid[i], errs[i] = auth.ValidatePassword(ctx, ids[i], passwords[i])
+		}()
+		go func() {
+			defer wg.Done()
+			if err := auth.UpdateUser(ctx, ids[i], fmt.Sprintf("Worker %d", i), fmt.Sprintf("worker%d@example.com", i),
+				entities.RoleManager, ""); err != nil {
+				t.Errorf("Error updating worker %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range workers {
+		if !valid[i] || errs[i] != nil {
+			t.Errorf("Expected the password of worker %d to be valid, got %v (%v)", i, valid[i], errs[i])
+		}
+		if user, err := auth.GetUser(ctx, ids[i]); err != nil || user.Role != entities.RoleManager {
+			t.Errorf("Expected worker %d updated, got %+v (%v)", i, user, err)
+		}
+	}
+}
+
+func testPersistence(t *testing.T, newInstance Factory) {
+	ctx := context.Background()
+	instance := newInstance(t, events.Discard{})
+	kept, password := createUser(t, instance.Auth, "Ken Cat", "kc@example.com")
+	if err := instance.Auth.UpdateUser(ctx, kept, "Ken Cat", "kc@example.com", entities.RoleAdmin, ""); err != nil {
+		t.Fatalf("Error updating the user: %v", err)
+	}
+	gone, _ := createUser(t, instance.Auth, "Ken Dog", "kd@example.com")
+	if err := instance.Auth.DeleteUser(ctx, gone); err != nil {
+		t.Fatalf("Error deleting the user: %v", err)
+	}
+	before, err := instance.Auth.GetUser(ctx, kept)
+	if err != nil {
+		t.Fatalf("Error getting the user: %v", err)
+	}
+
+	auth := instance.Reopen(t)
+	after, err := auth.GetUser(ctx, kept)
+	if err != nil {
+		t.Fatalf("Expected the user to survive a restart, got %v", err)
+	}
+	if after.Name != before.Name || after.Email != before.Email || after.Role != entities.RoleAdmin ||
+		after.JoinedAt != before.JoinedAt || after.Version != before.Version {
+		t.Errorf("Expected %+v after the restart, got %+v", before, after)
+	}
+	if valid, err := auth.ValidatePassword(ctx, kept, password); !valid || err != nil {
+		t.Errorf("Expected the password to survive a restart, got %v (%v)", valid, err)
+	}
+	if _, err := auth.GetUser(ctx, gone); !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected the deleted user to stay gone, got %v", err)
+	}
+	_, _, err = auth.CreateUser(ctx, "Ken Cow", entities.RoleWorker, "KC@example.com", "2024-01-01")
+	if !errors.Is(err, authenticator.ErrDuplicateEmail) {
+		t.Errorf("Expected emails to stay taken after a restart, got %v", err)
+	}
+	if newID, _ := createUser(t, auth, "Ken Cow", "kcow@example.com"); newID == gone || newID == kept {
+		t.Errorf("Expected a new id after the restart, got %d", newID)
+	}
+
+	// Versions carry on from where they were.
+	if err := auth.UpdateUser(ctx, kept, "Ken Cat", "kc@example.com", entities.RoleWorker, ""); err != nil {
+		t.Fatalf("Error updating the user: %v", err)
+	}
+	if user, _ := auth.GetUser(ctx, kept); user.Version <= before.Version {
+		t.Errorf("Expected a version above %d after the restart, got %d", before.Version, user.Version)
+	}
+}
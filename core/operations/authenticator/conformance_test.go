@@ -0,0 +1,183 @@
+package authenticator_test
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/operations/authenticator"
+	"aTES/core/operations/authenticator/authenticatortest"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func TestMockAuthenticatorConformance(t *testing.T) {
+	authenticatortest.Run(t, func(t *testing.T, bus events.Publisher) authenticatortest.Instance {
+		dir := t.TempDir()
+		passwordsPath, usersPath := filepath.Join(dir, "passwords.yaml"), filepath.Join(dir, "users.yaml")
+		for _, path := range []string{passwordsPath, usersPath} {
+			if err := os.WriteFile(path, []byte("{}\n"), 0o600); err != nil {
+				t.Fatalf("Error writing %s: %v", path, err)
+			}
+		}
+		open := func(t *testing.T, bus events.Publisher) authenticator.Authenticator {
+			auth, err := authenticator.NewMockAuthenticator(passwordsPath, usersPath)
+			if err != nil {
+				t.Fatalf("Error creating the authenticator: %v", err)
+			}
+			authenticator.UseTestPasswordParams(auth)
+			auth.SetPublisher(bus)
+			return auth
+		}
+
+		return authenticatortest.Instance{
+			Auth:   open(t, bus),
+			Reopen: func(t *testing.T) authenticator.Authenticator { return open(t, events.Discard{}) },
+		}
+	})
+}
+
+// Needs a database to play in: AUTHENTICATOR_TEST_DSN, e.g.
+// "host=localhost user=postgres password=postgres dbname=postgres sslmode=disable".
+// Every test gets a schema of its own, dropped afterwards.
+func TestPostgresAuthenticatorConformance(t *testing.T) {
+	dsn := os.Getenv("AUTHENTICATOR_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AUTHENTICATOR_TEST_DSN isn't set")
+	}
+
+	authenticatortest.Run(t, func(t *testing.T, bus events.Publisher) authenticatortest.Instance {
+		schema := newTestSchema(t, dsn)
+		open := func(t *testing.T, bus events.Publisher) authenticator.Authenticator {
+			auth, err := authenticator.NewPostgresAuthenticator(openTestSchema(t, dsn, schema))
+			if err != nil {
+				t.Fatalf("Error creating the authenticator: %v", err)
+			}
+			authenticator.UseTestPasswordParams(auth)
+			auth.SetPublisher(bus)
+			return auth
+		}
+
+		return authenticatortest.Instance{
+			Auth:   open(t, bus),
+			Reopen: func(t *testing.T) authenticator.Authenticator { return open(t, events.Discard{}) },
+		}
+	})
+}
+
+func newTestSchema(t *testing.T, dsn string) string {
+	schema := fmt.Sprintf("auth_test_%d", time.Now().UnixNano())
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("Error creating schema %s: %v", schema, err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+	return schema
+}
+
+func openTestSchema(t *testing.T, dsn, schema string) *sql.DB {
+	db, err := sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Writes events in the transaction it's handed, failing when told to.
+type txPublisher struct {
+	fail      bool
+	published []events.Event
+}
+
+func (p *txPublisher) Publish(evs ...events.Event) error {
+	return errors.New("expected the events in the transaction")
+}
+
+func (p *txPublisher) PublishTx(tx *sql.Tx, evs ...events.Event) error {
+	if p.fail {
+		return errors.New("outbox is down")
+	}
+	p.published = append(p.published, evs...)
+	return nil
+}
+
+// With a TxPublisher a change is kept only along with its events.
+func TestPostgresAuthenticatorPublishesInTransaction(t *testing.T) {
+	dsn := os.Getenv("AUTHENTICATOR_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AUTHENTICATOR_TEST_DSN isn't set")
+	}
+	auth, err := authenticator.NewPostgresAuthenticator(openTestSchema(t, dsn, newTestSchema(t, dsn)))
+	if err != nil {
+		t.Fatalf("Error creating the authenticator: %v", err)
+	}
+	authenticator.UseTestPasswordParams(auth)
+	publisher := &txPublisher{}
+	auth.SetPublisher(publisher)
+	ctx := context.Background()
+
+	userID, _, err := auth.CreateUser(ctx, "Ann", entities.RoleWorker, "ann@example.com", "2024-06-01")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(publisher.published) != 1 {
+		t.Errorf("Expected UserCreated published, got %v", publisher.published)
+	}
+
+	publisher.fail = true
+	if _, _, err := auth.CreateUser(ctx, "Bob", entities.RoleWorker, "bob@example.com", "2024-06-01"); err == nil {
+		t.Errorf("Expected the create to fail along with its event")
+	}
+	if err := auth.UpdateUser(ctx, userID, "Ann", "ann@example.com", entities.RoleManager, ""); err == nil {
+		t.Errorf("Expected the update to fail along with its events")
+	}
+	if err := auth.DeleteUser(ctx, userID); err == nil {
+		t.Errorf("Expected the delete to fail along with its event")
+	}
+
+	if user, err := auth.GetUser(ctx, userID); err != nil || user.Role != entities.RoleWorker {
+		t.Errorf("Expected Ann unchanged, got %+v (%v)", user, err)
+	}
+	if _, err := auth.GetUser(ctx, userID+1); !errors.Is(err, authenticator.ErrUserNotFound) {
+		t.Errorf("Expected Bob not created, got %v", err)
+	}
+}
+
+func TestPostgresBootstrapAdmin(t *testing.T) {
+	dsn := os.Getenv("AUTHENTICATOR_TEST_DSN")
+	if dsn == "" {
+		t.Skip("AUTHENTICATOR_TEST_DSN isn't set")
+	}
+	auth, err := authenticator.NewPostgresAuthenticator(openTestSchema(t, dsn, newTestSchema(t, dsn)))
+	if err != nil {
+		t.Fatalf("Error creating the authenticator: %v", err)
+	}
+	authenticator.UseTestPasswordParams(auth)
+	ctx := context.Background()
+
+	userID, password, err := auth.BootstrapAdmin(ctx, "admin", "admin@example.com")
+	if err != nil || userID == 0 || password == "" {
+		t.Fatalf("Expected an admin created, got %d %q (%v)", userID, password, err)
+	}
+	if user, err := auth.GetUser(ctx, userID); err != nil || user.Role != entities.RoleAdmin {
+		t.Errorf("Expected an admin, got %+v (%v)", user, err)
+	}
+	if ok, err := auth.ValidatePassword(ctx, userID, password); err != nil || !ok {
+		t.Errorf("Expected the printed password to work, got %v (%v)", ok, err)
+	}
+
+	if userID, _, err := auth.BootstrapAdmin(ctx, "admin", "other@example.com"); err != nil || userID != 0 {
+		t.Errorf("Expected no second admin, got %d (%v)", userID, err)
+	}
+}
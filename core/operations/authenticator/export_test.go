@@ -0,0 +1,11 @@
+package authenticator
+
+// Cheap hashing for the authenticatortest runs, see testPasswordParams.
+func UseTestPasswordParams(auth Authenticator) {
+	switch a := auth.(type) {
+	case *MockAuthenticator:
+		a.passwords.params = testPasswordParams
+	case *PostgresAuthenticator:
+		a.params = testPasswordParams
+	}
+}
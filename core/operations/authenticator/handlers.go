@@ -2,18 +2,39 @@ package authenticator
 
 import (
 	"aTES/core/entities"
+	"aTES/core/rbac"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func (a *MockAuthenticator) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+// The HTTP API of an authenticator, whichever backend it stores users in.
+type Server struct {
+	auth   Authenticator
+	policy *rbac.Policy   // Who may manage users.
+	logins *loginThrottle // Failed logins, to slow down password guessing.
+}
+
+func NewServer(auth Authenticator, policy *rbac.Policy) *Server {
+	return &Server{auth: auth, policy: policy, logins: newLoginThrottle()}
+}
+
+// Counting failed logins together with the OIDC sign-in page, so guesses can't be spread
+// over the two.
+func (s *Server) SetLoginThrottle(p *OIDCProvider) {
+	s.logins = p.logins
+}
+
+func (s *Server) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Calling checkTokenAndLogin to validate the login credentials + token or trigger a login.
-	loginUserID, loginRole, err := a.checkTokenAndLogin(w, r)
+	loginUserID, loginRole, err := s.checkTokenAndLogin(w, r)
 
 	// Checking if the logged in user exists.
-	if _, exists := a.users.usersMap[loginUserID]; !exists {
+	if _, loginErr := s.auth.GetUser(r.Context(), loginUserID); loginErr != nil {
 		http.Error(w, fmt.Sprintf("Login does not exist: %v", err), http.StatusNotFound)
 		return
 	}
@@ -22,8 +43,8 @@ func (a *MockAuthenticator) CreateUserHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// Checking that the login was made by an admin.
-	if loginRole != "admin" {
+	// Checking that the login may manage users.
+	if !s.policy.Allows(loginRole, rbac.UsersManage) {
 		http.Error(w, "Forbidden: unauthorised access.", http.StatusForbidden)
 		return
 	}
@@ -49,24 +70,25 @@ func (a *MockAuthenticator) CreateUserHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Using the fields of the temporary struct in the createUser method.
-	userID, err := a.createUser(reqBody.Target.Name, reqBody.Target.Role, reqBody.Target.Email, reqBody.Target.JoinedAt)
+	userID, password, err := s.auth.CreateUser(r.Context(), reqBody.Target.Name, reqBody.Target.Role, reqBody.Target.Email, reqBody.Target.JoinedAt)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating user: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error creating user: %v", err), userErrorStatus(err))
 		return
 	}
 
-	// Sending a response with the new user's ID.
-	response := map[string]int{"user_id": userID}
+	// Sending a response with the new user's ID and password. Only the password's hash is kept,
+	// this is the one time it's shown.
+	response := map[string]any{"user_id": userID, "password": password}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (a *MockAuthenticator) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Calling checkTokenAndLogin to validate the login credentials + token or trigger a login.
-	loginUserID, _, err := a.checkTokenAndLogin(w, r)
+	loginUserID, _, err := s.checkTokenAndLogin(w, r)
 
 	// Checking if the logged in user exists.
-	if _, exists := a.users.usersMap[loginUserID]; !exists {
+	if _, loginErr := s.auth.GetUser(r.Context(), loginUserID); loginErr != nil {
 		http.Error(w, fmt.Sprintf("Login does not exist: %v", err), http.StatusNotFound)
 		return
 	}
@@ -95,16 +117,20 @@ func (a *MockAuthenticator) GetUserHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Validating the password.
-	passwordIsValid := a.validatePassword(reqBody.Target.UserID, reqBody.Target.Password)
+	passwordIsValid, err := s.auth.ValidatePassword(r.Context(), reqBody.Target.UserID, reqBody.Target.Password)
+	if err != nil {
+		http.Error(w, "Error checking the password", http.StatusInternalServerError)
+		return
+	}
 	if !passwordIsValid {
 		http.Error(w, "Unauthorised acess", http.StatusUnauthorized)
 		return
 	}
 
 	// Getting the user's information.
-	user, err := a.getUser(reqBody.Target.UserID)
+	user, err := s.auth.GetUser(r.Context(), reqBody.Target.UserID)
 	if err != nil {
-		http.Error(w, "Error retrieving user's information.", http.StatusNotFound)
+		http.Error(w, "Error retrieving user's information.", userErrorStatus(err))
 		return
 	}
 
@@ -116,12 +142,12 @@ func (a *MockAuthenticator) GetUserHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func (a *MockAuthenticator) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Calling checkTokenAndLogin to validate the login credentials + token or trigger a login.
-	loginUserID, loginRole, err := a.checkTokenAndLogin(w, r)
+	loginUserID, loginRole, err := s.checkTokenAndLogin(w, r)
 
 	// Checking if the logged in user exists.
-	if _, exists := a.users.usersMap[loginUserID]; !exists {
+	if _, loginErr := s.auth.GetUser(r.Context(), loginUserID); loginErr != nil {
 		http.Error(w, fmt.Sprintf("Login does not exist: %v", err), http.StatusNotFound)
 		return
 	}
@@ -130,8 +156,8 @@ func (a *MockAuthenticator) UpdateUserHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// Checking that the login was made by an admin.
-	if loginRole != "admin" {
+	// Checking that the login may manage users.
+	if !s.policy.Allows(loginRole, rbac.UsersManage) {
 		http.Error(w, "Forbidden: unauthorised access.", http.StatusForbidden)
 		return
 	}
@@ -154,16 +180,21 @@ func (a *MockAuthenticator) UpdateUserHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Validating the password.
-	passwordIsValid := a.validatePassword(reqBody.Target.User.UserID, reqBody.Target.Password)
+	passwordIsValid, err := s.auth.ValidatePassword(r.Context(), reqBody.Target.User.UserID, reqBody.Target.Password)
+	if err != nil {
+		http.Error(w, "Error checking the password", http.StatusInternalServerError)
+		return
+	}
 	if !passwordIsValid {
 		http.Error(w, "Unauthorised acess", http.StatusUnauthorized)
 		return
 	}
 
 	// Updating the user.
-	err = a.updateUser(reqBody.Target.User)
+	target := reqBody.Target.User
+	err = s.auth.UpdateUser(r.Context(), target.UserID, target.Name, target.Email, target.Role, target.LeftAt)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error updating user: %v", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Error updating user: %v", err), userErrorStatus(err))
 		return
 	}
 
@@ -172,12 +203,12 @@ func (a *MockAuthenticator) UpdateUserHandler(w http.ResponseWriter, r *http.Req
 	w.Write([]byte("User successfully updated"))
 }
 
-func (a *MockAuthenticator) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Calling checkTokenAndLogin to validate the login credentials + token or trigger a login.
-	loginUserID, loginRole, err := a.checkTokenAndLogin(w, r)
+	loginUserID, loginRole, err := s.checkTokenAndLogin(w, r)
 
 	// Checking if the logged in user exists.
-	if _, exists := a.users.usersMap[loginUserID]; !exists {
+	if _, loginErr := s.auth.GetUser(r.Context(), loginUserID); loginErr != nil {
 		http.Error(w, fmt.Sprintf("Login does not exist: %v", err), http.StatusNotFound)
 		return
 	}
@@ -186,8 +217,8 @@ func (a *MockAuthenticator) DeleteUserHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// Checking that the login was made by an admin.
-	if loginRole != "admin" {
+	// Checking that the login may manage users.
+	if !s.policy.Allows(loginRole, rbac.UsersManage) {
 		http.Error(w, "Forbidden: unauthorised access.", http.StatusForbidden)
 		return
 	}
@@ -210,16 +241,20 @@ func (a *MockAuthenticator) DeleteUserHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	// Validating the password.
-	passwordIsValid := a.validatePassword(reqBody.Target.UserID, reqBody.Target.Password)
+	passwordIsValid, err := s.auth.ValidatePassword(r.Context(), reqBody.Target.UserID, reqBody.Target.Password)
+	if err != nil {
+		http.Error(w, "Error checking the password", http.StatusInternalServerError)
+		return
+	}
 	if !passwordIsValid {
 		http.Error(w, "Unauthorised acess", http.StatusUnauthorized)
 		return
 	}
 
 	// Deleting the user.
-	err = a.deleteUser(reqBody.Target.UserID)
+	err = s.auth.DeleteUser(r.Context(), reqBody.Target.UserID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error deleting user: %v", err), http.StatusNotFound)
+		http.Error(w, fmt.Sprintf("Error deleting user: %v", err), userErrorStatus(err))
 		return
 	}
 
@@ -228,13 +263,25 @@ func (a *MockAuthenticator) DeleteUserHandler(w http.ResponseWriter, r *http.Req
 	w.Write([]byte("User successfully updated"))
 }
 
+// The status to answer with when the authenticator refuses a change.
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateEmail):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // Checking if the token is provided in the header, validating it and triggering login if there's no valid token.
-func (a *MockAuthenticator) checkTokenAndLogin(w http.ResponseWriter, r *http.Request) (int, string, error) {
+func (s *Server) checkTokenAndLogin(w http.ResponseWriter, r *http.Request) (int, string, error) {
 	// Extract the token from the authorisation header.
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		// No token was found, triggering login.
-		return a.login(w, r)
+		return s.login(w, r)
 	}
 
 	// A token was found, checking if the format is Bearer <token body>.
@@ -244,10 +291,10 @@ func (a *MockAuthenticator) checkTokenAndLogin(w http.ResponseWriter, r *http.Re
 	}
 
 	// Validate the JWT token.
-	userID, role, err := a.ValidateJWT(tokenParts[1])
+	userID, role, err := ParseJWT(tokenParts[1])
 	if err != nil {
 		// Triggering login if token is not valid/ expired.
-		return a.login(w, r)
+		return s.login(w, r)
 	}
 
 	// Token is valid, return the userID and role.
@@ -256,12 +303,11 @@ func (a *MockAuthenticator) checkTokenAndLogin(w http.ResponseWriter, r *http.Re
 }
 
 // Password authentication and generation of a new token.
-func (a *MockAuthenticator) login(w http.ResponseWriter, r *http.Request) (int, string, error) {
+func (s *Server) login(w http.ResponseWriter, r *http.Request) (int, string, error) {
 	// Login information should contain the user credential: { "user_id": <userID>, "password": <password> }
 	var loginData struct {
 		Login struct {
 			UserID   int    `json:"user_id"`
-			Role     string `json:"role"`
 			Password string `json:"password"`
 		} `json:"login"`
 	}
@@ -272,14 +318,36 @@ func (a *MockAuthenticator) login(w http.ResponseWriter, r *http.Request) (int,
 		return 0, "", fmt.Errorf("failed to decode login request body: %w", err)
 	}
 
+	// Turning away logins for a user or from an address that failed too often lately.
+	userKey, ipKey := loginThrottleKeys(r, strconv.Itoa(loginData.Login.UserID))
+	if wait := s.logins.wait(userKey, ipKey); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+		return 0, "", fmt.Errorf("too many failed logins for user %d", loginData.Login.UserID)
+	}
+
 	// Validating the password.
-	if !a.validatePassword(loginData.Login.UserID, loginData.Login.Password) {
+	valid, err := s.auth.ValidatePassword(r.Context(), loginData.Login.UserID, loginData.Login.Password)
+	if err != nil {
+		http.Error(w, "Error checking the password", http.StatusInternalServerError)
+		return 0, "", fmt.Errorf("failed to check the password of user %d: %w", loginData.Login.UserID, err)
+	}
+	if !valid {
+		s.logins.fail(userKey, ipKey)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return 0, "", fmt.Errorf("wrong password for user %d", loginData.Login.UserID)
 	}
+	s.logins.succeed(userKey)
+
+	// The role comes from the stored user, not from the request.
+	user, err := s.auth.GetUser(r.Context(), loginData.Login.UserID)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return 0, "", fmt.Errorf("failed to get user %d: %w", loginData.Login.UserID, err)
+	}
 
 	// Generatig a new JWT for the user after a successful login.
-	token, err := a.GenerateJWT(loginData.Login.UserID, loginData.Login.Role)
+	token, err := GenerateJWT(user.UserID, user.Role)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return 0, "", fmt.Errorf("failed to generate JWT: %w", err)
@@ -290,5 +358,5 @@ func (a *MockAuthenticator) login(w http.ResponseWriter, r *http.Request) (int,
 	w.Write([]byte(fmt.Sprintf(`{"token": "%s"}`, token)))
 
 	// Returning userID and role to be easily available for further use.
-	return loginData.Login.UserID, loginData.Login.Role, nil
+	return user.UserID, user.Role, nil
 }
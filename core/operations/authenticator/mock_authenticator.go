@@ -2,48 +2,95 @@ package authenticator
 
 import (
 	"aTES/core/entities"
+	"aTES/core/events"
+	"context"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+// Environment variable holding the key tokens are signed and verified with.
+const jwtKeyEnv = "JWT_KEY_TES_APP"
+
+// How long a token from GenerateJWT stays valid.
+const tokenLifetime = 72 * time.Hour
+
 func NewMockAuthenticator(passwordYamlPath, usersYamlPath string) (*MockAuthenticator, error) {
 	passwords, err := loadPasswordsFromYaml(passwordYamlPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load passwords from yaml: %w", err)
 	}
+	for userID, stored := range passwords.passwordsMap {
+		if !isPasswordHash(stored) {
+			return nil, fmt.Errorf("the password of user %d in %s isn't hashed, run Authenticator -migrate-passwords first",
+				userID, passwordYamlPath)
+		}
+	}
 	users, err := loadUsersFromYaml(usersYamlPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load users from yaml: %w", err)
 	}
 
+	// Carrying on above the versions handed out before the restart.
+	var lastVersion int64
+	for _, user := range users.usersMap {
+		lastVersion = max(lastVersion, user.Version)
+	}
+
 	return &MockAuthenticator{
-		users:     users,
-		passwords: passwords,
+		users:       users,
+		passwords:   passwords,
+		events:      events.Discard{},
+		lastVersion: lastVersion,
 	}, nil
 }
 
+// Sets where user events go. Until this is called they're dropped.
+func (a *MockAuthenticator) SetPublisher(publisher events.Publisher) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.events = publisher
+}
+
 // Generating a new JWT for a given userID and role
 func (a *MockAuthenticator) GenerateJWT(userID int, role string) (string, error) {
+	return GenerateJWT(userID, role)
+}
+
+// Signs a token any service holding the key can check with ParseJWT.
+func GenerateJWT(userID int, role string) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id": userID,
 		"role":    role,
-		"exp":     time.Now().Add(time.Hour * 72).Unix(), // Token is valid for 72 hours.
+		"exp":     time.Now().Add(tokenLifetime).Unix(),
 	}
 
-	jwtKey := []byte(os.Getenv("JWT_KET_TES_APP"))
+	jwtKey := []byte(os.Getenv(jwtKeyEnv))
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtKey)
 }
 
 func (a *MockAuthenticator) ValidateJWT(tokenStr string) (int, string, error) {
+	return ParseJWT(tokenStr)
+}
+
+// Validates a token issued by the authenticator and extracts the userID and role claims.
+// Other services use it to identify the caller without talking to the authenticator.
+func ParseJWT(tokenStr string) (int, string, error) {
 	var claims jwt.MapClaims
 
 	// Parsing the token.
 	token, err := jwt.ParseWithClaims(tokenStr, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_KEY_TES_APP")), nil
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(os.Getenv(jwtKeyEnv)), nil
 	})
 
 	if err != nil || !token.Valid {
@@ -59,81 +106,142 @@ func (a *MockAuthenticator) ValidateJWT(tokenStr string) (int, string, error) {
 	return int(userID), role, nil
 }
 
-// Creating a new user using the Mock authenticator.
-func (a *MockAuthenticator) createUser(name, role, email, joinedAt string) (int, error) {
+// Reading the caller's role from the Bearer token the authenticator issued, for rbac.Require.
+func RoleFromRequest(r *http.Request) (string, error) {
+	tokenParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		return "", fmt.Errorf("invalid token format, expected 'Bearer <token>'")
+	}
+
+	_, role, err := ParseJWT(tokenParts[1])
+	return role, err
+}
+
+// Creating a new user using the Mock authenticator. Returns the user's generated password, which
+// isn't stored anywhere and can't be had again.
+func (a *MockAuthenticator) CreateUser(ctx context.Context, name, role, email, joinedAt string) (int, string, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+	// Hashing before taking the lock, logins and other changes don't wait for it.
+	password, hash, err := newPasswordHash(a.passwords.params)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create a password for user %s, %s: %w", name, role, err)
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	if a.emailTaken(email, 0) {
+		return 0, "", fmt.Errorf("email %s: %w", email, ErrDuplicateEmail)
+	}
+
+	// Taking the next id from the counter kept in the yaml, a deleted user's id isn't reused.
+	userID := a.users.nextUserID
+	a.users.nextUserID++
+
 	newUser := entities.User{
-		UserID:      len(a.users.usersMap) + 1,
+		UserID:      userID,
 		Name:        name,
 		Email:       email,
 		Role:        role,
-		Balance:     float64(0),
+		Balance:     entities.NewMoney(0),
 		JoinedAt:    joinedAt,
 		LeftAt:      "",
 		LastUpdated: time.Now().String(),
+		Version:     a.nextVersion(0),
 	}
-	a.users.usersMap[len(a.users.usersMap)+1] = newUser
+	a.users.usersMap[userID] = newUser
 
 	// Updating the users yaml.
-	a.users.saveUsersToYaml()
+	if err := a.users.saveUsersToYaml(); err != nil {
+		return 0, "", fmt.Errorf("error updating the users repo: %w", err)
+	}
 
-	// Generating and storing a new password for the user.
-	_, err := a.newPassword(newUser.UserID)
-	if err != nil {
-		return newUser.UserID, fmt.Errorf("failed to create a password for user %s, %s: %w", name, role, err)
+	// Storing the new password for the user.
+	if err := a.passwords.storePasswordHash(newUser.UserID, hash); err != nil {
+		return newUser.UserID, "", fmt.Errorf("failed to create a password for user %s, %s: %w", name, role, err)
+	}
+
+	// Letting the other services know about the new user.
+	if err := a.events.Publish(events.UserCreated{User: newUser}); err != nil {
+		return newUser.UserID, password, fmt.Errorf("created user %d but failed to publish it: %w", newUser.UserID, err)
 	}
 
-	return newUser.UserID, nil
+	return newUser.UserID, password, nil
 }
 
 // Returns the entities.User struct for an EXISTING user.
-func (a *MockAuthenticator) getUser(userID int) (entities.User, error) {
+func (a *MockAuthenticator) GetUser(ctx context.Context, userID int) (entities.User, error) {
+	if err := ctx.Err(); err != nil {
+		return entities.User{}, err
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	user, exists := a.users.usersMap[userID]
 	if !exists {
-		return entities.User{}, fmt.Errorf("the user doesn't exist")
+		return entities.User{}, fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
 	}
 
 	return user, nil
 }
 
 // Updates an existing user.
-func (a *MockAuthenticator) updateUser(updatedUser entities.User) error {
+func (a *MockAuthenticator) UpdateUser(ctx context.Context, userID int, name, email, role, leftAt string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	// Validating that the user exists.
-	user, exists := a.users.usersMap[updatedUser.UserID]
+	user, exists := a.users.usersMap[userID]
 	if !exists {
-		return fmt.Errorf("user does not exist")
+		return fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
+	}
+
+	if a.emailTaken(email, user.UserID) {
+		return fmt.Errorf("email %s: %w", email, ErrDuplicateEmail)
 	}
 
 	// Updating the fields of the user.
-	user.Name = updatedUser.Name
-	user.Email = updatedUser.Email
-	user.Role = updatedUser.Role
-	user.LeftAt = updatedUser.LeftAt
+	oldRole := user.Role
+	user.Name = name
+	user.Email = email
+	user.Role = role
+	user.LeftAt = leftAt
 	user.LastUpdated = time.Now().String()
+	user.Version = a.nextVersion(user.Version)
 
 	// Saving the changes.
-	a.users.usersMap[updatedUser.UserID] = user
+	a.users.usersMap[userID] = user
+	if err := a.users.saveUsersToYaml(); err != nil {
+		return fmt.Errorf("error updating the users repo: %w", err)
+	}
+
+	changes := []events.Event{events.UserUpdated{User: user}}
+	if user.Role != oldRole {
+		changes = append(changes, events.UserRoleChanged{UserID: user.UserID, OldRole: oldRole, NewRole: user.Role, Version: user.Version})
+	}
+	if err := a.events.Publish(changes...); err != nil {
+		return fmt.Errorf("updated user %d but failed to publish it: %w", user.UserID, err)
+	}
 
 	return nil
 }
 
 // Sends a delete request to remove data of a user.
-func (a *MockAuthenticator) deleteUser(userID int) error {
+func (a *MockAuthenticator) DeleteUser(ctx context.Context, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	// Validating that the user exists.
-	_, exists := a.users.usersMap[userID]
+	user, exists := a.users.usersMap[userID]
 	if !exists {
-		return fmt.Errorf("user does not exist")
+		return fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
 	}
 
 	// Deleting the user and updating the user's repo.
@@ -148,26 +256,66 @@ func (a *MockAuthenticator) deleteUser(userID int) error {
 		return fmt.Errorf("error updating the password repo: %w", err)
 	}
 
+	if err := a.events.Publish(events.UserDeleted{UserID: userID, Version: a.nextVersion(user.Version)}); err != nil {
+		return fmt.Errorf("deleted user %d but failed to publish it: %w", userID, err)
+	}
+
 	return nil
 }
 
-func (a *MockAuthenticator) validatePassword(userID int, password string) bool {
-	expectedpassword, exists := a.passwords.passwordsMap[userID]
-	if !exists || expectedpassword != password {
-		return false
+// Whether another user than except has the email, ignoring case like the Postgres backend.
+// Must be called with the lock held.
+func (a *MockAuthenticator) emailTaken(email string, except int) bool {
+	for userID, user := range a.users.usersMap {
+		if userID != except && strings.EqualFold(user.Email, email) {
+			return true
+		}
 	}
 
-	return true
+	return false
 }
 
-// Creates a new password and writes it to the password repo.
-// Wrapper for passwordYaml.generatepassword
-func (a *MockAuthenticator) newPassword(userID int) (string, error) {
+// The version of a user's next change, above the user's current one and anything handed out
+// before. Following the clock keeps versions going up when a deleted user's id is handed out
+// again, even across restarts.
+func (a *MockAuthenticator) nextVersion(current int64) int64 {
+	a.lastVersion = max(current+1, a.lastVersion+1, time.Now().UnixMilli())
+	return a.lastVersion
+}
 
-	err := a.passwords.generatePasswordForYaml(userID)
+// Checking a password against the stored hash. Hashes made with outdated settings are replaced
+// while the password is at hand.
+func (a *MockAuthenticator) ValidatePassword(ctx context.Context, userID int, password string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	// Only reading the hash under the lock, checking it takes a while.
+	a.mu.Lock()
+	stored, exists := a.passwords.passwordsMap[userID]
+	a.mu.Unlock()
+	if !exists {
+		return false, nil
+	}
+	ok, rehash, err := verifyPassword(stored, password, a.passwords.params)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate and store a new password: %w", err)
+		return false, fmt.Errorf("the password of user %d can't be checked: %w", userID, err)
+	}
+
+	if ok && rehash {
+		hash, err := hashPassword(password, a.passwords.params)
+		if err != nil {
+			log.Printf("Authenticator: failed to rehash the password of user %d: %v\n", userID, err)
+			return ok, nil
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// Only replacing the hash that was checked, a password changed or deleted meanwhile stays.
+		if a.passwords.passwordsMap[userID] == stored {
+			if err := a.passwords.storePasswordHash(userID, hash); err != nil {
+				log.Printf("Authenticator: failed to save the rehashed password of user %d: %v\n", userID, err)
+			}
+		}
 	}
 
-	return a.passwords.passwordsMap[userID], nil
+	return ok, nil
 }
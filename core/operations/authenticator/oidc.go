@@ -0,0 +1,260 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// The code can't be redeemed, sent back as the OAuth 2.0 error of the same name.
+var ErrInvalidGrant = errors.New("invalid grant")
+
+const (
+	authorizationCodeLifetime = time.Minute // Codes are redeemed right after the redirect.
+	idTokenLifetime           = time.Hour
+)
+
+// Signing users in for the other services with the OpenID Connect authorization code flow, PKCE
+// required. The access token handed out is the same JWT the authenticator always issued, so the
+// services keep checking it with ParseJWT. The ID token is signed with the provider's RSA key,
+// published at the JWKS endpoint.
+type OIDCProvider struct {
+	issuer  string // The authenticator's public base URL, e.g. http://localhost:8181.
+	auth    Authenticator
+	clients map[string]OIDCClient
+	key     *rsa.PrivateKey
+	keyID   string
+
+	mu    sync.Mutex
+	codes map[string]authorizationCode // Codes waiting to be redeemed, each only once.
+
+	logins *loginThrottle // Failed sign-ins, to slow down password guessing.
+}
+
+// What a code stands for: a user's sign-in to a client.
+type authorizationCode struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string // S256 of the client's code verifier.
+	scope         []string
+	nonce         string
+	userID        int
+	authTime      time.Time
+	expiresAt     time.Time
+}
+
+func NewOIDCProvider(issuer string, auth Authenticator, clients map[string]OIDCClient, key *rsa.PrivateKey) *OIDCProvider {
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyID := sha256.Sum256(der)
+
+	return &OIDCProvider{
+		issuer:  strings.TrimSuffix(issuer, "/"),
+		auth:    auth,
+		clients: clients,
+		key:     key,
+		keyID:   base64.RawURLEncoding.EncodeToString(keyID[:8]),
+		codes:   make(map[string]authorizationCode),
+		logins:  newLoginThrottle(),
+	}
+}
+
+// Reads the RSA key ID tokens are signed with from a PEM file (PKCS #1 or #8). Without a path a
+// fresh key is generated, so the tokens signed before a restart can't be checked after it.
+func LoadSigningKey(keyPemPath string) (*rsa.PrivateKey, error) {
+	if keyPemPath == "" {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("error generating a signing key: %w", err)
+		}
+		return key, nil
+	}
+
+	data, err := os.ReadFile(keyPemPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading signing key %s: %w", keyPemPath, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", keyPemPath)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key %s: %w", keyPemPath, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s isn't an RSA key", keyPemPath)
+	}
+
+	return key, nil
+}
+
+// Issuing a code for a user who just signed in to the client. The caller has checked the
+// client, the redirect URI and the password.
+func (p *OIDCProvider) issueCode(request authorizeRequest, userID int) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Dropping the codes nobody came for.
+	for stale, issued := range p.codes {
+		if now.After(issued.expiresAt) {
+			delete(p.codes, stale)
+		}
+	}
+	p.codes[code] = authorizationCode{
+		clientID:      request.ClientID,
+		redirectURI:   request.RedirectURI,
+		codeChallenge: request.CodeChallenge,
+		scope:         request.scopes(),
+		nonce:         request.Nonce,
+		userID:        userID,
+		authTime:      now,
+		expiresAt:     now.Add(authorizationCodeLifetime),
+	}
+
+	return code, nil
+}
+
+// The tokens a code is exchanged for.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"` // Seconds, of the access token.
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// Exchanging a code for tokens. The client has been authenticated, the rest is checked here. A
+// code is gone after the first attempt to redeem it, whether it worked or not.
+func (p *OIDCProvider) redeemCode(ctx context.Context, client OIDCClient, code, redirectURI, codeVerifier string) (tokenResponse, error) {
+	p.mu.Lock()
+	issued, exists := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	switch {
+	case !exists || time.Now().After(issued.expiresAt):
+		return tokenResponse{}, fmt.Errorf("%w: the code is unknown, used or expired", ErrInvalidGrant)
+	case issued.clientID != client.ID:
+		return tokenResponse{}, fmt.Errorf("%w: the code was issued to another client", ErrInvalidGrant)
+	case issued.redirectURI != redirectURI:
+		return tokenResponse{}, fmt.Errorf("%w: redirect_uri doesn't match the authorization request", ErrInvalidGrant)
+	case !verifyCodeChallenge(issued.codeChallenge, codeVerifier):
+		return tokenResponse{}, fmt.Errorf("%w: code_verifier doesn't match the code_challenge", ErrInvalidGrant)
+	}
+
+	// The user may have been deleted since signing in.
+	user, err := p.auth.GetUser(ctx, issued.userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return tokenResponse{}, fmt.Errorf("%w: the user is gone", ErrInvalidGrant)
+	}
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	accessToken, err := GenerateJWT(user.UserID, user.Role)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("error generating the access token: %w", err)
+	}
+	claims := jwt.MapClaims{
+		"iss":       p.issuer,
+		"sub":       strconv.Itoa(user.UserID),
+		"aud":       client.ID,
+		"iat":       time.Now().Unix(),
+		"exp":       time.Now().Add(idTokenLifetime).Unix(),
+		"auth_time": issued.authTime.Unix(),
+	}
+	if issued.nonce != "" {
+		claims["nonce"] = issued.nonce
+	}
+	for name, value := range userClaims(user.UserID, user.Name, user.Email, user.Role, issued.scope) {
+		claims[name] = value
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = p.keyID
+	signedIDToken, err := idToken.SignedString(p.key)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("error signing the ID token: %w", err)
+	}
+
+	return tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(tokenLifetime.Seconds()),
+		IDToken:     signedIDToken,
+		Scope:       strings.Join(issued.scope, " "),
+	}, nil
+}
+
+// The claims about a user the scopes grant: profile is the name and role, email the email.
+func userClaims(userID int, name, email, role string, scope []string) map[string]any {
+	claims := map[string]any{"sub": strconv.Itoa(userID)}
+	if slices.Contains(scope, "profile") {
+		claims["name"] = name
+		claims["role"] = role
+	}
+	if slices.Contains(scope, "email") {
+		claims["email"] = email
+	}
+
+	return claims
+}
+
+// PKCE with S256 (RFC 7636): the challenge is the unpadded base64url SHA-256 of the verifier.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// The public half of the signing key as a JSON Web Key Set.
+func (p *OIDCProvider) jwks() map[string]any {
+	public := p.key.PublicKey
+	return map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": p.keyID,
+		"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}}}
+}
+
+// 256 random bits, URL safe.
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("error generating a token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
@@ -0,0 +1,95 @@
+package authenticator
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A service users sign in to through the authenticator, see clients.yaml.
+type OIDCClient struct {
+	ID           string   `yaml:"client_id"`
+	Name         string   `yaml:"name"`                  // Shown on the login page.
+	SecretHash   string   `yaml:"secret_hash,omitempty"` // Argon2id, see NewClientSecret. Public clients have none and rely on PKCE alone.
+	RedirectURIs []string `yaml:"redirect_uris"`         // Codes are only ever sent to one of these, matched exactly.
+}
+
+// Loads the registered clients from a yaml file shaped like:
+//
+//	clients:
+//	  - client_id: tes
+//	    name: Task Exchange Service
+//	    secret_hash: $argon2id$v=19$...
+//	    redirect_uris: [http://localhost:8080/login/callback]
+func LoadOIDCClients(clientsYamlPath string) (map[string]OIDCClient, error) {
+	data, err := os.ReadFile(clientsYamlPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading clients %s: %w", clientsYamlPath, err)
+	}
+
+	var file struct {
+		Clients []OIDCClient `yaml:"clients"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error while parsing clients %s: %w", clientsYamlPath, err)
+	}
+
+	clients := make(map[string]OIDCClient, len(file.Clients))
+	for _, client := range file.Clients {
+		if err := client.validate(); err != nil {
+			return nil, fmt.Errorf("invalid clients %s: %w", clientsYamlPath, err)
+		}
+		if _, exists := clients[client.ID]; exists {
+			return nil, fmt.Errorf("invalid clients %s: client %q is registered twice", clientsYamlPath, client.ID)
+		}
+		clients[client.ID] = client
+	}
+
+	return clients, nil
+}
+
+func (client OIDCClient) validate() error {
+	if client.ID == "" {
+		return fmt.Errorf("a client has no client_id")
+	}
+	if len(client.RedirectURIs) == 0 {
+		return fmt.Errorf("client %q has no redirect_uris", client.ID)
+	}
+	if client.SecretHash != "" {
+		if _, _, _, err := decodePasswordHash(client.SecretHash); err != nil {
+			return fmt.Errorf("client %q: %w", client.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (client OIDCClient) allowsRedirect(redirectURI string) bool {
+	return slices.Contains(client.RedirectURIs, redirectURI)
+}
+
+// Public clients must not send a secret, confidential ones must send theirs.
+func (client OIDCClient) checkSecret(secret string) bool {
+	if client.SecretHash == "" {
+		return secret == ""
+	}
+	ok, _, err := verifyPassword(client.SecretHash, secret, defaultPasswordParams)
+
+	return ok && err == nil
+}
+
+// A secret for a confidential client along with the hash that goes into clients.yaml.
+func NewClientSecret() (secret, hash string, err error) {
+	secret, err = randomPassword()
+	if err != nil {
+		return "", "", err
+	}
+	hash, err = hashPassword(secret, defaultPasswordParams)
+	if err != nil {
+		return "", "", fmt.Errorf("error hashing the client secret: %w", err)
+	}
+
+	return secret, hash, nil
+}
@@ -0,0 +1,326 @@
+package authenticator
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Routes of the OpenID Connect provider:
+//
+//	GET      /.well-known/openid-configuration - the discovery document.
+//	GET      /oidc/authorize                   - the login page, for the authorization code flow with PKCE (S256).
+//	POST     /oidc/authorize                   - signs in and redirects back to the client with a code.
+//	POST     /oidc/token                       - exchanges a code for an access token and an ID token.
+//	GET/POST /oidc/userinfo                    - the claims about the holder of an access token.
+//	GET      /oidc/jwks                        - the keys ID tokens are signed with.
+func (p *OIDCProvider) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/.well-known/openid-configuration", p.DiscoveryHandler)
+	mux.HandleFunc("/oidc/authorize", p.AuthorizeHandler)
+	mux.HandleFunc("/oidc/token", p.TokenHandler)
+	mux.HandleFunc("/oidc/userinfo", p.UserInfoHandler)
+	mux.HandleFunc("/oidc/jwks", p.JWKSHandler)
+}
+
+func (p *OIDCProvider) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeOIDCJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/oidc/authorize",
+		"token_endpoint":                        p.issuer + "/oidc/token",
+		"userinfo_endpoint":                     p.issuer + "/oidc/userinfo",
+		"jwks_uri":                              p.issuer + "/oidc/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"claims_supported":                      []string{"sub", "name", "role", "email"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"none", "client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (p *OIDCProvider) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeOIDCJSON(w, http.StatusOK, p.jwks())
+}
+
+// The parameters of an authorization request. The login page posts them back along with the
+// credentials.
+type authorizeRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func parseAuthorizeRequest(values url.Values) authorizeRequest {
+	return authorizeRequest{
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		ResponseType:        values.Get("response_type"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		Nonce:               values.Get("nonce"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+}
+
+func (request authorizeRequest) scopes() []string {
+	return strings.Fields(request.Scope)
+}
+
+// What's wrong with the request as an OAuth 2.0 error code and a description, empty if nothing.
+func (request authorizeRequest) validate() (string, string) {
+	switch {
+	case request.ResponseType != "code":
+		return "unsupported_response_type", "only the authorization code flow is supported"
+	case !slices.Contains(request.scopes(), "openid"):
+		return "invalid_scope", "the openid scope is required"
+	case request.CodeChallenge == "" || request.CodeChallengeMethod != "S256":
+		return "invalid_request", "PKCE with code_challenge_method S256 is required"
+	default:
+		return "", ""
+	}
+}
+
+// Shows the login page on GET and signs the user in on POST. Requests naming an unknown client
+// or a redirect URI it didn't register get an error page, they can't be trusted with a redirect.
+// Other problems are reported back to the client's redirect URI.
+func (p *OIDCProvider) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	request := parseAuthorizeRequest(r.Form)
+	client, exists := p.clients[request.ClientID]
+	if !exists || !client.allowsRedirect(request.RedirectURI) {
+		http.Error(w, "Unknown client or redirect URI", http.StatusBadRequest)
+		return
+	}
+	if code, description := request.validate(); code != "" {
+		redirectBack(w, r, request, url.Values{"error": {code}, "error_description": {description}})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		p.renderLogin(w, http.StatusOK, client, request, "")
+		return
+	}
+
+	// Turning away sign-ins for a user id or from an address that failed too often lately,
+	// before any password is checked.
+	userKey, ipKey := loginThrottleKeys(r, r.PostForm.Get("user_id"))
+	if wait := p.logins.wait(userKey, ipKey); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		p.renderLogin(w, http.StatusTooManyRequests, client, request, "Too many failed sign-ins, please try again later.")
+		return
+	}
+
+	userID, err := strconv.Atoi(r.PostForm.Get("user_id"))
+	if err != nil {
+		p.logins.fail(userKey, ipKey)
+		p.renderLogin(w, http.StatusUnauthorized, client, request, "Wrong user id or password.")
+		return
+	}
+	valid, err := p.auth.ValidatePassword(r.Context(), userID, r.PostForm.Get("password"))
+	if err != nil {
+		log.Printf("Authenticator: failed to check the password of user %d: %v\n", userID, err)
+		p.renderLogin(w, http.StatusInternalServerError, client, request, "Signing in failed, please try again.")
+		return
+	}
+	if !valid {
+		p.logins.fail(userKey, ipKey)
+		p.renderLogin(w, http.StatusUnauthorized, client, request, "Wrong user id or password.")
+		return
+	}
+	p.logins.succeed(userKey)
+
+	code, err := p.issueCode(request, userID)
+	if err != nil {
+		redirectBack(w, r, request, url.Values{"error": {"server_error"}})
+		return
+	}
+	redirectBack(w, r, request, url.Values{"code": {code}})
+}
+
+// Sending the browser back to the client with the outcome, and the state it came with.
+func redirectBack(w http.ResponseWriter, r *http.Request, request authorizeRequest, params url.Values) {
+	target, _ := url.Parse(request.RedirectURI) // Registered by the client, so it parses.
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.Client}}</title></head>
+<body>
+<h1>Sign in to {{.Client}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/oidc/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>User id <input name="user_id" inputmode="numeric" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+func (p *OIDCProvider) renderLogin(w http.ResponseWriter, status int, client OIDCClient, request authorizeRequest, message string) {
+	name := client.Name
+	if name == "" {
+		name = client.ID
+	}
+	params := map[string]string{
+		"client_id":             request.ClientID,
+		"redirect_uri":          request.RedirectURI,
+		"response_type":         request.ResponseType,
+		"scope":                 request.Scope,
+		"state":                 request.State,
+		"nonce":                 request.Nonce,
+		"code_challenge":        request.CodeChallenge,
+		"code_challenge_method": request.CodeChallengeMethod,
+	}
+
+	// Not to be cached or framed by another site.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := loginPage.Execute(w, map[string]any{"Client": name, "Params": params, "Error": message}); err != nil {
+		log.Printf("Authenticator: failed to render the login page: %v\n", err)
+	}
+}
+
+// Exchanging an authorization code for tokens. Confidential clients authenticate with HTTP basic
+// auth or client_secret in the body, public ones only send their client_id.
+func (p *OIDCProvider) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "the body isn't a form")
+		return
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Basic auth credentials are form-urlencoded before being joined (RFC 6749 2.3.1).
+	clientID, secret, basic := r.BasicAuth()
+	var escapeErr error
+	if basic {
+		if clientID, escapeErr = url.QueryUnescape(clientID); escapeErr == nil {
+			secret, escapeErr = url.QueryUnescape(secret)
+		}
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, exists := p.clients[clientID]
+	if escapeErr != nil || !exists || !client.checkSecret(secret) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	tokens, err := p.redeemCode(r.Context(), client, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	if errors.Is(err, ErrInvalidGrant) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Authenticator: failed to issue tokens to %s: %v\n", client.ID, err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "the tokens couldn't be issued")
+		return
+	}
+
+	w.Header().Set("Pragma", "no-cache")
+	writeOIDCJSON(w, http.StatusOK, tokens)
+}
+
+// The claims about the user an access token was issued to.
+func (p *OIDCProvider) UserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oidc"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_request", "expected 'Bearer <token>'")
+		return
+	}
+	userID, _, err := ParseJWT(tokenParts[1])
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid or expired")
+		return
+	}
+
+	user, err := p.auth.GetUser(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "the user is gone")
+		return
+	}
+	if err != nil {
+		log.Printf("Authenticator: failed to get user %d: %v\n", userID, err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "the user couldn't be read")
+		return
+	}
+
+	writeOIDCJSON(w, http.StatusOK, userClaims(user.UserID, user.Name, user.Email, user.Role, []string{"profile", "email"}))
+}
+
+// Tokens and claims aren't to be cached anywhere.
+func writeOIDCJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Sending an error as { "error": <code>, "error_description": <text> } like OAuth 2.0 wants.
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeOIDCJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
@@ -0,0 +1,289 @@
+package authenticator
+
+import (
+	"aTES/core/entities"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	t.Setenv(jwtKeyEnv, "test-key")
+
+	auth := newTestMockAuthenticator(t)
+	userID, password, err := auth.CreateUser(context.Background(), "Ken Cat", entities.RoleManager, "kc@example.com", "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating a user: %v", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating a key: %v", err)
+	}
+	const redirectURI = "http://tes.example.com/login/callback"
+	clients := map[string]OIDCClient{"tes": {ID: "tes", Name: "Task Exchange Service", RedirectURIs: []string{redirectURI}}}
+	mux := http.NewServeMux()
+	NewOIDCProvider("http://auth.example.com", auth, clients, key).RegisterRoutes(mux)
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	var discovery map[string]any
+	if w := serve(http.MethodGet, "/.well-known/openid-configuration", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the discovery document, got %d", w.Code)
+	} else if json.NewDecoder(w.Body).Decode(&discovery); discovery["token_endpoint"] != "http://auth.example.com/oidc/token" {
+		t.Errorf("Unexpected discovery document %v", discovery)
+	}
+
+	verifier := strings.Repeat("v", 43)
+	challenge := sha256.Sum256([]byte(verifier))
+	authorize := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"tes"},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid profile email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	// Strangers' redirect URIs get nothing, requests without PKCE are sent back.
+	stranger := url.Values{}
+	for name, values := range authorize {
+		stranger[name] = values
+	}
+	stranger.Set("redirect_uri", "http://evil.example.com/")
+	if w := serve(http.MethodGet, "/oidc/authorize?"+stranger.Encode(), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unregistered redirect URI to be refused, got %d", w.Code)
+	}
+	withoutPKCE := url.Values{"response_type": {"code"}, "client_id": {"tes"}, "redirect_uri": {redirectURI}, "scope": {"openid"}}
+	if w := serve(http.MethodGet, "/oidc/authorize?"+withoutPKCE.Encode(), nil); w.Code != http.StatusFound ||
+		!strings.Contains(w.Header().Get("Location"), "error=invalid_request") {
+		t.Errorf("Expected a request without PKCE to be sent back with an error, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	if w := serve(http.MethodGet, "/oidc/authorize?"+authorize.Encode(), nil); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "Sign in to Task Exchange Service") {
+		t.Fatalf("Expected the login page, got %d", w.Code)
+	}
+
+	login := url.Values{"user_id": {strconv.Itoa(userID)}, "password": {password + "0"}}
+	for name, values := range authorize {
+		login[name] = values
+	}
+	if w := serve(http.MethodPost, "/oidc/authorize", login); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", w.Code)
+	}
+	login.Set("password", password)
+	w := serve(http.MethodPost, "/oidc/authorize", login)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), redirectURI) {
+		t.Fatalf("Expected a redirect back to the client, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	code := location.Query().Get("code")
+	if code == "" || location.Query().Get("state") != "xyz" {
+		t.Fatalf("Expected a code and the state, got %s", location)
+	}
+
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectURI},
+		"client_id": {"tes"}, "code_verifier": {verifier}}
+	w = serve(http.MethodPost, "/oidc/token", exchange)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected tokens, got %d %s", w.Code, w.Body)
+	}
+	var tokens tokenResponse
+	json.NewDecoder(w.Body).Decode(&tokens)
+
+	// The access token is the one the services already take, the ID token is for the client.
+	if tokenUserID, role, err := ParseJWT(tokens.AccessToken); err != nil || tokenUserID != userID || role != entities.RoleManager {
+		t.Errorf("Expected an access token for user %d, got %d %s (%v)", userID, tokenUserID, role, err)
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (any, error) { return &key.PublicKey, nil })
+	if err != nil {
+		t.Fatalf("Expected a valid ID token, got %v", err)
+	}
+	if claims["iss"] != "http://auth.example.com" || claims["aud"] != "tes" || claims["sub"] != strconv.Itoa(userID) ||
+		claims["nonce"] != "n-0S6" || claims["email"] != "kc@example.com" || claims["role"] != entities.RoleManager {
+		t.Errorf("Unexpected ID token claims %v", claims)
+	}
+
+	// Codes work once.
+	if w := serve(http.MethodPost, "/oidc/token", exchange); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("Expected a used code to be refused, got %d %s", w.Code, w.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var userInfo map[string]any
+	if json.NewDecoder(w.Body).Decode(&userInfo); w.Code != http.StatusOK || userInfo["name"] != "Ken Cat" {
+		t.Errorf("Expected the user's claims, got %d %v", w.Code, userInfo)
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// The example of RFC 7636, appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	if !verifyCodeChallenge("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", verifier) {
+		t.Errorf("Expected the RFC's verifier to match its challenge")
+	}
+	if verifyCodeChallenge("E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", verifier[1:]) {
+		t.Errorf("Expected another verifier not to match")
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	throttle := newLoginThrottle()
+	throttle.now = func() time.Time { return now }
+	req := httptest.NewRequest(http.MethodPost, "/oidc/authorize", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	user, ip := loginThrottleKeys(req, "7")
+
+	for range maxFailedLoginsPerUser {
+		if wait := throttle.wait(user, ip); wait != 0 {
+			t.Fatalf("Expected sign-ins let through, got a wait of %v", wait)
+		}
+		throttle.fail(user, ip)
+		now = now.Add(time.Minute)
+	}
+	if wait := throttle.wait(user, ip); wait != failedLoginWindow-maxFailedLoginsPerUser*time.Minute {
+		t.Errorf("Expected to wait until the first failure leaves the window, got %v", wait)
+	}
+
+	// Other users from the address go on until it has failed too often itself.
+	other, _ := loginThrottleKeys(req, "8")
+	if wait := throttle.wait(other, ip); wait != 0 {
+		t.Errorf("Expected another user let through, got a wait of %v", wait)
+	}
+	for range maxFailedLoginsPerIP - maxFailedLoginsPerUser {
+		_, other := loginThrottleKeys(req, "9")
+		throttle.fail(other, ip)
+	}
+	if wait := throttle.wait(other, ip); wait == 0 {
+		t.Errorf("Expected the address turned away")
+	}
+
+	now = now.Add(failedLoginWindow)
+	if wait := throttle.wait(user, ip); wait != 0 {
+		t.Errorf("Expected sign-ins let through after the window, got a wait of %v", wait)
+	}
+	if len(throttle.failures) != 0 {
+		t.Errorf("Expected old failures forgotten, got %v", throttle.failures)
+	}
+
+	// Getting the password right clears the user's failures.
+	throttle.fail(user, ip)
+	throttle.succeed(user)
+	if _, exists := throttle.failures[user.key]; exists {
+		t.Errorf("Expected the user's failures cleared")
+	}
+}
+
+// Once a user id failed too often even the right password is turned away, before it's checked.
+func TestAuthorizeHandlerThrottlesFailedLogins(t *testing.T) {
+	auth := newTestMockAuthenticator(t)
+	userID, password, err := auth.CreateUser(context.Background(), "Ken Cat", entities.RoleManager, "kc@example.com", "2024-01-01")
+	if err != nil {
+		t.Fatalf("Error creating a user: %v", err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating a key: %v", err)
+	}
+	const redirectURI = "http://tes.example.com/login/callback"
+	clients := map[string]OIDCClient{"tes": {ID: "tes", RedirectURIs: []string{redirectURI}}}
+	provider := NewOIDCProvider("http://auth.example.com", auth, clients, key)
+
+	challenge := sha256.Sum256([]byte(strings.Repeat("v", 43)))
+	login := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"tes"},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+		"user_id":               {strconv.Itoa(userID)},
+		"password":              {password + "0"},
+	}
+	signIn := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/oidc/authorize", strings.NewReader(login.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		provider.AuthorizeHandler(w, req)
+		return w
+	}
+
+	for range maxFailedLoginsPerUser {
+		if w := signIn(); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a wrong password to be refused, got %d", w.Code)
+		}
+	}
+	login.Set("password", password)
+	if w := signIn(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the sign-in turned away, got %d", w.Code)
+	}
+
+	provider.logins.now = func() time.Time { return time.Now().Add(failedLoginWindow) }
+	if w := signIn(); w.Code != http.StatusFound {
+		t.Errorf("Expected the sign-in let through after the window, got %d", w.Code)
+	}
+}
+
+// Clients form-urlencode their id and secret before basic auth, a secret with reserved characters
+// still has to match.
+func TestTokenHandlerUnescapesBasicAuth(t *testing.T) {
+	const secret = "a+b%2F&c/d= e"
+	hash, err := hashPassword(secret, testPasswordParams)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating a key: %v", err)
+	}
+	clients := map[string]OIDCClient{"tes app": {ID: "tes app", SecretHash: hash, RedirectURIs: []string{"http://tes.example.com/"}}}
+	provider := NewOIDCProvider("http://auth.example.com", newTestMockAuthenticator(t), clients, key)
+
+	exchange := func(clientID, secret string) *httptest.ResponseRecorder {
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {"unknown"}, "redirect_uri": {"http://tes.example.com/"}}
+		req := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+		w := httptest.NewRecorder()
+		provider.TokenHandler(w, req)
+		return w
+	}
+
+	// The client got through, only the made up code is refused.
+	if w := exchange("tes app", secret); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("Expected the client authenticated, got %d %s", w.Code, w.Body)
+	}
+	if w := exchange("tes app", secret+"!"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid_client") {
+		t.Errorf("Expected a wrong secret to be refused, got %d %s", w.Code, w.Body)
+	}
+}
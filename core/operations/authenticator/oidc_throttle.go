@@ -0,0 +1,109 @@
+package authenticator
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How many failed sign-ins are let through in failedLoginWindow before the rest are turned away.
+// An address gets more than a user id, a few people may share it.
+const (
+	maxFailedLoginsPerUser = 5
+	maxFailedLoginsPerIP   = 20
+	failedLoginWindow      = 15 * time.Minute
+)
+
+// Counting the failed sign-ins of every user id and address, so passwords can't be guessed at
+// the speed the login page answers. Kept in memory, a restart forgets them.
+type loginThrottle struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time // By throttleKey, oldest first, none older than the window.
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{failures: make(map[string][]time.Time), now: time.Now}
+}
+
+// What a sign-in is counted under, with how many failures each allows.
+type throttleKey struct {
+	key   string
+	limit int
+}
+
+// The user id as typed, valid or not, and the address the request came from. X-Forwarded-For
+// isn't looked at, anyone can set it.
+func loginThrottleKeys(r *http.Request, userID string) (user, ip throttleKey) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return throttleKey{key: "user:" + userID, limit: maxFailedLoginsPerUser},
+		throttleKey{key: "ip:" + host, limit: maxFailedLoginsPerIP}
+}
+
+// How long until another sign-in is let through, 0 when it is now.
+func (t *loginThrottle) wait(keys ...throttleKey) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var wait time.Duration
+	for _, k := range keys {
+		failures := t.recent(k.key, now)
+		if len(failures) >= k.limit {
+			// Free again once enough of them have left the window.
+			wait = max(wait, failures[len(failures)-k.limit].Add(failedLoginWindow).Sub(now))
+		}
+	}
+
+	return wait
+}
+
+func (t *loginThrottle) fail(keys ...throttleKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for _, k := range keys {
+		t.failures[k.key] = append(t.recent(k.key, now), now)
+	}
+
+	// Forgetting the keys nobody has failed with for a while.
+	if now.Sub(t.lastSweep) >= failedLoginWindow {
+		for key := range t.failures {
+			t.recent(key, now)
+		}
+		t.lastSweep = now
+	}
+}
+
+// A user who got their password right starts over, their address doesn't.
+func (t *loginThrottle) succeed(user throttleKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.failures, user.key)
+}
+
+// The failures of the key within the window, dropping the older ones. Must be called with the
+// lock held.
+func (t *loginThrottle) recent(key string, now time.Time) []time.Time {
+	failures := t.failures[key]
+	start := 0
+	for start < len(failures) && now.Sub(failures[start]) >= failedLoginWindow {
+		start++
+	}
+	if start == len(failures) {
+		delete(t.failures, key)
+		return nil
+	}
+	failures = failures[start:]
+	t.failures[key] = failures
+
+	return failures
+}
@@ -0,0 +1,122 @@
+package authenticator
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Settings of argon2id. They're encoded in every hash, so changing them only affects new hashes
+// and the old ones are upgraded on the next successful login.
+type passwordParams struct {
+	memory      uint32 // KiB.
+	iterations  uint32
+	parallelism uint8
+	saltLength  uint32
+	keyLength   uint32
+}
+
+// The second recommended option of RFC 9106, for machines with less memory to spare.
+var defaultPasswordParams = passwordParams{memory: 64 * 1024, iterations: 3, parallelism: 4, saltLength: 16, keyLength: 32}
+
+// How every hash starts, the rest is "v=19$m=65536,t=3,p=4$<salt>$<key>" in unpadded base64.
+const argon2idPrefix = "$argon2id$"
+
+// Hashing the password with a fresh salt into the PHC string format.
+func hashPassword(password string, params passwordParams) (string, error) {
+	salt := make([]byte, params.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating a salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, params.keyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, params.memory, params.iterations,
+		params.parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Checking a password against its hash in constant time. rehash reports whether the hash was made
+// with other settings than current, so it should be replaced once the password is known good.
+func verifyPassword(encoded, password string, current passwordParams) (ok, rehash bool, err error) {
+	params, salt, key, err := decodePasswordHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, params.keyLength)
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return false, false, nil
+	}
+
+	return true, params != current, nil
+}
+
+func decodePasswordHash(encoded string) (passwordParams, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || !isPasswordHash(encoded) {
+		return passwordParams{}, nil, nil, fmt.Errorf("%w: not an argon2id hash", ErrInvalidPasswordHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return passwordParams{}, nil, nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidPasswordHash, parts[2])
+	}
+	var params passwordParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return passwordParams{}, nil, nil, fmt.Errorf("%w: bad parameters %q", ErrInvalidPasswordHash, parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return passwordParams{}, nil, nil, fmt.Errorf("%w: bad salt: %w", ErrInvalidPasswordHash, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return passwordParams{}, nil, nil, fmt.Errorf("%w: bad key", ErrInvalidPasswordHash)
+	}
+	params.saltLength, params.keyLength = uint32(len(salt)), uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// Plaintext passwords from before hashing don't look like this.
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, argon2idPrefix)
+}
+
+// Hashing every plaintext password left in a passwords yaml, for files from before passwords were
+// hashed. Returns how many were hashed. Entries already hashed are left as they are, so running it
+// twice does no harm.
+func MigratePasswordsYaml(passwordYamlPath string) (int, error) {
+	passwords, err := loadPasswordsFromYaml(passwordYamlPath)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for userID, stored := range passwords.passwordsMap {
+		if isPasswordHash(stored) {
+			continue
+		}
+		hash, err := hashPassword(stored, passwords.params)
+		if err != nil {
+			return 0, fmt.Errorf("error hashing the password of user %d: %w", userID, err)
+		}
+		passwords.passwordsMap[userID] = hash
+		migrated++
+	}
+	if migrated == 0 {
+		return 0, nil
+	}
+
+	if err := passwords.savePasswordsToYaml(); err != nil {
+		return 0, err
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,78 @@
+package authenticator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Cheap settings so the tests don't spend their time hashing.
+var testPasswordParams = passwordParams{memory: 64, iterations: 1, parallelism: 1, saltLength: 16, keyLength: 32}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("s3cret", testPasswordParams)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Expected the settings encoded in the hash, got %q", hash)
+	}
+	if again, _ := hashPassword("s3cret", testPasswordParams); again == hash {
+		t.Errorf("Expected a fresh salt for every hash")
+	}
+
+	if ok, rehash, err := verifyPassword(hash, "s3cret", testPasswordParams); !ok || rehash || err != nil {
+		t.Errorf("Expected the password to match without a rehash, got %v, %v, %v", ok, rehash, err)
+	}
+	if ok, _, err := verifyPassword(hash, "s3cret!", testPasswordParams); ok || err != nil {
+		t.Errorf("Expected a wrong password not to match, got %v, %v", ok, err)
+	}
+
+	stronger := testPasswordParams
+	stronger.iterations = 2
+	if ok, rehash, _ := verifyPassword(hash, "s3cret", stronger); !ok || !rehash {
+		t.Errorf("Expected a rehash once the settings changed, got %v, %v", ok, rehash)
+	}
+
+	if _, _, err := verifyPassword("2611534e60ffcb3f42cda8106ec1ec69", "2611534e60ffcb3f42cda8106ec1ec69", testPasswordParams); !errors.Is(err, ErrInvalidPasswordHash) {
+		t.Errorf("Expected plaintext to be refused, got %v", err)
+	}
+}
+
+func TestMigratePasswordsYaml(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords.yaml")
+	if err := os.WriteFile(path, []byte("1: 2611534e60ffcb3f42cda8106ec1ec69\n"), 0o600); err != nil {
+		t.Fatalf("Error writing %s: %v", path, err)
+	}
+
+	if migrated, err := MigratePasswordsYaml(path); err != nil || migrated != 1 {
+		t.Fatalf("Expected 1 password migrated, got %d (%v)", migrated, err)
+	}
+	if migrated, err := MigratePasswordsYaml(path); err != nil || migrated != 0 {
+		t.Errorf("Expected nothing left to migrate, got %d (%v)", migrated, err)
+	}
+
+	passwords, err := loadPasswordsFromYaml(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ok, _, err := verifyPassword(passwords.passwordsMap[1], "2611534e60ffcb3f42cda8106ec1ec69", defaultPasswordParams); !ok {
+		t.Errorf("Expected the old password to still work, got %v", err)
+	}
+
+	// A new password is handed out once and only its hash is kept.
+	passwords.params = testPasswordParams
+	password, err := passwords.generatePasswordForYaml(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), password) {
+		t.Errorf("Expected the new password not to be stored")
+	}
+	if ok, _, _ := verifyPassword(passwords.passwordsMap[2], password, testPasswordParams); !ok {
+		t.Errorf("Expected the new password to match its hash")
+	}
+}
@@ -0,0 +1,288 @@
+package authenticator
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Users and their password hashes, owned by the authenticator. Ids come from the sequence, so a
+// deleted user's id is never handed out again. Emails are unique ignoring case.
+const authSchemaSQL = `
+CREATE TABLE IF NOT EXISTS auth_users (
+	user_id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	role VARCHAR(20) NOT NULL,
+	password_hash TEXT NOT NULL,
+	joined_at TEXT NOT NULL DEFAULT '',
+	left_at TEXT NOT NULL DEFAULT '',
+	last_updated TIMESTAMP NOT NULL,
+	version BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS auth_users_email_key ON auth_users (lower(email));
+`
+
+// The production authenticator, keeping users in Postgres.
+type PostgresAuthenticator struct {
+	db     *sql.DB
+	params passwordParams // What new hashes are made with.
+	mu     sync.Mutex
+	events events.Publisher // Told about every user created, updated or deleted.
+}
+
+// Creates the tables it needs if they aren't there yet.
+func NewPostgresAuthenticator(db *sql.DB) (*PostgresAuthenticator, error) {
+	if _, err := db.Exec(authSchemaSQL); err != nil {
+		return nil, fmt.Errorf("failed to create the authenticator's tables: %w", err)
+	}
+
+	return &PostgresAuthenticator{db: db, params: defaultPasswordParams, events: events.Discard{}}, nil
+}
+
+// A publisher that can write events in the transaction of the change they describe, e.g. to an
+// outbox in the same database. They're then kept exactly when the change is.
+type TxPublisher interface {
+	events.Publisher
+	PublishTx(tx *sql.Tx, evs ...events.Event) error
+}
+
+// Sets where user events go. Until this is called they're dropped. A TxPublisher gets them in
+// the transaction of the change, any other publisher once it's committed.
+func (a *PostgresAuthenticator) SetPublisher(publisher events.Publisher) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.events = publisher
+}
+
+// Committing a change along with its events. Reports whether the change was committed: with a
+// publisher that isn't a TxPublisher, it can be while the events fail.
+func (a *PostgresAuthenticator) commit(tx *sql.Tx, evs ...events.Event) (bool, error) {
+	a.mu.Lock()
+	publisher := a.events
+	a.mu.Unlock()
+
+	if txPublisher, ok := publisher.(TxPublisher); ok {
+		if err := txPublisher.PublishTx(tx, evs...); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, publisher.Publish(evs...)
+}
+
+const authUserColumns = `user_id, name, email, role, joined_at, left_at, to_char(last_updated, 'YYYY-MM-DD HH24:MI:SS'), version`
+
+func scanAuthUser(row interface{ Scan(...any) error }) (entities.User, error) {
+	user := entities.User{Balance: entities.NewMoney(0)}
+	err := row.Scan(&user.UserID, &user.Name, &user.Email, &user.Role, &user.JoinedAt, &user.LeftAt, &user.LastUpdated, &user.Version)
+
+	return user, err
+}
+
+// Creating a user with a generated password. Returns the password, which isn't stored anywhere
+// and can't be had again.
+func (a *PostgresAuthenticator) CreateUser(ctx context.Context, name, role, email, joinedAt string) (int, string, error) {
+	password, err := randomPassword()
+	if err != nil {
+		return 0, "", err
+	}
+	hash, err := hashPassword(password, a.params)
+	if err != nil {
+		return 0, "", fmt.Errorf("error hashing the new password: %w", err)
+	}
+
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Versions follow the clock like the mock's, user ids are never reused so that's enough.
+	now := time.Now()
+	query := `
+	INSERT INTO auth_users (name, email, role, password_hash, joined_at, left_at, last_updated, version)
+	VALUES ($1, $2, $3, $4, $5, '', $6, $7)
+	ON CONFLICT ((lower(email))) DO NOTHING
+	RETURNING ` + authUserColumns
+	user, err := scanAuthUser(tx.QueryRowContext(ctx, query, name, email, role, hash, joinedAt, now.Format(time.DateTime), now.UnixMilli()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", fmt.Errorf("email %s: %w", email, ErrDuplicateEmail)
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("error creating user %s, %s: %w", name, role, err)
+	}
+
+	// Letting the other services know about the new user.
+	committed, err := a.commit(tx, events.UserCreated{User: user})
+	if !committed {
+		return 0, "", fmt.Errorf("error creating user %s, %s: %w", name, role, err)
+	}
+	if err != nil {
+		return user.UserID, password, fmt.Errorf("created user %d but failed to publish it: %w", user.UserID, err)
+	}
+
+	return user.UserID, password, nil
+}
+
+// Creating an admin to manage the others with, unless there's one already. A fresh auth_users
+// has no one who may call /create_user. Returns 0 and no password when an admin exists.
+func (a *PostgresAuthenticator) BootstrapAdmin(ctx context.Context, name, email string) (int, string, error) {
+	var exists bool
+	err := a.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM auth_users WHERE role = $1)`, entities.RoleAdmin).Scan(&exists)
+	if err != nil {
+		return 0, "", fmt.Errorf("error looking for an admin: %w", err)
+	}
+	if exists {
+		return 0, "", nil
+	}
+
+	return a.CreateUser(ctx, name, entities.RoleAdmin, email, time.Now().Format(time.DateOnly))
+}
+
+func (a *PostgresAuthenticator) GetUser(ctx context.Context, userID int) (entities.User, error) {
+	user, err := scanAuthUser(a.db.QueryRowContext(ctx, `SELECT `+authUserColumns+` FROM auth_users WHERE user_id = $1`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.User{}, fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
+	}
+	if err != nil {
+		return entities.User{}, fmt.Errorf("error getting user %d: %w", userID, err)
+	}
+
+	return user, nil
+}
+
+func (a *PostgresAuthenticator) UpdateUser(ctx context.Context, userID int, name, email, role, leftAt string) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldRole string
+	err = tx.QueryRowContext(ctx, `SELECT role FROM auth_users WHERE user_id = $1 FOR UPDATE`, userID).Scan(&oldRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("error getting user %d: %w", userID, err)
+	}
+	var taken bool
+	query := `SELECT EXISTS (SELECT 1 FROM auth_users WHERE lower(email) = lower($1) AND user_id <> $2)`
+	if err := tx.QueryRowContext(ctx, query, email, userID).Scan(&taken); err != nil {
+		return fmt.Errorf("error checking email %s: %w", email, err)
+	}
+	if taken {
+		return fmt.Errorf("email %s: %w", email, ErrDuplicateEmail)
+	}
+
+	now := time.Now()
+	query = `
+	UPDATE auth_users
+	SET name = $1, email = $2, role = $3, left_at = $4, last_updated = $5, version = GREATEST(version + 1, $6)
+	WHERE user_id = $7
+	RETURNING ` + authUserColumns
+	user, err := scanAuthUser(tx.QueryRowContext(ctx, query, name, email, role, leftAt, now.Format(time.DateTime), now.UnixMilli(), userID))
+	// The check above doesn't see a user taking the email at the same time, the index does.
+	if isUniqueViolation(err) {
+		return fmt.Errorf("email %s: %w", email, ErrDuplicateEmail)
+	}
+	if err != nil {
+		return fmt.Errorf("error updating user %d: %w", userID, err)
+	}
+	changes := []events.Event{events.UserUpdated{User: user}}
+	if user.Role != oldRole {
+		changes = append(changes, events.UserRoleChanged{UserID: user.UserID, OldRole: oldRole, NewRole: user.Role, Version: user.Version})
+	}
+	committed, err := a.commit(tx, changes...)
+	if !committed {
+		return fmt.Errorf("error updating user %d: %w", userID, err)
+	}
+	if err != nil {
+		return fmt.Errorf("updated user %d but failed to publish it: %w", user.UserID, err)
+	}
+
+	return nil
+}
+
+// Postgres' unique_violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// Deleting the user along with their password hash.
+func (a *PostgresAuthenticator) DeleteUser(ctx context.Context, userID int) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int64
+	query := `DELETE FROM auth_users WHERE user_id = $1 RETURNING GREATEST(version + 1, $2)`
+	err = tx.QueryRowContext(ctx, query, userID, time.Now().UnixMilli()).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting user %d: %w", userID, err)
+	}
+
+	committed, err := a.commit(tx, events.UserDeleted{UserID: userID, Version: version})
+	if !committed {
+		return fmt.Errorf("error deleting user %d: %w", userID, err)
+	}
+	if err != nil {
+		return fmt.Errorf("deleted user %d but failed to publish it: %w", userID, err)
+	}
+
+	return nil
+}
+
+// Checking a password against the stored hash. Hashes made with outdated settings are replaced
+// while the password is at hand.
+func (a *PostgresAuthenticator) ValidatePassword(ctx context.Context, userID int, password string) (bool, error) {
+	var stored string
+	err := a.db.QueryRowContext(ctx, `SELECT password_hash FROM auth_users WHERE user_id = $1`, userID).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get the password of user %d: %w", userID, err)
+	}
+	ok, rehash, err := verifyPassword(stored, password, a.params)
+	if err != nil {
+		return false, fmt.Errorf("the password of user %d can't be checked: %w", userID, err)
+	}
+
+	if ok && rehash {
+		hash, err := hashPassword(password, a.params)
+		if err == nil {
+			// Only replacing the hash that was checked, a password changed meanwhile stays.
+			_, err = a.db.ExecContext(ctx, `UPDATE auth_users SET password_hash = $1 WHERE user_id = $2 AND password_hash = $3`,
+				hash, userID, stored)
+		}
+		if err != nil {
+			log.Printf("Authenticator: failed to rehash the password of user %d: %v\n", userID, err)
+		}
+	}
+
+	return ok, nil
+}
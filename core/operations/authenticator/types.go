@@ -2,32 +2,51 @@ package authenticator
 
 import (
 	"aTES/core/entities"
+	"aTES/core/events"
+	"context"
+	"errors"
 	"sync"
 )
 
-// This defines the service handling user related operations.
+// This defines the service handling user related operations. Every implementation has to pass
+// the authenticatortest suite.
 type Authenticator interface {
-	CreateUser(name, role, email, joinedAt string) (int, error) // Also generates a password and stores it in the dedicated password repo.
-	GetUser(userID int) (entities.User, error)
-	UpdateUser(userID int, name, email, role, leftAt string) error
-	DeleteUser(userID int) error
-	Validatepassword(userID int, password string) bool
+	CreateUser(ctx context.Context, name, role, email, joinedAt string) (int, string, error) // Also generates a password, returned once, and stores its hash in the dedicated password repo.
+	GetUser(ctx context.Context, userID int) (entities.User, error)
+	UpdateUser(ctx context.Context, userID int, name, email, role, leftAt string) error
+	DeleteUser(ctx context.Context, userID int) error
+	ValidatePassword(ctx context.Context, userID int, password string) (bool, error) // A wrong password or an unknown user is false with no error.
 }
 
+var (
+	ErrUserNotFound   = errors.New("the user doesn't exist")
+	ErrDuplicateEmail = errors.New("the email is already taken")
+)
+
+// Both backends are Authenticators.
+var (
+	_ Authenticator = (*MockAuthenticator)(nil)
+	_ Authenticator = (*PostgresAuthenticator)(nil)
+)
+
 type passwordYaml struct {
 	location     string         // Path to the actual yaml file.
-	passwordsMap map[int]string `yaml:"passwords"`
+	passwordsMap map[int]string `yaml:"passwords"` // Argon2id hashes, see hashPassword.
+	params       passwordParams // What new hashes are made with.
 }
 
 type usersYaml struct {
-	location string                // Path to the actual yaml file.
-	usersMap map[int]entities.User `yaml:"users"`
+	location   string                // Path to the actual yaml file.
+	usersMap   map[int]entities.User `yaml:"users"`
+	nextUserID int                   `yaml:"next_user_id"` // Ids aren't handed out twice, even after a deletion.
 }
 
 type MockAuthenticator struct {
-	users     *usersYaml
-	passwords *passwordYaml // The yaml file is loaded here for fast drawing.
-	mu        sync.Mutex
+	users       *usersYaml
+	passwords   *passwordYaml // The yaml file is loaded here for fast drawing.
+	mu          sync.Mutex
+	events      events.Publisher // Told about every user created, updated or deleted.
+	lastVersion int64            // The last user version handed out.
 }
 
 // type passwordRepo interface {
@@ -0,0 +1,27 @@
+package rbac
+
+import (
+	"aTES/core/httpjson"
+	"net/http"
+)
+
+// Tells the caller's role from the request, or why it can't.
+type RoleFunc func(r *http.Request) (string, error)
+
+// Wraps a route so only callers whose role has the permission get through. Callers who can't be
+// identified get a 401, the others without the permission a 403, both as { "error": <message> }.
+func (p *Policy) Require(permission Permission, roleOf RoleFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, err := roleOf(r)
+		if err != nil {
+			httpjson.Error(w, http.StatusUnauthorized, "Unauthorised: %v", err)
+			return
+		}
+		if !p.Allows(role, permission) {
+			httpjson.Error(w, http.StatusForbidden, "Forbidden: %s is required", permission)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,102 @@
+// Role based access control shared by the services: which role holds which permission comes
+// from a yaml policy, so the rules are written down once.
+package rbac
+
+import (
+	"aTES/core/entities"
+	_ "embed"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Permission string
+
+const (
+	TasksCreate       Permission = "tasks:create"        // Adding tasks.
+	TasksShuffle      Permission = "tasks:shuffle"       // Reassigning every open task.
+	TasksReadAll      Permission = "tasks:read_all"      // Anyone's tasks, not just one's own.
+	TasksHistory      Permission = "tasks:history"       // The history of any task, not just of those one has or had.
+	TasksCancel       Permission = "tasks:cancel"        // Calling off open tasks.
+	TasksAssignable   Permission = "tasks:assignable"    // Having tasks land on one when they're created or shuffled.
+	AccountingReadAll Permission = "accounting:read_all" // Anyone's accounts and the company wide figures, not just one's own.
+	UsersManage       Permission = "users:manage"        // Creating, changing and deleting users.
+	EventsManage      Permission = "events:manage"       // Dead letters and rewinding subscribers.
+	WebhooksManage    Permission = "webhooks:manage"     // Webhook subscriptions and their delivery logs.
+	AnalyticsRead     Permission = "analytics:read"      // The analytics service.
+)
+
+// Every permission a policy may hand out, anything else in a policy is a typo.
+var Permissions = []Permission{TasksCreate, TasksShuffle, TasksReadAll, TasksHistory, TasksCancel, TasksAssignable,
+	AccountingReadAll, UsersManage, EventsManage, WebhooksManage, AnalyticsRead}
+
+// The roles a policy may mention, the ones users can hold.
+var Roles = []string{entities.RoleAdmin, entities.RoleManager, entities.RoleAccountant, entities.RoleWorker}
+
+//go:embed policy.yaml
+var defaultPolicy []byte
+
+type Policy struct {
+	roles map[string]map[Permission]bool
+}
+
+// The policy in policy.yaml, built into the binary.
+var Default = sync.OnceValue(func() *Policy {
+	policy, err := ParsePolicy(defaultPolicy)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded rbac policy: %v", err))
+	}
+
+	return policy
+})
+
+// Loads a policy from a yaml file shaped like policy.yaml. Without a path it's the default one.
+func LoadPolicy(policyYamlPath string) (*Policy, error) {
+	if policyYamlPath == "" {
+		return Default(), nil
+	}
+
+	data, err := os.ReadFile(policyYamlPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading rbac policy %s: %w", policyYamlPath, err)
+	}
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rbac policy %s: %w", policyYamlPath, err)
+	}
+
+	return policy, nil
+}
+
+func ParsePolicy(data []byte) (*Policy, error) {
+	var file struct {
+		Roles map[string][]Permission `yaml:"roles"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error while parsing the policy: %w", err)
+	}
+
+	policy := &Policy{roles: make(map[string]map[Permission]bool, len(file.Roles))}
+	for role, permissions := range file.Roles {
+		if !slices.Contains(Roles, role) {
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		policy.roles[role] = make(map[Permission]bool, len(permissions))
+		for _, permission := range permissions {
+			if !slices.Contains(Permissions, permission) {
+				return nil, fmt.Errorf("role %s has unknown permission %q", role, permission)
+			}
+			policy.roles[role][permission] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// Whether users holding the role have the permission.
+func (p *Policy) Allows(role string, permission Permission) bool {
+	return p.roles[role][permission]
+}
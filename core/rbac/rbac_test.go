@@ -0,0 +1,101 @@
+package rbac
+
+import (
+	"aTES/core/entities"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	policy := Default()
+
+	cases := []struct {
+		role       string
+		permission Permission
+		allowed    bool
+	}{
+		{entities.RoleAdmin, UsersManage, true},
+		{entities.RoleAdmin, AccountingReadAll, true},
+		{entities.RoleManager, TasksShuffle, true},
+		{entities.RoleManager, AccountingReadAll, false},
+		{entities.RoleManager, UsersManage, false},
+		{entities.RoleAccountant, AccountingReadAll, true},
+		{entities.RoleAccountant, TasksShuffle, false},
+		{entities.RoleAccountant, TasksReadAll, true},
+		{entities.RoleAccountant, TasksHistory, false},
+		{entities.RoleManager, TasksCancel, true},
+		{entities.RoleManager, TasksAssignable, false},
+		{entities.RoleWorker, TasksAssignable, true},
+		{entities.RoleWorker, TasksCancel, false},
+		{entities.RoleWorker, TasksCreate, true},
+		{entities.RoleWorker, TasksShuffle, false},
+		{"", TasksCreate, false},
+		{"intern", TasksCreate, false},
+	}
+	for _, c := range cases {
+		if allowed := policy.Allows(c.role, c.permission); allowed != c.allowed {
+			t.Errorf("%q with %s: expected %v, got %v", c.role, c.permission, c.allowed, allowed)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	if policy, err := LoadPolicy(""); err != nil || policy != Default() {
+		t.Errorf("Expected the default policy without a path, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("roles:\n  accountant: [accounting:read_all, tasks:shuffle]\n"), 0o600); err != nil {
+		t.Fatalf("Error writing %s: %v", path, err)
+	}
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !policy.Allows(entities.RoleAccountant, TasksShuffle) || policy.Allows(entities.RoleAdmin, UsersManage) {
+		t.Errorf("Expected only what the file grants")
+	}
+
+	for _, broken := range []string{
+		"roles:\n  intern: [tasks:create]\n",
+		"roles:\n  worker: [tasks:delete]\n",
+		"roles: [admin]\n",
+	} {
+		if _, err := ParsePolicy([]byte(broken)); err == nil {
+			t.Errorf("Expected %q to be refused", broken)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	roleOf := func(r *http.Request) (string, error) {
+		role := r.Header.Get("X-Role")
+		if role == "" {
+			return "", errors.New("no role")
+		}
+		return role, nil
+	}
+	handler := Default().Require(TasksShuffle, roleOf, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for role, expected := range map[string]int{
+		"":                      http.StatusUnauthorized,
+		entities.RoleWorker:     http.StatusForbidden,
+		entities.RoleManager:    http.StatusNoContent,
+		entities.RoleAdmin:      http.StatusNoContent,
+		entities.RoleAccountant: http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/tasks/shuffle", nil)
+		req.Header.Set("X-Role", role)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != expected {
+			t.Errorf("%q: expected %d, got %d", role, expected, w.Code)
+		}
+	}
+}
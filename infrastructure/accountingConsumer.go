@@ -0,0 +1,94 @@
+package infrastructure
+
+import (
+	"aTES/core/events"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// The subscriber the ledger's postings for tasks run under.
+const accountingSubscriber = "accounting"
+
+// Posting the money of task events to the ledger: an assignment fee for every TaskAssigned that
+// carries one, a reward for every TaskCompleted. Each posting and its TransactionApplied are
+// written with the event marked processed, so a redelivered event never charges or pays twice.
+// Up to concurrency tasks are booked at once, the events of one task in order.
+func NewAccountingConsumer(db *sql.DB, concurrency int) *Consumer {
+	consumer := NewConsumer(db, accountingSubscriber, concurrency)
+
+	consumer.Handle(events.TaskAssignedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		assigned := event.(events.TaskAssigned)
+		// Tasks moved by hand aren't charged for.
+		if assigned.Fee.IsZero() {
+			return nil
+		}
+		task, err := GetTask(tx, assigned.TaskID)
+		if err != nil {
+			return err
+		}
+		entryID, err := PostAssignmentCharge(tx, assigned.To, task)
+		if err != nil {
+			return fmt.Errorf("failed to charge user %d for task %d: %w", assigned.To, assigned.TaskID, err)
+		}
+		return publishTransaction(tx, entryID)
+	})
+	consumer.Handle(events.TaskCompletedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		completed := event.(events.TaskCompleted)
+		task, err := GetTask(tx, completed.TaskID)
+		if err != nil {
+			return err
+		}
+		entryID, err := PostCompletionReward(tx, completed.CompletedBy, task)
+		if err != nil {
+			return fmt.Errorf("failed to reward user %d for task %d: %w", completed.CompletedBy, completed.TaskID, err)
+		}
+		return publishTransaction(tx, entryID)
+	})
+
+	return consumer
+}
+
+func publishTransaction(tx *sql.Tx, entryID int) error {
+	applied, err := transactionApplied(tx, entryID)
+	if err != nil {
+		return err
+	}
+
+	return writeOutbox(tx, tesProducer, []events.Event{applied})
+}
+
+// Task events from before the accounting consumer were booked when they happened. The first
+// time it's set up they're all marked processed for it, so it only books what comes after,
+// however late those events reach stored_events.
+func migrateAccountingConsumer(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO event_subscriptions (subscriber, last_event_id, attempts) VALUES ($1, 0, 0) ON CONFLICT (subscriber) DO NOTHING`,
+		accountingSubscriber)
+	if err != nil {
+		return fmt.Errorf("failed to register subscriber %s: %w", accountingSubscriber, err)
+	}
+	if registered, err := result.RowsAffected(); err != nil || registered == 0 {
+		return err
+	}
+
+	query := `
+	INSERT INTO processed_events (consumer, event_id, processed_at)
+	SELECT $1, event_id, now() FROM outbox_messages WHERE event_name = ANY($2)
+	UNION
+	SELECT $1, payload->>'event_id', now() FROM stored_events WHERE name = ANY($2)
+	ON CONFLICT DO NOTHING
+	`
+	_, err = tx.Exec(query, accountingSubscriber, pq.Array([]string{events.TaskAssignedName, events.TaskCompletedName}))
+	if err != nil {
+		return fmt.Errorf("failed to mark the booked task events processed: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,300 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/httpjson"
+	"aTES/core/rbac"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Workers only get to see their own accounts, roles with accounting:read_all anyone's.
+func (h *HandlersGroup) canViewAccount(actor businesslogic.Actor, userID int) bool {
+	return actor.UserID == userID || actor.Can(rbac.AccountingReadAll)
+}
+
+// Routes (all GET):
+//
+//	/accounting?user_id=<id>                               - the user's balance and latest transactions.
+//	/accounting/transactions?user_id=<id>&from=&to=&page=&page_size=
+//	                                                       - a page of the user's transactions, newest first.
+//	/accounting/statement?user_id=<id>&month=<YYYY-MM>     - the user's monthly statement.
+//	/accounting/balances                                   - every worker's balance.
+//	/accounting/earnings?from=&to=                         - the company's earnings today and per day.
+//
+// user_id defaults to the caller, month to the current one. Date ranges are [from, to) and take
+// YYYY-MM-DD or YYYY-MM-DD HH:MM:SS. Workers only get their own accounts, roles with
+// accounting:read_all anyone's, plus the company wide routes.
+func (h *HandlersGroup) AccountingHandler(w http.ResponseWriter, r *http.Request) {
+	actor, err := actorFromRequest(r, h.resources.policy)
+	if err != nil {
+		httpjson.Error(w, http.StatusUnauthorized, "Unauthorised: %v", err)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/accounting":
+		h.getAccountOverview(w, r, actor)
+	case "/accounting/transactions":
+		h.getTransactions(w, r, actor)
+	case "/accounting/statement":
+		h.getStatement(w, r, actor)
+	case "/accounting/balances":
+		h.getWorkerBalances(w, actor)
+	case "/accounting/earnings":
+		h.getCompanyEarnings(w, r, actor)
+	default:
+		httpjson.Error(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+// A page of a list along with where it sits in the whole.
+type page[T any] struct {
+	Items    []T `json:"items"`
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+	Total    int `json:"total"`
+}
+
+// Reading user_id, defaulting to the caller.
+func accountUserID(r *http.Request, actor businesslogic.Actor, fieldErrors validationErrors) int {
+	userID := actor.UserID
+	if raw := r.URL.Query().Get("user_id"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			fieldErrors["user_id"] = "must be a positive integer"
+		}
+		userID = parsed
+	}
+
+	return userID
+}
+
+// Reading from and to. Both are optional, when both are given from must come first.
+func parseDateRange(r *http.Request, fieldErrors validationErrors) (time.Time, time.Time) {
+	query := r.URL.Query()
+	from, err := parseTimeParam(query.Get("from"))
+	if err != nil {
+		fieldErrors["from"] = err.Error()
+	}
+	to, err := parseTimeParam(query.Get("to"))
+	if err != nil {
+		fieldErrors["to"] = err.Error()
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		fieldErrors["to"] = "must be after from"
+	}
+
+	return from, to
+}
+
+// Reading page (from 1) and page_size (up to maxPageSize).
+func parsePage(r *http.Request, fieldErrors validationErrors) (int, int) {
+	query := r.URL.Query()
+	pageNumber, pageSize := 1, defaultPageSize
+
+	if raw := query.Get("page"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			fieldErrors["page"] = "must be a positive integer"
+		}
+		pageNumber = parsed
+	}
+	if raw := query.Get("page_size"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxPageSize {
+			fieldErrors["page_size"] = "must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+		pageSize = parsed
+	}
+	// The rows to skip have to fit in an int.
+	if pageNumber > 1 && pageSize > 0 && pageNumber-1 > math.MaxInt/pageSize {
+		fieldErrors["page"] = "is too large"
+	}
+
+	return pageNumber, pageSize
+}
+
+func (h *HandlersGroup) getAccountOverview(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	fieldErrors := validationErrors{}
+	userID := accountUserID(r, actor, fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if !h.canViewAccount(actor, userID) {
+		httpjson.Error(w, http.StatusForbidden, "Forbidden: you can only see your own account")
+		return
+	}
+
+	balance, err := GetUserBalance(h.resources.db, userID)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the balance: %v", err)
+		return
+	}
+	transactions, total, err := ListUserTransactions(h.resources.db, userID, time.Time{}, time.Time{}, defaultPageSize, 0)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the transactions: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, struct {
+		UserID       int                      `json:"user_id"`
+		Balance      entities.Money           `json:"balance"`
+		Transactions page[AccountTransaction] `json:"transactions"`
+	}{
+		UserID:       userID,
+		Balance:      balance,
+		Transactions: page[AccountTransaction]{Items: transactions, Page: 1, PageSize: defaultPageSize, Total: total},
+	})
+}
+
+func (h *HandlersGroup) getTransactions(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	fieldErrors := validationErrors{}
+	userID := accountUserID(r, actor, fieldErrors)
+	from, to := parseDateRange(r, fieldErrors)
+	pageNumber, pageSize := parsePage(r, fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+	if !h.canViewAccount(actor, userID) {
+		httpjson.Error(w, http.StatusForbidden, "Forbidden: you can only see your own transactions")
+		return
+	}
+
+	transactions, total, err := ListUserTransactions(h.resources.db, userID, from, to, pageSize, (pageNumber-1)*pageSize)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the transactions: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, page[AccountTransaction]{Items: transactions, Page: pageNumber, PageSize: pageSize, Total: total})
+}
+
+func (h *HandlersGroup) getStatement(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	fieldErrors := validationErrors{}
+	userID := accountUserID(r, actor, fieldErrors)
+
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().Format("2006-01")
+	}
+	if _, _, err := businesslogic.MonthRange(month, time.Local); err != nil {
+		fieldErrors["month"] = "expected YYYY-MM"
+	}
+
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if !h.canViewAccount(actor, userID) {
+		httpjson.Error(w, http.StatusForbidden, "Forbidden: you can only see your own statements")
+		return
+	}
+
+	record, err := GetMonthlyStatement(h.resources.db, h.resources.gormDB, userID, month)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		httpjson.Error(w, http.StatusNotFound, "No statement for user %d in %s", userID, month)
+		return
+	}
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the statement: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, record)
+}
+
+func (h *HandlersGroup) getWorkerBalances(w http.ResponseWriter, actor businesslogic.Actor) {
+	if !actor.Can(rbac.AccountingReadAll) {
+		httpjson.Error(w, http.StatusForbidden, "Forbidden: every balance takes %s", rbac.AccountingReadAll)
+		return
+	}
+
+	balances, err := ListWorkerBalances(h.resources.db)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the balances: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, balances)
+}
+
+// Without a range only today is reported. Days without any activity are left out.
+func (h *HandlersGroup) getCompanyEarnings(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	if !actor.Can(rbac.AccountingReadAll) {
+		httpjson.Error(w, http.StatusForbidden, "Forbidden: the company's earnings take %s", rbac.AccountingReadAll)
+		return
+	}
+
+	fieldErrors := validationErrors{}
+	from, to := parseDateRange(r, fieldErrors)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	today := businesslogic.BillingDay(time.Now())
+	if from.IsZero() {
+		from = today
+	}
+	if to.IsZero() {
+		to = today.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		writeValidationErrors(w, validationErrors{"from": "must be before the end of today when to isn't given"})
+		return
+	}
+
+	days, err := ListCompanyEarnings(h.resources.db, from, to)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the earnings: %v", err)
+		return
+	}
+	todays, err := ListCompanyEarnings(h.resources.db, today, today.AddDate(0, 0, 1))
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting today's earnings: %v", err)
+		return
+	}
+
+	summary := struct {
+		From  string          `json:"from"`
+		To    string          `json:"to"`
+		Today DailyEarnings   `json:"today"`
+		Days  []DailyEarnings `json:"days"`
+		Total entities.Money  `json:"total"`
+	}{
+		From:  from.Format(time.DateTime),
+		To:    to.Format(time.DateTime),
+		Today: DailyEarnings{Day: today.Format(time.DateOnly), Fees: entities.NewMoney(0), Rewards: entities.NewMoney(0), Earnings: entities.NewMoney(0)},
+		Days:  days,
+		Total: entities.NewMoney(0),
+	}
+	if len(todays) > 0 {
+		summary.Today = todays[0]
+	}
+	for _, day := range days {
+		summary.Total = summary.Total.Add(day.Earnings)
+	}
+
+	httpjson.Write(w, http.StatusOK, summary)
+}
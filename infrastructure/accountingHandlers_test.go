@@ -0,0 +1,119 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Callers without a token or the permission, and bad input, are turned away before the database
+// is touched.
+func TestAccountingHandlerRejectsBadRequests(t *testing.T) {
+	handlers := newTestHandlers(nil)
+	cases := []struct {
+		userID               int
+		role, method, target string
+		expected             int
+	}{
+		{0, "", http.MethodGet, "/accounting", http.StatusUnauthorized},
+		{7, entities.RoleWorker, http.MethodPost, "/accounting", http.StatusMethodNotAllowed},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/ledger", http.StatusNotFound},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting?user_id=abc", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting?user_id=8", http.StatusForbidden},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?user_id=8", http.StatusForbidden},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?page=0", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?page_size=0", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, fmt.Sprintf("/accounting/transactions?page_size=%d", maxPageSize+1), http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, fmt.Sprintf("/accounting/transactions?page=%d&page_size=2", math.MaxInt), http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?from=2024-06-02&to=2024-06-01", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?from=yesterday", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/statement?month=2024-13", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/statement?user_id=8", http.StatusForbidden},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/balances", http.StatusForbidden},
+		{1, entities.RoleManager, http.MethodGet, "/accounting/balances", http.StatusForbidden},
+		{7, entities.RoleWorker, http.MethodGet, "/accounting/earnings", http.StatusForbidden},
+		{2, entities.RoleAccountant, http.MethodGet, "/accounting/earnings?from=2024-06-02&to=2024-06-01", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := serveAs(t, handlers.AccountingHandler, c.userID, c.role, c.method, c.target, ""); w.Code != c.expected {
+			t.Errorf("%s %s as %q: expected %d, got %d (%s)", c.method, c.target, c.role, c.expected, w.Code, w.Body)
+		}
+	}
+
+	// Without a policy the default one applies.
+	withoutPolicy := NewHandlersGroup(nil, nil, handlers.resources.pricing, nil)
+	for _, target := range []string{"/accounting/balances", "/accounting/earnings"} {
+		if w := serveAs(t, withoutPolicy.AccountingHandler, 7, entities.RoleWorker, http.MethodGet, target, ""); w.Code != http.StatusForbidden {
+			t.Errorf("GET %s without a policy: expected %d, got %d (%s)", target, http.StatusForbidden, w.Code, w.Body)
+		}
+	}
+	w := serveAs(t, withoutPolicy.AccountingHandler, 2, entities.RoleAccountant, http.MethodGet, "/accounting/earnings?from=2024-06-02&to=2024-06-01", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an accountant let through without a policy, got %d (%s)", w.Code, w.Body)
+	}
+
+	// Every bad field is reported at once.
+	w = serveAs(t, handlers.AccountingHandler, 7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?page=0&page_size=0&from=x", "")
+	var body struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Fields) != 3 {
+		t.Errorf("Expected three fields reported, got %s (%v)", w.Body, err)
+	}
+}
+
+func TestAccountingHandlerPagesTransactions(t *testing.T) {
+	db := newTestDB(t)
+	day := time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local)
+	for i := range 5 {
+		postReward(t, db, 7, day.AddDate(0, 0, i), entities.NewMoney(int64(100*(i+1))))
+	}
+	postReward(t, db, 8, day, entities.NewMoney(100))
+	handlers := newTestHandlers(db)
+
+	cases := []struct {
+		userID int
+		role   string
+		target string
+		items  int
+		total  int
+	}{
+		{7, entities.RoleWorker, "/accounting/transactions?page=1&page_size=2", 2, 5},
+		{7, entities.RoleWorker, "/accounting/transactions?page=3&page_size=2", 1, 5},
+		{7, entities.RoleWorker, "/accounting/transactions?page=4&page_size=2", 0, 5},
+		{7, entities.RoleWorker, "/accounting/transactions?from=2024-06-02&to=2024-06-04", 2, 2},
+		{2, entities.RoleAccountant, "/accounting/transactions?user_id=8", 1, 1},
+	}
+	for _, c := range cases {
+		w := serveAs(t, handlers.AccountingHandler, c.userID, c.role, http.MethodGet, c.target, "")
+		var listed page[AccountTransaction]
+		if err := json.Unmarshal(w.Body.Bytes(), &listed); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%s: expected a page, got %d %s", c.target, w.Code, w.Body)
+		}
+		if len(listed.Items) != c.items || listed.Total != c.total {
+			t.Errorf("%s: expected %d of %d transactions, got %d of %d", c.target, c.items, c.total, len(listed.Items), listed.Total)
+		}
+	}
+
+	// Newest first, across pages.
+	w := serveAs(t, handlers.AccountingHandler, 7, entities.RoleWorker, http.MethodGet, "/accounting/transactions?page_size=5", "")
+	var listed page[AccountTransaction]
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	for i := 1; i < len(listed.Items); i++ {
+		if listed.Items[i].PostedAt > listed.Items[i-1].PostedAt {
+			t.Errorf("Expected newest first, got %s before %s", listed.Items[i-1].PostedAt, listed.Items[i].PostedAt)
+		}
+	}
+
+	w = serveAs(t, handlers.AccountingHandler, 7, entities.RoleWorker, http.MethodGet, "/accounting", "")
+	var overview struct {
+		Balance entities.Money `json:"balance"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &overview); w.Code != http.StatusOK || err != nil || overview.Balance != entities.NewMoney(1500) {
+		t.Errorf("Expected a balance of 15.00, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,52 @@
+package infrastructure
+
+import (
+	"aTES/core/events"
+	"aTES/core/operations/analytics"
+	"database/sql"
+	"fmt"
+)
+
+// The subscriber analytics reads the stored events under.
+const analyticsSubscriber = "analytics"
+
+// Filling the analytics read model from the task and transaction events TES stores. Up to
+// concurrency accounts are applied at once, the entries of one account in the order they were
+// posted.
+func NewAnalyticsConsumer(db *sql.DB, service *analytics.Analytics, concurrency int) *Consumer {
+	consumer := NewConsumer(db, analyticsSubscriber, concurrency)
+
+	consumer.Handle(events.TaskCreatedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		return service.ApplyTaskCreated(tx, event.(events.TaskCreated))
+	})
+	consumer.Handle(events.TransactionAppliedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		return service.ApplyTransaction(tx, event.(events.TransactionApplied))
+	})
+
+	return consumer
+}
+
+// Emptying the analytics read model and filling it again from every event, in one transaction.
+// The consumer's cursor is left where it is: the entries it handles again were applied by the
+// rebuild and are skipped. Returns how many events were replayed.
+func RebuildAnalytics(db *sql.DB, service *analytics.Analytics) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := service.Reset(tx); err != nil {
+		return 0, err
+	}
+	replayed, err := NewAnalyticsConsumer(db, service, 1).Rebuild(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the rebuilt analytics: %w", err)
+	}
+
+	return replayed, nil
+}
@@ -0,0 +1,110 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/operations/analytics"
+	"testing"
+	"time"
+)
+
+// The read model is built from the events alone, and a rebuild ends up with the same numbers.
+func TestAnalyticsConsumer(t *testing.T) {
+	db := newTestDB(t)
+	service, err := analytics.New(db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cents := entities.NewMoney
+	task := entities.Task{TaskID: 1, Description: "Feed the parrots", AssignedTo: 7, Status: string(businesslogic.StatusPending),
+		AssignFee: cents(1500), Price: cents(3000), CreationTime: "2024-06-01 09:00:00"}
+	storeEvents(t, db,
+		events.TransactionApplied{EntryID: 1, Kind: businesslogic.EntryAssignmentCharge, TaskID: 1, UserID: 7,
+			Amount: cents(-1500), PostedAt: "2024-06-01 09:00:00"},
+		events.TransactionApplied{EntryID: 2, Kind: businesslogic.EntryCompletionReward, TaskID: 1, UserID: 7,
+			Amount: cents(3000), PostedAt: "2024-06-01 12:00:00"},
+		// The task arriving after its reward still names it.
+		events.TaskCreated{Task: task},
+		events.TransactionApplied{EntryID: 3, Kind: businesslogic.EntryAssignmentCharge, TaskID: 2, UserID: 8,
+			Amount: cents(-1500), PostedAt: "2024-06-01 13:00:00"},
+		events.TransactionApplied{EntryID: 4, Kind: businesslogic.EntryPayout, UserID: 7,
+			Amount: cents(-1500), PostedAt: "2024-06-01 23:00:00"},
+	)
+
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	check := func(stage string) {
+		t.Helper()
+		days, err := service.Earnings(from, from.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(days) != 1 || days[0].Fees != cents(3000) || days[0].Rewards != cents(3000) || !days[0].Earnings.IsZero() {
+			t.Errorf("%s: expected 30.00 in fees and rewards, got %+v", stage, days)
+		}
+		if negative, err := service.NegativeWorkersNow(); err != nil || negative != 1 {
+			t.Errorf("%s: expected one worker in the red, got %d (%v)", stage, negative, err)
+		}
+		tasks, err := service.TopTasks(from, from.AddDate(0, 0, 1), analytics.PeriodDay)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(tasks) != 1 || tasks[0].Description != "Feed the parrots" || tasks[0].Reward != cents(3000) {
+			t.Errorf("%s: expected task 1 on top, got %+v", stage, tasks)
+		}
+	}
+
+	if _, err := NewAnalyticsConsumer(db, service, 2).Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("Consumed")
+
+	if replayed, err := RebuildAnalytics(db, service); err != nil || replayed != 5 {
+		t.Fatalf("Expected five events replayed, got %d (%v)", replayed, err)
+	}
+	check("Rebuilt")
+
+	// Reversing the reward takes the task off the top.
+	storeEvents(t, db, events.TransactionApplied{EntryID: 5, Kind: businesslogic.EntryReversal,
+		Reverses: businesslogic.EntryCompletionReward, TaskID: 1, UserID: 7, Amount: cents(-3000), PostedAt: "2024-06-02 09:00:00"})
+	if _, err := NewAnalyticsConsumer(db, service, 2).Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tasks, err := service.TopTasks(from, from.AddDate(0, 0, 1), analytics.PeriodDay); err != nil || len(tasks) != 0 {
+		t.Errorf("Expected no top task after the reversal, got %+v (%v)", tasks, err)
+	}
+}
+
+// A payout posted at the end of a day but applied after the next day's charge counts on its own day.
+func TestAnalyticsConsumerBackdatedPayout(t *testing.T) {
+	db := newTestDB(t)
+	service, err := analytics.New(db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cents := entities.NewMoney
+	storeEvents(t, db,
+		events.TransactionApplied{EntryID: 1, Kind: businesslogic.EntryCompletionReward, TaskID: 1, UserID: 7,
+			Amount: cents(3000), PostedAt: "2024-06-01 12:00:00"},
+		events.TransactionApplied{EntryID: 2, Kind: businesslogic.EntryAssignmentCharge, TaskID: 2, UserID: 7,
+			Amount: cents(-1500), PostedAt: "2024-06-02 09:00:00"},
+		// Closing June 1st after midnight.
+		events.TransactionApplied{EntryID: 3, Kind: businesslogic.EntryPayout, UserID: 7,
+			Amount: cents(-3000), PostedAt: "2024-06-01 23:59:59"},
+	)
+	if _, err := NewAnalyticsConsumer(db, service, 2).Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+	days, err := service.NegativeWorkers(from, from.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(days) != 2 || days[0].Workers != 0 || days[1].Workers != 1 {
+		t.Errorf("Expected the worker in the red on June 2nd only, got %+v", days)
+	}
+	if negative, err := service.NegativeWorkersNow(); err != nil || negative != 1 {
+		t.Errorf("Expected one worker in the red, got %d (%v)", negative, err)
+	}
+}
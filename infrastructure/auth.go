@@ -0,0 +1,31 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	auth "aTES/core/operations/authenticator"
+	"aTES/core/rbac"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Identifying the caller from the Bearer token the authenticator issued. What they may do comes
+// from the policy.
+func actorFromRequest(r *http.Request, policy *rbac.Policy) (businesslogic.Actor, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return businesslogic.Actor{}, fmt.Errorf("missing authorization header")
+	}
+
+	tokenParts := strings.Split(authHeader, " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		return businesslogic.Actor{}, fmt.Errorf("invalid token format, expected 'Bearer <token>'")
+	}
+
+	userID, role, err := auth.ParseJWT(tokenParts[1])
+	if err != nil {
+		return businesslogic.Actor{}, err
+	}
+
+	return businesslogic.Actor{UserID: userID, Role: role, Policy: policy}, nil
+}
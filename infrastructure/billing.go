@@ -0,0 +1,373 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The result of closing a day. AlreadyClosed is set when an earlier run did the work.
+type BillingCloseSummary struct {
+	Cycle         entities.BillingCycle          `json:"cycle"`
+	Balances      []entities.BillingCycleBalance `json:"balances"`
+	AlreadyClosed bool                           `json:"already_closed"`
+}
+
+// Opening the cycle for a day if it isn't there yet and returning it.
+func OpenBillingCycle(db queryer, day time.Time) (entities.BillingCycle, error) {
+	query := `
+	INSERT INTO billing_cycles (day, status, opened_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (day) DO NOTHING
+	`
+	_, err := db.Exec(query, businesslogic.BillingDay(day).Format(time.DateOnly), businesslogic.CycleOpen,
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		return entities.BillingCycle{}, fmt.Errorf("failed to open the billing cycle of %s: %w",
+			day.Format(time.DateOnly), err)
+	}
+
+	return getBillingCycle(db, day)
+}
+
+const billingCycleColumns = `cycle_id, to_char(day, 'YYYY-MM-DD'), status,
+	COALESCE(to_char(opened_at, 'YYYY-MM-DD HH24:MI:SS'), ''),
+	COALESCE(to_char(closed_at, 'YYYY-MM-DD HH24:MI:SS'), '')`
+
+// Inside a transaction the cycle row is locked.
+func getBillingCycle(db queryer, day time.Time) (entities.BillingCycle, error) {
+	query := `SELECT ` + billingCycleColumns + ` FROM billing_cycles WHERE day = $1`
+	if _, inTx := db.(*sql.Tx); inTx {
+		query += ` FOR UPDATE`
+	}
+
+	var cycle entities.BillingCycle
+	err := db.QueryRow(query, businesslogic.BillingDay(day).Format(time.DateOnly)).
+		Scan(&cycle.CycleID, &cycle.Day, &cycle.Status, &cycle.OpenedAt, &cycle.ClosedAt)
+	if err != nil {
+		return entities.BillingCycle{}, fmt.Errorf("failed to get the billing cycle of %s: %w",
+			day.Format(time.DateOnly), err)
+	}
+
+	return cycle, nil
+}
+
+// The advisory lock every close takes, so they run one at a time.
+const billingCloseLock = 720240
+
+// Closing a finished day: every worker's balance is snapshotted, positive balances are paid out
+// and negative ones carried over. Payouts are posted at the end of the day, so the next day
+// starts from what's left however late the day is closed. Closing a day twice does nothing the
+// second time. Days are closed one at a time and in order: a day can't be closed while an
+// earlier one is still open or once a later one is closed, either way a balance would be paid
+// twice.
+func CloseBillingCycle(db *sql.DB, day time.Time) (BillingCloseSummary, error) {
+	day = businesslogic.BillingDay(day)
+	if err := businesslogic.CanCloseDay(day, time.Now()); err != nil {
+		return BillingCloseSummary{}, fmt.Errorf("can't close %s: %w", day.Format(time.DateOnly), err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return BillingCloseSummary{}, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, billingCloseLock); err != nil {
+		return BillingCloseSummary{}, fmt.Errorf("failed to wait for other billing closes: %w", err)
+	}
+
+	cycle, err := OpenBillingCycle(tx, day)
+	if err != nil {
+		return BillingCloseSummary{}, err
+	}
+
+	if cycle.Status == businesslogic.CycleClosed {
+		balances, err := getBillingCycleBalances(tx, cycle.CycleID)
+		if err != nil {
+			return BillingCloseSummary{}, err
+		}
+		return BillingCloseSummary{Cycle: cycle, Balances: balances, AlreadyClosed: true}, nil
+	}
+
+	var openBefore, closedAfter string
+	query := `
+	SELECT COALESCE(to_char(MIN(day) FILTER (WHERE day < $1 AND status = $2), 'YYYY-MM-DD'), ''),
+		COALESCE(to_char(MAX(day) FILTER (WHERE day > $1 AND status = $3), 'YYYY-MM-DD'), '')
+	FROM billing_cycles
+	`
+	err = tx.QueryRow(query, day.Format(time.DateOnly), businesslogic.CycleOpen, businesslogic.CycleClosed).
+		Scan(&openBefore, &closedAfter)
+	if err != nil {
+		return BillingCloseSummary{}, fmt.Errorf("failed to check the billing cycles around %s: %w", day.Format(time.DateOnly), err)
+	}
+	if openBefore != "" {
+		return BillingCloseSummary{}, fmt.Errorf("can't close %s, %s is still open: %w", day.Format(time.DateOnly), openBefore,
+			businesslogic.ErrCycleOutOfOrder)
+	}
+	if closedAfter != "" {
+		return BillingCloseSummary{}, fmt.Errorf("can't close %s, %s is closed already: %w", day.Format(time.DateOnly), closedAfter,
+			businesslogic.ErrCycleOutOfOrder)
+	}
+
+	balances, err := workerBalancesForDay(tx, day)
+	if err != nil {
+		return BillingCloseSummary{}, err
+	}
+
+	var published []events.Event
+	for i := range balances {
+		balance := &balances[i]
+		balance.CycleID = cycle.CycleID
+		balance.Payout, balance.CarriedOver = businesslogic.SettleBalance(balance.EndingBalance)
+
+		if balance.Payout.IsPositive() {
+			description := fmt.Sprintf("Payout for %s", day.Format(time.DateOnly))
+			balance.PayoutEntryID, err = PostPayout(tx, balance.UserID, balance.Payout, description,
+				businesslogic.PayoutTime(day))
+			if err != nil {
+				return BillingCloseSummary{}, fmt.Errorf("failed to pay out user %d: %w", balance.UserID, err)
+			}
+			paid, err := transactionApplied(tx, balance.PayoutEntryID)
+			if err != nil {
+				return BillingCloseSummary{}, err
+			}
+			published = append(published, paid)
+		}
+
+		query := `
+		INSERT INTO billing_cycle_balances
+			(cycle_id, user_id, opening_balance, ending_balance, payout, carried_over, payout_entry_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`
+		_, err = tx.Exec(query, balance.CycleID, balance.UserID, balance.OpeningBalance, balance.EndingBalance,
+			balance.Payout, balance.CarriedOver, balance.PayoutEntryID)
+		if err != nil {
+			return BillingCloseSummary{}, fmt.Errorf("failed to record the balance of user %d: %w", balance.UserID, err)
+		}
+	}
+
+	cycle.Status = businesslogic.CycleClosed
+	cycle.ClosedAt = time.Now().Format(time.DateTime)
+	_, err = tx.Exec(`UPDATE billing_cycles SET status = $1, closed_at = $2 WHERE cycle_id = $3`,
+		cycle.Status, cycle.ClosedAt, cycle.CycleID)
+	if err != nil {
+		return BillingCloseSummary{}, fmt.Errorf("failed to mark cycle %d closed: %w", cycle.CycleID, err)
+	}
+
+	if err := writeOutbox(tx, tesProducer, published); err != nil {
+		return BillingCloseSummary{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BillingCloseSummary{}, fmt.Errorf("failed to commit the billing close: %w", err)
+	}
+
+	// The snapshots are only a cache, a failure here doesn't undo the close.
+	if err := RefreshBalanceSnapshots(db); err != nil {
+		log.Printf("Closed %s but couldn't refresh balance snapshots: %v\n", day.Format(time.DateOnly), err)
+	}
+
+	return BillingCloseSummary{Cycle: cycle, Balances: balances}, nil
+}
+
+// Every worker's balance at the start and at the end of a day, computed from the ledger.
+func workerBalancesForDay(db queryer, day time.Time) ([]entities.BillingCycleBalance, error) {
+	query := `
+	SELECT a.user_id,
+		COALESCE(SUM(l.credit - l.debit) FILTER (WHERE e.posted_at < $1), 0)::bigint,
+		COALESCE(SUM(l.credit - l.debit) FILTER (WHERE e.posted_at < $2), 0)::bigint
+	FROM ledger_accounts a
+	LEFT JOIN journal_lines l ON l.account_id = a.account_id
+	LEFT JOIN journal_entries e ON e.entry_id = l.entry_id
+	WHERE a.kind = $3
+	GROUP BY a.user_id
+	ORDER BY a.user_id
+	`
+	rows, err := db.Query(query, day.Format(time.DateTime), day.AddDate(0, 0, 1).Format(time.DateTime),
+		businesslogic.AccountWorker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute worker balances for %s: %w", day.Format(time.DateOnly), err)
+	}
+	defer rows.Close()
+
+	var balances []entities.BillingCycleBalance
+	for rows.Next() {
+		var balance entities.BillingCycleBalance
+		if err := rows.Scan(&balance.UserID, &balance.OpeningBalance, &balance.EndingBalance); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, rows.Err()
+}
+
+func getBillingCycleBalances(db queryer, cycleID int) ([]entities.BillingCycleBalance, error) {
+	query := `
+	SELECT cycle_id, user_id, opening_balance, ending_balance, payout, carried_over, payout_entry_id
+	FROM billing_cycle_balances
+	WHERE cycle_id = $1
+	ORDER BY user_id
+	`
+	rows, err := db.Query(query, cycleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the balances of cycle %d: %w", cycleID, err)
+	}
+	defer rows.Close()
+
+	var balances []entities.BillingCycleBalance
+	for rows.Next() {
+		var b entities.BillingCycleBalance
+		err := rows.Scan(&b.CycleID, &b.UserID, &b.OpeningBalance, &b.EndingBalance, &b.Payout, &b.CarriedOver,
+			&b.PayoutEntryID)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, b)
+	}
+
+	return balances, rows.Err()
+}
+
+// Getting a cycle and its recorded balances, for audits.
+func GetBillingCycle(db *sql.DB, day time.Time) (BillingCloseSummary, error) {
+	cycle, err := getBillingCycle(db, day)
+	if err != nil {
+		return BillingCloseSummary{}, err
+	}
+
+	balances, err := getBillingCycleBalances(db, cycle.CycleID)
+	if err != nil {
+		return BillingCloseSummary{}, err
+	}
+
+	return BillingCloseSummary{Cycle: cycle, Balances: balances, AlreadyClosed: cycle.Status == businesslogic.CycleClosed}, nil
+}
+
+// Marking an open day closed without settling it, when a later day is closed already. That close
+// paid out every balance up to its own day, so there's nothing left to settle for this one, and
+// leaving it open would hold up every day after it. Returns false if no later day is closed.
+func closeSupersededCycle(db *sql.DB, day time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, billingCloseLock); err != nil {
+		return false, fmt.Errorf("failed to wait for other billing closes: %w", err)
+	}
+
+	query := `
+	UPDATE billing_cycles SET status = $1, closed_at = $2
+	WHERE day = $3 AND status = $4
+		AND EXISTS (SELECT 1 FROM billing_cycles WHERE day > $3 AND status = $1)
+	`
+	result, err := tx.Exec(query, businesslogic.CycleClosed, time.Now().Format(time.DateTime), day.Format(time.DateOnly),
+		businesslogic.CycleOpen)
+	if err != nil {
+		return false, fmt.Errorf("failed to close the billing cycle of %s: %w", day.Format(time.DateOnly), err)
+	}
+	closed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return closed > 0, tx.Commit()
+}
+
+// Opening today's cycle and closing every earlier one that's still open, including yesterday's
+// if it was never opened (e.g. the server was down over midnight). An open day left behind a
+// closed one is marked closed with a warning, see closeSupersededCycle. Then refreshing the
+// monthly statements.
+func CloseDueBillingCycles(db *sql.DB, now time.Time) error {
+	today := businesslogic.BillingDay(now)
+	if _, err := OpenBillingCycle(db, today); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT to_char(day, 'YYYY-MM-DD') FROM billing_cycles WHERE status = $1 AND day < $2 ORDER BY day`,
+		businesslogic.CycleOpen, today.Format(time.DateOnly))
+	if err != nil {
+		return fmt.Errorf("failed to find open billing cycles: %w", err)
+	}
+	var due []time.Time
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return err
+		}
+		parsed, err := time.ParseInLocation(time.DateOnly, day, now.Location())
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("bad billing day %q: %w", day, err)
+		}
+		due = append(due, parsed)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read open billing cycles: %w", err)
+	}
+
+	yesterday := today.AddDate(0, 0, -1)
+	if len(due) == 0 || !due[len(due)-1].Equal(yesterday) {
+		due = append(due, yesterday)
+	}
+
+	for _, day := range due {
+		summary, err := CloseBillingCycle(db, day)
+		if errors.Is(err, businesslogic.ErrCycleOutOfOrder) {
+			superseded, closeErr := closeSupersededCycle(db, day)
+			if closeErr != nil {
+				return closeErr
+			}
+			if superseded {
+				log.Printf("Warning: billing cycle %s was still open after a later one was closed, marked it closed without settling it.\n",
+					day.Format(time.DateOnly))
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if !summary.AlreadyClosed {
+			log.Printf("Closed billing cycle %s: %d workers settled.\n", summary.Cycle.Day, len(summary.Balances))
+		}
+	}
+
+	// Bringing the monthly statements up to date. On the first of a month this finalises the
+	// previous month, since yesterday belongs to it.
+	for _, day := range []time.Time{yesterday, today} {
+		if _, err := BuildMonthlyStatements(db, day.Format("2006-01")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Closing due billing cycles on every tick until the context is cancelled.
+func RunBillingScheduler(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := CloseDueBillingCycles(db, time.Now()); err != nil {
+			log.Printf("Billing scheduler: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Crediting a worker as if they completed a task at the given time.
+func postReward(t *testing.T, db *sql.DB, userID int, at time.Time, amount entities.Money) {
+	t.Helper()
+	workerAccount, err := workerAccountID(db, userID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	companyAccount, err := systemAccountID(db, businesslogic.AccountCompany)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	entry := entities.JournalEntry{Kind: businesslogic.EntryCompletionReward, Description: "Reward",
+		PostedAt: at.Format(time.DateTime)}
+	if _, err := PostJournalEntry(db, entry, businesslogic.CompletionRewardLines(workerAccount, companyAccount, amount)); err != nil {
+		t.Fatalf("Error posting a reward: %v", err)
+	}
+}
+
+func TestCloseDueBillingCyclesCatchesUp(t *testing.T) {
+	db := newTestDB(t)
+	day := businesslogic.BillingDay(time.Now()).AddDate(0, 0, -4)
+	next := day.AddDate(0, 0, 1)
+	postReward(t, db, 7, day.Add(10*time.Hour), entities.NewMoney(3000))
+	postReward(t, db, 7, next.Add(10*time.Hour), entities.NewMoney(1000))
+
+	// Both days are still open when the scheduler comes back, two days late.
+	for _, open := range []time.Time{day, next} {
+		if _, err := OpenBillingCycle(db, open); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := CloseDueBillingCycles(db, next.AddDate(0, 0, 1).Add(time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Each day pays what was earned on it, nothing twice.
+	for _, c := range []struct {
+		day                     time.Time
+		opening, ending, payout int64
+	}{
+		{day, 0, 3000, 3000},
+		{next, 0, 1000, 1000},
+	} {
+		summary, err := GetBillingCycle(db, c.day)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !summary.AlreadyClosed || len(summary.Balances) != 1 {
+			t.Fatalf("%s: expected a closed cycle with one balance, got %+v", c.day.Format(time.DateOnly), summary)
+		}
+		balance := summary.Balances[0]
+		if balance.OpeningBalance != entities.NewMoney(c.opening) || balance.EndingBalance != entities.NewMoney(c.ending) ||
+			balance.Payout != entities.NewMoney(c.payout) {
+			t.Errorf("%s: expected %d -> %d paying %d, got %+v", c.day.Format(time.DateOnly), c.opening, c.ending, c.payout, balance)
+		}
+	}
+	if balance, err := GetUserBalance(db, 7); err != nil || !balance.IsZero() {
+		t.Errorf("Expected everything paid out, got %v (%v)", balance, err)
+	}
+}
+
+// A day left open behind a closed one doesn't hold up the days after it.
+func TestCloseDueBillingCyclesSkipsSupersededDay(t *testing.T) {
+	db := newTestDB(t)
+	stale := businesslogic.BillingDay(time.Now()).AddDate(0, 0, -5)
+	closed, due := stale.AddDate(0, 0, 1), stale.AddDate(0, 0, 2)
+	postReward(t, db, 7, stale.Add(10*time.Hour), entities.NewMoney(3000))
+	postReward(t, db, 7, due.Add(10*time.Hour), entities.NewMoney(1000))
+
+	if _, err := CloseBillingCycle(db, closed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, open := range []time.Time{stale, due} {
+		if _, err := OpenBillingCycle(db, open); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := CloseDueBillingCycles(db, due.AddDate(0, 0, 1).Add(time.Hour)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The stale day is closed with nothing to settle, the later close already paid its reward.
+	summary, err := GetBillingCycle(db, stale)
+	if err != nil || !summary.AlreadyClosed || len(summary.Balances) != 0 {
+		t.Errorf("Expected %s closed without balances, got %+v (%v)", stale.Format(time.DateOnly), summary, err)
+	}
+	summary, err = GetBillingCycle(db, due)
+	if err != nil || !summary.AlreadyClosed || len(summary.Balances) != 1 || summary.Balances[0].Payout != entities.NewMoney(1000) {
+		t.Errorf("Expected %s closed paying 1000, got %+v (%v)", due.Format(time.DateOnly), summary, err)
+	}
+	if balance, err := GetUserBalance(db, 7); err != nil || !balance.IsZero() {
+		t.Errorf("Expected everything paid out, got %v (%v)", balance, err)
+	}
+}
+
+func TestCloseBillingCycleTwice(t *testing.T) {
+	db := newTestDB(t)
+	day := businesslogic.BillingDay(time.Now()).AddDate(0, 0, -2)
+	postReward(t, db, 7, day.Add(time.Hour), entities.NewMoney(2500))
+	postReward(t, db, 8, day.Add(2*time.Hour), entities.NewMoney(500))
+
+	first, err := CloseBillingCycle(db, day)
+	if err != nil || first.AlreadyClosed {
+		t.Fatalf("Expected the day to be closed, got %+v (%v)", first, err)
+	}
+	again, err := CloseBillingCycle(db, day)
+	if err != nil || !again.AlreadyClosed || len(again.Balances) != len(first.Balances) {
+		t.Fatalf("Expected the earlier close back, got %+v (%v)", again, err)
+	}
+	for i := range first.Balances {
+		if again.Balances[i] != first.Balances[i] {
+			t.Errorf("Expected %+v, got %+v", first.Balances[i], again.Balances[i])
+		}
+	}
+	var payouts int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM journal_entries WHERE kind = $1`, businesslogic.EntryPayout).Scan(&payouts); err != nil || payouts != 2 {
+		t.Errorf("Expected 2 payouts, got %d (%v)", payouts, err)
+	}
+
+	// An earlier day would pay the same balances again.
+	if _, err := CloseBillingCycle(db, day.AddDate(0, 0, -1)); !errors.Is(err, businesslogic.ErrCycleOutOfOrder) {
+		t.Errorf("Expected ErrCycleOutOfOrder, got %v", err)
+	}
+}
@@ -1,9 +1,16 @@
 package infrastructure
 
 import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -14,6 +21,26 @@ type Config struct {
 	DBPass    string
 	DBName    string
 	DBSSLMode string
+
+	PricingPolicy    string         // classic/fixed/table.
+	PricingSeed      int64          // Seed for the pricing random source, 0 seeds from the clock.
+	PricingTablePath string         // Yaml table used by the table policy.
+	FixedAssignFee   entities.Money // Prices used by the fixed policy.
+	FixedReward      entities.Money
+
+	BillingCheckInterval time.Duration // How often the scheduler looks for billing days to close.
+
+	EventBroker         string        // Where the outbox relay sends events: postgres/kafka.
+	KafkaBrokers        []string      // Addresses of the kafka brokers, for the kafka broker.
+	OutboxRelayInterval time.Duration // How often the relay looks for messages to deliver.
+	ConsumerConcurrency int           // How many aggregates a consumer handles events of at once.
+
+	RBACPolicyPath string // Yaml policy of who may do what, the built-in one when empty.
+
+	OIDCIssuer       string // Base URL of the authenticator users are sent to for signing in, /login is off when empty.
+	OIDCClientID     string // What this service is registered as in the authenticator's clients.yaml.
+	OIDCClientSecret string // Empty for public clients.
+	OIDCRedirectURL  string // Where the authenticator sends users back to, /login/callback on this service.
 }
 
 func LoadConfig() (Config, error) {
@@ -28,6 +55,36 @@ func LoadConfig() (Config, error) {
 		return Config{}, err
 	}
 
+	pricingSeed, err := strconv.ParseInt(getEnv("PRICING_SEED", "0"), 10, 64)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid pricing seed: %w", err)
+	}
+
+	fixedAssignFee, err := entities.ParseMoney(getEnv("PRICING_FIXED_ASSIGN_FEE", "15"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid fixed assignment fee: %w", err)
+	}
+
+	fixedReward, err := entities.ParseMoney(getEnv("PRICING_FIXED_REWARD", "30"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid fixed reward: %w", err)
+	}
+
+	billingCheckInterval, err := time.ParseDuration(getEnv("BILLING_CHECK_INTERVAL", "10m"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid billing check interval: %w", err)
+	}
+
+	outboxRelayInterval, err := time.ParseDuration(getEnv("OUTBOX_RELAY_INTERVAL", "1s"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid outbox relay interval: %w", err)
+	}
+
+	consumerConcurrency, err := strconv.Atoi(getEnv("EVENT_CONSUMER_CONCURRENCY", "4"))
+	if err != nil || consumerConcurrency < 1 {
+		return Config{}, fmt.Errorf("invalid event consumer concurrency %q, expected a positive integer", getEnv("EVENT_CONSUMER_CONCURRENCY", "4"))
+	}
+
 	return Config{
 		Port:      port,
 		DBHost:    getEnv("DB_HOST", "localhost"),
@@ -36,9 +93,80 @@ func LoadConfig() (Config, error) {
 		DBPass:    getEnv("DB_PASS", ""),
 		DBName:    getEnv("DB_NAME", "aTES"),
 		DBSSLMode: getEnv("DB_SSL_MODE", "disable"),
+
+		PricingPolicy:    getEnv("PRICING_POLICY", "classic"),
+		PricingSeed:      pricingSeed,
+		PricingTablePath: getEnv("PRICING_TABLE_PATH", ""),
+		FixedAssignFee:   fixedAssignFee,
+		FixedReward:      fixedReward,
+
+		BillingCheckInterval: billingCheckInterval,
+
+		EventBroker:         getEnv("EVENT_BROKER", "postgres"),
+		KafkaBrokers:        strings.Split(getEnv("KAFKA_BROKERS", "localhost:9092"), ","),
+		OutboxRelayInterval: outboxRelayInterval,
+		ConsumerConcurrency: consumerConcurrency,
+
+		RBACPolicyPath: getEnv("RBAC_POLICY_PATH", ""),
+
+		OIDCIssuer:       getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:     getEnv("OIDC_CLIENT_ID", "tes"),
+		OIDCClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:  getEnv("OIDC_REDIRECT_URL", fmt.Sprintf("http://localhost:%d/login/callback", port)),
 	}, nil
 }
 
+// Building the transport the outbox relay delivers to.
+func NewEventBroker(config Config, db *sql.DB) (events.Transport, error) {
+	switch config.EventBroker {
+	case "postgres":
+		return NewPostgresBus(db, ""), nil
+	case "kafka":
+		return NewStreamBus(NewKafkaBroker(config.KafkaBrokers), nil, "", ""), nil
+	default:
+		return nil, fmt.Errorf("unknown event broker %q", config.EventBroker)
+	}
+}
+
+// Bringing the topics' events from the broker into stored_events, where the service's Consumers
+// read them, under the given consumer group. Nil with the postgres broker: events are stored
+// there already.
+func NewEventInbox(config Config, db *sql.DB, group string, topics ...string) (*StreamBus, error) {
+	switch config.EventBroker {
+	case "postgres":
+		return nil, nil
+	case "kafka":
+		return newEventInbox(NewKafkaBroker(config.KafkaBrokers), db, group, topics...), nil
+	default:
+		return nil, fmt.Errorf("unknown event broker %q", config.EventBroker)
+	}
+}
+
+func newEventInbox(log streamLog, db *sql.DB, group string, topics ...string) *StreamBus {
+	inbox := NewStreamBus(log, db, group, "")
+	inbox.Forward(NewPostgresBus(db, ""), topics...)
+	return inbox
+}
+
+// Building the pricing policy the config asks for.
+func NewPricingPolicy(config Config) (businesslogic.PricingPolicy, error) {
+	rng := businesslogic.NewRandSource(config.PricingSeed)
+
+	switch config.PricingPolicy {
+	case "classic":
+		return businesslogic.NewClassicPricing(rng), nil
+	case "fixed":
+		return businesslogic.FixedPricing{AssignFee: config.FixedAssignFee, Reward: config.FixedReward}, nil
+	case "table":
+		if config.PricingTablePath == "" {
+			return nil, fmt.Errorf("the table pricing policy needs PRICING_TABLE_PATH")
+		}
+		return businesslogic.LoadTablePricing(config.PricingTablePath, rng)
+	default:
+		return nil, fmt.Errorf("unknown pricing policy %q", config.PricingPolicy)
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -0,0 +1,19 @@
+package infrastructure
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// The table policy won't start without its table.
+func TestNewPricingPolicyNeedsTable(t *testing.T) {
+	for _, path := range []string{"", filepath.Join(t.TempDir(), "missing.yaml")} {
+		if _, err := NewPricingPolicy(Config{PricingPolicy: "table", PricingTablePath: path}); err == nil {
+			t.Errorf("Expected an error for the table %q", path)
+		}
+	}
+
+	if _, err := NewPricingPolicy(Config{PricingPolicy: "table", PricingTablePath: "pricing.yaml"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+package infrastructure
+
+import (
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Counts redelivered events consumers recognised and skipped, served on /debug/vars.
+var eventsDuplicatesSkipped = expvar.NewInt("events_duplicates_skipped_total")
+
+// Handles an event. Writes made through tx are committed together with the event being marked
+// processed, so either both happen or neither does.
+type ConsumerHandler func(tx *sql.Tx, envelope events.Envelope, event events.Event) error
+
+// An exactly-once consumer of the stored events, for handlers whose writes mustn't happen twice
+// (e.g. anything that moves money). Every event is handled in a transaction that also records
+// its envelope's event_id in processed_events, an event_id already there is skipped, so
+// redeliveries by the broker or after a crash are harmless.
+//
+// Like PostgresBus it reads from its own cursor, retries a failing event on the next poll and
+// dead-letters it after maxEventAttempts. Within a batch, the events of different aggregates
+// (see events.AggregateKey) are handled by up to concurrency workers at once, those of one
+// aggregate one after another in the order they were stored. A failure holds back the rest of
+// its aggregate only.
+type Consumer struct {
+	db          *sql.DB
+	name        string
+	concurrency int
+	mu          sync.Mutex
+	handlers    map[string][]ConsumerHandler
+}
+
+// The name identifies the consumer's cursor, processed events and dead letters.
+func NewConsumer(db *sql.DB, name string, concurrency int) *Consumer {
+	return &Consumer{db: db, name: name, concurrency: max(concurrency, 1), handlers: make(map[string][]ConsumerHandler)}
+}
+
+func (c *Consumer) Handle(name string, handler ConsumerHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handlers[name] = append(c.handlers[name], handler)
+}
+
+func (c *Consumer) snapshotHandlers() map[string][]ConsumerHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	handlers := make(map[string][]ConsumerHandler, len(c.handlers))
+	for name, list := range c.handlers {
+		handlers[name] = list
+	}
+
+	return handlers
+}
+
+// A stored event opened for its handlers.
+type delivery struct {
+	stored   storedEvent
+	envelope events.Envelope
+	event    events.Event
+	err      error // Why it couldn't be opened, wraps errPoisonEvent.
+}
+
+func openStoredEvent(stored storedEvent) delivery {
+	d := delivery{stored: stored}
+	if err := json.Unmarshal(stored.payload, &d.envelope); err != nil {
+		d.err = fmt.Errorf("%w: %w", errPoisonEvent, err)
+		return d
+	}
+	event, err := schemas.Default().Open(d.envelope)
+	if err != nil {
+		d.err = fmt.Errorf("%w: %w", errPoisonEvent, err)
+		return d
+	}
+	d.event = event
+
+	return d
+}
+
+// Running the handlers in one transaction, where the event is marked processed. It's skipped
+// if it was already.
+func (c *Consumer) handle(handlers []ConsumerHandler, d delivery) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO processed_events (consumer, event_id, processed_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		c.name, d.envelope.EventID, time.Now().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("failed to mark event %s processed: %w", d.envelope.EventID, err)
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		eventsDuplicatesSkipped.Add(1)
+		return nil
+	}
+
+	if err := runHandlers(tx, handlers, d); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func runHandlers(tx *sql.Tx, handlers []ConsumerHandler, d delivery) error {
+	if d.err != nil {
+		return d.err
+	}
+	for _, handler := range handlers {
+		if err := handler(tx, d.envelope, d.event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaying the consumer's queued dead letters, then handling the events stored since its
+// cursor. Returns how many were handled.
+func (c *Consumer) Dispatch() (int, error) {
+	handlers := c.snapshotHandlers()
+	handled, err := replayDeadLetters(c.db, c.name, func(eventName string, payload []byte) error {
+		return c.handle(handlers[eventName], openStoredEvent(storedEvent{name: eventName, payload: payload}))
+	})
+	if err != nil {
+		return handled, err
+	}
+
+	for {
+		n, err := c.dispatchBatch()
+		handled += n
+		if err != nil || n < eventBatchSize {
+			return handled, err
+		}
+	}
+}
+
+// The cursor row is locked for the whole batch, so two processes with the same consumer name
+// never work on the same events at once. Events handled past a failure are left behind the
+// cursor and skipped as duplicates when the batch is read again.
+func (c *Consumer) dispatchBatch() (int, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	cursor, attempts, err := lockSubscription(tx, c.name)
+	if err != nil {
+		return 0, err
+	}
+	batch, err := storedEventsAfter(tx, cursor, time.Time{}, eventBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// Grouping the events by aggregate, in stored order. Nobody handles the rest, they're done.
+	handlers := c.snapshotHandlers()
+	deliveries := make([]delivery, len(batch))
+	done := make([]bool, len(batch))
+	failures := make([]error, len(batch))
+	groups := make(map[string][]int)
+	var keys []string
+	for i, stored := range batch {
+		if len(handlers[stored.name]) == 0 {
+			done[i] = true
+			continue
+		}
+		deliveries[i] = openStoredEvent(stored)
+		key := ""
+		if deliveries[i].event != nil {
+			key = events.AggregateKey(deliveries[i].event)
+		}
+		if _, seen := groups[key]; !seen {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	work := make(chan []int)
+	var workers sync.WaitGroup
+	for range min(c.concurrency, len(keys)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for group := range work {
+				for _, i := range group {
+					if err := c.handle(handlers[batch[i].name], deliveries[i]); err != nil {
+						failures[i] = err
+						break
+					}
+					done[i] = true
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		work <- groups[key]
+	}
+	close(work)
+	workers.Wait()
+
+	// The cursor moves up to the first event that isn't done. If that one keeps failing, or
+	// can never succeed, it's dead-lettered and the cursor moves past it.
+	handled := 0
+	failed := -1
+	for i := range batch {
+		if done[i] {
+			handled++
+		} else if failed < 0 {
+			failed = i
+		}
+	}
+	lastError := ""
+	var handlerErr error
+	switch {
+	case failed < 0:
+		if len(batch) > 0 {
+			cursor = batch[len(batch)-1].position()
+		}
+		attempts = 0
+	default:
+		if failed > 0 {
+			cursor = batch[failed-1].position()
+			attempts = 0
+		}
+		attempts++
+		stored, cause := batch[failed], failures[failed]
+		if errors.Is(cause, errPoisonEvent) || attempts >= maxEventAttempts {
+			if err := deadLetter(tx, c.name, stored, cause, attempts); err != nil {
+				return 0, err
+			}
+			log.Printf("Consumer: %s gave up on event %d (%s) after %d attempts: %v\n", c.name, stored.id, stored.name, attempts, cause)
+			cursor = stored.position()
+			attempts = 0
+		} else {
+			lastError = cause.Error()
+			handlerErr = fmt.Errorf("%s failed on event %d (%s), attempt %d: %w", c.name, stored.id, stored.name, attempts, cause)
+		}
+	}
+
+	if err := saveSubscription(tx, c.name, cursor, attempts, lastError); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the cursor of %s: %w", c.name, err)
+	}
+
+	return handled, handlerErr
+}
+
+// Running the handlers over the whole history in tx, without the cursor, the dead letters or
+// deduplication, to fill a read model the caller emptied in tx (see RebuildUserReplica). Events
+// of transactions still running are left to the consumer, which sees them after its cursor.
+// Stops at the first failure. Returns how many events were handled.
+func (c *Consumer) Rebuild(tx *sql.Tx) (int, error) {
+	handlers := c.snapshotHandlers()
+
+	handled := 0
+	var after eventPosition
+	for {
+		batch, err := storedEventsAfter(tx, after, time.Time{}, eventBatchSize)
+		if err != nil {
+			return handled, err
+		}
+		for _, stored := range batch {
+			if list := handlers[stored.name]; len(list) > 0 {
+				if err := runHandlers(tx, list, openStoredEvent(stored)); err != nil {
+					return handled, fmt.Errorf("rebuild failed on event %d (%s): %w", stored.id, stored.name, err)
+				}
+			}
+			after = stored.position()
+			handled++
+		}
+		if len(batch) < eventBatchSize {
+			return handled, nil
+		}
+	}
+}
+
+// Dispatching on every tick until the context is cancelled. A batch in flight is finished
+// first, so nothing is cut off halfway: Run returning means the consumer is drained.
+func (c *Consumer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := c.Dispatch(); err != nil {
+			log.Printf("Consumer: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Storing the events the way the relay does, one envelope each.
+func storeEvents(t *testing.T, db *sql.DB, evs ...events.Event) []events.Envelope {
+	t.Helper()
+	envelopes := make([]events.Envelope, len(evs))
+	for i, event := range evs {
+		envelope, err := schemas.Default().Seal("tes", event)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		envelopes[i] = envelope
+	}
+	if err := NewPostgresBus(db, "").Send(envelopes...); err != nil {
+		t.Fatalf("Error storing events: %v", err)
+	}
+	return envelopes
+}
+
+func getSubscription(t *testing.T, db *sql.DB, subscriber string) entities.EventSubscription {
+	t.Helper()
+	var subscription entities.EventSubscription
+	err := db.QueryRow(`SELECT last_event_id, attempts FROM event_subscriptions WHERE subscriber = $1`, subscriber).
+		Scan(&subscription.LastEventID, &subscription.Attempts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return subscription
+}
+
+func lastStoredEventID(t *testing.T, db *sql.DB) int64 {
+	t.Helper()
+	var eventID int64
+	if err := db.QueryRow(`SELECT MAX(event_id) FROM stored_events`).Scan(&eventID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return eventID
+}
+
+func assigned(taskID, to int) events.TaskAssigned {
+	return events.TaskAssigned{TaskID: taskID, To: to, Fee: entities.NewMoney(0)}
+}
+
+// A redelivered envelope is recognised by its event_id and skipped, in the same batch or later.
+func TestConsumerSkipsDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	envelope := storeEvents(t, db, assigned(1, 7))[0]
+	if err := NewPostgresBus(db, "").Send(envelope); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	calls := 0
+	consumer := NewConsumer(db, "test", 2)
+	consumer.Handle(events.TaskAssignedName, func(*sql.Tx, events.Envelope, events.Event) error {
+		calls++
+		return nil
+	})
+	if _, err := consumer.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := NewPostgresBus(db, "").Send(envelope); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := consumer.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected the event handled once, got %d", calls)
+	}
+	var processed int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM processed_events WHERE consumer = 'test' AND event_id = $1`, envelope.EventID).
+		Scan(&processed); err != nil || processed != 1 {
+		t.Errorf("Expected the event marked processed once, got %d (%v)", processed, err)
+	}
+	if subscription := getSubscription(t, db, "test"); subscription.LastEventID != lastStoredEventID(t, db) {
+		t.Errorf("Expected the cursor past the duplicates, got %+v", subscription)
+	}
+}
+
+// Aggregates are handled side by side, the events of one in the order they were stored.
+func TestConsumerOrdersEventsPerAggregate(t *testing.T) {
+	db := newTestDB(t)
+	const tasks, assignments = 4, 5
+	var stored []events.Event
+	for to := 1; to <= assignments; to++ {
+		for taskID := 1; taskID <= tasks; taskID++ {
+			stored = append(stored, assigned(taskID, to))
+		}
+	}
+	storeEvents(t, db, stored...)
+
+	var mu sync.Mutex
+	seen := map[int][]int{}
+	inFlight, maxInFlight := 0, 0
+	consumer := NewConsumer(db, "test", tasks)
+	consumer.Handle(events.TaskAssignedName, func(_ *sql.Tx, _ events.Envelope, event events.Event) error {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight--
+		e := event.(events.TaskAssigned)
+		seen[e.TaskID] = append(seen[e.TaskID], e.To)
+		return nil
+	})
+	if handled, err := consumer.Dispatch(); err != nil || handled != len(stored) {
+		t.Fatalf("Expected %d events handled, got %d (%v)", len(stored), handled, err)
+	}
+
+	for taskID := 1; taskID <= tasks; taskID++ {
+		if len(seen[taskID]) != assignments {
+			t.Fatalf("Expected %d events of task %d, got %v", assignments, taskID, seen[taskID])
+		}
+		for i, to := range seen[taskID] {
+			if to != i+1 {
+				t.Errorf("Expected the events of task %d in order, got %v", taskID, seen[taskID])
+				break
+			}
+		}
+	}
+	if maxInFlight < 2 {
+		t.Errorf("Expected aggregates handled concurrently, at most %d were", maxInFlight)
+	}
+}
+
+// A failing event holds back its aggregate and the cursor, other aggregates go ahead and aren't
+// handled again when the batch is read again.
+func TestConsumerCursorStaysOnFailure(t *testing.T) {
+	db := newTestDB(t)
+	storeEvents(t, db, assigned(1, 7), assigned(2, 7), assigned(1, 8))
+
+	failing := true
+	var mu sync.Mutex
+	var handled []events.TaskAssigned
+	consumer := NewConsumer(db, "test", 2)
+	consumer.Handle(events.TaskAssignedName, func(_ *sql.Tx, _ events.Envelope, event events.Event) error {
+		e := event.(events.TaskAssigned)
+		if failing && e.TaskID == 1 {
+			return errors.New("ledger is down")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, e)
+		return nil
+	})
+
+	if _, err := consumer.Dispatch(); err == nil {
+		t.Fatalf("Expected the failure reported")
+	}
+	if len(handled) != 1 || handled[0].TaskID != 2 {
+		t.Fatalf("Expected only task 2 handled, got %+v", handled)
+	}
+	if subscription := getSubscription(t, db, "test"); subscription.LastEventID != 0 || subscription.Attempts != 1 {
+		t.Errorf("Expected the cursor before the failed event with one attempt, got %+v", subscription)
+	}
+
+	failing = false
+	if _, err := consumer.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(handled) != 3 || handled[1] != assigned(1, 7) || handled[2] != assigned(1, 8) {
+		t.Errorf("Expected task 1's events once each in order after task 2, got %+v", handled)
+	}
+	if subscription := getSubscription(t, db, "test"); subscription.LastEventID != lastStoredEventID(t, db) || subscription.Attempts != 0 {
+		t.Errorf("Expected the cursor at the last event, got %+v", subscription)
+	}
+}
+
+// Shutting down waits for the event being handled, which is committed along with the cursor.
+func TestConsumerDrainsOnShutdown(t *testing.T) {
+	db := newTestDB(t)
+	envelope := storeEvents(t, db, assigned(1, 7))[0]
+
+	started, release := make(chan struct{}), make(chan struct{})
+	consumer := NewConsumer(db, "test", 2)
+	consumer.Handle(events.TaskAssignedName, func(*sql.Tx, events.Envelope, events.Event) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run(ctx, time.Hour)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-done:
+		t.Fatalf("Expected Run to wait for the event in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-done
+
+	var processed int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM processed_events WHERE event_id = $1`, envelope.EventID).Scan(&processed); err != nil ||
+		processed != 1 {
+		t.Errorf("Expected the event processed, got %d (%v)", processed, err)
+	}
+	if subscription := getSubscription(t, db, "test"); subscription.LastEventID != lastStoredEventID(t, db) {
+		t.Errorf("Expected the cursor past the event, got %+v", subscription)
+	}
+}
+
+// The fee of a new task is charged by the accounting consumer, once however often it's delivered.
+func TestAccountingConsumerChargesOnce(t *testing.T) {
+	db := newTestDB(t)
+	if err := upsertReplicaUser(db, entities.User{UserID: 7, Name: "worker", Role: entities.RoleWorker, JoinedAt: "2024-01-01",
+		LastUpdated: "2024-01-01 00:00:00", Version: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pricing := businesslogic.FixedPricing{AssignFee: entities.NewMoney(1500), Reward: entities.NewMoney(3000)}
+	if _, err := CreateAssignedTask(db, businesslogic.Actor{UserID: 1, Role: entities.RoleManager}, pricing, "Write docs",
+		rand.New(rand.NewSource(1))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if balance, err := GetUserBalance(db, 7); err != nil || !balance.IsZero() {
+		t.Fatalf("Expected nothing charged before the event is handled, got %s (%v)", balance, err)
+	}
+
+	if _, err := NewOutboxRelay(db, NewPostgresBus(db, "")).RelayOnce(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var payload string
+	if err := db.QueryRow(`SELECT payload FROM stored_events WHERE name = $1`, events.TaskAssignedName).Scan(&payload); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	accounting := NewAccountingConsumer(db, 2)
+	if _, err := accounting.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The broker delivering the TaskAssigned again.
+	if _, err := db.Exec(`INSERT INTO stored_events (name, payload, occurred_at) VALUES ($1, $2, now())`,
+		events.TaskAssignedName, payload); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := accounting.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if balance, err := GetUserBalance(db, 7); err != nil || balance != entities.NewMoney(-1500) {
+		t.Errorf("Expected the fee charged once, got %s (%v)", balance, err)
+	}
+	var applied int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM outbox_messages WHERE event_name = $1`, events.TransactionAppliedName).
+		Scan(&applied); err != nil || applied != 1 {
+		t.Errorf("Expected one TransactionApplied, got %d (%v)", applied, err)
+	}
+}
+
+// A rebuild replaces the replica even where it's ahead of the events, which a replay can't.
+func TestRebuildUserReplica(t *testing.T) {
+	db := newTestDB(t)
+	user := entities.User{UserID: 7, Name: "worker", Email: "w@example.com", Role: entities.RoleWorker, JoinedAt: "2024-01-01",
+		LastUpdated: "2024-01-01 00:00:00", Version: 1}
+	renamed := user
+	renamed.Name, renamed.Version = "Ken Cat", 2
+	storeEvents(t, db, events.UserCreated{User: user}, events.UserUpdated{User: renamed},
+		events.UserCreated{User: entities.User{UserID: 8, Name: "gone", Role: entities.RoleWorker, JoinedAt: "2024-01-01",
+			LastUpdated: "2024-01-01 00:00:00", Version: 1}},
+		events.UserDeleted{UserID: 8, Version: 2})
+	if _, err := NewUserReplica(db, 2).Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE users SET name = 'garbage', version = 99 WHERE user_id = 7`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (user_id, name, email, role, joined_at, version) VALUES (9, 'stray', '', 'worker', '', 1)`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if replayed, err := RebuildUserReplica(db); err != nil || replayed != 4 {
+		t.Fatalf("Expected four events replayed, got %d (%v)", replayed, err)
+	}
+
+	users, err := GetUsers(db)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	byID := map[int]entities.User{}
+	for _, u := range users {
+		byID[u.UserID] = u
+	}
+	if got := byID[7]; got.Name != "Ken Cat" || got.Version != 2 {
+		t.Errorf("Expected user 7 as of its last event, got %+v", got)
+	}
+	if _, ok := byID[9]; ok {
+		t.Errorf("Expected the user without events gone, got %+v", byID[9])
+	}
+	var removedAt sql.NullString
+	if err := db.QueryRow(`SELECT removed_at FROM users WHERE user_id = 8`).Scan(&removedAt); err != nil || !removedAt.Valid {
+		t.Errorf("Expected user 8 left as a tombstone, got %v (%v)", removedAt, err)
+	}
+}
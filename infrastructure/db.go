@@ -1,11 +1,14 @@
 package infrastructure
 
 import (
+	businesslogic "aTES/core/businessLogic"
 	"aTES/core/entities"
+	"aTES/core/events"
 	"database/sql"
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -18,6 +21,58 @@ TODO: Make sure that the task table has task_id for each row and not just id.
 Same with users table - user_id and accounting_records tables - record_id.
 */
 func InitDB(config Config) (*sql.DB, *gorm.DB, error) {
+	if err := createDatabase(config); err != nil {
+		return nil, nil, err
+	}
+
+	// Connecting to the target db.
+	sqlDB, err := ConnectDB(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Wrapping the sql.DB we've opened with an gorm.DB object.
+	gormDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialise GORM with an existing sql.DB: %w", err)
+	}
+
+	// Money used to be stored as decimals, converting before automigration touches the columns.
+	if err := migrateMoneyColumns(sqlDB); err != nil {
+		return nil, nil, err
+	}
+
+	// Creating tables from our entitites structs and autimigration.
+	err = gormDB.AutoMigrate(&entities.User{}, &entities.Task{}, &entities.AccountingRecord{},
+		&entities.LedgerAccount{}, &entities.JournalEntry{}, &entities.JournalLine{}, &entities.BalanceSnapshot{},
+		&entities.BillingCycle{}, &entities.BillingCycleBalance{}, &entities.StoredEvent{}, &entities.EventSubscription{},
+		&entities.OutboxMessage{}, &entities.DeadLetter{},
+		&entities.ProcessedEvent{}, &entities.WebhookSubscription{}, &entities.WebhookDelivery{},
+		&entities.TaskEvent{}, &entities.TaskSnapshot{}, &entities.TaskHistoryEntry{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to migrate the DB: %w", err)
+	}
+	if err := migrateCommitOrder(sqlDB); err != nil {
+		return nil, nil, err
+	}
+
+	if err := importTaskStreams(sqlDB); err != nil {
+		return nil, nil, err
+	}
+
+	if err := initLedger(sqlDB); err != nil {
+		return nil, nil, err
+	}
+	if err := migrateAccountingConsumer(sqlDB); err != nil {
+		return nil, nil, err
+	}
+
+	log.Println("DB connected and migrated successfully.")
+	return sqlDB, gormDB, nil
+}
+
+// Creating the database if it doesn't exist yet.
+func createDatabase(config Config) error {
 	connectStringNoDB := fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s sslmode=%s",
 		config.DBHost, config.DBPort, config.DBUser, config.DBPass, config.DBSSLMode,
@@ -25,113 +80,283 @@ func InitDB(config Config) (*sql.DB, *gorm.DB, error) {
 
 	sqlDB, err := sql.Open("postgres", connectStringNoDB)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error connecting to postgres server: %w", err)
+		return fmt.Errorf("error connecting to postgres server: %w", err)
 	}
+	defer sqlDB.Close() // The connection isn't needed once the database is there.
 
 	// Checking if our target DB exists. We're extracting a boolean from the query and an error
 	// means there was a problem with the check.
 	var itExists bool
-	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = '%s'", config.DBName)
+	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = '%s')", config.DBName)
 	err = sqlDB.QueryRow(query).Scan(&itExists)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error checking if database exists: %w", err)
+		return fmt.Errorf("error checking if database exists: %w", err)
 	}
 
 	// We create the DB if it doesn't exist.
 	if !itExists {
 		_, err = sqlDB.Exec(fmt.Sprintf("CREATE DATABASE %s", config.DBName))
 		if err != nil {
-			return nil, nil, fmt.Errorf("couldn't create the database: %w", err)
+			return fmt.Errorf("couldn't create the database: %w", err)
 		}
 		log.Printf("Database %s created.\n", config.DBName)
 	} else {
 		log.Printf("Database %s already exists.\n", config.DBName)
 	}
-	sqlDB.Close() // Closing the initial connection we made to the server since it's not needed anymore.
 
-	// Connecting to the target db. We'll use the string created earlier and att dbname to it.
-	connectStringWithDB := fmt.Sprintf("%s dbname=%s", connectStringNoDB, config.DBName)
+	return nil
+}
+
+// Connecting to the TES database without creating or migrating anything, for services that only
+// keep tables of their own next to the stored events (e.g. analytics). TES creates the database.
+func ConnectDB(config Config) (*sql.DB, error) {
+	connectString := fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s sslmode=%s dbname=%s",
+		config.DBHost, config.DBPort, config.DBUser, config.DBPass, config.DBSSLMode, config.DBName,
+	)
 
-	sqlDB, err = sql.Open("postgres", connectStringWithDB)
+	sqlDB, err := sql.Open("postgres", connectString)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error connecting to target database: %w", err)
+		return nil, fmt.Errorf("error connecting to target database: %w", err)
 	}
 
 	if err := sqlDB.Ping(); err != nil {
-		return nil, nil, fmt.Errorf("connection was successful but DB is not responding: %w", err)
+		sqlDB.Close()
+		return nil, fmt.Errorf("connection was successful but DB is not responding: %w", err)
 	}
 
-	// Wrapping the sql.DB we've opened with an gorm.DB object.
-	gormDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	return sqlDB, nil
+}
+
+// Common subset of *sql.DB and *sql.Tx so the same queries can run inside or outside a transaction.
+type queryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Creating a new task with prices decided by a pricing policy and returning its taskID. A leading
+// [JIRA-ID] in the description is stored separately. The task's stream starts with its creation,
+// prices and assignment, all made by the actor.
+func CreateTask(db queryer, actor businesslogic.Actor, description string, assignedTo int, prices businesslogic.TaskPrices) (int, error) {
+	taskID, err := nextTaskID(db)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to initialise GORM with an existing sql.DB: %w", err)
+		return 0, err
 	}
 
-	// Creating tables from our entitites structs and autimigration.
-	err = gormDB.AutoMigrate(&entities.User{}, &entities.Task{}, &entities.AccountingRecord{})
+	now := time.Now()
+	created := entities.Task{TaskID: taskID}
+	task := created
+	jiraID, description := businesslogic.SplitJiraID(description)
+	changes := []struct {
+		eventType string
+		data      entities.TaskEventData
+	}{
+		{entities.TaskEventCreated, entities.TaskEventData{JiraID: jiraID, Description: description}},
+		{entities.TaskEventPriceSet, entities.TaskEventData{AssignFee: &prices.AssignFee, Price: &prices.Reward}},
+		{entities.TaskEventAssigned, entities.TaskEventData{To: assignedTo}},
+	}
+	var recorded []entities.TaskEvent
+	for _, change := range changes {
+		event, err := businesslogic.RecordTaskEvent(&task, change.eventType, change.data, actor.UserID, now)
+		if err != nil {
+			return 0, err
+		}
+		recorded = append(recorded, event)
+	}
+
+	if err := saveTaskEvents(db, created, recorded); err != nil {
+		return 0, fmt.Errorf("failed to create task: %w", err)
+	}
+
+	return taskID, nil
+}
+
+// Columns selected for a task, with timestamps rendered the same way they are written.
+const taskColumns = `task_id, COALESCE(jira_id, ''), description, assigned_to, status, assign_fee, price,
+	COALESCE(to_char(creation_time, 'YYYY-MM-DD HH24:MI:SS'), ''),
+	COALESCE(to_char(completion_time, 'YYYY-MM-DD HH24:MI:SS'), ''),
+	COALESCE(to_char(last_updated, 'YYYY-MM-DD HH24:MI:SS'), ''), version`
+
+// Implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTask(row rowScanner) (entities.Task, error) {
+	var task entities.Task
+	err := row.Scan(&task.TaskID, &task.JiraID, &task.Description, &task.AssignedTo, &task.Status, &task.AssignFee, &task.Price,
+		&task.CreationTime, &task.CompletionTime, &task.LastUpdated, &task.Version)
+
+	return task, err
+}
+
+// Getting a single task by its ID. Inside a transaction the row is locked until commit.
+func GetTask(db queryer, taskID int) (entities.Task, error) {
+	query := `SELECT ` + taskColumns + ` FROM tasks WHERE task_id = $1`
+	if _, inTx := db.(*sql.Tx); inTx {
+		query += ` FOR UPDATE`
+	}
+
+	task, err := scanTask(db.QueryRow(query, taskID))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to migrate the DB: %w", err)
+		return entities.Task{}, fmt.Errorf("failed to get task %d: %w", taskID, err)
 	}
 
-	log.Println("DB connected and migrated successfully.")
-	return sqlDB, gormDB, nil
+	return task, nil
 }
 
-// Creating a new task and returning its taskID.
-func CreateTask(db *sql.DB, description string, assignedTo int) (int, error) {
-	price := rand.Float64()*20 + 20 // Random price between 20 and 40.
-	query := `INSERT INTO tasks (description, assigned_to, status, price, creation_time, completion_time)` +
-		`VALUES ($1, $2, $3, $4, $5, $6)`
+// Creating a task on the actor's behalf and assigning it to a random worker (see the actor's
+// policy) in one transaction. TaskCreated and TaskAssigned go to the outbox in the same
+// transaction, the accounting consumer charges the worker from the latter.
+func CreateAssignedTask(db *sql.DB, actor businesslogic.Actor, pricing businesslogic.PricingPolicy, description string, rng *rand.Rand) (entities.Task, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return entities.Task{}, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	result, err := db.Exec(query, description, assignedTo, "pending", price, time.Now().Format("YYYY-MM-DD HH:MM"), "")
+	users, err := GetUsers(tx)
 	if err != nil {
-		return 0, err
+		return entities.Task{}, err
+	}
+	worker, err := businesslogic.PickAssignee(businesslogic.EligibleAssignees(actor.Policy, users), rng)
+	if err != nil {
+		return entities.Task{}, err
 	}
 
-	taskID, err := result.LastInsertId()
+	taskID, err := CreateTask(tx, actor, description, worker.UserID, pricing.PriceTask(description))
 	if err != nil {
-		return 0, err
+		return entities.Task{}, err
+	}
+	task, err := GetTask(tx, taskID)
+	if err != nil {
+		return entities.Task{}, err
+	}
+
+	created := []events.Event{
+		events.TaskCreated{Task: task},
+		events.TaskAssigned{TaskID: task.TaskID, To: worker.UserID, Fee: businesslogic.AssignmentFee(task)},
+	}
+	if err := writeOutbox(tx, tesProducer, created); err != nil {
+		return entities.Task{}, err
 	}
 
-	return int(taskID), nil
+	if err := tx.Commit(); err != nil {
+		return entities.Task{}, fmt.Errorf("failed to commit the new task: %w", err)
+	}
+
+	return task, nil
 }
 
-func UpdateTask(db *sql.DB, description, status string, taskID, assignedTo int, price float64, isCompleted bool) error {
-	query := `
-		UPDATE tasks
-		SET description = $1,
-			status = $2,
-			assigned_to = $3,
-			price = $4,
-			is_completed = $5
-		WHERE task_id = $6
-		`
-	_, err := db.Exec(query, description, status, assignedTo, price, isCompleted, taskID)
+// Changing only the status of a task on behalf of an actor.
+func UpdateTaskStatus(db *sql.DB, actor businesslogic.Actor, taskID int, status string) error {
+	to, err := businesslogic.ParseTaskStatus(status)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	task, err := GetTask(tx, taskID)
 	if err != nil {
-		return fmt.Errorf("failed to update task: %w", err)
+		return err
+	}
+
+	before := task
+	transition, err := businesslogic.RecordTransition(&task, to, actor, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := saveTaskEvents(tx, before, []entities.TaskEvent{transition}); err != nil {
+		return err
+	}
+
+	if err := writeOutbox(tx, tesProducer, transitionEvents(task)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit task %d: %w", taskID, err)
 	}
 
 	return nil
 }
 
-// Getting tasks that are assigned to a specific user.
-func GetTasks(db *sql.DB, userID int) ([]entities.Task, error) {
-	query := `SELECT task_id, description, assigned_to, status, price FROM tasks WHERE assigned_to = $1`
-	rows, err := db.Query(query, userID)
+// The events to put in the outbox along with a status change. The reward of a completed task
+// is paid by the accounting consumer from its TaskCompleted, which commits with the change.
+func transitionEvents(task entities.Task) []events.Event {
+	if task.Status != string(businesslogic.StatusCompleted) {
+		return nil
+	}
+
+	completed := events.TaskCompleted{TaskID: task.TaskID, CompletedBy: task.AssignedTo, Reward: task.Price,
+		CompletedAt: task.CompletionTime}
+	return []events.Event{completed}
+}
+
+// Criteria for listing tasks. Zero values mean "don't filter on this".
+type TaskFilter struct {
+	AssignedTo  int
+	Status      string
+	CreatedFrom time.Time // Inclusive.
+	CreatedTo   time.Time // Exclusive.
+}
+
+// Getting tasks that match the filter, oldest first.
+func ListTasks(db queryer, filter TaskFilter) ([]entities.Task, error) {
+	var conditions []string
+	var args []any
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.AssignedTo != 0 {
+		addCondition("assigned_to = $%d", filter.AssignedTo)
+	}
+	if filter.Status != "" {
+		addCondition("status = $%d", filter.Status)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		addCondition("creation_time >= $%d", filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		addCondition("creation_time < $%d", filter.CreatedTo)
+	}
+
+	query := `SELECT ` + taskColumns + ` FROM tasks`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY task_id`
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
 	}
 	defer rows.Close()
 
-	var tasks []entities.Task
+	tasks := []entities.Task{}
 	for rows.Next() {
-		var task entities.Task
-		if err := rows.Scan(&task.TaskID, &task.Description, &task.AssignedTo, &task.Status, &task.Price); err != nil {
+		task, err := scanTask(rows)
+		if err != nil {
 			return nil, err
 		}
 		tasks = append(tasks, task)
 	}
-	return tasks, nil
+
+	return tasks, rows.Err()
+}
+
+// Getting tasks that are assigned to a specific user.
+func GetTasks(db queryer, userID int) ([]entities.Task, error) {
+	return ListTasks(db, TaskFilter{AssignedTo: userID})
 }
 
 func CreateUser(db *sql.DB, name, email, role, joinedAt string) (int, error) {
@@ -159,7 +384,7 @@ func GetUser(db *sql.DB, userIDp *int, name, email, role string) (entities.User,
 		query = `
 		SELECT user_id, name, email, role, joined_at 
 		FROM users 
-		WHERE id = $1
+		WHERE user_id = $1
 		`
 		err = db.QueryRow(query, *userIDp).Scan(&user.UserID, &user.Name, &user.Email, &user.Role, &user.JoinedAt)
 	} else {
@@ -180,55 +405,42 @@ func GetUser(db *sql.DB, userIDp *int, name, email, role string) (entities.User,
 	return user, nil
 }
 
-func UpdateUser(db *sql.DB, userID int, name, email, role string) error {
+// Getting every user known to TES, removed ones included.
+func GetUsers(db queryer) ([]entities.User, error) {
 	query := `
-	UPDATE users
-	SET name = $1, email = $2, role = $3
-	WHERE user_id = $4
+	SELECT user_id, name, email, role, joined_at, COALESCE(left_at, ''), version, COALESCE(removed_at, '')
+	FROM users
+	ORDER BY user_id
 	`
-
-	_, err := db.Exec(query, name, email, role, userID)
+	rows, err := db.Query(query)
 	if err != nil {
-		return fmt.Errorf("failed to update user: %w", err)
+		return nil, fmt.Errorf("issue with getting users from the DB: %w", err)
 	}
+	defer rows.Close()
 
-	return nil
-}
-
-func CreateAccountingRecord(db *sql.DB, userID, taskID int, status string, assignedTo int, price float64, isCompleted bool) (int, error) {
-	var recordID int
-
-	query := `
-	INSERT INTO accounting_records (user_id, task_id, status, assigned_to, price, is_completed)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	RETURNING record_id
-	`
-	err := db.QueryRow(query, userID, taskID, status, assignedTo, price, isCompleted).Scan(&recordID)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create an accounting record: %w", err)
+	var users []entities.User
+	for rows.Next() {
+		var user entities.User
+		if err := rows.Scan(&user.UserID, &user.Name, &user.Email, &user.Role, &user.JoinedAt, &user.LeftAt,
+			&user.Version, &user.RemovedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
 	}
 
-	return recordID, nil
+	return users, rows.Err()
 }
 
-// Updating an existing accounting record to the new values sent to the function.
-func UpdateAccountingRecord(db *gorm.DB, recordID, assignedTo, taskID int, status string, amount float64) error {
-	var record entities.AccountingRecord
-
-	if err := db.First(&record, recordID).Error; err != nil {
-		return fmt.Errorf("record not found: %w", err)
-	}
-
-	// In case the record does exist, we update it.
-	record.Status = status
-	record.UserID = assignedTo
-	record.TaskID = taskID
-	record.Amount = amount
-	record.LastUpdated = time.Now().Format("YYYY-MM-DD HH:MM")
+func UpdateUser(db *sql.DB, userID int, name, email, role string) error {
+	query := `
+	UPDATE users
+	SET name = $1, email = $2, role = $3
+	WHERE user_id = $4
+	`
 
-	// Saving the updated record to the db instead of the old one.
-	if err := db.Save(&record).Error; err != nil {
-		return fmt.Errorf("couldn't save the updated accounting record: %w", err)
+	_, err := db.Exec(query, name, email, role, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,141 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Needs a Postgres server to create throwaway databases on: TES_TEST_DSN, e.g.
+// "host=localhost port=5432 user=postgres password=postgres sslmode=disable". Every test gets a
+// database of its own, migrated by InitDB and dropped afterwards.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TES_TEST_DSN isn't set")
+	}
+
+	config := Config{DBHost: "localhost", DBPort: 5432, DBUser: "postgres", DBSSLMode: "disable",
+		DBName: fmt.Sprintf("ates_test_%d", time.Now().UnixNano())}
+	for _, field := range strings.Fields(dsn) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "host":
+			config.DBHost = value
+		case "port":
+			config.DBPort, _ = strconv.Atoi(value)
+		case "user":
+			config.DBUser = value
+		case "password":
+			config.DBPass = value
+		case "sslmode":
+			config.DBSSLMode = value
+		}
+	}
+
+	db, _, err := InitDB(config)
+	if err != nil {
+		t.Fatalf("Error creating a test database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if admin, err := sql.Open("postgres", dsn); err == nil {
+			admin.Exec(`DROP DATABASE IF EXISTS ` + config.DBName)
+			admin.Close()
+		}
+	})
+
+	return db
+}
+
+// A new task's stream and history name whoever created it.
+func TestCreateAssignedTaskRecordsActor(t *testing.T) {
+	db := newTestDB(t)
+	if err := upsertReplicaUser(db, entities.User{UserID: 7, Name: "worker", Role: entities.RoleWorker, JoinedAt: "2024-01-01",
+		LastUpdated: "2024-01-01 00:00:00", Version: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	pricing := businesslogic.FixedPricing{AssignFee: entities.NewMoney(1500), Reward: entities.NewMoney(3000)}
+	task, err := CreateAssignedTask(db, businesslogic.Actor{UserID: 3, Role: entities.RoleManager}, pricing, "Write docs",
+		rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	stream, err := TaskStream(db, task.TaskID, 0)
+	if err != nil || len(stream) == 0 {
+		t.Fatalf("Expected the task's stream, got %v (%v)", stream, err)
+	}
+	for _, event := range stream {
+		if event.ActorID != 3 {
+			t.Errorf("Expected the %s event made by user 3, got %d", event.Type, event.ActorID)
+		}
+	}
+	history, err := GetTaskHistory(db, task.TaskID)
+	if err != nil || len(history) == 0 {
+		t.Fatalf("Expected the task's history, got %v (%v)", history, err)
+	}
+	for _, entry := range history {
+		if entry.ActorID != 3 {
+			t.Errorf("Expected the %s change made by user 3, got %d", entry.Field, entry.ActorID)
+		}
+	}
+}
+
+// Tasks from before assignment fees are priced by the policy, once. Tasks the policy priced at 0
+// keep their fee.
+func TestBackfillAssignFees(t *testing.T) {
+	db := newTestDB(t)
+	if err := upsertReplicaUser(db, entities.User{UserID: 7, Name: "worker", Role: entities.RoleWorker, JoinedAt: "2024-01-01",
+		LastUpdated: "2024-01-01 00:00:00", Version: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err := db.Exec(`INSERT INTO tasks (description, assigned_to, status, price, creation_time, last_updated)
+		VALUES ('Old task', 7, 'pending', 3000, '2024-01-01 00:00:00', '2024-01-01 00:00:00')`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := importTaskStreams(db); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	free := businesslogic.FixedPricing{AssignFee: entities.NewMoney(0), Reward: entities.NewMoney(3000)}
+	freeTask, err := CreateAssignedTask(db, businesslogic.Actor{UserID: 3, Role: entities.RoleManager}, free, "Free task",
+		rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pricing := businesslogic.FixedPricing{AssignFee: entities.NewMoney(1500), Reward: entities.NewMoney(4000)}
+	if priced, err := BackfillAssignFees(db, pricing); err != nil || priced != 1 {
+		t.Fatalf("Expected one task priced, got %d (%v)", priced, err)
+	}
+	if priced, err := BackfillAssignFees(db, pricing); err != nil || priced != 0 {
+		t.Errorf("Expected nothing left to price, got %d (%v)", priced, err)
+	}
+
+	// The fee is in the stream, a rebuilt projection keeps it.
+	if _, err := RebuildTaskProjections(db); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tasks, err := ListTasks(db, TaskFilter{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, task := range tasks {
+		expected := entities.NewMoney(1500)
+		if task.TaskID == freeTask.TaskID {
+			expected = entities.NewMoney(0)
+		}
+		if task.AssignFee != expected || task.Price != entities.NewMoney(3000) {
+			t.Errorf("Task %d: expected a fee of %s and the reward kept, got %s and %s", task.TaskID, expected, task.AssignFee, task.Price)
+		}
+	}
+}
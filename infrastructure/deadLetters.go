@@ -0,0 +1,288 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Counts events subscribers gave up on, served on /debug/vars.
+var eventsDeadLettered = expvar.NewInt("events_dead_lettered_total")
+
+// Queued and replayed dead letters are left as they are, only dead ones can be corrected.
+var ErrDeadLetterNotDead = errors.New("the dead letter is queued or was replayed already")
+
+const deadLetterColumns = `dead_letter_id, subscriber, stored_event_id, event_name, payload, error, attempts, status,
+	to_char(dead_at, 'YYYY-MM-DD HH24:MI:SS'), COALESCE(to_char(replayed_at, 'YYYY-MM-DD HH24:MI:SS'), '')`
+
+func scanDeadLetter(row interface{ Scan(...any) error }) (entities.DeadLetter, error) {
+	var letter entities.DeadLetter
+	err := row.Scan(&letter.DeadLetterID, &letter.Subscriber, &letter.StoredEventID, &letter.EventName, &letter.Payload,
+		&letter.Error, &letter.Attempts, &letter.Status, &letter.DeadAt, &letter.ReplayedAt)
+
+	return letter, err
+}
+
+// Filing an event the subscriber gave up on. Called in the dispatch transaction, so the event is
+// dead-lettered and skipped together.
+func deadLetter(db queryer, subscriber string, stored storedEvent, cause error, attempts int) error {
+	query := `
+	INSERT INTO dead_letters (subscriber, stored_event_id, event_name, payload, error, attempts, status, dead_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := db.Exec(query, subscriber, stored.id, stored.name, string(stored.payload), cause.Error(), attempts,
+		entities.DeadLetterDead, time.Now().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter event %d for %s: %w", stored.id, subscriber, err)
+	}
+	eventsDeadLettered.Add(1)
+
+	return nil
+}
+
+// Replaying the dead letters queued for the subscriber, oldest first. They're handled out of
+// order with the rest of the stream, consumers are expected to cope (e.g. by version). One that
+// fails again goes back to dead with the new error. Returns how many were replayed.
+func replayDeadLetters(db *sql.DB, subscriber string, handle func(eventName string, payload []byte) error) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT ` + deadLetterColumns + `
+	FROM dead_letters
+	WHERE subscriber = $1 AND status = $2
+	ORDER BY dead_letter_id
+	FOR UPDATE SKIP LOCKED
+	`
+	rows, err := tx.Query(query, subscriber, entities.DeadLetterQueued)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the queued dead letters of %s: %w", subscriber, err)
+	}
+	var queued []entities.DeadLetter
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		queued = append(queued, letter)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read the queued dead letters of %s: %w", subscriber, err)
+	}
+
+	now := time.Now().Format(time.DateTime)
+	replayed := 0
+	for _, letter := range queued {
+		if err := handle(letter.EventName, []byte(letter.Payload)); err != nil {
+			_, err = tx.Exec(`UPDATE dead_letters SET status = $1, attempts = attempts + 1, error = $2 WHERE dead_letter_id = $3`,
+				entities.DeadLetterDead, err.Error(), letter.DeadLetterID)
+		} else {
+			_, err = tx.Exec(`UPDATE dead_letters SET status = $1, replayed_at = $2 WHERE dead_letter_id = $3`,
+				entities.DeadLetterReplayed, now, letter.DeadLetterID)
+			replayed++
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to update dead letter %d: %w", letter.DeadLetterID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the replayed dead letters of %s: %w", subscriber, err)
+	}
+
+	return replayed, nil
+}
+
+// Criteria for listing dead letters. Zero values mean "don't filter on this".
+type DeadLetterFilter struct {
+	Subscriber string
+	Status     string // One of the entities.DeadLetter* statuses.
+	Limit      int    // Defaults to 100.
+}
+
+// Getting the dead letters that match the filter, newest first.
+func ListDeadLetters(db queryer, filter DeadLetterFilter) ([]entities.DeadLetter, error) {
+	var conditions []string
+	var args []any
+	if filter.Subscriber != "" {
+		args = append(args, filter.Subscriber)
+		conditions = append(conditions, fmt.Sprintf("subscriber = $%d", len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = eventBatchSize
+	}
+
+	query := `SELECT ` + deadLetterColumns + ` FROM dead_letters`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(` ORDER BY dead_letter_id DESC LIMIT $%d`, len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	letters := []entities.DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, rows.Err()
+}
+
+// Getting a dead letter, locked when called in a transaction. Wraps sql.ErrNoRows when there's none.
+func GetDeadLetter(db queryer, deadLetterID int64) (entities.DeadLetter, error) {
+	query := `SELECT ` + deadLetterColumns + ` FROM dead_letters WHERE dead_letter_id = $1`
+	if _, inTx := db.(*sql.Tx); inTx {
+		query += ` FOR UPDATE`
+	}
+
+	letter, err := scanDeadLetter(db.QueryRow(query, deadLetterID))
+	if err != nil {
+		return entities.DeadLetter{}, fmt.Errorf("failed to get dead letter %d: %w", deadLetterID, err)
+	}
+
+	return letter, nil
+}
+
+// Replacing the envelope of a dead letter, e.g. to fix what made it fail. The new one must open
+// through the schema registry, otherwise the error wraps schemas.ErrInvalidEvent (or the other
+// registry errors).
+func EditDeadLetter(db *sql.DB, deadLetterID int64, payload []byte) (entities.DeadLetter, error) {
+	var envelope events.Envelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return entities.DeadLetter{}, fmt.Errorf("%w: the payload isn't an envelope: %v", schemas.ErrInvalidEvent, err)
+	}
+	if _, err := schemas.Default().Open(envelope); err != nil {
+		return entities.DeadLetter{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return entities.DeadLetter{}, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	letter, err := GetDeadLetter(tx, deadLetterID)
+	if err != nil {
+		return entities.DeadLetter{}, err
+	}
+	if letter.Status != entities.DeadLetterDead {
+		return entities.DeadLetter{}, fmt.Errorf("dead letter %d: %w", deadLetterID, ErrDeadLetterNotDead)
+	}
+
+	_, err = tx.Exec(`UPDATE dead_letters SET event_name = $1, payload = $2 WHERE dead_letter_id = $3`,
+		envelope.EventName, string(payload), deadLetterID)
+	if err != nil {
+		return entities.DeadLetter{}, fmt.Errorf("failed to edit dead letter %d: %w", deadLetterID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return entities.DeadLetter{}, fmt.Errorf("failed to commit dead letter %d: %w", deadLetterID, err)
+	}
+
+	return GetDeadLetter(db, deadLetterID)
+}
+
+// Queueing dead letters to be replayed on their subscriber's next poll. Without IDs every dead
+// letter is queued. Returns how many were.
+func QueueDeadLetters(db queryer, deadLetterIDs ...int64) (int, error) {
+	if deadLetterIDs == nil {
+		deadLetterIDs = []int64{}
+	}
+
+	query := `
+	UPDATE dead_letters SET status = $1
+	WHERE status = $2 AND (cardinality($3::bigint[]) = 0 OR dead_letter_id = ANY($3::bigint[]))
+	`
+	result, err := db.Exec(query, entities.DeadLetterQueued, entities.DeadLetterDead, pq.Array(deadLetterIDs))
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue dead letters: %w", err)
+	}
+
+	queued, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(queued), nil
+}
+
+// Moving a subscriber's cursor back to just before the first event stored at or after since, so
+// it handles them all again on its next poll. A subscriber that never ran starts there, which is
+// how a new read model is filled from a point in history. A consumer also forgets it processed
+// them. Returns how many events it has ahead.
+func RewindSubscriber(db *sql.DB, subscriber string, since time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The cursor goes on the last event before the first one at or after since, in the order
+	// events are read (see eventPosition), or on the last event there is if none are.
+	var cursor eventPosition
+	err = tx.QueryRow(`
+	WITH rewind_to AS (
+		SELECT tx_id, event_id FROM stored_events WHERE occurred_at >= $1 ORDER BY tx_id, event_id LIMIT 1
+	)
+	SELECT e.tx_id, e.event_id FROM stored_events e
+	WHERE NOT EXISTS (SELECT 1 FROM rewind_to) OR (e.tx_id, e.event_id) < (SELECT tx_id, event_id FROM rewind_to)
+	ORDER BY e.tx_id DESC, e.event_id DESC
+	LIMIT 1
+	`, since.Format(time.DateTime)).Scan(&cursor.txID, &cursor.eventID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to find where to rewind %s to: %w", subscriber, err)
+	}
+
+	query := `
+	INSERT INTO event_subscriptions (subscriber, last_tx_id, last_event_id, attempts, last_error) VALUES ($1, $2::xid8, $3, 0, '')
+	ON CONFLICT (subscriber) DO UPDATE
+	SET last_tx_id = EXCLUDED.last_tx_id, last_event_id = EXCLUDED.last_event_id, attempts = 0, last_error = ''
+	`
+	if _, err := tx.Exec(query, subscriber, cursor.txID, cursor.eventID); err != nil {
+		return 0, fmt.Errorf("failed to rewind %s: %w", subscriber, err)
+	}
+
+	// Consumers would skip the events they processed before as duplicates.
+	_, err = tx.Exec(`
+	DELETE FROM processed_events
+	WHERE consumer = $1 AND event_id IN (SELECT payload->>'event_id' FROM stored_events WHERE (tx_id, event_id) > ($2::xid8, $3))
+	`, subscriber, cursor.txID, cursor.eventID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to forget the events %s processed: %w", subscriber, err)
+	}
+
+	var ahead int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM stored_events WHERE (tx_id, event_id) > ($1::xid8, $2)`, cursor.txID, cursor.eventID).
+		Scan(&ahead)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count the events ahead of %s: %w", subscriber, err)
+	}
+
+	return ahead, tx.Commit()
+}
@@ -0,0 +1,208 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Storing an event as if it occurred at the given time.
+func storeEventAt(t *testing.T, db *sql.DB, event events.Event, at time.Time) events.Envelope {
+	t.Helper()
+	envelope, err := schemas.Default().Seal("tes", event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO stored_events (name, payload, occurred_at) VALUES ($1, $2, $3)`,
+		envelope.EventName, string(payload), at.Format(time.DateTime))
+	if err != nil {
+		t.Fatalf("Error storing an event: %v", err)
+	}
+	return envelope
+}
+
+// Storing the events and having the subscriber give up on every one of them.
+func deadLetterEvents(t *testing.T, db *sql.DB, subscriber string, evs ...events.Event) []entities.DeadLetter {
+	t.Helper()
+	storeEvents(t, db, evs...)
+	stored, err := storedEventsAfter(db, eventPosition{}, time.Time{}, eventBatchSize)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, s := range stored[len(stored)-len(evs):] {
+		if err := deadLetter(db, subscriber, s, errors.New("ledger is down"), maxEventAttempts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	letters, err := ListDeadLetters(db, DeadLetterFilter{Subscriber: subscriber, Limit: len(evs)})
+	if err != nil || len(letters) != len(evs) {
+		t.Fatalf("Expected %d dead letters, got %d (%v)", len(evs), len(letters), err)
+	}
+	return letters
+}
+
+func TestListDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	deadLetterEvents(t, db, "accounting", assigned(1, 7), assigned(2, 7))
+	mine := deadLetterEvents(t, db, "test", assigned(3, 7), assigned(4, 7), assigned(5, 7))
+	if _, err := QueueDeadLetters(db, mine[0].DeadLetterID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		filter   DeadLetterFilter
+		expected int
+	}{
+		{DeadLetterFilter{}, 5},
+		{DeadLetterFilter{Subscriber: "test"}, 3},
+		{DeadLetterFilter{Subscriber: "test", Status: entities.DeadLetterDead}, 2},
+		{DeadLetterFilter{Status: entities.DeadLetterQueued}, 1},
+		{DeadLetterFilter{Limit: 2}, 2},
+	}
+	for _, c := range cases {
+		letters, err := ListDeadLetters(db, c.filter)
+		if err != nil || len(letters) != c.expected {
+			t.Errorf("%+v: expected %d dead letters, got %d (%v)", c.filter, c.expected, len(letters), err)
+		}
+		for i := 1; i < len(letters); i++ {
+			if letters[i].DeadLetterID > letters[i-1].DeadLetterID {
+				t.Errorf("%+v: expected newest first, got %d before %d", c.filter, letters[i-1].DeadLetterID, letters[i].DeadLetterID)
+			}
+		}
+	}
+}
+
+func TestEditDeadLetter(t *testing.T) {
+	db := newTestDB(t)
+	letter := deadLetterEvents(t, db, "test", assigned(1, 7))[0]
+
+	fixed, err := schemas.Default().Seal("tes", assigned(1, 8))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	payload, _ := json.Marshal(fixed)
+	edited, err := EditDeadLetter(db, letter.DeadLetterID, payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var envelope events.Envelope
+	if err := json.Unmarshal([]byte(edited.Payload), &envelope); err != nil || envelope.EventID != fixed.EventID {
+		t.Errorf("Expected the new envelope stored, got %s (%v)", edited.Payload, err)
+	}
+
+	if _, err := EditDeadLetter(db, letter.DeadLetterID, []byte(`{"event_name": "TaskAssigned"`)); !errors.Is(err, schemas.ErrInvalidEvent) {
+		t.Errorf("Expected ErrInvalidEvent for a broken envelope, got %v", err)
+	}
+	if _, err := EditDeadLetter(db, letter.DeadLetterID+100, payload); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for a missing dead letter, got %v", err)
+	}
+	if _, err := QueueDeadLetters(db, letter.DeadLetterID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := EditDeadLetter(db, letter.DeadLetterID, payload); !errors.Is(err, ErrDeadLetterNotDead) {
+		t.Errorf("Expected ErrDeadLetterNotDead for a queued dead letter, got %v", err)
+	}
+}
+
+// Queued dead letters are replayed on the subscriber's next poll, those failing again go back to dead.
+func TestQueueAndReplayDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	letters := deadLetterEvents(t, db, "test", assigned(1, 7), assigned(2, 7), assigned(3, 7))
+	consumer := NewConsumer(db, "test", 1)
+	if _, err := consumer.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if queued, err := QueueDeadLetters(db, letters[0].DeadLetterID); err != nil || queued != 1 {
+		t.Fatalf("Expected one dead letter queued, got %d (%v)", queued, err)
+	}
+	if queued, err := QueueDeadLetters(db); err != nil || queued != 2 {
+		t.Fatalf("Expected the other two queued, got %d (%v)", queued, err)
+	}
+	if queued, err := QueueDeadLetters(db, letters[0].DeadLetterID); err != nil || queued != 0 {
+		t.Errorf("Expected a queued dead letter left alone, got %d (%v)", queued, err)
+	}
+
+	var replayed []int
+	consumer.Handle(events.TaskAssignedName, func(_ *sql.Tx, _ events.Envelope, event events.Event) error {
+		e := event.(events.TaskAssigned)
+		if e.TaskID == 2 {
+			return errors.New("still down")
+		}
+		replayed = append(replayed, e.TaskID)
+		return nil
+	})
+	if _, err := consumer.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(replayed) != 2 || replayed[0] != 1 || replayed[1] != 3 {
+		t.Errorf("Expected tasks 1 and 3 replayed oldest first, got %v", replayed)
+	}
+	for _, letter := range letters {
+		letter, err := GetDeadLetter(db, letter.DeadLetterID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var envelope events.Envelope
+		json.Unmarshal([]byte(letter.Payload), &envelope)
+		if event, _ := schemas.Default().Open(envelope); event.(events.TaskAssigned).TaskID == 2 {
+			if letter.Status != entities.DeadLetterDead || letter.Attempts != maxEventAttempts+1 || letter.Error != "still down" {
+				t.Errorf("Expected the failing replay back to dead, got %+v", letter)
+			}
+		} else if letter.Status != entities.DeadLetterReplayed || letter.ReplayedAt == "" {
+			t.Errorf("Expected the dead letter replayed, got %+v", letter)
+		}
+	}
+}
+
+func TestRewindSubscriber(t *testing.T) {
+	db := newTestDB(t)
+	day := time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local)
+	for i := range 3 {
+		storeEventAt(t, db, assigned(i+1, 7), day.AddDate(0, 0, i))
+	}
+
+	var handled []int
+	consumer := NewConsumer(db, "test", 1)
+	consumer.Handle(events.TaskAssignedName, func(_ *sql.Tx, _ events.Envelope, event events.Event) error {
+		handled = append(handled, event.(events.TaskAssigned).TaskID)
+		return nil
+	})
+	if _, err := consumer.Dispatch(); err != nil || len(handled) != 3 {
+		t.Fatalf("Expected the three events handled, got %v (%v)", handled, err)
+	}
+
+	// The events since the second day are handled again, they aren't skipped as duplicates.
+	if ahead, err := RewindSubscriber(db, "test", day.AddDate(0, 0, 1)); err != nil || ahead != 2 {
+		t.Fatalf("Expected two events ahead, got %d (%v)", ahead, err)
+	}
+	if _, err := consumer.Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(handled) != 5 || handled[3] != 2 || handled[4] != 3 {
+		t.Errorf("Expected tasks 2 and 3 handled again, got %v", handled)
+	}
+
+	// Past the last event the cursor stays at the end.
+	if ahead, err := RewindSubscriber(db, "test", day.AddDate(0, 1, 0)); err != nil || ahead != 0 {
+		t.Errorf("Expected nothing ahead, got %d (%v)", ahead, err)
+	}
+	if subscription := getSubscription(t, db, "test"); subscription.LastEventID != lastStoredEventID(t, db) {
+		t.Errorf("Expected the cursor at the last event, got %+v", subscription)
+	}
+
+	// A subscriber that never ran starts from the beginning.
+	if ahead, err := RewindSubscriber(db, "fresh", time.Time{}); err != nil || ahead != 3 {
+		t.Errorf("Expected three events ahead of a new subscriber, got %d (%v)", ahead, err)
+	}
+}
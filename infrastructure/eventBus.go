@@ -0,0 +1,314 @@
+package infrastructure
+
+import (
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How many events a subscriber handles per transaction.
+const eventBatchSize = 100
+
+// How often a subscriber tries an event before dead-lettering it and moving on.
+const maxEventAttempts = 5
+
+// Marks events that can't succeed however often they're tried, e.g. a payload that doesn't
+// match its schema. They're dead-lettered on the first failure.
+var errPoisonEvent = errors.New("poison event")
+
+// A durable event bus on top of the stored_events table. Sent envelopes are kept forever and
+// every subscriber (a named consumer, e.g. "accounting") reads them in commit order (see
+// eventPosition) from its own cursor, so nothing is lost while it's down. Envelopes are opened through the schema registry,
+// so handlers get the latest version of every event. A handler failing stops its subscriber at
+// that event, which is delivered again on the next poll, up to maxEventAttempts times. After
+// that, or straight away for envelopes that can't be opened, the event goes to the subscriber's
+// dead letters and the subscriber carries on with the next one.
+type PostgresBus struct {
+	db         *sql.DB
+	subscriber string
+	mu         sync.Mutex
+	handlers   map[string][]events.Handler
+}
+
+// The subscriber name identifies the cursor. Buses that only send can leave it empty.
+func NewPostgresBus(db *sql.DB, subscriber string) *PostgresBus {
+	return &PostgresBus{db: db, subscriber: subscriber, handlers: make(map[string][]events.Handler)}
+}
+
+// Storing the envelopes in one transaction, they're all kept or none is.
+func (b *PostgresBus) Send(envelopes ...events.Envelope) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format(time.DateTime)
+	for _, envelope := range envelopes {
+		payload, err := json.Marshal(envelope)
+		if err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", envelope.EventID, err)
+		}
+
+		_, err = tx.Exec(`INSERT INTO stored_events (name, payload, occurred_at) VALUES ($1, $2, $3)`,
+			envelope.EventName, string(payload), now)
+		if err != nil {
+			return fmt.Errorf("failed to store event %s: %w", envelope.EventID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (b *PostgresBus) Subscribe(name string, handler events.Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[name] = append(b.handlers[name], handler)
+}
+
+// Replaying the subscriber's dead letters queued for it, then handling the events stored since
+// its cursor. Returns how many were handled.
+func (b *PostgresBus) Dispatch() (int, error) {
+	if b.subscriber == "" {
+		return 0, fmt.Errorf("the bus has no subscriber name to dispatch for")
+	}
+
+	handlers := b.snapshotHandlers()
+	handled, err := replayDeadLetters(b.db, b.subscriber, func(eventName string, payload []byte) error {
+		return handleEnvelope(handlers[eventName], payload)
+	})
+	if err != nil {
+		return handled, err
+	}
+	for {
+		n, err := b.dispatchBatch()
+		handled += n
+		if err != nil || n < eventBatchSize {
+			return handled, err
+		}
+	}
+}
+
+// The cursor row is locked for the whole batch, so two processes with the same subscriber
+// name never handle the same events concurrently.
+func (b *PostgresBus) dispatchBatch() (int, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	cursor, attempts, err := lockSubscription(tx, b.subscriber)
+	if err != nil {
+		return 0, err
+	}
+
+	batch, err := storedEventsAfter(tx, cursor, time.Time{}, eventBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	handlers := b.snapshotHandlers()
+	handled := 0
+	lastError := ""
+	var handlerErr error
+	for _, stored := range batch {
+		if err := handleEnvelope(handlers[stored.name], stored.payload); err != nil {
+			attempts++
+			if !errors.Is(err, errPoisonEvent) && attempts < maxEventAttempts {
+				lastError = err.Error()
+				handlerErr = fmt.Errorf("%s failed on event %d (%s), attempt %d: %w", b.subscriber, stored.id, stored.name, attempts, err)
+				break
+			}
+			if err := deadLetter(tx, b.subscriber, stored, err, attempts); err != nil {
+				return 0, err
+			}
+			log.Printf("Event bus: %s gave up on event %d (%s) after %d attempts: %v\n", b.subscriber, stored.id, stored.name, attempts, err)
+		}
+		cursor = stored.position()
+		attempts = 0
+		handled++
+	}
+
+	if err := saveSubscription(tx, b.subscriber, cursor, attempts, lastError); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the cursor of %s: %w", b.subscriber, err)
+	}
+
+	return handled, handlerErr
+}
+
+// Registering the subscriber if it's new and locking its cursor row. Returns the cursor and the
+// failed attempts at the event after it.
+func lockSubscription(tx *sql.Tx, subscriber string) (eventPosition, int, error) {
+	_, err := tx.Exec(`INSERT INTO event_subscriptions (subscriber, last_event_id, attempts) VALUES ($1, 0, 0) ON CONFLICT (subscriber) DO NOTHING`,
+		subscriber)
+	if err != nil {
+		return eventPosition{}, 0, fmt.Errorf("failed to register subscriber %s: %w", subscriber, err)
+	}
+
+	var cursor eventPosition
+	var attempts int
+	err = tx.QueryRow(`SELECT last_tx_id, last_event_id, attempts FROM event_subscriptions WHERE subscriber = $1 FOR UPDATE`, subscriber).
+		Scan(&cursor.txID, &cursor.eventID, &attempts)
+	if err != nil {
+		return eventPosition{}, 0, fmt.Errorf("failed to read the cursor of %s: %w", subscriber, err)
+	}
+
+	return cursor, attempts, nil
+}
+
+func saveSubscription(tx *sql.Tx, subscriber string, cursor eventPosition, attempts int, lastError string) error {
+	_, err := tx.Exec(`UPDATE event_subscriptions SET last_tx_id = $1::xid8, last_event_id = $2, attempts = $3, last_error = $4 WHERE subscriber = $5`,
+		cursor.txID, cursor.eventID, attempts, lastError, subscriber)
+	if err != nil {
+		return fmt.Errorf("failed to move the cursor of %s: %w", subscriber, err)
+	}
+
+	return nil
+}
+
+// Where a reader is in stored_events. Event IDs are handed out when events are inserted, so an
+// event can commit after events with higher IDs were already read. Events are read by the
+// transaction that stored them first and only from transactions older than any still running
+// (pg_snapshot_xmin), so nothing can commit behind a position once it's been read.
+type eventPosition struct {
+	txID    uint64
+	eventID int64
+}
+
+// An event as kept in stored_events.
+type storedEvent struct {
+	txID       uint64
+	id         int64
+	name       string
+	payload    []byte
+	occurredAt string
+}
+
+func (s storedEvent) position() eventPosition {
+	return eventPosition{txID: s.txID, eventID: s.id}
+}
+
+// Reading events in commit order, after the given position and, unless it's zero, not before
+// since. Events of transactions still running, or newer than one that is, wait for the next read.
+func storedEventsAfter(db queryer, after eventPosition, since time.Time, limit int) ([]storedEvent, error) {
+	query := `
+	SELECT tx_id, event_id, name, payload, to_char(occurred_at, 'YYYY-MM-DD HH24:MI:SS')
+	FROM stored_events
+	WHERE (tx_id, event_id) > ($1::xid8, $2) AND tx_id < pg_snapshot_xmin(pg_current_snapshot())
+		AND ($3::timestamp IS NULL OR occurred_at >= $3)
+	ORDER BY tx_id, event_id
+	LIMIT $4
+	`
+	rows, err := db.Query(query, after.txID, after.eventID, nullTime(since), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	defer rows.Close()
+
+	var batch []storedEvent
+	for rows.Next() {
+		var stored storedEvent
+		if err := rows.Scan(&stored.txID, &stored.id, &stored.name, &stored.payload, &stored.occurredAt); err != nil {
+			return nil, err
+		}
+		batch = append(batch, stored)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+
+	return batch, nil
+}
+
+func (b *PostgresBus) snapshotHandlers() map[string][]events.Handler {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	handlers := make(map[string][]events.Handler, len(b.handlers))
+	for name, list := range b.handlers {
+		handlers[name] = list
+	}
+
+	return handlers
+}
+
+// Opening an envelope and running the handlers on its event, stopping at the first that fails.
+// Envelopes that can't be opened never will be, those errors wrap errPoisonEvent.
+func handleEnvelope(handlers []events.Handler, payload []byte) error {
+	if len(handlers) == 0 {
+		return nil
+	}
+
+	var envelope events.Envelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return fmt.Errorf("%w: %w", errPoisonEvent, err)
+	}
+	event, err := schemas.Default().Open(envelope)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errPoisonEvent, err)
+	}
+
+	for _, handler := range handlers {
+		if err := handler(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Running the handlers over the events stored since the given time without touching the
+// subscriber's cursor or dead letters, e.g. to fill a fresh read model from history. Stops at
+// the first failure. Returns how many events were handled.
+func (b *PostgresBus) Replay(since time.Time) (int, error) {
+	handlers := b.snapshotHandlers()
+
+	handled := 0
+	var after eventPosition
+	for {
+		batch, err := storedEventsAfter(b.db, after, since, eventBatchSize)
+		if err != nil {
+			return handled, err
+		}
+		for _, stored := range batch {
+			if err := handleEnvelope(handlers[stored.name], stored.payload); err != nil {
+				return handled, fmt.Errorf("replay failed on event %d (%s): %w", stored.id, stored.name, err)
+			}
+			after = stored.position()
+			handled++
+		}
+		if len(batch) < eventBatchSize {
+			return handled, nil
+		}
+	}
+}
+
+// Dispatching on every tick until the context is cancelled.
+func (b *PostgresBus) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := b.Dispatch(); err != nil {
+			log.Printf("Event bus: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
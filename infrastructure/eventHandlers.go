@@ -0,0 +1,169 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events/schemas"
+	"aTES/core/httpjson"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Routes (served behind events:manage):
+//
+//	GET  /events/dead_letters?subscriber=&status=&limit=   - dead letters, newest first.
+//	GET  /events/dead_letters/<id>                         - a single dead letter.
+//	PUT  /events/dead_letters/<id>   <envelope>            - replaces its envelope, e.g. to fix the data.
+//	POST /events/dead_letters/<id>/replay                  - queues it for its subscriber's next poll.
+//	POST /events/dead_letters/replay                       - queues every dead letter.
+//	POST /events/rewind?subscriber=<name>&from=<time>      - has the subscriber handle the events since from again,
+//	                                                         from the beginning without from.
+func (h *HandlersGroup) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "rewind":
+		h.rewindSubscriber(w, r)
+	case len(parts) == 2 && parts[1] == "dead_letters":
+		h.listDeadLetters(w, r)
+	case len(parts) == 3 && parts[1] == "dead_letters" && parts[2] == "replay":
+		h.replayDeadLetters(w, r, nil)
+	case len(parts) >= 3 && parts[1] == "dead_letters":
+		deadLetterID, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || deadLetterID <= 0 {
+			httpjson.Error(w, http.StatusNotFound, "Not found.")
+			return
+		}
+		switch {
+		case len(parts) == 3:
+			h.deadLetter(w, r, deadLetterID)
+		case len(parts) == 4 && parts[3] == "replay":
+			h.replayDeadLetters(w, r, []int64{deadLetterID})
+		default:
+			httpjson.Error(w, http.StatusNotFound, "Not found.")
+		}
+	default:
+		httpjson.Error(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+func (h *HandlersGroup) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := DeadLetterFilter{Subscriber: query.Get("subscriber"), Status: query.Get("status")}
+	fieldErrors := validationErrors{}
+	switch filter.Status {
+	case "", entities.DeadLetterDead, entities.DeadLetterQueued, entities.DeadLetterReplayed:
+	default:
+		fieldErrors["status"] = "must be dead, queued or replayed"
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			fieldErrors["limit"] = "must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+		filter.Limit = limit
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	letters, err := ListDeadLetters(h.resources.db, filter)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error listing dead letters: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, letters)
+}
+
+// Inspecting (GET) or correcting (PUT) a dead letter.
+func (h *HandlersGroup) deadLetter(w http.ResponseWriter, r *http.Request, deadLetterID int64) {
+	var letter entities.DeadLetter
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		letter, err = GetDeadLetter(h.resources.db, deadLetterID)
+	case http.MethodPut:
+		var payload []byte
+		payload, err = io.ReadAll(r.Body)
+		if err != nil {
+			httpjson.Error(w, http.StatusBadRequest, "Error reading the request's body: %v", err)
+			return
+		}
+		letter, err = EditDeadLetter(h.resources.db, deadLetterID, payload)
+	default:
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		httpjson.Error(w, http.StatusNotFound, "Dead letter %d not found", deadLetterID)
+	case errors.Is(err, ErrDeadLetterNotDead):
+		httpjson.Error(w, http.StatusConflict, "%v", err)
+	case errors.Is(err, schemas.ErrInvalidEvent), errors.Is(err, schemas.ErrUnknownEvent), errors.Is(err, schemas.ErrUnknownVersion):
+		httpjson.Error(w, http.StatusBadRequest, "Invalid envelope: %v", err)
+	case err != nil:
+		httpjson.Error(w, http.StatusInternalServerError, "Error with dead letter %d: %v", deadLetterID, err)
+	default:
+		httpjson.Write(w, http.StatusOK, letter)
+	}
+}
+
+// Queueing the given dead letters for replay, or all of them without IDs.
+func (h *HandlersGroup) replayDeadLetters(w http.ResponseWriter, r *http.Request, deadLetterIDs []int64) {
+	if r.Method != http.MethodPost {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	queued, err := QueueDeadLetters(h.resources.db, deadLetterIDs...)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error queueing dead letters: %v", err)
+		return
+	}
+	if len(deadLetterIDs) > 0 && queued == 0 {
+		httpjson.Error(w, http.StatusConflict, "Dead letter %d doesn't exist or isn't dead", deadLetterIDs[0])
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, map[string]int{"queued": queued})
+}
+
+func (h *HandlersGroup) rewindSubscriber(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	query := r.URL.Query()
+	fieldErrors := validationErrors{}
+	subscriber := query.Get("subscriber")
+	if subscriber == "" {
+		fieldErrors["subscriber"] = "is required"
+	}
+	from, err := parseTimeParam(query.Get("from"))
+	if err != nil {
+		fieldErrors["from"] = err.Error()
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	ahead, err := RewindSubscriber(h.resources.db, subscriber, from)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error rewinding %s: %v", subscriber, err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, map[string]any{"subscriber": subscriber, "events_ahead": ahead})
+}
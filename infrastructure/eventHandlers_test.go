@@ -0,0 +1,113 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events/schemas"
+	"aTES/core/rbac"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveEvents(db *sql.DB, method, target, body string) *httptest.ResponseRecorder {
+	handlers := NewHandlersGroup(db, nil, nil, rbac.Default())
+	w := httptest.NewRecorder()
+	handlers.EventsHandler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// Bad routes, methods and parameters are turned away before the database is touched.
+func TestEventsHandlerRejectsBadRequests(t *testing.T) {
+	cases := []struct {
+		method, target string
+		expected       int
+	}{
+		{http.MethodGet, "/events/", http.StatusNotFound},
+		{http.MethodGet, "/events/dead_letters/abc", http.StatusNotFound},
+		{http.MethodGet, "/events/dead_letters/0", http.StatusNotFound},
+		{http.MethodGet, "/events/dead_letters/1/edit", http.StatusNotFound},
+		{http.MethodDelete, "/events/dead_letters", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/events/dead_letters/1", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/events/dead_letters/1/replay", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/events/dead_letters/replay", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/events/rewind?subscriber=test", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/events/dead_letters?status=lost", http.StatusBadRequest},
+		{http.MethodGet, "/events/dead_letters?limit=0", http.StatusBadRequest},
+		{http.MethodGet, fmt.Sprintf("/events/dead_letters?limit=%d", maxPageSize+1), http.StatusBadRequest},
+		{http.MethodPost, "/events/rewind", http.StatusBadRequest},
+		{http.MethodPost, "/events/rewind?subscriber=test&from=yesterday", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := serveEvents(nil, c.method, c.target, ""); w.Code != c.expected {
+			t.Errorf("%s %s: expected %d, got %d (%s)", c.method, c.target, c.expected, w.Code, w.Body)
+		}
+	}
+
+	w := serveEvents(nil, http.MethodPost, "/events/rewind?from=yesterday", "")
+	var body struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Fields["subscriber"] == "" || body.Fields["from"] == "" {
+		t.Errorf("Expected both fields reported, got %s (%v)", w.Body, err)
+	}
+}
+
+func TestEventsHandlerDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	letters := deadLetterEvents(t, db, "test", assigned(1, 7), assigned(2, 7))
+	first, second := letters[1], letters[0]
+	path := func(letter entities.DeadLetter, suffix string) string {
+		return fmt.Sprintf("/events/dead_letters/%d%s", letter.DeadLetterID, suffix)
+	}
+
+	w := serveEvents(db, http.MethodGet, "/events/dead_letters?subscriber=test&status=dead&limit=1", "")
+	var listed []entities.DeadLetter
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); w.Code != http.StatusOK || err != nil || len(listed) != 1 ||
+		listed[0].DeadLetterID != second.DeadLetterID {
+		t.Errorf("Expected the newest dead letter listed, got %d %s", w.Code, w.Body)
+	}
+
+	if w := serveEvents(db, http.MethodGet, path(first, ""), ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the dead letter, got %d %s", w.Code, w.Body)
+	}
+	if w := serveEvents(db, http.MethodGet, fmt.Sprintf("/events/dead_letters/%d", second.DeadLetterID+100), ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing dead letter, got %d", w.Code)
+	}
+
+	if w := serveEvents(db, http.MethodPut, path(first, ""), `{"event_name": "TaskAssigned"`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a broken envelope, got %d %s", w.Code, w.Body)
+	}
+	fixed, err := schemas.Default().Seal("tes", assigned(1, 8))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	payload, _ := json.Marshal(fixed)
+	if w := serveEvents(db, http.MethodPut, path(first, ""), string(payload)); w.Code != http.StatusOK ||
+		!bytes.Contains(w.Body.Bytes(), []byte(fixed.EventID)) {
+		t.Errorf("Expected the envelope replaced, got %d %s", w.Code, w.Body)
+	}
+
+	if w := serveEvents(db, http.MethodPost, path(first, "/replay"), ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the dead letter queued, got %d %s", w.Code, w.Body)
+	}
+	if w := serveEvents(db, http.MethodPost, path(first, "/replay"), ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 queueing it again, got %d %s", w.Code, w.Body)
+	}
+	if w := serveEvents(db, http.MethodPut, path(first, ""), string(payload)); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 editing a queued dead letter, got %d %s", w.Code, w.Body)
+	}
+	if w := serveEvents(db, http.MethodPost, "/events/dead_letters/replay", ""); w.Code != http.StatusOK ||
+		!bytes.Contains(w.Body.Bytes(), []byte(`"queued":1`)) {
+		t.Errorf("Expected the other dead letter queued, got %d %s", w.Code, w.Body)
+	}
+
+	if w := serveEvents(db, http.MethodPost, "/events/rewind?subscriber=test&from=2024-06-01", ""); w.Code != http.StatusOK ||
+		!bytes.Contains(w.Body.Bytes(), []byte(`"events_ahead":2`)) {
+		t.Errorf("Expected the subscriber rewound, got %d %s", w.Code, w.Body)
+	}
+}
@@ -1,37 +1,34 @@
 package infrastructure
 
 import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/httpjson"
+	"aTES/core/rbac"
 	"database/sql"
-	"fmt"
 	"net/http"
+
+	"gorm.io/gorm"
 )
 
 type resources struct {
-	db *sql.DB
+	db      *sql.DB
+	gormDB  *gorm.DB
+	pricing businesslogic.PricingPolicy
+	policy  *rbac.Policy
 }
 
 type HandlersGroup struct { // A container object for resources and methods for handling http routes.
 	resources resources
 }
 
-func NewHandlersGroup(db *sql.DB) *HandlersGroup {
-	return &HandlersGroup{resources: resources{db: db}}
+func NewHandlersGroup(db *sql.DB, gormDB *gorm.DB, pricing businesslogic.PricingPolicy, policy *rbac.Policy) *HandlersGroup {
+	return &HandlersGroup{resources: resources{db: db, gormDB: gormDB, pricing: pricing, policy: policy}}
 }
 
-func (h *HandlersGroup) TaskHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		{
-			fmt.Fprintln(w, "Placeholder for fetching tasks logic.")
-			fmt.Println("Checking if case can get multi lines without braces.")
-		}
-	case "POST":
-		fmt.Fprintln(w, "Placeholder for creating a new task.")
-	default:
-		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
-	}
-}
+// Field name -> what's wrong with it. Sent back to the client on bad input.
+type validationErrors map[string]string
 
-func (h *HandlersGroup) AccountingHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Placeholder for accouting logic.")
+// Sending per field validation errors as { "error": "invalid request", "fields": {...} }.
+func writeValidationErrors(w http.ResponseWriter, fields validationErrors) {
+	httpjson.Write(w, http.StatusBadRequest, map[string]any{"error": "invalid request", "fields": fields})
 }
@@ -0,0 +1,71 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// The Kafka side of StreamBus. Messages are spread over a topic's partitions by key hash, and
+// readers join consumer groups so Kafka balances the partitions between a group's members.
+// Topics are created on first write when the cluster allows it.
+type KafkaBroker struct {
+	brokers []string
+	writer  *kafka.Writer
+}
+
+func NewKafkaBroker(brokers []string) *KafkaBroker {
+	return &KafkaBroker{
+		brokers: brokers,
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			AllowAutoTopicCreation: true,
+		},
+	}
+}
+
+func (b *KafkaBroker) Write(ctx context.Context, messages ...streamMessage) error {
+	batch := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		batch[i] = kafka.Message{Topic: message.Topic, Key: message.Key, Value: message.Value}
+	}
+
+	if err := b.writer.WriteMessages(ctx, batch...); err != nil {
+		return fmt.Errorf("failed to write to kafka: %w", err)
+	}
+
+	return nil
+}
+
+func (b *KafkaBroker) Reader(group, topic string) streamReader {
+	return &kafkaReader{reader: kafka.NewReader(kafka.ReaderConfig{Brokers: b.brokers, GroupID: group, Topic: topic})}
+}
+
+func (b *KafkaBroker) Close() error {
+	return b.writer.Close()
+}
+
+type kafkaReader struct {
+	reader *kafka.Reader
+}
+
+func (r *kafkaReader) Fetch(ctx context.Context) (streamMessage, error) {
+	message, err := r.reader.FetchMessage(ctx)
+	if err != nil {
+		return streamMessage{}, err
+	}
+
+	return streamMessage{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Key: message.Key,
+		Value: message.Value}, nil
+}
+
+func (r *kafkaReader) Commit(ctx context.Context, message streamMessage) error {
+	return r.reader.CommitMessages(ctx, kafka.Message{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset})
+}
+
+func (r *kafkaReader) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,538 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Journal entries and lines are append-only. These triggers make the database refuse to
+// change them, so a correction can only ever be a reversing entry.
+const appendOnlyLedgerSQL = `
+CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'ledger table % is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_entries_append_only ON journal_entries;
+CREATE TRIGGER journal_entries_append_only BEFORE UPDATE OR DELETE ON journal_entries
+	FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+
+DROP TRIGGER IF EXISTS journal_lines_append_only ON journal_lines;
+CREATE TRIGGER journal_lines_append_only BEFORE UPDATE OR DELETE ON journal_lines
+	FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+`
+
+// Creating the system accounts and the append-only triggers. Safe to run on every start.
+func initLedger(db *sql.DB) error {
+	for _, kind := range []string{businesslogic.AccountCompany, businesslogic.AccountCash} {
+		query := `
+		INSERT INTO ledger_accounts (kind, opened_at)
+		SELECT $1::varchar, $2
+		WHERE NOT EXISTS (SELECT 1 FROM ledger_accounts WHERE kind = $1 AND user_id IS NULL)
+		`
+		if _, err := db.Exec(query, kind, time.Now().Format(time.DateTime)); err != nil {
+			return fmt.Errorf("failed to create the %s account: %w", kind, err)
+		}
+	}
+
+	if _, err := db.Exec(appendOnlyLedgerSQL); err != nil {
+		return fmt.Errorf("failed to make the ledger append-only: %w", err)
+	}
+
+	return nil
+}
+
+// Getting the ID of a system account (company or cash).
+func systemAccountID(db queryer, kind string) (int, error) {
+	var accountID int
+	err := db.QueryRow(`SELECT account_id FROM ledger_accounts WHERE kind = $1 AND user_id IS NULL`, kind).
+		Scan(&accountID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the %s account: %w", kind, err)
+	}
+
+	return accountID, nil
+}
+
+// Getting a worker's account ID, opening the account on first use.
+func workerAccountID(db queryer, userID int) (int, error) {
+	query := `
+	INSERT INTO ledger_accounts (kind, user_id, opened_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (user_id) DO NOTHING
+	`
+	if _, err := db.Exec(query, businesslogic.AccountWorker, userID, time.Now().Format(time.DateTime)); err != nil {
+		return 0, fmt.Errorf("failed to open an account for user %d: %w", userID, err)
+	}
+
+	var accountID int
+	err := db.QueryRow(`SELECT account_id FROM ledger_accounts WHERE user_id = $1`, userID).Scan(&accountID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the account of user %d: %w", userID, err)
+	}
+
+	return accountID, nil
+}
+
+// Writing a balanced entry and its lines, returning the entryID. Entries are posted now unless
+// they carry a PostedAt of their own.
+func PostJournalEntry(db queryer, entry entities.JournalEntry, lines []entities.JournalLine) (int, error) {
+	if err := businesslogic.ValidateEntry(lines); err != nil {
+		return 0, err
+	}
+	if entry.PostedAt == "" {
+		entry.PostedAt = time.Now().Format(time.DateTime)
+	}
+
+	var entryID int
+	query := `
+	INSERT INTO journal_entries (kind, task_id, description, reverses_entry_id, posted_at)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING entry_id
+	`
+	err := db.QueryRow(query, entry.Kind, entry.TaskID, entry.Description, entry.ReversesEntryID, entry.PostedAt).
+		Scan(&entryID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to post a journal entry: %w", err)
+	}
+
+	for _, line := range lines {
+		_, err := db.Exec(`INSERT INTO journal_lines (entry_id, account_id, debit, credit) VALUES ($1, $2, $3, $4)`,
+			entryID, line.AccountID, line.Debit, line.Credit)
+		if err != nil {
+			return 0, fmt.Errorf("failed to post a journal line: %w", err)
+		}
+	}
+
+	return entryID, nil
+}
+
+// Charging a worker the assignment fee of a task that landed on them.
+func PostAssignmentCharge(db queryer, userID int, task entities.Task) (int, error) {
+	workerAccount, err := workerAccountID(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	companyAccount, err := systemAccountID(db, businesslogic.AccountCompany)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := entities.JournalEntry{
+		Kind:        businesslogic.EntryAssignmentCharge,
+		TaskID:      task.TaskID,
+		Description: fmt.Sprintf("Assignment of task %d: %s", task.TaskID, task.Description),
+	}
+	return PostJournalEntry(db, entry, businesslogic.AssignmentChargeLines(workerAccount, companyAccount, businesslogic.AssignmentFee(task)))
+}
+
+// Paying the reward of a completed task to the worker who completed it.
+func PostCompletionReward(db queryer, userID int, task entities.Task) (int, error) {
+	workerAccount, err := workerAccountID(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	companyAccount, err := systemAccountID(db, businesslogic.AccountCompany)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := entities.JournalEntry{
+		Kind:        businesslogic.EntryCompletionReward,
+		TaskID:      task.TaskID,
+		Description: fmt.Sprintf("Completion of task %d: %s", task.TaskID, task.Description),
+	}
+	return PostJournalEntry(db, entry, businesslogic.CompletionRewardLines(workerAccount, companyAccount, task.Price))
+}
+
+// Recording money paid out to a worker, as of postedAt.
+func PostPayout(db queryer, userID int, amount entities.Money, description string, postedAt time.Time) (int, error) {
+	workerAccount, err := workerAccountID(db, userID)
+	if err != nil {
+		return 0, err
+	}
+	cashAccount, err := systemAccountID(db, businesslogic.AccountCash)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := entities.JournalEntry{Kind: businesslogic.EntryPayout, Description: description,
+		PostedAt: postedAt.Format(time.DateTime)}
+	return PostJournalEntry(db, entry, businesslogic.PayoutLines(workerAccount, cashAccount, amount))
+}
+
+// Correcting a posted entry by posting its mirror image. An entry can only be reversed once.
+func ReverseJournalEntry(db *sql.DB, entryID int, reason string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the original so two concurrent reversals can't both pass the check below.
+	var original entities.JournalEntry
+	err = tx.QueryRow(`SELECT entry_id, task_id FROM journal_entries WHERE entry_id = $1 FOR UPDATE`, entryID).
+		Scan(&original.EntryID, &original.TaskID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find journal entry %d: %w", entryID, err)
+	}
+
+	var alreadyReversed bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM journal_entries WHERE reverses_entry_id = $1)`, entryID).
+		Scan(&alreadyReversed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check for reversals of entry %d: %w", entryID, err)
+	}
+	if alreadyReversed {
+		return 0, fmt.Errorf("entry %d: %w", entryID, businesslogic.ErrAlreadyReversed)
+	}
+
+	lines, err := getJournalLines(tx, entryID)
+	if err != nil {
+		return 0, err
+	}
+
+	reversal := entities.JournalEntry{
+		Kind:            businesslogic.EntryReversal,
+		TaskID:          original.TaskID,
+		Description:     reason,
+		ReversesEntryID: entryID,
+	}
+	reversalID, err := PostJournalEntry(tx, reversal, businesslogic.ReversalLines(lines))
+	if err != nil {
+		return 0, err
+	}
+	applied, err := transactionApplied(tx, reversalID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writeOutbox(tx, tesProducer, []events.Event{applied}); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the reversal: %w", err)
+	}
+
+	return reversalID, nil
+}
+
+func getJournalLines(db queryer, entryID int) ([]entities.JournalLine, error) {
+	rows, err := db.Query(`SELECT line_id, entry_id, account_id, debit, credit FROM journal_lines WHERE entry_id = $1 ORDER BY line_id`, entryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lines of entry %d: %w", entryID, err)
+	}
+	defer rows.Close()
+
+	var lines []entities.JournalLine
+	for rows.Next() {
+		var line entities.JournalLine
+		if err := rows.Scan(&line.LineID, &line.EntryID, &line.AccountID, &line.Debit, &line.Credit); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// Computing an account's balance: the cached snapshot plus every line posted after it. Lines are
+// ordered by the transaction that posted them, then by ID, like stored events (see eventPosition).
+func GetAccountBalance(db queryer, accountID int) (entities.Money, error) {
+	var snapshot entities.BalanceSnapshot
+	err := db.QueryRow(`SELECT balance, last_tx_id, last_line_id FROM balance_snapshots WHERE account_id = $1`, accountID).
+		Scan(&snapshot.Balance, &snapshot.LastTxID, &snapshot.LastLineID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return entities.Money{}, fmt.Errorf("failed to read the balance snapshot of account %d: %w", accountID, err)
+	}
+
+	var sinceSnapshot entities.Money
+	query := `SELECT COALESCE(SUM(credit - debit), 0)::bigint FROM journal_lines WHERE account_id = $1 AND (tx_id, line_id) > ($2::xid8, $3)`
+	if err := db.QueryRow(query, accountID, snapshot.LastTxID, snapshot.LastLineID).Scan(&sinceSnapshot); err != nil {
+		return entities.Money{}, fmt.Errorf("failed to sum the lines of account %d: %w", accountID, err)
+	}
+
+	return snapshot.Balance.Add(sinceSnapshot), nil
+}
+
+// Computing what the company owes a worker (negative when the worker owes the company).
+func GetUserBalance(db queryer, userID int) (entities.Money, error) {
+	var accountID int
+	err := db.QueryRow(`SELECT account_id FROM ledger_accounts WHERE user_id = $1`, userID).Scan(&accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.NewMoney(0), nil // No account yet means nothing was ever posted for the user.
+	}
+	if err != nil {
+		return entities.Money{}, fmt.Errorf("failed to find the account of user %d: %w", userID, err)
+	}
+
+	return GetAccountBalance(db, accountID)
+}
+
+// Moving every account's snapshot up to the newest line and refreshing the balance cached on users.
+// Only lines of transactions older than any still running are taken in, a line committing later
+// is always after the snapshot and still counted by GetAccountBalance.
+func RefreshBalanceSnapshots(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := refreshBalanceSnapshots(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Throwing the balance snapshots away and taking them again from every journal line, e.g. after
+// a line was fixed by hand. The snapshots are locked until they're back, so balances are never
+// read from half of them.
+func RebuildBalanceSnapshots(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`LOCK TABLE balance_snapshots IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("failed to lock the balance snapshots: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM balance_snapshots`); err != nil {
+		return fmt.Errorf("failed to clear the balance snapshots: %w", err)
+	}
+	if err := refreshBalanceSnapshots(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func refreshBalanceSnapshots(tx *sql.Tx) error {
+	query := `
+	WITH fresh AS (
+		SELECT l.account_id, l.tx_id, l.line_id, l.credit - l.debit AS amount
+		FROM journal_lines l
+		LEFT JOIN balance_snapshots s ON s.account_id = l.account_id
+		WHERE (l.tx_id, l.line_id) > (COALESCE(s.last_tx_id, '0'::xid8), COALESCE(s.last_line_id, 0))
+			AND l.tx_id < pg_snapshot_xmin(pg_current_snapshot())
+	), totals AS (
+		SELECT DISTINCT ON (account_id) account_id, tx_id, line_id, SUM(amount) OVER (PARTITION BY account_id) AS amount
+		FROM fresh
+		ORDER BY account_id, tx_id DESC, line_id DESC
+	)
+	INSERT INTO balance_snapshots (account_id, balance, last_tx_id, last_line_id, taken_at)
+	SELECT a.account_id,
+		(COALESCE(s.balance, 0) + COALESCE(t.amount, 0))::bigint,
+		COALESCE(t.tx_id, s.last_tx_id, '0'::xid8),
+		COALESCE(t.line_id, s.last_line_id, 0),
+		$1
+	FROM ledger_accounts a
+	LEFT JOIN balance_snapshots s ON s.account_id = a.account_id
+	LEFT JOIN totals t ON t.account_id = a.account_id
+	ON CONFLICT (account_id) DO UPDATE
+	SET balance = EXCLUDED.balance, last_tx_id = EXCLUDED.last_tx_id, last_line_id = EXCLUDED.last_line_id,
+		taken_at = EXCLUDED.taken_at
+	`
+	if _, err := tx.Exec(query, time.Now().Format(time.DateTime)); err != nil {
+		return fmt.Errorf("failed to refresh balance snapshots: %w", err)
+	}
+
+	return refreshCachedBalances(tx)
+}
+
+func refreshCachedBalances(db queryer) error {
+	query := `
+	UPDATE users u
+	SET balance = s.balance
+	FROM ledger_accounts a
+	JOIN balance_snapshots s ON s.account_id = a.account_id
+	WHERE a.user_id = u.user_id
+	`
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("failed to refresh cached user balances: %w", err)
+	}
+
+	return nil
+}
+
+// A journal entry as seen from one worker's account.
+type AccountTransaction struct {
+	EntryID         int            `json:"entry_id"`
+	Kind            string         `json:"kind"`
+	TaskID          int            `json:"task_id,omitempty"`
+	TaskDescription string         `json:"task_description,omitempty"`
+	Description     string         `json:"description"`
+	Amount          entities.Money `json:"amount"` // Positive when the worker gained money.
+	PostedAt        string         `json:"posted_at"`
+}
+
+// Getting a page of a worker's transactions posted in [from, to), newest first, with the total
+// number of matching transactions. Zero times mean no bound.
+func ListUserTransactions(db queryer, userID int, from, to time.Time, limit, offset int) ([]AccountTransaction, int, error) {
+	conditions := `a.user_id = $1
+		AND ($2::timestamp IS NULL OR e.posted_at >= $2)
+		AND ($3::timestamp IS NULL OR e.posted_at < $3)`
+	args := []any{userID, nullTime(from), nullTime(to)}
+
+	var total int
+	countQuery := `
+	SELECT COUNT(DISTINCT e.entry_id)
+	FROM ledger_accounts a
+	JOIN journal_lines l ON l.account_id = a.account_id
+	JOIN journal_entries e ON e.entry_id = l.entry_id
+	WHERE ` + conditions
+	if err := db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count the transactions of user %d: %w", userID, err)
+	}
+
+	query := `
+	SELECT e.entry_id, e.kind, e.task_id, COALESCE(t.description, ''), e.description,
+		SUM(l.credit - l.debit)::bigint, to_char(e.posted_at, 'YYYY-MM-DD HH24:MI:SS')
+	FROM ledger_accounts a
+	JOIN journal_lines l ON l.account_id = a.account_id
+	JOIN journal_entries e ON e.entry_id = l.entry_id
+	LEFT JOIN tasks t ON t.task_id = e.task_id
+	WHERE ` + conditions + `
+	GROUP BY e.entry_id, t.description
+	ORDER BY e.posted_at DESC, e.entry_id DESC
+	LIMIT $4 OFFSET $5
+	`
+	rows, err := db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list the transactions of user %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	transactions := []AccountTransaction{}
+	for rows.Next() {
+		var tr AccountTransaction
+		err := rows.Scan(&tr.EntryID, &tr.Kind, &tr.TaskID, &tr.TaskDescription, &tr.Description, &tr.Amount, &tr.PostedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		transactions = append(transactions, tr)
+	}
+
+	return transactions, total, rows.Err()
+}
+
+// Zero times go to the database as NULL.
+func nullTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: t.Format(time.DateTime), Valid: true}
+}
+
+// A worker and what the company currently owes them.
+type WorkerBalance struct {
+	UserID  int            `json:"user_id"`
+	Name    string         `json:"name"`
+	Balance entities.Money `json:"balance"`
+}
+
+// Getting the current balance of every worker account, from the snapshots plus newer lines.
+func ListWorkerBalances(db queryer) ([]WorkerBalance, error) {
+	query := `
+	SELECT a.user_id, COALESCE(u.name, ''),
+		(COALESCE(s.balance, 0) + COALESCE(SUM(l.credit - l.debit), 0))::bigint
+	FROM ledger_accounts a
+	LEFT JOIN users u ON u.user_id = a.user_id
+	LEFT JOIN balance_snapshots s ON s.account_id = a.account_id
+	LEFT JOIN journal_lines l ON l.account_id = a.account_id
+		AND (l.tx_id, l.line_id) > (COALESCE(s.last_tx_id, '0'::xid8), COALESCE(s.last_line_id, 0))
+	WHERE a.kind = $1
+	GROUP BY a.user_id, u.name, s.balance
+	ORDER BY a.user_id
+	`
+	rows, err := db.Query(query, businesslogic.AccountWorker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list worker balances: %w", err)
+	}
+	defer rows.Close()
+
+	balances := []WorkerBalance{}
+	for rows.Next() {
+		var balance WorkerBalance
+		if err := rows.Scan(&balance.UserID, &balance.Name, &balance.Balance); err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, rows.Err()
+}
+
+// What the company made on one day: assignment fees taken minus completion rewards paid.
+type DailyEarnings struct {
+	Day      string         `json:"day"`
+	Fees     entities.Money `json:"fees"`
+	Rewards  entities.Money `json:"rewards"`
+	Earnings entities.Money `json:"earnings"`
+}
+
+// Getting the company's earnings for each day in [from, to) that had any activity, oldest first.
+func ListCompanyEarnings(db queryer, from, to time.Time) ([]DailyEarnings, error) {
+	query := `
+	SELECT to_char(date_trunc('day', e.posted_at), 'YYYY-MM-DD'),
+		COALESCE(SUM(l.credit) FILTER (WHERE e.kind = $2), 0)::bigint,
+		COALESCE(SUM(l.debit) FILTER (WHERE e.kind = $3), 0)::bigint,
+		COALESCE(SUM(l.credit - l.debit), 0)::bigint
+	FROM ledger_accounts a
+	JOIN journal_lines l ON l.account_id = a.account_id
+	JOIN journal_entries e ON e.entry_id = l.entry_id
+	WHERE a.kind = $1 AND a.user_id IS NULL AND e.posted_at >= $4 AND e.posted_at < $5
+	GROUP BY 1
+	ORDER BY 1
+	`
+	rows, err := db.Query(query, businesslogic.AccountCompany, businesslogic.EntryAssignmentCharge,
+		businesslogic.EntryCompletionReward, from.Format(time.DateTime), to.Format(time.DateTime))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list company earnings: %w", err)
+	}
+	defer rows.Close()
+
+	earnings := []DailyEarnings{}
+	for rows.Next() {
+		var day DailyEarnings
+		if err := rows.Scan(&day.Day, &day.Fees, &day.Rewards, &day.Earnings); err != nil {
+			return nil, err
+		}
+		earnings = append(earnings, day)
+	}
+
+	return earnings, rows.Err()
+}
+
+// Describing a posted entry as an event, from the side of the worker it concerns.
+func transactionApplied(db queryer, entryID int) (events.TransactionApplied, error) {
+	query := `
+	SELECT e.entry_id, e.kind, COALESCE(r.kind, ''), e.task_id, to_char(e.posted_at, 'YYYY-MM-DD HH24:MI:SS'),
+		COALESCE(MAX(a.user_id) FILTER (WHERE a.kind = $2), 0),
+		COALESCE(SUM(l.credit - l.debit) FILTER (WHERE a.kind = $2), 0)::bigint
+	FROM journal_entries e
+	JOIN journal_lines l ON l.entry_id = e.entry_id
+	JOIN ledger_accounts a ON a.account_id = l.account_id
+	LEFT JOIN journal_entries r ON r.entry_id = e.reverses_entry_id
+	WHERE e.entry_id = $1
+	GROUP BY e.entry_id, r.kind
+	`
+	var event events.TransactionApplied
+	err := db.QueryRow(query, entryID, businesslogic.AccountWorker).
+		Scan(&event.EntryID, &event.Kind, &event.Reverses, &event.TaskID, &event.PostedAt, &event.UserID, &event.Amount)
+	if err != nil {
+		return events.TransactionApplied{}, fmt.Errorf("failed to describe journal entry %d: %w", entryID, err)
+	}
+
+	return event, nil
+}
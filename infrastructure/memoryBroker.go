@@ -0,0 +1,193 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// A stand-in for Kafka that keeps everything in memory, with the same semantics as far as
+// StreamBus can tell: messages are spread over partitions by key hash and kept in order within
+// one, every consumer group reads each topic from its own committed offsets, and a partition
+// only hands its next message to a group once the previous one was committed. Meant for tests
+// and single process setups, nothing survives a restart.
+type MemoryBroker struct {
+	partitions int
+	mu         sync.Mutex
+	changed    chan struct{} // Closed and replaced whenever something happens readers wait for.
+	topics     map[string][][]streamMessage
+	groups     map[string]*memoryGroup // "<group>/<topic>" -> where the group is at.
+	closed     bool
+}
+
+type memoryGroup struct {
+	committed []int64 // Per partition, the offset of the next message to hand out.
+	inFlight  []bool  // Per partition, whether a message was handed out and not committed yet.
+}
+
+var errBrokerClosed = errors.New("the broker is closed")
+
+// Every topic gets the given number of partitions.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	return &MemoryBroker{
+		partitions: max(partitions, 1),
+		changed:    make(chan struct{}),
+		topics:     make(map[string][][]streamMessage),
+		groups:     make(map[string]*memoryGroup),
+	}
+}
+
+// Where a key lands, FNV-1a like kafka-go's hash balancer.
+func (b *MemoryBroker) partitionOf(key []byte) int {
+	hash := fnv.New32a()
+	hash.Write(key)
+
+	return int(hash.Sum32() % uint32(b.partitions))
+}
+
+// Must be called with the lock held.
+func (b *MemoryBroker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *MemoryBroker) Write(_ context.Context, messages ...streamMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errBrokerClosed
+	}
+	for _, message := range messages {
+		if message.Topic == "" {
+			return fmt.Errorf("message without a topic")
+		}
+	}
+
+	for _, message := range messages {
+		partitions := b.topics[message.Topic]
+		if partitions == nil {
+			partitions = make([][]streamMessage, b.partitions)
+			b.topics[message.Topic] = partitions
+		}
+		message.Partition = b.partitionOf(message.Key)
+		message.Offset = int64(len(partitions[message.Partition]))
+		partitions[message.Partition] = append(partitions[message.Partition], message)
+	}
+	b.notify()
+
+	return nil
+}
+
+// All the messages written to a topic so far, partition by partition.
+func (b *MemoryBroker) Messages(topic string) [][]streamMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	partitions := make([][]streamMessage, len(b.topics[topic]))
+	for i, partition := range b.topics[topic] {
+		partitions[i] = append([]streamMessage(nil), partition...)
+	}
+
+	return partitions
+}
+
+func (b *MemoryBroker) Reader(group, topic string) streamReader {
+	return &memoryReader{broker: b, group: group, topic: topic}
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.notify()
+
+	return nil
+}
+
+// Must be called with the lock held.
+func (b *MemoryBroker) groupState(group, topic string) *memoryGroup {
+	key := group + "/" + topic
+	state := b.groups[key]
+	if state == nil {
+		state = &memoryGroup{committed: make([]int64, b.partitions), inFlight: make([]bool, b.partitions)}
+		b.groups[key] = state
+	}
+
+	return state
+}
+
+type memoryReader struct {
+	broker *MemoryBroker
+	group  string
+	topic  string
+	held   []streamMessage // Fetched and not committed yet.
+}
+
+func (r *memoryReader) Fetch(ctx context.Context) (streamMessage, error) {
+	b := r.broker
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return streamMessage{}, errBrokerClosed
+		}
+		state := b.groupState(r.group, r.topic)
+		for partition, messages := range b.topics[r.topic] {
+			if state.inFlight[partition] || state.committed[partition] >= int64(len(messages)) {
+				continue
+			}
+			message := messages[state.committed[partition]]
+			state.inFlight[partition] = true
+			r.held = append(r.held, message)
+			b.mu.Unlock()
+			return message, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return streamMessage{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (r *memoryReader) Commit(_ context.Context, message streamMessage) error {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.groupState(r.group, r.topic)
+	state.committed[message.Partition] = max(state.committed[message.Partition], message.Offset+1)
+	state.inFlight[message.Partition] = false
+	for i, held := range r.held {
+		if held.Partition == message.Partition && held.Offset == message.Offset {
+			r.held = append(r.held[:i], r.held[i+1:]...)
+			break
+		}
+	}
+	b.notify()
+
+	return nil
+}
+
+// Messages fetched and not committed go back to the group, like on a Kafka rebalance.
+func (r *memoryReader) Close() error {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.groupState(r.group, r.topic)
+	for _, held := range r.held {
+		state.inFlight[held.Partition] = false
+	}
+	r.held = nil
+	b.notify()
+
+	return nil
+}
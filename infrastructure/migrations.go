@@ -0,0 +1,93 @@
+package infrastructure
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Money columns that used to be decimals. They now hold entities.Money as minor units.
+var moneyColumns = []struct{ table, column string }{
+	{"tasks", "price"},
+	{"tasks", "assign_fee"},
+	{"users", "balance"},
+	{"journal_lines", "debit"},
+	{"journal_lines", "credit"},
+	{"balance_snapshots", "balance"},
+}
+
+// Converting decimal money columns into BIGINT minor units. Runs before automigration, which
+// would otherwise try to change the type without converting the values. Columns that don't
+// exist yet or were already converted are left alone, so it's safe to run on every start.
+func migrateMoneyColumns(db *sql.DB) error {
+	for _, money := range moneyColumns {
+		var dataType string
+		query := `SELECT data_type FROM information_schema.columns WHERE table_name = $1 AND column_name = $2`
+		err := db.QueryRow(query, money.table, money.column).Scan(&dataType)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s.%s: %w", money.table, money.column, err)
+		}
+		if dataType != "numeric" {
+			continue
+		}
+
+		// Table and column names come from the list above, not from input.
+		alter := fmt.Sprintf(`ALTER TABLE %[1]s ALTER COLUMN %[2]s TYPE bigint USING round(%[2]s * 100)::bigint`,
+			money.table, money.column)
+		if _, err := db.Exec(alter); err != nil {
+			return fmt.Errorf("failed to convert %s.%s to minor units: %w", money.table, money.column, err)
+		}
+		log.Printf("Converted %s.%s to minor units.\n", money.table, money.column)
+	}
+
+	return nil
+}
+
+// Tables read in commit order and the cursors into them. The ID of a row only says when it was
+// inserted, a row with a lower ID can still commit after higher ones were read. So every row
+// also keeps the transaction that wrote it (tx_id), readers go in (tx_id, id) order and stop at
+// the oldest transaction still running, and cursors remember both.
+var commitOrderColumns = []struct{ table, column, cursor string }{
+	{"stored_events", "event_id", ""},
+	{"journal_lines", "line_id", ""},
+	{"event_subscriptions", "last_event_id", "last_tx_id"},
+	{"balance_snapshots", "last_line_id", "last_tx_id"},
+}
+
+// Adding the tx_id columns and the tx parts of the cursors. Runs in one transaction after
+// automigration, so rows from before get its ID and keep their order, and cursors into them are
+// moved onto it. Columns that already exist are left alone, so it's safe to run on every start.
+func migrateCommitOrder(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Table and column names come from the list above, not from input.
+	for _, c := range commitOrderColumns {
+		var statements []string
+		if c.cursor == "" {
+			statements = []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS tx_id xid8 NOT NULL DEFAULT pg_current_xact_id()`, c.table),
+				fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%[1]s_commit_order ON %[1]s (tx_id, %[2]s)`, c.table, c.column),
+			}
+		} else {
+			statements = []string{
+				fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s xid8 NOT NULL DEFAULT '0'`, c.table, c.cursor),
+				fmt.Sprintf(`UPDATE %[1]s SET %[2]s = pg_current_xact_id() WHERE %[2]s = '0' AND %[3]s > 0`, c.table, c.cursor, c.column),
+			}
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("failed to migrate %s to commit order: %w", c.table, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,180 @@
+package infrastructure
+
+import (
+	"aTES/core/httpjson"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The cookie carrying the state and PKCE verifier of a sign-in from /login to its callback.
+const loginCookie = "ates_login"
+
+// Signing users in through the authenticator's OpenID Connect provider, so clients never handle
+// passwords. The access token it hands back is the Bearer token every route here takes.
+type OIDCLogin struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	client       *http.Client
+}
+
+// Nil when no issuer is configured.
+func NewOIDCLogin(config Config) *OIDCLogin {
+	if config.OIDCIssuer == "" {
+		return nil
+	}
+
+	return &OIDCLogin{
+		issuer:       strings.TrimSuffix(config.OIDCIssuer, "/"),
+		clientID:     config.OIDCClientID,
+		clientSecret: config.OIDCClientSecret,
+		redirectURL:  config.OIDCRedirectURL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// GET /login - redirects to the authenticator's login page.
+func (l *OIDCLogin) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	state, err := randomLoginToken()
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error starting the sign-in: %v", err)
+		return
+	}
+	verifier, err := randomLoginToken()
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error starting the sign-in: %v", err)
+		return
+	}
+	http.SetCookie(w, l.cookie(state+"."+verifier, 600))
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {l.clientID},
+		"redirect_uri":          {l.redirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, l.issuer+"/oidc/authorize?"+query.Encode(), http.StatusFound)
+}
+
+// GET /login/callback?code=&state= - exchanges the code and responds with the tokens:
+// { "access_token", "token_type", "expires_in", "id_token" }.
+func (l *OIDCLogin) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	query := r.URL.Query()
+	if failure := query.Get("error"); failure != "" {
+		httpjson.Error(w, http.StatusUnauthorized, "Signing in failed: %s %s", failure, query.Get("error_description"))
+		return
+	}
+
+	// Only the browser that started the sign-in may finish it.
+	cookie, err := r.Cookie(loginCookie)
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "No sign-in in progress, start at /login")
+		return
+	}
+	state, verifier, found := strings.Cut(cookie.Value, ".")
+	if !found || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		httpjson.Error(w, http.StatusBadRequest, "The sign-in doesn't match the one in progress, start again at /login")
+		return
+	}
+	http.SetCookie(w, l.cookie("", -1))
+
+	tokens, err := l.exchangeCode(r, query.Get("code"), verifier)
+	if err != nil {
+		httpjson.Error(w, http.StatusBadGateway, "Error getting the tokens: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, tokens)
+}
+
+type loginTokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+func (l *OIDCLogin) exchangeCode(r *http.Request, code, verifier string) (loginTokens, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {l.redirectURL},
+		"client_id":     {l.clientID},
+		"code_verifier": {verifier},
+	}
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodPost, l.issuer+"/oidc/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return loginTokens{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if l.clientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(l.clientID), url.QueryEscape(l.clientSecret))
+	}
+
+	response, err := l.client.Do(request)
+	if err != nil {
+		return loginTokens{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		return loginTokens{}, fmt.Errorf("the authenticator answered %d: %s %s", response.StatusCode, failure.Error, failure.Description)
+	}
+	var tokens loginTokens
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return loginTokens{}, fmt.Errorf("error decoding the tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// The sign-in cookie, only sent back to /login and only over https when the callback is.
+func (l *OIDCLogin) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     loginCookie,
+		Value:    value,
+		Path:     "/login",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(l.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// 256 random bits, URL safe. Long enough for a PKCE verifier.
+func randomLoginToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("error generating a token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
@@ -0,0 +1,340 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// How many outbox messages a relay pass locks and delivers at once.
+const outboxBatchSize = 100
+
+// Relay metrics, served on /debug/vars by every binary that runs a relay.
+var (
+	outboxPending   = expvar.NewInt("outbox_pending")
+	outboxLag       = expvar.NewFloat("outbox_lag_seconds") // Age of the oldest undelivered message.
+	outboxDelivered = expvar.NewInt("outbox_delivered_total")
+	outboxFailures  = expvar.NewInt("outbox_failed_attempts_total")
+)
+
+// The producer name TES puts on its events.
+const tesProducer = "tes"
+
+// Sealing events and queueing them for the relay. Called with the transaction of the change
+// they describe, an event that doesn't match its schema fails the whole change.
+func writeOutbox(db queryer, producer string, evs []events.Event) error {
+	now := time.Now().Format(time.DateTime)
+	for _, event := range evs {
+		envelope, err := schemas.Default().Seal(producer, event)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(envelope)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", event.EventName(), err)
+		}
+
+		query := `
+		INSERT INTO outbox_messages (event_id, event_name, payload, created_at, attempts, next_attempt_at)
+		VALUES ($1, $2, $3, $4, 0, $4)
+		`
+		if _, err := db.Exec(query, envelope.EventID, envelope.EventName, string(payload), now); err != nil {
+			return fmt.Errorf("failed to queue %s: %w", event.EventName(), err)
+		}
+	}
+
+	return nil
+}
+
+// Connecting to the TES database for a service that only queues events (e.g. the authenticator).
+// The database and the outbox table are created if they're missing, the rest of TES's schema is
+// left to TES.
+func InitOutboxDB(config Config) (*sql.DB, error) {
+	if err := createDatabase(config); err != nil {
+		return nil, err
+	}
+	sqlDB, err := ConnectDB(config)
+	if err != nil {
+		return nil, err
+	}
+
+	gormDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	if err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to initialise GORM with an existing sql.DB: %w", err)
+	}
+	if err := gormDB.AutoMigrate(&entities.OutboxMessage{}); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to migrate the outbox: %w", err)
+	}
+
+	return sqlDB, nil
+}
+
+// A publisher for code outside this package (e.g. the authenticator): events are queued in the
+// outbox and the relay takes it from there. Code with a transaction on the same database passes
+// it to PublishTx, so the events are queued exactly when its change is committed.
+type OutboxPublisher struct {
+	db       *sql.DB
+	producer string
+}
+
+func NewOutboxPublisher(db *sql.DB, producer string) *OutboxPublisher {
+	return &OutboxPublisher{db: db, producer: producer}
+}
+
+func (p *OutboxPublisher) Publish(evs ...events.Event) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := writeOutbox(tx, p.producer, evs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *OutboxPublisher) PublishTx(tx *sql.Tx, evs ...events.Event) error {
+	return writeOutbox(tx, p.producer, evs)
+}
+
+// Moves outbox messages to the broker. Several relays can run side by side, each locks its own
+// batch. Delivery is at least once: a message the broker took is sent again if marking it
+// delivered fails.
+type OutboxRelay struct {
+	db     *sql.DB
+	broker events.Transport
+}
+
+func NewOutboxRelay(db *sql.DB, broker events.Transport) *OutboxRelay {
+	return &OutboxRelay{db: db, broker: broker}
+}
+
+// Delivering every message that's due. Returns how many were delivered.
+func (r *OutboxRelay) RelayOnce() (int, error) {
+	delivered := 0
+	for {
+		n, due, err := r.relayBatch()
+		delivered += n
+		if err != nil || due < outboxBatchSize {
+			if statsErr := refreshOutboxMetrics(r.db); err == nil {
+				err = statsErr
+			}
+			return delivered, err
+		}
+	}
+}
+
+// Returns how many messages were delivered and how many were due in the batch.
+func (r *OutboxRelay) relayBatch() (int, int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT message_id, event_name, payload, attempts
+	FROM outbox_messages
+	WHERE delivered_at IS NULL AND next_attempt_at <= $1
+	ORDER BY message_id
+	LIMIT $2
+	FOR UPDATE SKIP LOCKED
+	`
+	now := time.Now()
+	rows, err := tx.Query(query, now.Format(time.DateTime), outboxBatchSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to lock outbox messages: %w", err)
+	}
+	var batch []entities.OutboxMessage
+	for rows.Next() {
+		var message entities.OutboxMessage
+		if err := rows.Scan(&message.MessageID, &message.EventName, &message.Payload, &message.Attempts); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		batch = append(batch, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to read outbox messages: %w", err)
+	}
+
+	delivered := 0
+	for _, message := range batch {
+		var envelope events.Envelope
+		err := json.Unmarshal([]byte(message.Payload), &envelope)
+		if err == nil {
+			err = r.broker.Send(envelope)
+		}
+
+		if err != nil {
+			outboxFailures.Add(1)
+			message.Attempts++
+			next := now.Add(events.RetryDelay(message.Attempts)).Format(time.DateTime)
+			_, err = tx.Exec(`UPDATE outbox_messages SET attempts = $1, next_attempt_at = $2, last_error = $3 WHERE message_id = $4`,
+				message.Attempts, next, err.Error(), message.MessageID)
+			if err != nil {
+				return delivered, len(batch), fmt.Errorf("failed to reschedule outbox message %d: %w", message.MessageID, err)
+			}
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE outbox_messages SET delivered_at = $1, last_error = '' WHERE message_id = $2`,
+			time.Now().Format(time.DateTime), message.MessageID)
+		if err != nil {
+			return delivered, len(batch), fmt.Errorf("failed to mark outbox message %d delivered: %w", message.MessageID, err)
+		}
+		delivered++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, len(batch), fmt.Errorf("failed to commit the relay batch: %w", err)
+	}
+	outboxDelivered.Add(int64(delivered))
+
+	return delivered, len(batch), nil
+}
+
+// Relaying on every tick until the context is cancelled.
+func (r *OutboxRelay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.RelayOnce(); err != nil {
+			log.Printf("Outbox relay: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// The state of the outbox at a glance.
+type OutboxStats struct {
+	Pending       int     `json:"pending"`        // Not delivered yet.
+	Failing       int     `json:"failing"`        // Not delivered and failed at least once.
+	Delivered     int     `json:"delivered"`      // Delivered, ever.
+	OldestPending string  `json:"oldest_pending"` // When the oldest pending message was written.
+	LagSeconds    float64 `json:"lag_seconds"`    // How long ago that was.
+}
+
+func GetOutboxStats(db queryer) (OutboxStats, error) {
+	query := `
+	SELECT COUNT(*) FILTER (WHERE delivered_at IS NULL),
+		COUNT(*) FILTER (WHERE delivered_at IS NULL AND attempts > 0),
+		COUNT(*) FILTER (WHERE delivered_at IS NOT NULL),
+		COALESCE(to_char(MIN(created_at) FILTER (WHERE delivered_at IS NULL), 'YYYY-MM-DD HH24:MI:SS'), ''),
+		COALESCE(EXTRACT(EPOCH FROM $1::timestamp - MIN(created_at) FILTER (WHERE delivered_at IS NULL)), 0)
+	FROM outbox_messages
+	`
+	var stats OutboxStats
+	err := db.QueryRow(query, time.Now().Format(time.DateTime)).
+		Scan(&stats.Pending, &stats.Failing, &stats.Delivered, &stats.OldestPending, &stats.LagSeconds)
+	if err != nil {
+		return OutboxStats{}, fmt.Errorf("failed to get outbox stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+func refreshOutboxMetrics(db queryer) error {
+	stats, err := GetOutboxStats(db)
+	if err != nil {
+		return err
+	}
+	outboxPending.Set(int64(stats.Pending))
+	outboxLag.Set(stats.LagSeconds)
+
+	return nil
+}
+
+// Criteria for listing outbox messages. Zero values mean "don't filter on this".
+type OutboxFilter struct {
+	Pending     bool // Only messages that weren't delivered yet.
+	MinAttempts int
+	Limit       int // Defaults to 100.
+}
+
+// Getting outbox messages that match the filter, oldest first.
+func ListOutboxMessages(db queryer, filter OutboxFilter) ([]entities.OutboxMessage, error) {
+	conditions := []string{"attempts >= $1"}
+	if filter.Pending {
+		conditions = append(conditions, "delivered_at IS NULL")
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = outboxBatchSize
+	}
+
+	query := `
+	SELECT message_id, COALESCE(event_id, ''), event_name, payload, to_char(created_at, 'YYYY-MM-DD HH24:MI:SS'), attempts,
+		to_char(next_attempt_at, 'YYYY-MM-DD HH24:MI:SS'),
+		COALESCE(to_char(delivered_at, 'YYYY-MM-DD HH24:MI:SS'), ''), COALESCE(last_error, '')
+	FROM outbox_messages
+	WHERE ` + strings.Join(conditions, " AND ") + `
+	ORDER BY message_id
+	LIMIT $2
+	`
+	rows, err := db.Query(query, filter.MinAttempts, filter.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []entities.OutboxMessage{}
+	for rows.Next() {
+		var m entities.OutboxMessage
+		err := rows.Scan(&m.MessageID, &m.EventID, &m.EventName, &m.Payload, &m.CreatedAt, &m.Attempts, &m.NextAttemptAt,
+			&m.DeliveredAt, &m.LastError)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// Making undelivered messages due right away instead of waiting out their backoff. Without
+// IDs every message that failed at least once is re-driven. Returns how many were.
+func RedriveOutboxMessages(db queryer, messageIDs ...int64) (int, error) {
+	if messageIDs == nil {
+		messageIDs = []int64{}
+	}
+
+	query := `
+	UPDATE outbox_messages SET next_attempt_at = $1
+	WHERE delivered_at IS NULL
+		AND (cardinality($2::bigint[]) = 0 AND attempts > 0 OR message_id = ANY($2::bigint[]))
+	`
+	result, err := db.Exec(query, time.Now().Format(time.DateTime), pq.Array(messageIDs))
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-drive outbox messages: %w", err)
+	}
+
+	redriven, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(redriven), nil
+}
@@ -0,0 +1,102 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/rbac"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Reassigning every open task to a random worker in one transaction, the accounting consumer
+// charges the new assignees from the TaskAssigned events. Open tasks are locked in a fixed
+// order, so a completion racing with the shuffle either commits first (and the task drops out of
+// the draw) or waits and sees the new assignee.
+func ShuffleOpenTasks(db *sql.DB, actor businesslogic.Actor, rng *rand.Rand) (businesslogic.ShuffleSummary, error) {
+	if !actor.Can(rbac.TasksShuffle) {
+		return businesslogic.ShuffleSummary{}, businesslogic.ErrNotAllowed
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return businesslogic.ShuffleSummary{}, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	tasks, err := lockOpenTasks(tx)
+	if err != nil {
+		return businesslogic.ShuffleSummary{}, err
+	}
+
+	users, err := GetUsers(tx)
+	if err != nil {
+		return businesslogic.ShuffleSummary{}, err
+	}
+
+	summary, err := businesslogic.ShuffleTasks(actor, tasks, users, rng)
+	if err != nil {
+		return businesslogic.ShuffleSummary{}, err
+	}
+
+	tasksByID := make(map[int]entities.Task, len(tasks))
+	for _, task := range tasks {
+		tasksByID[task.TaskID] = task
+	}
+
+	now := time.Now()
+	var published []events.Event
+	for _, moved := range summary.Reassignments {
+		before := tasksByID[moved.TaskID]
+		task := before
+		reassigned, err := businesslogic.RecordTaskEvent(&task, entities.TaskEventReassigned,
+			entities.TaskEventData{From: moved.From, To: moved.To}, actor.UserID, now)
+		if err != nil {
+			return businesslogic.ShuffleSummary{}, err
+		}
+		if err := saveTaskEvents(tx, before, []entities.TaskEvent{reassigned}); err != nil {
+			return businesslogic.ShuffleSummary{}, fmt.Errorf("failed to reassign task %d: %w", moved.TaskID, err)
+		}
+
+		// The accounting consumer charges the new assignee the fee.
+		published = append(published, events.TaskAssigned{TaskID: moved.TaskID, From: moved.From, To: moved.To, Fee: moved.Fee})
+	}
+
+	if err := writeOutbox(tx, tesProducer, published); err != nil {
+		return businesslogic.ShuffleSummary{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return businesslogic.ShuffleSummary{}, fmt.Errorf("failed to commit the shuffle: %w", err)
+	}
+
+	return summary, nil
+}
+
+// Selecting and locking all tasks that aren't closed yet.
+func lockOpenTasks(tx *sql.Tx) ([]entities.Task, error) {
+	query := `SELECT ` + taskColumns + `
+	FROM tasks
+	WHERE status NOT IN ($1, $2)
+	ORDER BY task_id
+	FOR UPDATE
+	`
+	rows, err := tx.Query(query, businesslogic.StatusCompleted, businesslogic.StatusCancelled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock open tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []entities.Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
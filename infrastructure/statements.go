@@ -0,0 +1,138 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+// Builds or rebuilds the monthly statements of the given users, or of every worker when no
+// users are given. Money comes from the ledger. Task counts come from the ledger for
+// assignments and completions, and from the task streams for started and cancelled tasks: each
+// started or cancelled event of the month counts for whoever had the task at the time.
+const buildStatementsSQL = `
+WITH bounds AS (
+	SELECT $1::timestamp AS month_start, $2::timestamp AS month_end
+),
+accounts AS (
+	SELECT account_id, user_id FROM ledger_accounts
+	WHERE kind = $4 AND (cardinality($5::int[]) = 0 OR user_id = ANY($5::int[]))
+),
+money AS (
+	SELECT a.user_id,
+		COALESCE(SUM(l.credit - l.debit) FILTER (WHERE e.posted_at < b.month_start), 0) AS opening,
+		COALESCE(SUM(l.debit) FILTER (WHERE e.kind = $6 AND e.posted_at >= b.month_start AND e.posted_at < b.month_end), 0) AS charges,
+		COALESCE(SUM(l.credit) FILTER (WHERE e.kind = $7 AND e.posted_at >= b.month_start AND e.posted_at < b.month_end), 0) AS rewards,
+		COALESCE(SUM(l.debit) FILTER (WHERE e.kind = $8 AND e.posted_at >= b.month_start AND e.posted_at < b.month_end), 0) AS payouts,
+		COALESCE(SUM(l.credit - l.debit) FILTER (WHERE e.kind = $9 AND e.posted_at >= b.month_start AND e.posted_at < b.month_end), 0) AS adjustments,
+		COALESCE(SUM(l.credit - l.debit) FILTER (WHERE e.posted_at < b.month_end), 0) AS closing,
+		COUNT(DISTINCT e.entry_id) FILTER (WHERE e.kind = $6 AND e.posted_at >= b.month_start AND e.posted_at < b.month_end) AS assigned,
+		COUNT(DISTINCT e.entry_id) FILTER (WHERE e.kind = $7 AND e.posted_at >= b.month_start AND e.posted_at < b.month_end) AS completed
+	FROM accounts a
+	CROSS JOIN bounds b
+	LEFT JOIN journal_lines l ON l.account_id = a.account_id
+	LEFT JOIN journal_entries e ON e.entry_id = l.entry_id
+	GROUP BY a.user_id
+),
+task_counts AS (
+	SELECT holder.user_id,
+		COUNT(*) FILTER (WHERE te.type = $10) AS started,
+		COUNT(*) FILTER (WHERE te.type = $11) AS cancelled
+	FROM task_events te
+	CROSS JOIN bounds b
+	CROSS JOIN LATERAL (
+		SELECT COALESCE((a.data->>'to')::int, (a.data->'task'->>'assigned_to')::int) AS user_id
+		FROM task_events a
+		WHERE a.task_id = te.task_id AND a.version < te.version AND a.type = ANY($13)
+		ORDER BY a.version DESC
+		LIMIT 1
+	) holder
+	WHERE te.type IN ($10, $11) AND te.occurred_at >= b.month_start AND te.occurred_at < b.month_end
+	GROUP BY holder.user_id
+)
+INSERT INTO accounting_records (user_id, month, opening_balance, charges, rewards, payouts, adjustments,
+	closing_balance, tasks_assigned, tasks_started, tasks_completed, tasks_cancelled, last_updated)
+SELECT m.user_id, $3, m.opening::bigint, m.charges::bigint, m.rewards::bigint, m.payouts::bigint,
+	m.adjustments::bigint, m.closing::bigint, m.assigned, COALESCE(tc.started, 0), m.completed,
+	COALESCE(tc.cancelled, 0), $12
+FROM money m
+LEFT JOIN task_counts tc ON tc.user_id = m.user_id
+ON CONFLICT (user_id, month) DO UPDATE SET
+	opening_balance = EXCLUDED.opening_balance,
+	charges = EXCLUDED.charges,
+	rewards = EXCLUDED.rewards,
+	payouts = EXCLUDED.payouts,
+	adjustments = EXCLUDED.adjustments,
+	closing_balance = EXCLUDED.closing_balance,
+	tasks_assigned = EXCLUDED.tasks_assigned,
+	tasks_started = EXCLUDED.tasks_started,
+	tasks_completed = EXCLUDED.tasks_completed,
+	tasks_cancelled = EXCLUDED.tasks_cancelled,
+	last_updated = EXCLUDED.last_updated
+`
+
+// Aggregating the ledger into monthly statements for a month (YYYY-MM). Rebuilding a month
+// overwrites its statements, so the job can run as often as needed. Returns how many were written.
+func BuildMonthlyStatements(db *sql.DB, month string, userIDs ...int) (int, error) {
+	start, end, err := businesslogic.MonthRange(month, time.Local)
+	if err != nil {
+		return 0, err
+	}
+
+	if userIDs == nil {
+		userIDs = []int{}
+	}
+
+	result, err := db.Exec(buildStatementsSQL,
+		start.Format(time.DateTime), end.Format(time.DateTime), month,
+		businesslogic.AccountWorker, pq.Array(userIDs),
+		businesslogic.EntryAssignmentCharge, businesslogic.EntryCompletionReward,
+		businesslogic.EntryPayout, businesslogic.EntryReversal,
+		entities.TaskEventStarted, entities.TaskEventCancelled,
+		time.Now().Format(time.DateTime),
+		pq.Array([]string{entities.TaskEventAssigned, entities.TaskEventReassigned, entities.TaskEventImported}))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build the statements of %s: %w", month, err)
+	}
+
+	written, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(written), nil
+}
+
+// Getting a user's statement for a month. A statement is only final if it was built after the
+// month ended, anything older (or missing) is rebuilt first so it includes the latest activity.
+func GetMonthlyStatement(sqlDB *sql.DB, gormDB *gorm.DB, userID int, month string) (entities.AccountingRecord, error) {
+	_, end, err := businesslogic.MonthRange(month, time.Local)
+	if err != nil {
+		return entities.AccountingRecord{}, err
+	}
+
+	var record entities.AccountingRecord
+	err = gormDB.Where("user_id = ? AND month = ? AND last_updated >= ?", userID, month, end.Format(time.DateTime)).
+		First(&record).Error
+	if err == nil {
+		return record, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return entities.AccountingRecord{}, fmt.Errorf("failed to retrieve the statement: %w", err)
+	}
+
+	if _, err := BuildMonthlyStatements(sqlDB, month, userID); err != nil {
+		return entities.AccountingRecord{}, err
+	}
+	if err := gormDB.Where("user_id = ? AND month = ?", userID, month).First(&record).Error; err != nil {
+		return entities.AccountingRecord{}, fmt.Errorf("failed to retrieve the statement: %w", err)
+	}
+
+	return record, nil
+}
@@ -0,0 +1,73 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Storing a task event as if it occurred at the given time.
+func storeTaskEvent(t *testing.T, db *sql.DB, taskID, version int, kind string, data entities.TaskEventData, at time.Time) {
+	t.Helper()
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO task_events (task_id, version, type, data, actor_id, occurred_at) VALUES ($1, $2, $3, $4, 0, $5)`,
+		taskID, version, kind, string(payload), at.Format(time.DateTime))
+	if err != nil {
+		t.Fatalf("Error storing a task event: %v", err)
+	}
+}
+
+// Started and cancelled count in the month they happened, for whoever had the task then, however
+// the task ended up.
+func TestBuildMonthlyStatementsCountsTransitions(t *testing.T) {
+	db := newTestDB(t)
+	may := time.Date(2024, 5, 20, 10, 0, 0, 0, time.Local)
+	june := time.Date(2024, 6, 10, 10, 0, 0, 0, time.Local)
+	for _, userID := range []int{7, 8} {
+		postReward(t, db, userID, may, entities.NewMoney(100))
+	}
+
+	// Task 1 is started by 7 in May, moved to 8 and cancelled in June.
+	storeTaskEvent(t, db, 1, 1, entities.TaskEventCreated, entities.TaskEventData{Description: "One"}, may)
+	storeTaskEvent(t, db, 1, 2, entities.TaskEventAssigned, entities.TaskEventData{To: 7}, may)
+	storeTaskEvent(t, db, 1, 3, entities.TaskEventStarted, entities.TaskEventData{}, may.Add(time.Hour))
+	storeTaskEvent(t, db, 1, 4, entities.TaskEventReassigned, entities.TaskEventData{From: 7, To: 8}, june)
+	storeTaskEvent(t, db, 1, 5, entities.TaskEventCancelled, entities.TaskEventData{}, june.Add(time.Hour))
+	// Task 2 came in with the import, assigned to 7, and is started in June.
+	storeTaskEvent(t, db, 2, 1, entities.TaskEventImported, entities.TaskEventData{Task: &entities.Task{TaskID: 2, AssignedTo: 7}}, may)
+	storeTaskEvent(t, db, 2, 2, entities.TaskEventStarted, entities.TaskEventData{}, june)
+
+	for _, month := range []string{"2024-05", "2024-06"} {
+		if _, err := BuildMonthlyStatements(db, month); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	cases := []struct {
+		userID             int
+		month              string
+		started, cancelled int
+	}{
+		{7, "2024-05", 1, 0},
+		{8, "2024-05", 0, 0},
+		{7, "2024-06", 1, 0},
+		{8, "2024-06", 0, 1},
+	}
+	for _, c := range cases {
+		var started, cancelled int
+		err := db.QueryRow(`SELECT tasks_started, tasks_cancelled FROM accounting_records WHERE user_id = $1 AND month = $2`,
+			c.userID, c.month).Scan(&started, &cancelled)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if started != c.started || cancelled != c.cancelled {
+			t.Errorf("User %d in %s: expected %d started and %d cancelled, got %d and %d",
+				c.userID, c.month, c.started, c.cancelled, started, cancelled)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package infrastructure
+
+import (
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A message on a partitioned log, as Kafka keeps them.
+type streamMessage struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte // Messages with the same key land on the same partition, in order.
+	Value     []byte
+}
+
+// The parts of a Kafka-like broker StreamBus relies on: topics split in partitions by message key,
+// and consumer groups that share the partitions of a topic and commit how far they've read.
+type streamLog interface {
+	Write(ctx context.Context, messages ...streamMessage) error
+	Reader(group, topic string) streamReader
+	Close() error
+}
+
+type streamReader interface {
+	// Blocks until there's a message for this reader or the context is done. Until it's
+	// committed, no other reader of the group gets a message of the same partition.
+	Fetch(ctx context.Context) (streamMessage, error)
+	Commit(ctx context.Context, message streamMessage) error
+	Close() error
+}
+
+// An event bus over a Kafka-like log. Events go to the topic of their stream (see events.TopicOf)
+// keyed by their aggregate, so the events of a task or a user stay in order. Each bus belongs to
+// a consumer group: buses of different groups all get every event, those of one group share them.
+//
+// Delivery is at least once: a message is committed once its handlers succeed. A failing one is
+// retried with backoff, up to maxEventAttempts, then it goes to the group's dead letters (see
+// streamSubscriber) and is committed so its partition can move on. Queued dead letters are
+// replayed while the bus runs. Handlers that mustn't run twice should sit behind a Consumer (see
+// Forward).
+type StreamBus struct {
+	log      streamLog
+	db       *sql.DB // Keeps the dead letters, buses that only send may leave it nil.
+	group    string
+	producer string // Put on events sealed by Publish.
+	mu       sync.Mutex
+	sinks    map[string][]func(events.Envelope) error // Topic -> what gets its envelopes.
+}
+
+func NewStreamBus(log streamLog, db *sql.DB, group, producer string) *StreamBus {
+	return &StreamBus{log: log, db: db, group: group, producer: producer, sinks: make(map[string][]func(events.Envelope) error)}
+}
+
+// How often a running bus replays the dead letters queued for its group.
+const streamDeadLetterInterval = 10 * time.Second
+
+// The subscriber a group's dead letters are filed under, apart from the Consumers' and
+// PostgresBuses' of the same name.
+func streamSubscriber(group string) string {
+	return "stream:" + group
+}
+
+// Writing envelopes to their topics, all of them or none.
+func (b *StreamBus) Send(envelopes ...events.Envelope) error {
+	messages := make([]streamMessage, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		topic := events.TopicOf(envelope.EventName)
+		if topic == "" {
+			return fmt.Errorf("%w %q: no topic to send it to", schemas.ErrUnknownEvent, envelope.EventName)
+		}
+		value, err := json.Marshal(envelope)
+		if err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", envelope.EventID, err)
+		}
+
+		// Envelopes that don't open still go out, consumers dead-letter them.
+		key := ""
+		if event, err := schemas.Default().Open(envelope); err == nil {
+			key = events.AggregateKey(event)
+		}
+		messages = append(messages, streamMessage{Topic: topic, Key: []byte(key), Value: value})
+	}
+
+	return b.log.Write(context.Background(), messages...)
+}
+
+// Sealing the events and sending them. Producers with a database should go through the outbox.
+func (b *StreamBus) Publish(evs ...events.Event) error {
+	envelopes := make([]events.Envelope, 0, len(evs))
+	for _, event := range evs {
+		envelope, err := schemas.Default().Seal(b.producer, event)
+		if err != nil {
+			return err
+		}
+		envelopes = append(envelopes, envelope)
+	}
+
+	return b.Send(envelopes...)
+}
+
+func (b *StreamBus) Subscribe(name string, handler events.Handler) {
+	b.addSink(events.TopicOf(name), func(envelope events.Envelope) error {
+		if envelope.EventName != name {
+			return nil
+		}
+		event, err := schemas.Default().Open(envelope)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errPoisonEvent, err)
+		}
+		return handler(event)
+	})
+}
+
+// Handing every envelope of the topics to another transport as is, e.g. a PostgresBus whose
+// stored events local Consumers read exactly once.
+func (b *StreamBus) Forward(to events.Transport, topics ...string) {
+	for _, topic := range topics {
+		b.addSink(topic, func(envelope events.Envelope) error {
+			return to.Send(envelope)
+		})
+	}
+}
+
+func (b *StreamBus) addSink(topic string, sink func(events.Envelope) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sinks[topic] = append(b.sinks[topic], sink)
+}
+
+// Reading every subscribed topic until the context is cancelled. Messages being handled are
+// finished first: Run returning means the bus is drained.
+func (b *StreamBus) Run(ctx context.Context) {
+	b.mu.Lock()
+	sinks := make(map[string][]func(events.Envelope) error, len(b.sinks))
+	for topic, list := range b.sinks {
+		sinks[topic] = list
+	}
+	b.mu.Unlock()
+
+	var readers sync.WaitGroup
+	for topic, list := range sinks {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			b.read(ctx, topic, list)
+		}()
+	}
+	if b.db != nil {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				if _, err := b.replayDeadLetters(sinks); err != nil {
+					log.Printf("Stream bus: %v\n", err)
+				}
+				if !sleepCtx(ctx, streamDeadLetterInterval) {
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+}
+
+// Handing the group's queued dead letters to the sinks of their topics again.
+func (b *StreamBus) replayDeadLetters(sinks map[string][]func(events.Envelope) error) (int, error) {
+	return replayDeadLetters(b.db, streamSubscriber(b.group), func(eventName string, payload []byte) error {
+		return deliverStreamMessage(streamMessage{Value: payload}, sinks[events.TopicOf(eventName)])
+	})
+}
+
+func (b *StreamBus) read(ctx context.Context, topic string, sinks []func(events.Envelope) error) {
+	reader := b.log.Reader(b.group, topic)
+	defer reader.Close()
+
+	for {
+		message, err := reader.Fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Stream bus: %s failed to read %s: %v\n", b.group, topic, err)
+			if !sleepCtx(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := deliverStreamMessage(message, sinks)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errPoisonEvent) || attempt >= maxEventAttempts {
+				log.Printf("Stream bus: %s gave up on %s/%d@%d after %d attempts: %v\n", b.group, topic,
+					message.Partition, message.Offset, attempt, err)
+				if !b.deadLetter(ctx, message, err, attempt) {
+					return
+				}
+				break
+			}
+			if !sleepCtx(ctx, events.RetryDelay(attempt)) {
+				return
+			}
+		}
+
+		// Committing even when the context is done: the message was dealt with.
+		if err := reader.Commit(context.Background(), message); err != nil {
+			log.Printf("Stream bus: %s failed to commit %s/%d@%d: %v\n", b.group, topic, message.Partition, message.Offset, err)
+		}
+	}
+}
+
+// Filing a message the group gave up on, retrying until it's kept: it's only committed after.
+// Reports false if the context was done first, the message is then read again after a restart.
+func (b *StreamBus) deadLetter(ctx context.Context, message streamMessage, cause error, attempts int) bool {
+	// The name is all that's needed of the envelope, a broken one is filed without. Payloads are
+	// kept as JSON, one that isn't is kept as a JSON string.
+	var envelope events.Envelope
+	json.Unmarshal(message.Value, &envelope)
+	stored := storedEvent{name: envelope.EventName, payload: message.Value}
+	if !json.Valid(message.Value) {
+		stored.payload, _ = json.Marshal(string(message.Value))
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := errors.New("no database to keep dead letters in")
+		if b.db != nil {
+			err = deadLetter(b.db, streamSubscriber(b.group), stored, cause, attempts)
+		}
+		if err == nil {
+			return true
+		}
+		log.Printf("Stream bus: %s failed to dead-letter %s/%d@%d: %v\n", b.group, message.Topic, message.Partition, message.Offset, err)
+		if !sleepCtx(ctx, events.RetryDelay(attempt)) {
+			return false
+		}
+	}
+}
+
+func deliverStreamMessage(message streamMessage, sinks []func(events.Envelope) error) error {
+	var envelope events.Envelope
+	if err := json.Unmarshal(message.Value, &envelope); err != nil {
+		return fmt.Errorf("%w: %w", errPoisonEvent, err)
+	}
+	for _, sink := range sinks {
+		if err := sink(envelope); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Waiting for d, or less if the context is done first. Reports whether it wasn't.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (b *StreamBus) Close() error {
+	return b.log.Close()
+}
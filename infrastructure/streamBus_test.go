@@ -0,0 +1,262 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects what's handed to it, like a PostgresBus would store it.
+type recordingTransport struct {
+	mu        sync.Mutex
+	envelopes []events.Envelope
+}
+
+func (t *recordingTransport) Send(envelopes ...events.Envelope) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.envelopes = append(t.envelopes, envelopes...)
+	return nil
+}
+
+func TestStreamBusOverMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker(3)
+	producer := NewStreamBus(broker, nil, "", "tes")
+
+	// Two consumer groups: both get everything, whatever the partitioning.
+	var mu sync.Mutex
+	assignedTo := map[int][]int{} // Task -> its assignees in the order they were handled.
+	accounting := NewStreamBus(broker, nil, "accounting", "")
+	accounting.Subscribe(events.TaskAssignedName, func(event events.Event) error {
+		assigned := event.(events.TaskAssigned)
+		mu.Lock()
+		defer mu.Unlock()
+		assignedTo[assigned.TaskID] = append(assignedTo[assigned.TaskID], assigned.To)
+		return nil
+	})
+	forwarded := &recordingTransport{}
+	inbox := NewStreamBus(broker, nil, "analytics", "")
+	inbox.Forward(forwarded, events.TasksLifecycleTopic)
+
+	var published []events.Event
+	for round := 1; round <= 4; round++ {
+		for taskID := 1; taskID <= 5; taskID++ {
+			published = append(published, events.TaskAssigned{TaskID: taskID, To: round, Fee: entities.NewMoney(1000)})
+		}
+	}
+	if err := producer.Publish(published...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The events of a task share a key, so a partition.
+	for _, partition := range broker.Messages(events.TasksLifecycleTopic) {
+		for _, message := range partition {
+			if message.Partition != broker.partitionOf(message.Key) {
+				t.Errorf("Message %s landed on partition %d", message.Key, message.Partition)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	for _, bus := range []*StreamBus{accounting, inbox} {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			bus.Run(ctx)
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		handled := 0
+		for _, assignees := range assignedTo {
+			handled += len(assignees)
+		}
+		mu.Unlock()
+		forwarded.mu.Lock()
+		received := len(forwarded.envelopes)
+		forwarded.mu.Unlock()
+		if handled == len(published) && received == len(published) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d events in both groups, got %d and %d", len(published), handled, received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	running.Wait()
+
+	for taskID, assignees := range assignedTo {
+		for i, to := range assignees {
+			if to != i+1 {
+				t.Errorf("Task %d: expected its assignments in order, got %v", taskID, assignees)
+				break
+			}
+		}
+	}
+}
+
+func TestMemoryBrokerRedeliversUncommitted(t *testing.T) {
+	broker := NewMemoryBroker(1)
+	if err := broker.Write(context.Background(), streamMessage{Topic: "t", Key: []byte("a"), Value: []byte("1")},
+		streamMessage{Topic: "t", Key: []byte("a"), Value: []byte("2")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	first := broker.Reader("g", "t")
+	message, err := first.Fetch(ctx)
+	if err != nil || string(message.Value) != "1" {
+		t.Fatalf("Expected message 1, got %q (%v)", message.Value, err)
+	}
+
+	// The partition is held until the message is committed, or its reader leaves the group.
+	second := broker.Reader("g", "t")
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if message, err := second.Fetch(short); err == nil {
+		t.Fatalf("Expected nothing while the partition is held, got %q", message.Value)
+	}
+	first.Close()
+
+	message, err = second.Fetch(ctx)
+	if err != nil || string(message.Value) != "1" {
+		t.Fatalf("Expected message 1 again, got %q (%v)", message.Value, err)
+	}
+	second.Commit(ctx, message)
+	if message, err = second.Fetch(ctx); err != nil || string(message.Value) != "2" {
+		t.Fatalf("Expected message 2, got %q (%v)", message.Value, err)
+	}
+}
+
+// TES publishes its events to the broker, its webhooks only see them through the inbox.
+func TestEventInboxFeedsWebhookFanout(t *testing.T) {
+	db := newTestDB(t)
+	subscription, err := CreateWebhookSubscription(db, "http://localhost/hook",
+		[]string{events.TaskCompletedName, events.TransactionAppliedName, events.UserCreatedName}, "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	broker := NewMemoryBroker(2)
+	published := []events.Event{
+		events.TaskCreated{Task: entities.Task{TaskID: 1, Description: "Write docs", AssignedTo: 7, Status: string(businesslogic.StatusPending)}},
+		events.TaskCompleted{TaskID: 1, CompletedBy: 7, Reward: entities.NewMoney(3000), CompletedAt: "2024-06-13 10:00:00"},
+		events.TransactionApplied{EntryID: 1, Kind: businesslogic.EntryCompletionReward, TaskID: 1, UserID: 7,
+			Amount: entities.NewMoney(3000), PostedAt: "2024-06-13 10:00:00"},
+		events.UserCreated{User: entities.User{UserID: 7, Name: "worker", Role: entities.RoleWorker}},
+	}
+	if err := NewStreamBus(broker, nil, "", "tes").Publish(published...); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inbox := newEventInbox(broker, db, "tes", events.Topics()...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inbox.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var stored int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM stored_events`).Scan(&stored); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if stored == len(published) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d stored events, got %d", len(published), stored)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if _, err := NewWebhookFanout(db, 2).Dispatch(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	deliveries, err := ListWebhookDeliveries(db, subscription.SubscriptionID, "", 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queued := map[string]bool{}
+	for _, delivery := range deliveries {
+		queued[delivery.EventName] = true
+	}
+	if len(deliveries) != 3 || !queued[events.TaskCompletedName] || !queued[events.TransactionAppliedName] || !queued[events.UserCreatedName] {
+		t.Errorf("Expected deliveries of the three subscribed events, got %+v", deliveries)
+	}
+}
+
+// A message the group gives up on is dead-lettered before it's committed, the partition moves
+// on, and the dead letter comes back once it's fixed and queued.
+func TestStreamBusDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	broker := NewMemoryBroker(1)
+	err := broker.Write(context.Background(), streamMessage{Topic: events.TasksLifecycleTopic, Value: []byte("not an envelope")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := NewStreamBus(broker, nil, "", "tes").Publish(assigned(1, 7)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	forwarded := &recordingTransport{}
+	inbox := NewStreamBus(broker, db, "tes", "")
+	inbox.Forward(forwarded, events.TasksLifecycleTopic)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inbox.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		forwarded.mu.Lock()
+		received := len(forwarded.envelopes)
+		forwarded.mu.Unlock()
+		if received == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the event after the broken message forwarded, got %d", received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	letters, err := ListDeadLetters(db, DeadLetterFilter{Subscriber: streamSubscriber("tes")})
+	if err != nil || len(letters) != 1 || letters[0].Status != entities.DeadLetterDead {
+		t.Fatalf("Expected the broken message dead-lettered, got %+v (%v)", letters, err)
+	}
+
+	fixed, err := schemas.Default().Seal("tes", assigned(2, 7))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	payload, _ := json.Marshal(fixed)
+	if _, err := EditDeadLetter(db, letters[0].DeadLetterID, payload); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := QueueDeadLetters(db, letters[0].DeadLetterID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	replayed, err := inbox.replayDeadLetters(inbox.sinks)
+	if err != nil || replayed != 1 || len(forwarded.envelopes) != 2 || forwarded.envelopes[1].EventID != fixed.EventID {
+		t.Errorf("Expected the fixed envelope forwarded, got %d %+v (%v)", replayed, forwarded.envelopes, err)
+	}
+}
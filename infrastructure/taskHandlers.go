@@ -0,0 +1,302 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/httpjson"
+	"aTES/core/rbac"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Routes:
+//
+//	GET  /tasks?task_id=<id>                                        - a single task.
+//	GET  /tasks?task_id=<id>&at=<time>                              - the task as it was then, from its event stream.
+//	GET  /tasks?assigned_to=&status=&created_from=&created_to=      - tasks matching the filters.
+//	POST /tasks   { "description": <text> }                         - creates and randomly assigns a task.
+//	PUT  /tasks   { "task_id": <id>, "status": <started/completed/cancelled> }
+//
+// Workers only see their own tasks, everyone else sees all of them.
+func (h *HandlersGroup) TaskHandler(w http.ResponseWriter, r *http.Request) {
+	actor, err := actorFromRequest(r, h.resources.policy)
+	if err != nil {
+		httpjson.Error(w, http.StatusUnauthorized, "Unauthorised: %v", err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("task_id") {
+			h.getTask(w, r, actor)
+		} else {
+			h.listTasks(w, r, actor)
+		}
+	case http.MethodPost:
+		if !actor.Can(rbac.TasksCreate) {
+			httpjson.Error(w, http.StatusForbidden, "Forbidden: %s is required", rbac.TasksCreate)
+			return
+		}
+		h.createTask(w, r, actor)
+	case http.MethodPut:
+		h.updateTaskStatus(w, r, actor)
+	default:
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+	}
+}
+
+func (h *HandlersGroup) getTask(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	taskID, err := strconv.Atoi(r.URL.Query().Get("task_id"))
+	if err != nil || taskID <= 0 {
+		writeValidationErrors(w, validationErrors{"task_id": "must be a positive integer"})
+		return
+	}
+
+	at, err := parseTimeParam(r.URL.Query().Get("at"))
+	if err != nil {
+		writeValidationErrors(w, validationErrors{"at": err.Error()})
+		return
+	}
+
+	var task entities.Task
+	if at.IsZero() {
+		task, err = GetTask(h.resources.db, taskID)
+	} else {
+		task, err = TaskAt(h.resources.db, taskID, at)
+	}
+	if err != nil {
+		httpjson.Error(w, taskErrorStatus(err), "Error getting task: %v", err)
+		return
+	}
+
+	// Not telling workers that someone else's task exists.
+	if !businesslogic.CanViewTask(actor, task) {
+		httpjson.Error(w, http.StatusNotFound, "Task %d not found", taskID)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, task)
+}
+
+func (h *HandlersGroup) listTasks(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	filter, fieldErrors := parseTaskFilter(r)
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if !businesslogic.CanViewAllTasks(actor) {
+		if filter.AssignedTo != 0 && filter.AssignedTo != actor.UserID {
+			httpjson.Error(w, http.StatusForbidden, "Workers can only list their own tasks")
+			return
+		}
+		filter.AssignedTo = actor.UserID
+	}
+
+	tasks, err := ListTasks(h.resources.db, filter)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error listing tasks: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, tasks)
+}
+
+// Reading the list filters from the query string.
+func parseTaskFilter(r *http.Request) (TaskFilter, validationErrors) {
+	var filter TaskFilter
+	fieldErrors := validationErrors{}
+	query := r.URL.Query()
+
+	if assignedTo := query.Get("assigned_to"); assignedTo != "" {
+		userID, err := strconv.Atoi(assignedTo)
+		if err != nil || userID <= 0 {
+			fieldErrors["assigned_to"] = "must be a positive integer"
+		}
+		filter.AssignedTo = userID
+	}
+
+	if status := query.Get("status"); status != "" {
+		if _, err := businesslogic.ParseTaskStatus(status); err != nil {
+			fieldErrors["status"] = err.Error()
+		}
+		filter.Status = status
+	}
+
+	var err error
+	if filter.CreatedFrom, err = parseTimeParam(query.Get("created_from")); err != nil {
+		fieldErrors["created_from"] = err.Error()
+	}
+	if filter.CreatedTo, err = parseTimeParam(query.Get("created_to")); err != nil {
+		fieldErrors["created_to"] = err.Error()
+	}
+	if !filter.CreatedFrom.IsZero() && !filter.CreatedTo.IsZero() && !filter.CreatedFrom.Before(filter.CreatedTo) {
+		fieldErrors["created_to"] = "must be after created_from"
+	}
+
+	return filter, fieldErrors
+}
+
+// Accepting either a date or a date and time. Empty means no bound.
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, errors.New("expected YYYY-MM-DD or YYYY-MM-DD HH:MM:SS")
+}
+
+// Creating a task and assigning it to a random worker. Body: { "description": <text> }
+func (h *HandlersGroup) createTask(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	var reqBody struct {
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "Error decoding the request's body: %v", err)
+		return
+	}
+
+	reqBody.Description = strings.TrimSpace(reqBody.Description)
+	if reqBody.Description == "" {
+		writeValidationErrors(w, validationErrors{"description": "must not be empty"})
+		return
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	task, err := CreateAssignedTask(h.resources.db, actor, h.resources.pricing, reqBody.Description, rng)
+	if err != nil {
+		httpjson.Error(w, taskErrorStatus(err), "Error creating task: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusCreated, task)
+}
+
+// Moving a task to a new status. Body: { "task_id": <taskID>, "status": <status> }
+func (h *HandlersGroup) updateTaskStatus(w http.ResponseWriter, r *http.Request, actor businesslogic.Actor) {
+	var reqBody struct {
+		TaskID int    `json:"task_id"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "Error decoding the request's body: %v", err)
+		return
+	}
+
+	fieldErrors := validationErrors{}
+	if reqBody.TaskID <= 0 {
+		fieldErrors["task_id"] = "must be a positive integer"
+	}
+	if _, err := businesslogic.ParseTaskStatus(reqBody.Status); err != nil {
+		fieldErrors["status"] = err.Error()
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	err := UpdateTaskStatus(h.resources.db, actor, reqBody.TaskID, reqBody.Status)
+	if err != nil {
+		httpjson.Error(w, taskErrorStatus(err), "Error updating task: %v", err)
+		return
+	}
+
+	task, err := GetTask(h.resources.db, reqBody.TaskID)
+	if err != nil {
+		httpjson.Error(w, taskErrorStatus(err), "Error getting task: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, task)
+}
+
+// The changes made to a task, oldest first: GET /tasks/history?task_id=<id>. Managers, admins
+// and anyone the task is or was assigned to may look.
+func (h *HandlersGroup) TaskHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	actor, err := actorFromRequest(r, h.resources.policy)
+	if err != nil {
+		httpjson.Error(w, http.StatusUnauthorized, "Unauthorised: %v", err)
+		return
+	}
+
+	taskID, err := strconv.Atoi(r.URL.Query().Get("task_id"))
+	if err != nil || taskID <= 0 {
+		writeValidationErrors(w, validationErrors{"task_id": "must be a positive integer"})
+		return
+	}
+
+	task, err := GetTask(h.resources.db, taskID)
+	if err != nil {
+		httpjson.Error(w, taskErrorStatus(err), "Error getting task: %v", err)
+		return
+	}
+	history, err := GetTaskHistory(h.resources.db, taskID)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error getting the history: %v", err)
+		return
+	}
+
+	if !businesslogic.CanViewTaskHistory(actor, task, history) {
+		httpjson.Error(w, http.StatusNotFound, "Task %d not found", taskID)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, history)
+}
+
+// Randomly reassigning all open tasks among the workers. Served behind tasks:shuffle, and the
+// shuffle itself is still management's.
+func (h *HandlersGroup) ShuffleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	actor, err := actorFromRequest(r, h.resources.policy)
+	if err != nil {
+		httpjson.Error(w, http.StatusUnauthorized, "Unauthorised: %v", err)
+		return
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	summary, err := ShuffleOpenTasks(h.resources.db, actor, rng)
+	if err != nil {
+		httpjson.Error(w, taskErrorStatus(err), "Error shuffling tasks: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, summary)
+}
+
+// Mapping task state machine errors to HTTP status codes.
+func taskErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound
+	case errors.Is(err, businesslogic.ErrUnknownStatus):
+		return http.StatusBadRequest
+	case errors.Is(err, businesslogic.ErrNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, businesslogic.ErrIllegalTransition),
+		errors.Is(err, businesslogic.ErrNoEligibleWorkers):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
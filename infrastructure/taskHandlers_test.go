@@ -0,0 +1,142 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	auth "aTES/core/operations/authenticator"
+	"aTES/core/rbac"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serving a request as the user, with the token the authenticator would have issued them. User 0
+// sends no token.
+func serveAs(t *testing.T, handler http.HandlerFunc, userID int, role, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Setenv("JWT_KEY_TES_APP", "test-key")
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if userID != 0 {
+		token, err := auth.GenerateJWT(userID, role)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func newTestHandlers(db *sql.DB) *HandlersGroup {
+	pricing := businesslogic.FixedPricing{AssignFee: entities.NewMoney(1500), Reward: entities.NewMoney(3000)}
+	return NewHandlersGroup(db, nil, pricing, rbac.Default())
+}
+
+// Callers without a token or the permission, and bad input, are turned away before the database
+// is touched.
+func TestTaskHandlerRejectsBadRequests(t *testing.T) {
+	handlers := newTestHandlers(nil)
+	cases := []struct {
+		userID               int
+		role, method, target string
+		body                 string
+		expected             int
+	}{
+		{0, "", http.MethodGet, "/tasks", "", http.StatusUnauthorized},
+		{7, entities.RoleWorker, http.MethodDelete, "/tasks", "", http.StatusMethodNotAllowed},
+		{7, "guest", http.MethodPost, "/tasks", `{"description": "Write docs"}`, http.StatusForbidden},
+		{7, entities.RoleWorker, http.MethodGet, "/tasks?assigned_to=8", "", http.StatusForbidden},
+		{7, entities.RoleWorker, http.MethodGet, "/tasks?task_id=abc", "", http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodGet, "/tasks?task_id=1&at=yesterday", "", http.StatusBadRequest},
+		{1, entities.RoleManager, http.MethodGet, "/tasks?assigned_to=0", "", http.StatusBadRequest},
+		{1, entities.RoleManager, http.MethodGet, "/tasks?status=lost", "", http.StatusBadRequest},
+		{1, entities.RoleManager, http.MethodGet, "/tasks?created_from=2024-06-02&created_to=2024-06-01", "", http.StatusBadRequest},
+		{1, entities.RoleManager, http.MethodPost, "/tasks", `{"description": `, http.StatusBadRequest},
+		{1, entities.RoleManager, http.MethodPost, "/tasks", `{"description": "  "}`, http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodPut, "/tasks", `{"task_id": 0, "status": "started"}`, http.StatusBadRequest},
+		{7, entities.RoleWorker, http.MethodPut, "/tasks", `{"task_id": 1, "status": "lost"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := serveAs(t, handlers.TaskHandler, c.userID, c.role, c.method, c.target, c.body); w.Code != c.expected {
+			t.Errorf("%s %s as %q: expected %d, got %d (%s)", c.method, c.target, c.role, c.expected, w.Code, w.Body)
+		}
+	}
+
+	if w := serveAs(t, handlers.TaskHistoryHandler, 0, "", http.MethodGet, "/tasks/history?task_id=1", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+	if w := serveAs(t, handlers.TaskHistoryHandler, 7, entities.RoleWorker, http.MethodGet, "/tasks/history", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a task_id, got %d", w.Code)
+	}
+	if w := serveAs(t, handlers.TaskHistoryHandler, 7, entities.RoleWorker, http.MethodPost, "/tasks/history?task_id=1", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for a POST, got %d", w.Code)
+	}
+}
+
+// Workers only get to see and move their own tasks, managers see them all.
+func TestTaskHandler(t *testing.T) {
+	db := newTestDB(t)
+	for _, userID := range []int{7, 8} {
+		if err := upsertReplicaUser(db, entities.User{UserID: userID, Name: fmt.Sprintf("worker %d", userID), Role: entities.RoleWorker,
+			JoinedAt: "2024-01-01", LastUpdated: "2024-01-01 00:00:00", Version: 1}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	handlers := newTestHandlers(db)
+
+	w := serveAs(t, handlers.TaskHandler, 1, entities.RoleManager, http.MethodPost, "/tasks", `{"description": "[DOC-1] Write docs"}`)
+	var task entities.Task
+	if err := json.Unmarshal(w.Body.Bytes(), &task); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("Expected the task created, got %d %s", w.Code, w.Body)
+	}
+	if task.JiraID != "DOC-1" || task.Description != "Write docs" || task.Status != string(businesslogic.StatusPending) {
+		t.Errorf("Unexpected task %+v", task)
+	}
+	owner, stranger := task.AssignedTo, 15-task.AssignedTo
+	get := fmt.Sprintf("/tasks?task_id=%d", task.TaskID)
+
+	if w := serveAs(t, handlers.TaskHandler, owner, entities.RoleWorker, http.MethodGet, get, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the assignee to see the task, got %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(t, handlers.TaskHandler, stranger, entities.RoleWorker, http.MethodGet, get, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another worker, got %d", w.Code)
+	}
+	if w := serveAs(t, handlers.TaskHandler, 1, entities.RoleManager, http.MethodGet, "/tasks?task_id=1000", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing task, got %d", w.Code)
+	}
+
+	var listed []entities.Task
+	w = serveAs(t, handlers.TaskHandler, stranger, entities.RoleWorker, http.MethodGet, "/tasks", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); w.Code != http.StatusOK || err != nil || len(listed) != 0 {
+		t.Errorf("Expected no tasks for the other worker, got %d %s", w.Code, w.Body)
+	}
+	w = serveAs(t, handlers.TaskHandler, 1, entities.RoleManager, http.MethodGet, "/tasks?status=pending", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); w.Code != http.StatusOK || err != nil || len(listed) != 1 {
+		t.Errorf("Expected the manager to see the task, got %d %s", w.Code, w.Body)
+	}
+
+	update := fmt.Sprintf(`{"task_id": %d, "status": "started"}`, task.TaskID)
+	if w := serveAs(t, handlers.TaskHandler, stranger, entities.RoleWorker, http.MethodPut, "/tasks", update); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 starting someone else's task, got %d %s", w.Code, w.Body)
+	}
+	w = serveAs(t, handlers.TaskHandler, owner, entities.RoleWorker, http.MethodPut, "/tasks", update)
+	if err := json.Unmarshal(w.Body.Bytes(), &task); w.Code != http.StatusOK || err != nil || task.Status != string(businesslogic.StatusStarted) {
+		t.Errorf("Expected the task started, got %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(t, handlers.TaskHandler, owner, entities.RoleWorker, http.MethodPut, "/tasks", update); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 starting it again, got %d %s", w.Code, w.Body)
+	}
+
+	history := fmt.Sprintf("/tasks/history?task_id=%d", task.TaskID)
+	if w := serveAs(t, handlers.TaskHistoryHandler, owner, entities.RoleWorker, http.MethodGet, history, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the assignee to see the history, got %d %s", w.Code, w.Body)
+	}
+	if w := serveAs(t, handlers.TaskHistoryHandler, stranger, entities.RoleWorker, http.MethodGet, history, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another worker, got %d", w.Code)
+	}
+}
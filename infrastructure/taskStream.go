@@ -0,0 +1,412 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Somebody else appended to the task's stream first.
+var ErrTaskVersionConflict = errors.New("task was changed concurrently")
+
+// Appending the events recorded by a command to the task's stream and bringing the projection
+// (the tasks table), its history and snapshots up to date. before is the task as the command found
+// it. Meant to run in the command's transaction.
+func saveTaskEvents(db queryer, before entities.Task, recorded []entities.TaskEvent) error {
+	if len(recorded) == 0 {
+		return nil
+	}
+
+	task := before
+	for _, event := range recorded {
+		previous := task
+		if err := businesslogic.ApplyTaskEvent(&task, event); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return fmt.Errorf("failed to encode event %d of task %d: %w", event.Version, event.TaskID, err)
+		}
+		query := `
+		INSERT INTO task_events (task_id, version, type, data, actor_id, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (task_id, version) DO NOTHING
+		`
+		result, err := db.Exec(query, event.TaskID, event.Version, event.Type, string(data), event.ActorID, event.OccurredAt)
+		if err != nil {
+			return fmt.Errorf("failed to append event %d of task %d: %w", event.Version, event.TaskID, err)
+		}
+		if appended, err := result.RowsAffected(); err != nil {
+			return err
+		} else if appended == 0 {
+			return fmt.Errorf("task %d, version %d: %w", event.TaskID, event.Version, ErrTaskVersionConflict)
+		}
+
+		for _, entry := range businesslogic.TaskHistory(previous, task, event) {
+			query := `
+			INSERT INTO task_history (task_id, version, actor_id, field, old_value, new_value, changed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			`
+			_, err := db.Exec(query, entry.TaskID, entry.Version, entry.ActorID, entry.Field, entry.OldValue, entry.NewValue,
+				entry.ChangedAt)
+			if err != nil {
+				return fmt.Errorf("failed to record the history of task %d: %w", entry.TaskID, err)
+			}
+		}
+	}
+
+	if err := projectTask(db, task); err != nil {
+		return err
+	}
+
+	// Snapshotting whenever the events crossed a multiple of TaskSnapshotEvery.
+	first := recorded[0].Version
+	if (first-1)/businesslogic.TaskSnapshotEvery != task.Version/businesslogic.TaskSnapshotEvery {
+		if err := saveTaskSnapshot(db, task, recorded[len(recorded)-1].OccurredAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writing the task's state into the tasks table, the read model everything else queries.
+func projectTask(db queryer, task entities.Task) error {
+	query := `
+	INSERT INTO tasks (task_id, jira_id, description, assigned_to, status, assign_fee, price, creation_time, completion_time, last_updated, version)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, '')::timestamp, NULLIF($9, '')::timestamp, $10, $11)
+	ON CONFLICT (task_id) DO UPDATE
+	SET jira_id = EXCLUDED.jira_id,
+		description = EXCLUDED.description,
+		assigned_to = EXCLUDED.assigned_to,
+		status = EXCLUDED.status,
+		assign_fee = EXCLUDED.assign_fee,
+		price = EXCLUDED.price,
+		creation_time = EXCLUDED.creation_time,
+		completion_time = EXCLUDED.completion_time,
+		last_updated = EXCLUDED.last_updated,
+		version = EXCLUDED.version
+	`
+	_, err := db.Exec(query, task.TaskID, task.JiraID, task.Description, task.AssignedTo, task.Status, task.AssignFee,
+		task.Price, task.CreationTime, task.CompletionTime, task.LastUpdated, task.Version)
+	if err != nil {
+		return fmt.Errorf("failed to project task %d: %w", task.TaskID, err)
+	}
+
+	return nil
+}
+
+func saveTaskSnapshot(db queryer, task entities.Task, occurredAt string) error {
+	state, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to encode task %d: %w", task.TaskID, err)
+	}
+
+	query := `
+	INSERT INTO task_snapshots (task_id, version, state, occurred_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (task_id, version) DO UPDATE SET state = EXCLUDED.state, occurred_at = EXCLUDED.occurred_at
+	`
+	if _, err := db.Exec(query, task.TaskID, task.Version, string(state), occurredAt); err != nil {
+		return fmt.Errorf("failed to snapshot task %d at version %d: %w", task.TaskID, task.Version, err)
+	}
+
+	return nil
+}
+
+// The next task ID, taken before the task's first event is written.
+func nextTaskID(db queryer) (int, error) {
+	var taskID int
+	if err := db.QueryRow(`SELECT nextval(pg_get_serial_sequence('tasks', 'task_id'))`).Scan(&taskID); err != nil {
+		return 0, fmt.Errorf("failed to allocate a task ID: %w", err)
+	}
+
+	return taskID, nil
+}
+
+const taskEventColumns = `task_id, version, type, data, actor_id, to_char(occurred_at, 'YYYY-MM-DD HH24:MI:SS')`
+
+func scanTaskEvent(row rowScanner) (entities.TaskEvent, error) {
+	var event entities.TaskEvent
+	var data []byte
+	if err := row.Scan(&event.TaskID, &event.Version, &event.Type, &data, &event.ActorID, &event.OccurredAt); err != nil {
+		return entities.TaskEvent{}, err
+	}
+	if err := json.Unmarshal(data, &event.Data); err != nil {
+		return entities.TaskEvent{}, fmt.Errorf("invalid data in event %d of task %d: %w", event.Version, event.TaskID, err)
+	}
+
+	return event, nil
+}
+
+// The task's events after the given version, in order.
+func TaskStream(db queryer, taskID, afterVersion int) ([]entities.TaskEvent, error) {
+	query := `SELECT ` + taskEventColumns + ` FROM task_events WHERE task_id = $1 AND version > $2 ORDER BY version`
+	rows, err := db.Query(query, taskID, afterVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the stream of task %d: %w", taskID, err)
+	}
+	defer rows.Close()
+
+	stream := []entities.TaskEvent{}
+	for rows.Next() {
+		event, err := scanTaskEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		stream = append(stream, event)
+	}
+
+	return stream, rows.Err()
+}
+
+// The task as it was at the given time, or as it is now with a zero time, folded from its latest
+// snapshot before then and the events after it. Wraps sql.ErrNoRows when the task didn't exist yet.
+func TaskAt(db queryer, taskID int, at time.Time) (entities.Task, error) {
+	var task entities.Task
+	query := `SELECT state FROM task_snapshots WHERE task_id = $1 AND ($2::timestamp IS NULL OR occurred_at <= $2) ORDER BY version DESC LIMIT 1`
+	var state []byte
+	err := db.QueryRow(query, taskID, nullTime(at)).Scan(&state)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return entities.Task{}, fmt.Errorf("failed to read the snapshots of task %d: %w", taskID, err)
+	default:
+		if err := json.Unmarshal(state, &task); err != nil {
+			return entities.Task{}, fmt.Errorf("invalid snapshot of task %d: %w", taskID, err)
+		}
+	}
+
+	stream, err := TaskStream(db, taskID, task.Version)
+	if err != nil {
+		return entities.Task{}, err
+	}
+	cutoff := at.Format(time.DateTime)
+	for _, event := range stream {
+		if !at.IsZero() && event.OccurredAt > cutoff {
+			break
+		}
+		if err := businesslogic.ApplyTaskEvent(&task, event); err != nil {
+			return entities.Task{}, err
+		}
+	}
+	if task.Version == 0 {
+		return entities.Task{}, fmt.Errorf("task %d at %s: %w", taskID, cutoff, sql.ErrNoRows)
+	}
+
+	return task, nil
+}
+
+// Rebuilding the tasks table and the snapshots by folding every task's stream from the start.
+// Returns how many tasks were rebuilt.
+func RebuildTaskProjections(db *sql.DB) (int, error) {
+	var taskIDs []int
+	rows, err := db.Query(`SELECT DISTINCT task_id FROM task_events ORDER BY task_id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list task streams: %w", err)
+	}
+	for rows.Next() {
+		var taskID int
+		if err := rows.Scan(&taskID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		taskIDs = append(taskIDs, taskID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list task streams: %w", err)
+	}
+
+	for i, taskID := range taskIDs {
+		if err := rebuildTask(db, taskID); err != nil {
+			return i, err
+		}
+	}
+
+	return len(taskIDs), nil
+}
+
+// A task at a time, so commands on other tasks aren't held up.
+func rebuildTask(db *sql.DB, taskID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Taking the projection's lock first, like the commands do.
+	if _, err := tx.Exec(`SELECT 1 FROM tasks WHERE task_id = $1 FOR UPDATE`, taskID); err != nil {
+		return fmt.Errorf("failed to lock task %d: %w", taskID, err)
+	}
+	stream, err := TaskStream(tx, taskID, 0)
+	if err != nil {
+		return err
+	}
+	// The history is left alone: it's written along with the events and has nothing to rebuild.
+	if _, err := tx.Exec(`DELETE FROM task_snapshots WHERE task_id = $1`, taskID); err != nil {
+		return fmt.Errorf("failed to drop the snapshots of task %d: %w", taskID, err)
+	}
+
+	var task entities.Task
+	for _, event := range stream {
+		if err := businesslogic.ApplyTaskEvent(&task, event); err != nil {
+			return err
+		}
+		if task.Version%businesslogic.TaskSnapshotEvery == 0 {
+			if err := saveTaskSnapshot(tx, task, event.OccurredAt); err != nil {
+				return err
+			}
+		}
+	}
+	if err := projectTask(tx, task); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Giving every task from before the streams one, made of a single import of its current state.
+// Their earlier history is lost, so the import counts from the task's last update. Runs on every
+// start and does nothing once all tasks have streams.
+func importTaskStreams(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT ` + taskColumns + ` FROM tasks WHERE version = 0 ORDER BY task_id FOR UPDATE`
+	rows, err := tx.Query(query)
+	if err != nil {
+		return fmt.Errorf("failed to find tasks without streams: %w", err)
+	}
+	var tasks []entities.Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tasks = append(tasks, task)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find tasks without streams: %w", err)
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	for _, found := range tasks {
+		occurredAt := found.LastUpdated
+		if occurredAt == "" {
+			occurredAt = found.CreationTime
+		}
+		imported := entities.TaskEvent{TaskID: found.TaskID, Version: 1, Type: entities.TaskEventImported,
+			Data: entities.TaskEventData{Task: &found}, OccurredAt: occurredAt}
+		if err := saveTaskEvents(tx, entities.Task{}, []entities.TaskEvent{imported}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit the task imports: %w", err)
+	}
+	log.Printf("Gave %d existing tasks an event stream.\n", len(tasks))
+
+	return nil
+}
+
+// Pricing the tasks from before assignment fees, which got a fee of 0 when the column was added.
+// They're the tasks at 0 whose stream never set a price, each gets a price_set with a fee from
+// the policy, the reward stays. Runs on every start and does nothing once they're all priced.
+// Returns how many tasks were priced.
+func BackfillAssignFees(db *sql.DB, pricing businesslogic.PricingPolicy) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT ` + taskColumns + ` FROM tasks t
+	WHERE assign_fee = 0 AND NOT EXISTS (SELECT 1 FROM task_events e WHERE e.task_id = t.task_id AND e.type = $1)
+	ORDER BY task_id
+	FOR UPDATE
+	`
+	rows, err := tx.Query(query, entities.TaskEventPriceSet)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find tasks without an assignment fee: %w", err)
+	}
+	var tasks []entities.Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tasks = append(tasks, task)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to find tasks without an assignment fee: %w", err)
+	}
+	if len(tasks) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	for _, found := range tasks {
+		task := found
+		fee := pricing.PriceTask(task.Description).AssignFee
+		priced, err := businesslogic.RecordTaskEvent(&task, entities.TaskEventPriceSet, entities.TaskEventData{AssignFee: &fee}, 0, now)
+		if err != nil {
+			return 0, err
+		}
+		if err := saveTaskEvents(tx, found, []entities.TaskEvent{priced}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the assignment fees: %w", err)
+	}
+	log.Printf("Priced the assignment of %d existing tasks.\n", len(tasks))
+
+	return len(tasks), nil
+}
+
+// Every recorded change to the task, oldest first.
+func GetTaskHistory(db queryer, taskID int) ([]entities.TaskHistoryEntry, error) {
+	query := `
+	SELECT history_id, task_id, version, actor_id, field, old_value, new_value, to_char(changed_at, 'YYYY-MM-DD HH24:MI:SS')
+	FROM task_history
+	WHERE task_id = $1
+	ORDER BY version, history_id
+	`
+	rows, err := db.Query(query, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the history of task %d: %w", taskID, err)
+	}
+	defer rows.Close()
+
+	history := []entities.TaskHistoryEntry{}
+	for rows.Next() {
+		var entry entities.TaskHistoryEntry
+		err := rows.Scan(&entry.HistoryID, &entry.TaskID, &entry.Version, &entry.ActorID, &entry.Field, &entry.OldValue,
+			&entry.NewValue, &entry.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
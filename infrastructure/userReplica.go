@@ -0,0 +1,118 @@
+package infrastructure
+
+import (
+	"aTES/core/entities"
+	"aTES/core/events"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The subscriber TES keeps its copy of the users under.
+const userReplicaSubscriber = "tes-users"
+
+// Keeping the users table in step with the authenticator. Every change carries the user's
+// version and is only applied over an older one, so late deliveries are no-ops, and the consumer
+// skips duplicates. Deleted users stay behind as tombstones (removed_at set) so a late create or
+// update can't bring them back; they're never picked for tasks. Up to concurrency users are
+// updated at once, the changes to one user are applied in order.
+func NewUserReplica(db *sql.DB, concurrency int) *Consumer {
+	consumer := NewConsumer(db, userReplicaSubscriber, concurrency)
+
+	consumer.Handle(events.UserCreatedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		return upsertReplicaUser(tx, event.(events.UserCreated).User)
+	})
+	consumer.Handle(events.UserUpdatedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		return upsertReplicaUser(tx, event.(events.UserUpdated).User)
+	})
+	consumer.Handle(events.UserDeletedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		deleted := event.(events.UserDeleted)
+		return removeReplicaUser(tx, deleted.UserID, deleted.Version)
+	})
+	consumer.Handle(events.UserRoleChangedName, func(tx *sql.Tx, _ events.Envelope, event events.Event) error {
+		changed := event.(events.UserRoleChanged)
+		return changeReplicaRole(tx, changed.UserID, changed.NewRole, changed.Version)
+	})
+
+	return consumer
+}
+
+// Emptying the users table and filling it again from every user event, with the balances
+// cached from the snapshots. The table is locked until it's whole again, and the replica's
+// cursor is left where it is: what it handles again is older than what the rebuild applied and
+// loses to the versions. Returns how many events were replayed.
+func RebuildUserReplica(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`LOCK TABLE users IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return 0, fmt.Errorf("failed to lock the users: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM users`); err != nil {
+		return 0, fmt.Errorf("failed to clear the users: %w", err)
+	}
+	replayed, err := NewUserReplica(db, 1).Rebuild(tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := refreshCachedBalances(tx); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit the rebuilt users: %w", err)
+	}
+
+	return replayed, nil
+}
+
+// Version 0 events predate versions and always win, as they did before. The balance isn't
+// touched, it's cached from the ledger.
+func upsertReplicaUser(db queryer, user entities.User) error {
+	query := `
+	INSERT INTO users (user_id, name, email, role, joined_at, left_at, last_updated, version)
+	VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)
+	ON CONFLICT (user_id) DO UPDATE
+	SET name = EXCLUDED.name, email = EXCLUDED.email, role = EXCLUDED.role, joined_at = EXCLUDED.joined_at,
+		left_at = EXCLUDED.left_at, last_updated = EXCLUDED.last_updated, version = EXCLUDED.version, removed_at = NULL
+	WHERE users.version < EXCLUDED.version OR EXCLUDED.version = 0
+	`
+	_, err := db.Exec(query, user.UserID, user.Name, user.Email, user.Role, user.JoinedAt, user.LeftAt,
+		user.LastUpdated, user.Version)
+	if err != nil {
+		return fmt.Errorf("failed to replicate user %d v%d: %w", user.UserID, user.Version, err)
+	}
+
+	return nil
+}
+
+// A delete for a user TES hasn't seen yet still leaves a tombstone, the create may be on its way.
+func removeReplicaUser(db queryer, userID int, version int64) error {
+	query := `
+	INSERT INTO users (user_id, name, email, role, joined_at, version, removed_at)
+	VALUES ($1, '', '', '', '', $2, $3)
+	ON CONFLICT (user_id) DO UPDATE
+	SET version = EXCLUDED.version, removed_at = EXCLUDED.removed_at
+	WHERE users.version < EXCLUDED.version OR EXCLUDED.version = 0
+	`
+	_, err := db.Exec(query, userID, version, time.Now().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("failed to remove replicated user %d v%d: %w", userID, version, err)
+	}
+
+	return nil
+}
+
+// The role is applied early but the version is left alone: the UserUpdated published with the
+// role change carries the same version and the rest of the user.
+func changeReplicaRole(db queryer, userID int, role string, version int64) error {
+	_, err := db.Exec(`UPDATE users SET role = $1 WHERE user_id = $2 AND version < $3`, role, userID, version)
+	if err != nil {
+		return fmt.Errorf("failed to change the role of replicated user %d v%d: %w", userID, version, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events/schemas"
+	"aTES/core/httpjson"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Routes (served behind webhooks:manage):
+//
+//	GET    /webhooks                                          - every subscription.
+//	POST   /webhooks  {url, event_types, secret}              - subscribes, the secret is generated when empty.
+//	                                                            It's only ever shown in this response.
+//	GET    /webhooks/<id>                                     - a single subscription.
+//	PUT    /webhooks/<id>  {url, event_types, active}         - changes it, "active": true turns a disabled one back on.
+//	DELETE /webhooks/<id>                                     - unsubscribes, dropping its delivery log.
+//	GET    /webhooks/<id>/deliveries?status=&limit=           - its delivery log, newest first.
+func (h *HandlersGroup) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			h.listWebhooks(w)
+		case http.MethodPost:
+			h.createWebhook(w, r)
+		default:
+			httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		}
+		return
+	}
+
+	subscriptionID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || subscriptionID <= 0 {
+		httpjson.Error(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	switch {
+	case len(parts) == 2:
+		h.webhook(w, r, subscriptionID)
+	case len(parts) == 3 && parts[2] == "deliveries":
+		h.listWebhookDeliveries(w, r, subscriptionID)
+	default:
+		httpjson.Error(w, http.StatusNotFound, "Not found.")
+	}
+}
+
+// A subscription as admins see it, with the secret when it was just made.
+type webhookResponse struct {
+	entities.WebhookSubscription
+	Secret string `json:"secret,omitempty"`
+}
+
+type webhookRequest struct {
+	URL        *string  `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"`
+	Active     *bool    `json:"active"`
+}
+
+// Checking the fields that were given.
+func (request webhookRequest) validate() validationErrors {
+	fieldErrors := validationErrors{}
+	if request.URL != nil {
+		if err := businesslogic.ValidateWebhookURL(*request.URL); err != nil {
+			fieldErrors["url"] = err.Error()
+		}
+	}
+	if request.EventTypes != nil {
+		if len(request.EventTypes) == 0 {
+			fieldErrors["event_types"] = "must name at least one event"
+		}
+		for _, name := range request.EventTypes {
+			if schemas.Default().Latest(name) == 0 {
+				fieldErrors["event_types"] = "unknown event " + strconv.Quote(name)
+				break
+			}
+		}
+	}
+	if len(request.Secret) > 100 {
+		fieldErrors["secret"] = "must be at most 100 characters"
+	}
+
+	return fieldErrors
+}
+
+func (h *HandlersGroup) listWebhooks(w http.ResponseWriter) {
+	subscriptions, err := ListWebhookSubscriptions(h.resources.db)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error listing webhooks: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, subscriptions)
+}
+
+func (h *HandlersGroup) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var request webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "Invalid request body: %v", err)
+		return
+	}
+	fieldErrors := request.validate()
+	if request.URL == nil {
+		fieldErrors["url"] = "is required"
+	}
+	if request.EventTypes == nil {
+		fieldErrors["event_types"] = "is required"
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	secret := request.Secret
+	if secret == "" {
+		var err error
+		if secret, err = businesslogic.NewWebhookSecret(); err != nil {
+			httpjson.Error(w, http.StatusInternalServerError, "Error generating a secret: %v", err)
+			return
+		}
+	}
+	subscription, err := CreateWebhookSubscription(h.resources.db, *request.URL, request.EventTypes, secret)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error creating the webhook: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusCreated, webhookResponse{WebhookSubscription: subscription, Secret: subscription.Secret})
+}
+
+// Inspecting (GET), changing (PUT) or removing (DELETE) a subscription.
+func (h *HandlersGroup) webhook(w http.ResponseWriter, r *http.Request, subscriptionID int64) {
+	var subscription entities.WebhookSubscription
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		subscription, err = GetWebhookSubscription(h.resources.db, subscriptionID)
+	case http.MethodPut:
+		var request webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, "Invalid request body: %v", err)
+			return
+		}
+		fieldErrors := request.validate()
+		if request.Secret != "" {
+			fieldErrors["secret"] = "can't be changed, subscribe again for a new one"
+		}
+		if len(fieldErrors) > 0 {
+			writeValidationErrors(w, fieldErrors)
+			return
+		}
+		subscription, err = UpdateWebhookSubscription(h.resources.db, subscriptionID,
+			WebhookUpdate{URL: request.URL, EventTypes: request.EventTypes, Active: request.Active})
+	case http.MethodDelete:
+		err = DeleteWebhookSubscription(h.resources.db, subscriptionID)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		httpjson.Error(w, http.StatusNotFound, "Webhook %d not found", subscriptionID)
+	case err != nil:
+		httpjson.Error(w, http.StatusInternalServerError, "Error with webhook %d: %v", subscriptionID, err)
+	default:
+		httpjson.Write(w, http.StatusOK, subscription)
+	}
+}
+
+func (h *HandlersGroup) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, subscriptionID int64) {
+	if r.Method != http.MethodGet {
+		httpjson.Error(w, http.StatusMethodNotAllowed, "Method not allowed.")
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	limit := defaultPageSize
+	fieldErrors := validationErrors{}
+	switch status {
+	case "", entities.WebhookPending, entities.WebhookInFlight, entities.WebhookDelivered, entities.WebhookFailed:
+	default:
+		fieldErrors["status"] = "must be pending, in_flight, delivered or failed"
+	}
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			fieldErrors["limit"] = "must be between 1 and " + strconv.Itoa(maxPageSize)
+		}
+	}
+	if len(fieldErrors) > 0 {
+		writeValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if _, err := GetWebhookSubscription(h.resources.db, subscriptionID); errors.Is(err, sql.ErrNoRows) {
+		httpjson.Error(w, http.StatusNotFound, "Webhook %d not found", subscriptionID)
+		return
+	} else if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error with webhook %d: %v", subscriptionID, err)
+		return
+	}
+	deliveries, err := ListWebhookDeliveries(h.resources.db, subscriptionID, status, limit)
+	if err != nil {
+		httpjson.Error(w, http.StatusInternalServerError, "Error listing deliveries: %v", err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,494 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The consumer queueing webhook deliveries.
+const webhookSubscriber = "webhooks"
+
+// How many deliveries a dispatcher pass locks and posts at once. Posts are slow, batches are small.
+const webhookBatchSize = 20
+
+// Dispatcher metrics, served on /debug/vars.
+var (
+	webhooksDelivered = expvar.NewInt("webhooks_delivered_total")
+	webhookFailures   = expvar.NewInt("webhook_failed_attempts_total")
+)
+
+// Queueing a delivery of every event to each subscription that wants it. It runs as a Consumer,
+// so an event is queued once however often it's received. Disabled subscriptions get theirs
+// too, the dispatcher holds them until the subscription is turned back on.
+func NewWebhookFanout(db *sql.DB, concurrency int) *Consumer {
+	consumer := NewConsumer(db, webhookSubscriber, concurrency)
+	for _, name := range schemas.Default().Names() {
+		consumer.Handle(name, queueWebhookDeliveries)
+	}
+
+	return consumer
+}
+
+// Subscribers get the event at its latest version, whatever version it was published at.
+func queueWebhookDeliveries(tx *sql.Tx, envelope events.Envelope, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", envelope.EventName, err)
+	}
+	envelope.Data = data
+	envelope.EventVersion = schemas.Default().Latest(envelope.EventName)
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to encode event %s: %w", envelope.EventID, err)
+	}
+
+	query := `
+	INSERT INTO webhook_deliveries (subscription_id, event_id, event_name, payload, status, attempts, next_attempt_at, created_at)
+	SELECT subscription_id, $1, $2, $3, $4, 0, $5, $5
+	FROM webhook_subscriptions
+	WHERE event_types ? $2
+	`
+	_, err = tx.Exec(query, envelope.EventID, envelope.EventName, string(payload), entities.WebhookPending,
+		time.Now().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("failed to queue webhooks for event %s: %w", envelope.EventID, err)
+	}
+
+	return nil
+}
+
+// Posts due webhook deliveries. Several dispatchers can run side by side: each claims its own
+// batch, marking it in flight for webhookLease, and posts it outside any transaction, so slow
+// endpoints hold no locks. A claim left behind by a dispatcher that died runs out and the
+// deliveries are picked up again. Failed posts are retried with backoff (events.RetryDelay)
+// until businesslogic.MaxWebhookAttempts, and a subscription failing
+// businesslogic.WebhookDisableAfter times in a row is disabled: its deliveries wait until an
+// admin turns it back on.
+type WebhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+}
+
+// How long a post may take, and how long a claimed batch is left alone: time to post all of it.
+const (
+	webhookPostTimeout = 10 * time.Second
+	webhookLease       = webhookBatchSize*webhookPostTimeout + time.Minute
+)
+
+func NewWebhookDispatcher(db *sql.DB) *WebhookDispatcher {
+	return &WebhookDispatcher{db: db, client: &http.Client{Timeout: webhookPostTimeout}}
+}
+
+// Posting every delivery that's due. Returns how many were delivered.
+func (d *WebhookDispatcher) DeliverOnce() (int, error) {
+	delivered := 0
+	for {
+		n, due, err := d.deliverBatch()
+		delivered += n
+		if err != nil || due < webhookBatchSize {
+			return delivered, err
+		}
+	}
+}
+
+// A delivery claimed for posting, with where it goes.
+type dueWebhook struct {
+	delivery entities.WebhookDelivery
+	url      string
+	secret   string
+	lease    string // Until when it's claimed, outcomes are only recorded while the claim holds.
+}
+
+// Returns how many deliveries were delivered and how many were due in the batch.
+func (d *WebhookDispatcher) deliverBatch() (int, int, error) {
+	now := time.Now()
+	batch, err := d.claimBatch(now)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delivered := 0
+	disabled := make(map[int64]bool) // Subscriptions disabled during this batch.
+	for _, due := range batch {
+		if disabled[due.delivery.SubscriptionID] {
+			if err := d.release(due); err != nil {
+				return delivered, len(batch), err
+			}
+			continue
+		}
+
+		responseStatus, postErr := d.post(due)
+		if postErr == nil {
+			if err := d.recordDelivered(due, responseStatus); err != nil {
+				return delivered, len(batch), err
+			}
+			webhooksDelivered.Add(1)
+			delivered++
+			continue
+		}
+
+		webhookFailures.Add(1)
+		active, err := d.recordFailure(due, now, responseStatus, postErr)
+		if err != nil {
+			return delivered, len(batch), err
+		}
+		if !active {
+			disabled[due.delivery.SubscriptionID] = true
+			log.Printf("Webhooks: disabled subscription %d after %d failures in a row, last: %v\n",
+				due.delivery.SubscriptionID, businesslogic.WebhookDisableAfter, postErr)
+		}
+	}
+
+	return delivered, len(batch), nil
+}
+
+// Claiming the oldest due deliveries of active subscriptions, along with those whose claim ran
+// out. They're in flight once this returns.
+func (d *WebhookDispatcher) claimBatch(now time.Time) ([]dueWebhook, error) {
+	query := `
+	UPDATE webhook_deliveries d
+	SET status = $1, next_attempt_at = $2
+	FROM webhook_subscriptions s
+	WHERE s.subscription_id = d.subscription_id AND d.delivery_id IN (
+		SELECT due.delivery_id
+		FROM webhook_deliveries due
+		JOIN webhook_subscriptions sub ON sub.subscription_id = due.subscription_id
+		WHERE due.status IN ($3, $1) AND due.next_attempt_at <= $4 AND sub.active
+		ORDER BY due.delivery_id
+		LIMIT $5
+		FOR UPDATE OF due SKIP LOCKED
+	)
+	RETURNING d.delivery_id, d.subscription_id, d.event_id, d.event_name, d.payload, d.attempts, s.url, s.secret,
+		to_char(d.next_attempt_at, 'YYYY-MM-DD HH24:MI:SS')
+	`
+	lease := now.Add(webhookLease).Format(time.DateTime)
+	rows, err := d.db.Query(query, entities.WebhookInFlight, lease, entities.WebhookPending, now.Format(time.DateTime),
+		webhookBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var batch []dueWebhook
+	for rows.Next() {
+		var due dueWebhook
+		err := rows.Scan(&due.delivery.DeliveryID, &due.delivery.SubscriptionID, &due.delivery.EventID, &due.delivery.EventName,
+			&due.delivery.Payload, &due.delivery.Attempts, &due.url, &due.secret, &due.lease)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, due)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read webhook deliveries: %w", err)
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].delivery.DeliveryID < batch[j].delivery.DeliveryID })
+
+	return batch, nil
+}
+
+// Matches the delivery while this dispatcher's claim on it holds.
+const claimedDelivery = `delivery_id = $1 AND status = '` + entities.WebhookInFlight + `' AND next_attempt_at = $2`
+
+func (d *WebhookDispatcher) recordDelivered(due dueWebhook, responseStatus int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE webhook_deliveries SET status = $3, delivered_at = $4, response_status = $5, last_error = ''
+	WHERE `+claimedDelivery,
+		due.delivery.DeliveryID, due.lease, entities.WebhookDelivered, time.Now().Format(time.DateTime), responseStatus)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE webhook_subscriptions SET consecutive_failures = 0 WHERE subscription_id = $1`,
+			due.delivery.SubscriptionID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark webhook delivery %d delivered: %w", due.delivery.DeliveryID, err)
+	}
+
+	return nil
+}
+
+// Rescheduling the delivery, or giving up on it, and counting the failure against its
+// subscription. Returns whether the subscription is still active.
+func (d *WebhookDispatcher) recordFailure(due dueWebhook, now time.Time, responseStatus int, postErr error) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	attempts := due.delivery.Attempts + 1
+	status := entities.WebhookPending
+	if attempts >= businesslogic.MaxWebhookAttempts {
+		status = entities.WebhookFailed
+	}
+	next := now.Add(events.RetryDelay(attempts)).Format(time.DateTime)
+	_, err = tx.Exec(`
+	UPDATE webhook_deliveries SET status = $3, attempts = $4, next_attempt_at = $5, response_status = $6, last_error = $7
+	WHERE `+claimedDelivery,
+		due.delivery.DeliveryID, due.lease, status, attempts, next, responseStatus, postErr.Error())
+	if err != nil {
+		return false, fmt.Errorf("failed to reschedule webhook delivery %d: %w", due.delivery.DeliveryID, err)
+	}
+
+	var active bool
+	err = tx.QueryRow(`
+	UPDATE webhook_subscriptions
+	SET consecutive_failures = consecutive_failures + 1,
+		active = active AND consecutive_failures + 1 < $1,
+		disabled_at = CASE WHEN consecutive_failures + 1 < $1 THEN disabled_at ELSE $2::timestamp END
+	WHERE subscription_id = $3
+	RETURNING active
+	`, businesslogic.WebhookDisableAfter, now.Format(time.DateTime), due.delivery.SubscriptionID).Scan(&active)
+	if err != nil {
+		return false, fmt.Errorf("failed to count the failure of webhook %d: %w", due.delivery.SubscriptionID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to reschedule webhook delivery %d: %w", due.delivery.DeliveryID, err)
+	}
+
+	return active, nil
+}
+
+// Handing a claimed delivery back untouched, e.g. when its subscription was just disabled.
+func (d *WebhookDispatcher) release(due dueWebhook) error {
+	_, err := d.db.Exec(`UPDATE webhook_deliveries SET status = $3, next_attempt_at = $4 WHERE `+claimedDelivery,
+		due.delivery.DeliveryID, due.lease, entities.WebhookPending, time.Now().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("failed to release webhook delivery %d: %w", due.delivery.DeliveryID, err)
+	}
+
+	return nil
+}
+
+// Posting the payload signed with the subscription's secret. Any 2xx is a success. Returns the
+// response's status, 0 when there was none.
+func (d *WebhookDispatcher) post(due dueWebhook) (int, error) {
+	body := []byte(due.delivery.Payload)
+	request, err := http.NewRequest(http.MethodPost, due.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build the request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "aTES-webhooks")
+	request.Header.Set("X-Ates-Event", due.delivery.EventName)
+	request.Header.Set("X-Ates-Event-Id", due.delivery.EventID)
+	request.Header.Set(businesslogic.WebhookSignatureHeader, businesslogic.SignWebhook(due.secret, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("responded with %s", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+// Dispatching on every tick until the context is cancelled.
+func (d *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := d.DeliverOnce(); err != nil {
+			log.Printf("Webhooks: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+const webhookSubscriptionColumns = `subscription_id, url, event_types, secret, active, consecutive_failures,
+	COALESCE(to_char(disabled_at, 'YYYY-MM-DD HH24:MI:SS'), ''), to_char(created_at, 'YYYY-MM-DD HH24:MI:SS')`
+
+func scanWebhookSubscription(row interface{ Scan(...any) error }) (entities.WebhookSubscription, error) {
+	var subscription entities.WebhookSubscription
+	var eventTypes []byte
+	err := row.Scan(&subscription.SubscriptionID, &subscription.URL, &eventTypes, &subscription.Secret, &subscription.Active,
+		&subscription.ConsecutiveFailures, &subscription.DisabledAt, &subscription.CreatedAt)
+	if err != nil {
+		return entities.WebhookSubscription{}, err
+	}
+	if err := json.Unmarshal(eventTypes, &subscription.EventTypes); err != nil {
+		return entities.WebhookSubscription{}, fmt.Errorf("invalid event types of webhook %d: %w", subscription.SubscriptionID, err)
+	}
+
+	return subscription, nil
+}
+
+// Registering a subscription. The URL and event types are expected to be validated.
+func CreateWebhookSubscription(db queryer, url string, eventTypes []string, secret string) (entities.WebhookSubscription, error) {
+	encoded, err := json.Marshal(eventTypes)
+	if err != nil {
+		return entities.WebhookSubscription{}, err
+	}
+
+	query := `
+	INSERT INTO webhook_subscriptions (url, event_types, secret, active, consecutive_failures, created_at)
+	VALUES ($1, $2, $3, TRUE, 0, $4)
+	RETURNING ` + webhookSubscriptionColumns
+	subscription, err := scanWebhookSubscription(db.QueryRow(query, url, string(encoded), secret, time.Now().Format(time.DateTime)))
+	if err != nil {
+		return entities.WebhookSubscription{}, fmt.Errorf("failed to create the webhook subscription: %w", err)
+	}
+
+	return subscription, nil
+}
+
+func ListWebhookSubscriptions(db queryer) ([]entities.WebhookSubscription, error) {
+	rows, err := db.Query(`SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions ORDER BY subscription_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []entities.WebhookSubscription{}
+	for rows.Next() {
+		subscription, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// Wraps sql.ErrNoRows when there's no such subscription.
+func GetWebhookSubscription(db queryer, subscriptionID int64) (entities.WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions WHERE subscription_id = $1`
+	subscription, err := scanWebhookSubscription(db.QueryRow(query, subscriptionID))
+	if err != nil {
+		return entities.WebhookSubscription{}, fmt.Errorf("failed to get webhook subscription %d: %w", subscriptionID, err)
+	}
+
+	return subscription, nil
+}
+
+// Changes to a subscription, nil fields are left alone.
+type WebhookUpdate struct {
+	URL        *string
+	EventTypes []string
+	Active     *bool // Turning a subscription back on also forgets its failures.
+}
+
+// Wraps sql.ErrNoRows when there's no such subscription.
+func UpdateWebhookSubscription(db queryer, subscriptionID int64, update WebhookUpdate) (entities.WebhookSubscription, error) {
+	var eventTypes sql.NullString
+	if update.EventTypes != nil {
+		encoded, err := json.Marshal(update.EventTypes)
+		if err != nil {
+			return entities.WebhookSubscription{}, err
+		}
+		eventTypes = sql.NullString{String: string(encoded), Valid: true}
+	}
+	var url sql.NullString
+	if update.URL != nil {
+		url = sql.NullString{String: *update.URL, Valid: true}
+	}
+	var active sql.NullBool
+	if update.Active != nil {
+		active = sql.NullBool{Bool: *update.Active, Valid: true}
+	}
+
+	query := `
+	UPDATE webhook_subscriptions
+	SET url = COALESCE($1, url),
+		event_types = COALESCE($2::jsonb, event_types),
+		consecutive_failures = CASE WHEN $3 AND NOT active THEN 0 ELSE consecutive_failures END,
+		disabled_at = CASE WHEN $3 THEN NULL ELSE disabled_at END,
+		active = COALESCE($3, active)
+	WHERE subscription_id = $4
+	RETURNING ` + webhookSubscriptionColumns
+	subscription, err := scanWebhookSubscription(db.QueryRow(query, url, eventTypes, active, subscriptionID))
+	if err != nil {
+		return entities.WebhookSubscription{}, fmt.Errorf("failed to update webhook subscription %d: %w", subscriptionID, err)
+	}
+
+	return subscription, nil
+}
+
+// Removing a subscription along with its delivery log. Wraps sql.ErrNoRows when there's none.
+func DeleteWebhookSubscription(db *sql.DB, subscriptionID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start a transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE subscription_id = $1`, subscriptionID); err != nil {
+		return fmt.Errorf("failed to delete the deliveries of webhook %d: %w", subscriptionID, err)
+	}
+	result, err := tx.Exec(`DELETE FROM webhook_subscriptions WHERE subscription_id = $1`, subscriptionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook subscription %d: %w", subscriptionID, err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return fmt.Errorf("webhook subscription %d: %w", subscriptionID, sql.ErrNoRows)
+	}
+
+	return tx.Commit()
+}
+
+// A subscription's deliveries, newest first, optionally only those in the given status.
+func ListWebhookDeliveries(db queryer, subscriptionID int64, status string, limit int) ([]entities.WebhookDelivery, error) {
+	query := `
+	SELECT delivery_id, subscription_id, event_id, event_name, payload, status, attempts,
+		to_char(next_attempt_at, 'YYYY-MM-DD HH24:MI:SS'), COALESCE(response_status, 0), COALESCE(last_error, ''),
+		to_char(created_at, 'YYYY-MM-DD HH24:MI:SS'), COALESCE(to_char(delivered_at, 'YYYY-MM-DD HH24:MI:SS'), '')
+	FROM webhook_deliveries
+	WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+	ORDER BY delivery_id DESC
+	LIMIT $3
+	`
+	rows, err := db.Query(query, subscriptionID, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the deliveries of webhook %d: %w", subscriptionID, err)
+	}
+	defer rows.Close()
+
+	deliveries := []entities.WebhookDelivery{}
+	for rows.Next() {
+		var d entities.WebhookDelivery
+		err := rows.Scan(&d.DeliveryID, &d.SubscriptionID, &d.EventID, &d.EventName, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
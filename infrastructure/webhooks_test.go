@@ -0,0 +1,182 @@
+package infrastructure
+
+import (
+	businesslogic "aTES/core/businessLogic"
+	"aTES/core/entities"
+	"aTES/core/events"
+	"aTES/core/events/schemas"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An endpoint answering with whatever status it's set to, keeping what it was sent.
+type webhookEndpoint struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookEndpoint(t *testing.T, status int) (*webhookEndpoint, string) {
+	endpoint := &webhookEndpoint{status: status}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		endpoint.mu.Lock()
+		defer endpoint.mu.Unlock()
+		endpoint.requests = append(endpoint.requests, r)
+		endpoint.bodies = append(endpoint.bodies, body)
+		w.WriteHeader(endpoint.status)
+	}))
+	t.Cleanup(server.Close)
+
+	return endpoint, server.URL
+}
+
+func (e *webhookEndpoint) setStatus(status int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status = status
+}
+
+func (e *webhookEndpoint) received() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.requests)
+}
+
+// Queueing a TaskCompleted for every subscription that wants it, the way the fanout does.
+func queueTaskCompleted(t *testing.T, db *sql.DB, taskID int) {
+	t.Helper()
+	event := events.TaskCompleted{TaskID: taskID, CompletedBy: 7, Reward: entities.NewMoney(3000), CompletedAt: "2024-06-13 10:00:00"}
+	envelope, err := schemas.Default().Seal("tes", event)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer tx.Rollback()
+	if err := queueWebhookDeliveries(tx, envelope, event); err != nil {
+		t.Fatalf("Error queueing webhooks: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func getWebhookDelivery(t *testing.T, db *sql.DB, subscriptionID int64) entities.WebhookDelivery {
+	t.Helper()
+	deliveries, err := ListWebhookDeliveries(db, subscriptionID, "", 1)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("Expected a delivery, got %+v (%v)", deliveries, err)
+	}
+	return deliveries[0]
+}
+
+func TestWebhookDispatcherSigns(t *testing.T) {
+	db := newTestDB(t)
+	endpoint, url := newWebhookEndpoint(t, http.StatusNoContent)
+	subscription, err := CreateWebhookSubscription(db, url, []string{events.TaskCompletedName}, "s3cret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queueTaskCompleted(t, db, 1)
+
+	delivered, err := NewWebhookDispatcher(db).DeliverOnce()
+	if err != nil || delivered != 1 || endpoint.received() != 1 {
+		t.Fatalf("Expected one delivery, got %d posted %d times (%v)", delivered, endpoint.received(), err)
+	}
+	request, body := endpoint.requests[0], endpoint.bodies[0]
+	if !businesslogic.VerifyWebhookSignature("s3cret", body, request.Header.Get(businesslogic.WebhookSignatureHeader)) {
+		t.Errorf("Expected the body signed with the secret, got %q", request.Header.Get(businesslogic.WebhookSignatureHeader))
+	}
+	if request.Header.Get("X-Ates-Event") != events.TaskCompletedName {
+		t.Errorf("Expected the event name in X-Ates-Event, got %q", request.Header.Get("X-Ates-Event"))
+	}
+	if delivery := getWebhookDelivery(t, db, subscription.SubscriptionID); delivery.Status != entities.WebhookDelivered ||
+		delivery.ResponseStatus != http.StatusNoContent {
+		t.Errorf("Expected the delivery delivered, got %+v", delivery)
+	}
+}
+
+func TestWebhookDispatcherRetries(t *testing.T) {
+	db := newTestDB(t)
+	endpoint, url := newWebhookEndpoint(t, http.StatusInternalServerError)
+	subscription, err := CreateWebhookSubscription(db, url, []string{events.TaskCompletedName}, "s3cret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	queueTaskCompleted(t, db, 1)
+	dispatcher := NewWebhookDispatcher(db)
+
+	before := time.Now()
+	if delivered, err := dispatcher.DeliverOnce(); err != nil || delivered != 0 {
+		t.Fatalf("Expected nothing delivered, got %d (%v)", delivered, err)
+	}
+	delivery := getWebhookDelivery(t, db, subscription.SubscriptionID)
+	if delivery.Status != entities.WebhookPending || delivery.Attempts != 1 || delivery.ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("Expected a pending delivery after one failure, got %+v", delivery)
+	}
+	next, err := time.ParseInLocation(time.DateTime, delivery.NextAttemptAt, time.Local)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if wait := next.Sub(before.Truncate(time.Second)); wait < events.RetryDelay(1) || wait > events.RetryDelay(1)+2*time.Second {
+		t.Errorf("Expected the next attempt in %s, got %s", events.RetryDelay(1), wait)
+	}
+
+	// Not due yet.
+	if _, err := dispatcher.DeliverOnce(); err != nil || endpoint.received() != 1 {
+		t.Fatalf("Expected no post before the backoff, got %d (%v)", endpoint.received(), err)
+	}
+
+	endpoint.setStatus(http.StatusOK)
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = next_attempt_at - interval '1 day'`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if delivered, err := dispatcher.DeliverOnce(); err != nil || delivered != 1 {
+		t.Fatalf("Expected the retry delivered, got %d (%v)", delivered, err)
+	}
+	if delivery := getWebhookDelivery(t, db, subscription.SubscriptionID); delivery.Status != entities.WebhookDelivered || delivery.Attempts != 1 {
+		t.Errorf("Expected the delivery delivered on its second post, got %+v", delivery)
+	}
+}
+
+func TestWebhookDispatcherDisables(t *testing.T) {
+	db := newTestDB(t)
+	endpoint, url := newWebhookEndpoint(t, http.StatusBadGateway)
+	subscription, err := CreateWebhookSubscription(db, url, []string{events.TaskCompletedName}, "s3cret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for taskID := 1; taskID <= businesslogic.WebhookDisableAfter+2; taskID++ {
+		queueTaskCompleted(t, db, taskID)
+	}
+
+	if _, err := NewWebhookDispatcher(db).DeliverOnce(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if endpoint.received() != businesslogic.WebhookDisableAfter {
+		t.Errorf("Expected %d posts before giving up on the endpoint, got %d", businesslogic.WebhookDisableAfter, endpoint.received())
+	}
+	subscription, err = GetWebhookSubscription(db, subscription.SubscriptionID)
+	if err != nil || subscription.Active || subscription.DisabledAt == "" {
+		t.Fatalf("Expected the subscription disabled, got %+v (%v)", subscription, err)
+	}
+
+	// Events keep being queued while it's off, and wait for it to be turned back on.
+	queueTaskCompleted(t, db, 100)
+	pending, err := ListWebhookDeliveries(db, subscription.SubscriptionID, entities.WebhookPending, 100)
+	if err != nil || len(pending) != businesslogic.WebhookDisableAfter+3 {
+		t.Fatalf("Expected %d pending deliveries, got %d (%v)", businesslogic.WebhookDisableAfter+3, len(pending), err)
+	}
+	if _, err := NewWebhookDispatcher(db).DeliverOnce(); err != nil || endpoint.received() != businesslogic.WebhookDisableAfter {
+		t.Errorf("Expected no posts to a disabled subscription, got %d (%v)", endpoint.received(), err)
+	}
+}